@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// adminKeys holds the keys accepted for the /admin endpoints, loaded from the
+// comma-separated ADMIN_KEYS variable. They are separate from apiKeys, which
+// don't grant access to them, and the endpoints are disabled when it is
+// empty.
+var adminKeys []string
+
+// activityQuery lists the backends connected with the same application_name
+// as the connection running it, which all connections of a pool share, also
+// while a transaction extends it as configured by applicationNameDetail.
+const activityQuery = `SELECT pid, usename, datname, application_name, client_addr::text,
+	backend_start, xact_start, query_start, state_change,
+	wait_event_type, wait_event, state, query
+FROM pg_stat_activity
+WHERE (application_name = current_setting('application_name')
+		OR starts_with(application_name, current_setting('application_name') || '/'))
+	AND pid <> pg_backend_pid()
+ORDER BY backend_start`
+
+// backendActivity is a row of pg_stat_activity as reported by
+// /admin/activity.
+type backendActivity struct {
+	PID             int32      `json:"pid"`
+	User            *string    `json:"usename"`
+	Database        *string    `json:"datname"`
+	ApplicationName *string    `json:"application_name"`
+	ClientAddr      *string    `json:"client_addr"`
+	BackendStart    *time.Time `json:"backend_start"`
+	XactStart       *time.Time `json:"xact_start"`
+	QueryStart      *time.Time `json:"query_start"`
+	StateChange     *time.Time `json:"state_change"`
+	WaitEventType   *string    `json:"wait_event_type"`
+	WaitEvent       *string    `json:"wait_event"`
+	State           *string    `json:"state"`
+	Query           *string    `json:"query"`
+}
+
+// requireAdmin rejects requests that don't carry one of adminKeys, in the
+// same headers as an API key.
+func requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if len(adminKeys) == 0 {
+			writeJSONError(w, http.StatusNotFound, "Admin endpoints are disabled")
+			return
+		}
+		key := requestAPIKey(r)
+		if key == "" {
+			writeJSONError(w, http.StatusUnauthorized, "Missing admin key")
+			return
+		}
+		valid := 0
+		for _, k := range adminKeys {
+			valid |= subtle.ConstantTimeCompare([]byte(key), []byte(k))
+		}
+		if valid != 1 {
+			writeJSONError(w, http.StatusForbidden, "Invalid admin key")
+			return
+		}
+		requestInfoFrom(r.Context()).principal = "admin:" + keyFingerprint(key)
+		next(w, r)
+	}
+}
+
+// activityHandler lists the backends of the proxy's connections to the
+// database named by ?db=, as found in pg_stat_activity:
+//
+//	GET /admin/activity?db=reporting
+//	{"backends":[{"pid":4711,"state":"active","query":"SELECT ...",...}]}
+func activityHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "Invalid request method")
+		return
+	}
+	pool, err := requestPool(r, "")
+	if err != nil {
+		writePoolError(w, err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	rows, err := pool.Query(ctx, activityQuery)
+	if err != nil {
+		writeQueryFailure(ctx, w, err)
+		return
+	}
+	defer rows.Close()
+	backends := []backendActivity{}
+	for rows.Next() {
+		var b backendActivity
+		if err := rows.Scan(&b.PID, &b.User, &b.Database, &b.ApplicationName, &b.ClientAddr,
+			&b.BackendStart, &b.XactStart, &b.QueryStart, &b.StateChange,
+			&b.WaitEventType, &b.WaitEvent, &b.State, &b.Query); err != nil {
+			writeQueryFailure(ctx, w, err)
+			return
+		}
+		backends = append(backends, b)
+	}
+	if err := rows.Err(); err != nil {
+		writeQueryFailure(ctx, w, err)
+		return
+	}
+	writeStatus(w, http.StatusOK, map[string]interface{}{"backends": backends})
+}
+
+// terminateHandler ends the backend with the given PID through
+// pg_terminate_backend, which rolls back whatever it was running:
+//
+//	POST /admin/terminate?pid=4711&db=reporting
+//	{"terminated":4711}
+//
+// Postgres only lets the proxy's role terminate backends of the same role,
+// unless it has pg_signal_backend.
+func terminateHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "Invalid request method")
+		return
+	}
+	value := r.URL.Query().Get("pid")
+	pid, err := strconv.ParseInt(value, 10, 32)
+	if err != nil || pid <= 0 {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("Invalid pid %q: must be a positive integer", value))
+		return
+	}
+	pool, err := requestPool(r, "")
+	if err != nil {
+		writePoolError(w, err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	// pg_terminate_backend only warns about a PID that isn't a backend, so
+	// check for one first to report it properly.
+	var terminated *bool
+	err = pool.QueryRow(ctx, "SELECT pg_terminate_backend(pid) FROM pg_stat_activity WHERE pid = $1", int32(pid)).Scan(&terminated)
+	switch {
+	case err == nil && terminated != nil && *terminated:
+		writeStatus(w, http.StatusOK, map[string]interface{}{"terminated": pid})
+	case err == nil:
+		writeJSONError(w, http.StatusConflict, "Backend could not be terminated")
+	case errors.Is(err, pgx.ErrNoRows):
+		writeJSONError(w, http.StatusNotFound, fmt.Sprintf("No backend with pid %d", pid))
+	default:
+		writeQueryFailure(ctx, w, err)
+	}
+}
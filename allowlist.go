@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// queryAllowlist, when set, limits clients to queries matching one of its
+// patterns. The patterns are read from QUERY_ALLOWLIST, or from the file
+// named by QUERY_ALLOWLIST_FILE, one per line; blank lines and lines
+// starting with # are ignored. A pattern must match the whole query, which
+// is compared with comments removed and its tokens separated by single
+// spaces, e.g.
+//
+//	SELECT \* FROM points WHERE id = \$1
+//	(?i)SELECT name FROM (roads|rivers) LIMIT \d+
+//
+// Patterns are case-sensitive unless they start with (?i). Named queries are
+// defined by the operator and aren't checked. /copy takes a table rather
+// than a query, so it's disabled altogether while an allowlist is set.
+var queryAllowlist []*regexp.Regexp
+
+var errQueryNotAllowed = errors.New("query does not match the query allowlist")
+
+// loadQueryAllowlist compiles the configured allowlist patterns.
+func loadQueryAllowlist() error {
+	value, err := envOrFile("QUERY_ALLOWLIST")
+	if err != nil {
+		return err
+	}
+	queryAllowlist = nil
+	for i, line := range strings.Split(value, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		re, err := regexp.Compile(`^(?:` + line + `)$`)
+		if err != nil {
+			return fmt.Errorf("invalid QUERY_ALLOWLIST pattern on line %d: %v", i+1, err)
+		}
+		queryAllowlist = append(queryAllowlist, re)
+	}
+	return nil
+}
+
+// checkAllowlist returns an error unless sql is a single statement matching
+// the allowlist, when one is configured. A pattern such as '.*' could
+// otherwise match across a semicolon into a second statement.
+func checkAllowlist(sql string) error {
+	if len(queryAllowlist) == 0 {
+		return nil
+	}
+	tokens, err := tokenize(sql)
+	if err != nil {
+		return err
+	}
+	statements := splitStatements(tokens)
+	switch {
+	case len(statements) == 0:
+		return errEmptyQuery
+	case len(statements) > 1:
+		return errors.New("only a single statement is allowed with the query allowlist")
+	}
+	texts := make([]string, len(statements[0]))
+	for i, t := range statements[0] {
+		texts[i] = t.text
+	}
+	normalized := strings.Join(texts, " ")
+	for _, re := range queryAllowlist {
+		if re.MatchString(normalized) {
+			return nil
+		}
+	}
+	return errQueryNotAllowed
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCheckAllowlist(t *testing.T) {
+	t.Setenv("QUERY_ALLOWLIST", "# points by id\nSELECT \\* FROM points WHERE id = \\$1\n\n(?i)SELECT name FROM (roads|rivers) LIMIT \\d+")
+	defer func() { queryAllowlist = nil }()
+	if err := loadQueryAllowlist(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		sql  string
+		want error
+	}{
+		{"SELECT * FROM points WHERE id = $1", nil},
+		{"SELECT *\n  FROM points -- by id\n  WHERE id = $1;", nil},
+		{"select name from ROADS limit 10", nil},
+		{"select * from points where id = $1", errQueryNotAllowed},
+		{"SELECT * FROM points WHERE id = $1 OR true", errQueryNotAllowed},
+		{"SELECT name FROM lakes LIMIT 10", errQueryNotAllowed},
+		{"DELETE FROM points", errQueryNotAllowed},
+		{"", errEmptyQuery},
+	}
+	for _, tt := range tests {
+		if err := checkAllowlist(tt.sql); !errors.Is(err, tt.want) {
+			t.Errorf("checkAllowlist(%q) = %v, want %v", tt.sql, err, tt.want)
+		}
+	}
+}
+
+func TestCheckAllowlistSingleStatement(t *testing.T) {
+	t.Setenv("QUERY_ALLOWLIST", ".*")
+	defer func() { queryAllowlist = nil }()
+	if err := loadQueryAllowlist(); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkAllowlist("SELECT 1; DROP TABLE points"); err == nil {
+		t.Error("a second statement matched the allowlist")
+	}
+}
+
+func TestLoadQueryAllowlist(t *testing.T) {
+	defer func() { queryAllowlist = nil }()
+	t.Setenv("QUERY_ALLOWLIST", "SELECT 1\nSELECT (")
+	if err := loadQueryAllowlist(); err == nil {
+		t.Error("invalid pattern accepted")
+	}
+	t.Setenv("QUERY_ALLOWLIST", "")
+	if err := loadQueryAllowlist(); err != nil || len(queryAllowlist) != 0 {
+		t.Errorf("empty allowlist: %d patterns, error %v", len(queryAllowlist), err)
+	}
+	if err := checkAllowlist("DELETE FROM points"); err != nil {
+		t.Errorf("without an allowlist: %v", err)
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/apache/arrow/go/v17/arrow"
+	"github.com/apache/arrow/go/v17/arrow/array"
+	"github.com/apache/arrow/go/v17/arrow/ipc"
+	"github.com/apache/arrow/go/v17/arrow/memory"
+	"github.com/jackc/pgtype"
+)
+
+// arrowBatchRows is the number of rows per Arrow record batch.
+const arrowBatchRows = 8192
+
+// arrowWriter emits the result as an Arrow IPC stream. Booleans, integers,
+// floats, dates, timestamps and bytea map to the matching Arrow types, with
+// timestamptz in UTC; every other type is sent as its normalized text, JSON
+// encoded when it isn't a string. NULLs and infinite dates and timestamps
+// are null. Rows are sent in batches of arrowBatchRows.
+//
+// The stream has no room for a summary, so truncation isn't reported, and a
+// failure mid-stream leaves out the end-of-stream marker.
+type arrowWriter struct {
+	columns []column
+	schema  *arrow.Schema
+	builder *array.RecordBuilder
+	ipc     *ipc.Writer
+	pending int
+	// binaryEncoding renders bytea values in columns without an Arrow
+	// counterpart, such as bytea arrays; bytea columns stay binary.
+	binaryEncoding binaryEncoding
+}
+
+func (a *arrowWriter) contentType() string { return "application/vnd.apache.arrow.stream" }
+
+// rawRows makes streamRows pass the values as pgx decoded them, since the
+// Arrow columns are typed.
+func (a *arrowWriter) rawRows() {}
+
+func (a *arrowWriter) writeHeader(w io.Writer, columns []column) error {
+	fields := make([]arrow.Field, len(columns))
+	for i, c := range columns {
+		fields[i] = arrow.Field{
+			Name:     c.Name,
+			Type:     arrowType(c.OID),
+			Nullable: true,
+			Metadata: arrow.NewMetadata([]string{"pg_type"}, []string{c.Type}),
+		}
+	}
+	a.columns = columns
+	a.schema = arrow.NewSchema(fields, nil)
+	a.builder = array.NewRecordBuilder(memory.DefaultAllocator, a.schema)
+	a.ipc = ipc.NewWriter(w, ipc.WithSchema(a.schema))
+	return nil
+}
+
+func (a *arrowWriter) writeRow(w io.Writer, values []interface{}) error {
+	for i, v := range values {
+		if err := appendArrow(a.builder.Field(i), v, a.columns[i].OID, a.binaryEncoding); err != nil {
+			return fmt.Errorf("column %q: %v", a.columns[i].Name, err)
+		}
+	}
+	a.pending++
+	if a.pending == arrowBatchRows {
+		return a.flushBatch()
+	}
+	return nil
+}
+
+func (a *arrowWriter) writeFooter(w io.Writer, summary resultSummary) error {
+	defer a.builder.Release()
+	if summary.err != nil {
+		return summary.err
+	}
+	if a.pending > 0 {
+		if err := a.flushBatch(); err != nil {
+			return err
+		}
+	}
+	return a.ipc.Close()
+}
+
+// flushBatch writes the pending rows as a record batch.
+func (a *arrowWriter) flushBatch() error {
+	rec := a.builder.NewRecord()
+	defer rec.Release()
+	a.pending = 0
+	return a.ipc.Write(rec)
+}
+
+// arrowType returns the Arrow type for a Postgres type.
+func arrowType(oid uint32) arrow.DataType {
+	switch oid {
+	case pgtype.BoolOID:
+		return arrow.FixedWidthTypes.Boolean
+	case pgtype.Int2OID:
+		return arrow.PrimitiveTypes.Int16
+	case pgtype.Int4OID:
+		return arrow.PrimitiveTypes.Int32
+	case pgtype.Int8OID:
+		return arrow.PrimitiveTypes.Int64
+	case pgtype.Float4OID:
+		return arrow.PrimitiveTypes.Float32
+	case pgtype.Float8OID:
+		return arrow.PrimitiveTypes.Float64
+	case pgtype.DateOID:
+		return arrow.FixedWidthTypes.Date32
+	case pgtype.TimestampOID:
+		return &arrow.TimestampType{Unit: arrow.Microsecond}
+	case pgtype.TimestamptzOID:
+		return &arrow.TimestampType{Unit: arrow.Microsecond, TimeZone: "UTC"}
+	case pgtype.ByteaOID:
+		return arrow.BinaryTypes.Binary
+	}
+	return arrow.BinaryTypes.String
+}
+
+// appendArrow appends a value decoded by pgx to the builder of its column.
+func appendArrow(b array.Builder, v interface{}, oid uint32, enc binaryEncoding) error {
+	if v == nil {
+		b.AppendNull()
+		return nil
+	}
+	if _, ok := v.(pgtype.InfinityModifier); ok {
+		b.AppendNull()
+		return nil
+	}
+
+	switch b := b.(type) {
+	case *array.BooleanBuilder:
+		if v, ok := v.(bool); ok {
+			b.Append(v)
+			return nil
+		}
+	case *array.Int16Builder:
+		if v, ok := v.(int16); ok {
+			b.Append(v)
+			return nil
+		}
+	case *array.Int32Builder:
+		if v, ok := v.(int32); ok {
+			b.Append(v)
+			return nil
+		}
+	case *array.Int64Builder:
+		if v, ok := v.(int64); ok {
+			b.Append(v)
+			return nil
+		}
+	case *array.Float32Builder:
+		if v, ok := v.(float32); ok {
+			b.Append(v)
+			return nil
+		}
+	case *array.Float64Builder:
+		if v, ok := v.(float64); ok {
+			b.Append(v)
+			return nil
+		}
+	case *array.Date32Builder:
+		if v, ok := v.(time.Time); ok {
+			b.Append(arrow.Date32FromTime(v))
+			return nil
+		}
+	case *array.TimestampBuilder:
+		if v, ok := v.(time.Time); ok {
+			b.Append(arrow.Timestamp(v.UnixMicro()))
+			return nil
+		}
+	case *array.BinaryBuilder:
+		if v, ok := v.([]byte); ok {
+			if maxByteaBytes > 0 && len(v) > maxByteaBytes {
+				return fmt.Errorf("binary value of %d bytes exceeds the %d byte limit", len(v), maxByteaBytes)
+			}
+			b.Append(v)
+			return nil
+		}
+	case *array.StringBuilder:
+		s, err := arrowText(v, oid, enc)
+		if err != nil {
+			return err
+		}
+		b.Append(s)
+		return nil
+	}
+	return fmt.Errorf("unexpected %T value", v)
+}
+
+// arrowText renders a value of a type without an Arrow counterpart.
+func arrowText(v interface{}, oid uint32, enc binaryEncoding) (string, error) {
+	n, err := normalizeValue(v, oid, enc)
+	if err != nil {
+		return "", err
+	}
+	switch n := n.(type) {
+	case string:
+		return n, nil
+	case int64:
+		return strconv.FormatInt(n, 10), nil
+	}
+	buf, err := json.Marshal(n)
+	if err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// auditColumns are the columns written to the audit table, which has to be
+// created beforehand, e.g.:
+//
+//	CREATE TABLE pgproxy_audit (
+//		at          timestamptz NOT NULL,
+//		request_id  text NOT NULL,
+//		principal   text,
+//		client_ip   text NOT NULL,
+//		method      text NOT NULL,
+//		path        text NOT NULL,
+//		query       text,
+//		rows        bigint NOT NULL,
+//		duration_ms double precision NOT NULL,
+//		status      integer NOT NULL,
+//		success     boolean NOT NULL
+//	);
+var auditColumns = []string{"at", "request_id", "principal", "client_ip", "method", "path", "query", "rows", "duration_ms", "status", "success"}
+
+// auditRecord is a row of the audit table.
+type auditRecord struct {
+	at        time.Time
+	requestID string
+	principal string
+	clientIP  string
+	method    string
+	path      string
+	query     string
+	rows      int64
+	duration  time.Duration
+	status    int
+}
+
+func (a auditRecord) values() []interface{} {
+	var principal, query interface{}
+	if a.principal != "" {
+		principal = a.principal
+	}
+	if a.query != "" {
+		query = a.query
+	}
+	return []interface{}{
+		a.at, a.requestID, principal, a.clientIP, a.method, a.path, query,
+		a.rows, float64(a.duration.Microseconds()) / 1000, int32(a.status), a.status < 400,
+	}
+}
+
+var auditDropped = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "pgproxy_audit_dropped_total",
+	Help: "Number of audit records dropped because the audit buffer was full.",
+})
+
+// auditLog writes audit records to a table in the background, in batches.
+type auditLog struct {
+	table   pgx.Identifier
+	db      string
+	queries string
+	block   bool
+	records chan auditRecord
+	done    sync.WaitGroup
+
+	// mu keeps add from sending on records once close has closed it.
+	mu     sync.RWMutex
+	closed bool
+}
+
+// audit is the audit log, or nil when auditing is disabled.
+var audit *auditLog
+
+// Audit batching: the writer copies at most auditBatchSize records at a time
+// and waits at most auditFlushInterval before writing a partial batch.
+const (
+	auditBatchSize     = 500
+	auditFlushInterval = time.Second
+)
+
+// setupAudit enables the audit log when AUDIT_TABLE names a table. Records
+// go to the database named by AUDIT_DB (default: the default database), with
+// the query text as configured by AUDIT_QUERIES (full, redacted or off;
+// default redacted). Up to AUDIT_BUFFER (default 10000) records are queued;
+// once the queue is full records are dropped, or requests wait for room when
+// AUDIT_BLOCK=true.
+func setupAudit() error {
+	name := os.Getenv("AUDIT_TABLE")
+	if name == "" {
+		return nil
+	}
+	table, err := parseIdentifier(name)
+	if err != nil {
+		return fmt.Errorf("invalid AUDIT_TABLE %q", name)
+	}
+	a := &auditLog{table: table, db: os.Getenv("AUDIT_DB"), queries: os.Getenv("AUDIT_QUERIES")}
+	if a.db == "" {
+		a.db = defaultDB
+	}
+	if _, ok := currentPools()[a.db]; !ok {
+		return fmt.Errorf("AUDIT_DB %q is not a configured database", a.db)
+	}
+	switch a.queries {
+	case "":
+		a.queries = "redacted"
+	case "full", "redacted", "off":
+	default:
+		return fmt.Errorf("invalid AUDIT_QUERIES %q: must be full, redacted or off", a.queries)
+	}
+	size, err := envInt("AUDIT_BUFFER", 10000)
+	if err != nil {
+		return err
+	}
+	if size < 0 {
+		return fmt.Errorf("invalid AUDIT_BUFFER %d: must not be negative", size)
+	}
+	if value := os.Getenv("AUDIT_BLOCK"); value != "" {
+		if a.block, err = strconv.ParseBool(value); err != nil {
+			return fmt.Errorf("invalid AUDIT_BLOCK %q: must be true or false", value)
+		}
+	}
+
+	a.records = make(chan auditRecord, size)
+	a.done.Add(1)
+	go a.run()
+	audit = a
+	return nil
+}
+
+// add queues a record without waiting for it to be written.
+func (a *auditLog) add(rec auditRecord) {
+	rec.query = formatQueries([]string{rec.query}, a.queries)
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if a.closed {
+		auditDropped.Inc()
+		return
+	}
+	if a.block {
+		a.records <- rec
+		return
+	}
+	select {
+	case a.records <- rec:
+	default:
+		auditDropped.Inc()
+	}
+}
+
+// run writes queued records until the log is closed.
+func (a *auditLog) run() {
+	defer a.done.Done()
+	batch := make([]auditRecord, 0, auditBatchSize)
+	ticker := time.NewTicker(auditFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case rec, ok := <-a.records:
+			if !ok {
+				a.write(batch)
+				return
+			}
+			if batch = append(batch, rec); len(batch) == auditBatchSize {
+				a.write(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			a.write(batch)
+			batch = batch[:0]
+		}
+	}
+}
+
+// write copies a batch of records into the audit table. A failed batch is
+// logged and dropped, so an unavailable audit database doesn't hold up
+// requests.
+func (a *auditLog) write(batch []auditRecord) {
+	if len(batch) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err := currentPools()[a.db].CopyFrom(ctx, a.table, auditColumns, pgx.CopyFromSlice(len(batch), func(i int) ([]interface{}, error) {
+		return batch[i].values(), nil
+	}))
+	if err != nil {
+		slog.Error("Error writing audit records", "error", err, "records", len(batch))
+	}
+}
+
+// close writes the queued records and stops the writer.
+func (a *auditLog) close() {
+	a.mu.Lock()
+	a.closed = true
+	close(a.records)
+	a.mu.Unlock()
+	a.done.Wait()
+}
+
+// keyFingerprint identifies an API key in the audit log without revealing it.
+func keyFingerprint(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return "key:" + hex.EncodeToString(sum[:8])
+}
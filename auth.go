@@ -0,0 +1,99 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// apiKeys holds the keys accepted by requireAPIKey, loaded from the
+// comma-separated API_KEYS variable. Authentication is disabled when empty.
+var apiKeys []string
+
+// unauthenticatedPaths are reachable without a key so orchestration probes
+// keep working.
+var unauthenticatedPaths = map[string]bool{
+	"/health": true,
+	"/ready":  true,
+}
+
+// authenticate rejects requests that don't carry one of apiKeys in either an
+// "Authorization: Bearer <key>" or an "X-API-Key: <key>" header, or, when
+// JWT authentication is configured, a valid JWT as the bearer token, or,
+// when basicAuthUsers is set, the credentials of one of them in an
+// "Authorization: Basic" header. Any configured mechanism will do. The
+// claims of a JWT are added to the request context.
+func authenticate(next http.Handler) http.Handler {
+	if len(apiKeys) == 0 && jwtKeyfunc == nil && len(basicAuthUsers) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The admin endpoints check their own keys, see requireAdmin.
+		if unauthenticatedPaths[r.URL.Path] || strings.HasPrefix(r.URL.Path, "/admin/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if user, password, ok := r.BasicAuth(); ok && len(basicAuthUsers) > 0 {
+			if !validBasicAuth(user, password) {
+				writeBasicChallenge(w, "Invalid username or password")
+				return
+			}
+			requestInfoFrom(r.Context()).principal = "user:" + user
+			next.ServeHTTP(w, r)
+			return
+		}
+		key := requestAPIKey(r)
+		if key == "" && len(basicAuthUsers) > 0 {
+			writeBasicChallenge(w, "Missing credentials")
+			return
+		}
+		if key == "" && len(apiKeys) == 0 {
+			writeJSONError(w, http.StatusUnauthorized, "Missing bearer token")
+			return
+		}
+		if key == "" {
+			writeJSONError(w, http.StatusUnauthorized, "Missing API key")
+			return
+		}
+		if len(apiKeys) > 0 && validAPIKey(key) {
+			requestInfoFrom(r.Context()).principal = keyFingerprint(key)
+			next.ServeHTTP(w, r)
+			return
+		}
+		if jwtKeyfunc == nil || r.Header.Get("X-API-Key") != "" {
+			writeJSONError(w, http.StatusUnauthorized, "Invalid API key")
+			return
+		}
+		claims, err := parseJWT(key)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			writeJSONError(w, http.StatusUnauthorized, "Invalid token: "+err.Error())
+			return
+		}
+		if sub, _ := claims.GetSubject(); sub != "" {
+			requestInfoFrom(r.Context()).principal = "sub:" + sub
+		}
+		next.ServeHTTP(w, r.WithContext(withClaims(r.Context(), claims)))
+	})
+}
+
+func requestAPIKey(r *http.Request) string {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return key
+	}
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if ok && strings.EqualFold(scheme, "Bearer") {
+		return strings.TrimSpace(token)
+	}
+	return ""
+}
+
+// validAPIKey compares key against every configured key in constant time, so
+// response timing doesn't reveal how much of a key matched.
+func validAPIKey(key string) bool {
+	valid := 0
+	for _, k := range apiKeys {
+		valid |= subtle.ConstantTimeCompare([]byte(key), []byte(k))
+	}
+	return valid == 1
+}
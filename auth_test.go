@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAuthenticate(t *testing.T) {
+	apiKeys = []string{"key-1", "key-2"}
+	defer func() { apiKeys = nil }()
+	handler := authenticate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	tests := []struct {
+		name   string
+		path   string
+		header string
+		value  string
+		want   int
+	}{
+		{"missing key", "/query", "", "", http.StatusUnauthorized},
+		{"wrong key", "/query", "X-API-Key", "key-3", http.StatusUnauthorized},
+		{"prefix of a key", "/query", "X-API-Key", "key-", http.StatusUnauthorized},
+		{"correct key", "/query", "X-API-Key", "key-2", http.StatusOK},
+		{"bearer key", "/query", "Authorization", "Bearer key-1", http.StatusOK},
+		{"wrong bearer key", "/query", "Authorization", "Bearer key-3", http.StatusUnauthorized},
+		{"other scheme", "/query", "Authorization", "Basic key-1", http.StatusUnauthorized},
+		{"health check", "/health", "", "", http.StatusOK},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, tt.path, nil)
+		if tt.header != "" {
+			r.Header.Set(tt.header, tt.value)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != tt.want {
+			t.Errorf("%s: status %d, want %d", tt.name, w.Code, tt.want)
+		}
+	}
+}
+
+func TestAuthenticateDisabled(t *testing.T) {
+	apiKeys = nil
+	w := httptest.NewRecorder()
+	authenticate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/query", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("status %d without configured keys", w.Code)
+	}
+}
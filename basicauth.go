@@ -0,0 +1,93 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// basicAuthUsers maps the users accepted through HTTP Basic authentication
+// to their bcrypt password hashes, for tools that can't send a bearer token.
+// They are loaded from BASIC_AUTH_USERS, or the file named by
+// BASIC_AUTH_USERS_FILE, as user:hash entries separated by commas or
+// newlines, the format of an htpasswd file created with htpasswd -B:
+//
+//	BASIC_AUTH_USERS=alice:$2y$10$...,bob:$2y$10$...
+var basicAuthUsers map[string][]byte
+
+// basicAuthRealm is the realm of the Basic challenge.
+const basicAuthRealm = "go-pgproxy"
+
+// verifiedCredentials holds a digest of credentials that passed bcrypt, so
+// a client sending the same ones with every request doesn't pay for the
+// deliberately slow comparison each time. It is keyed by user, so a new
+// password for a user replaces the old one.
+var verifiedCredentials = struct {
+	sync.Mutex
+	m map[string][sha256.Size]byte
+}{m: make(map[string][sha256.Size]byte)}
+
+// loadBasicAuthUsers reads basicAuthUsers.
+func loadBasicAuthUsers() error {
+	value, err := envOrFile("BASIC_AUTH_USERS")
+	if err != nil || value == "" {
+		return err
+	}
+	users := make(map[string][]byte)
+	for _, entry := range strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == '\n' }) {
+		entry = strings.TrimSpace(entry)
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+		user, hash, ok := strings.Cut(entry, ":")
+		if !ok || user == "" {
+			return fmt.Errorf("invalid BASIC_AUTH_USERS entry %q: must be user:hash", entry)
+		}
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return fmt.Errorf("invalid BASIC_AUTH_USERS entry for %q: password must be a bcrypt hash", user)
+		}
+		users[user] = []byte(hash)
+	}
+	basicAuthUsers = users
+	return nil
+}
+
+// validBasicAuth reports whether password is the password of user.
+func validBasicAuth(user, password string) bool {
+	hash, ok := basicAuthUsers[user]
+	if !ok {
+		// Compare anyway, so timing doesn't reveal which users exist.
+		bcrypt.CompareHashAndPassword(unknownUserHash(), []byte(password))
+		return false
+	}
+	digest := sha256.Sum256(append(append([]byte{}, hash...), password...))
+	verifiedCredentials.Lock()
+	verified, ok := verifiedCredentials.m[user]
+	verifiedCredentials.Unlock()
+	if ok && verified == digest {
+		return true
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil {
+		return false
+	}
+	verifiedCredentials.Lock()
+	verifiedCredentials.m[user] = digest
+	verifiedCredentials.Unlock()
+	return true
+}
+
+// unknownUserHash is compared against for users that don't exist.
+var unknownUserHash = sync.OnceValue(func() []byte {
+	hash, _ := bcrypt.GenerateFromPassword([]byte(basicAuthRealm), bcrypt.DefaultCost)
+	return hash
+})
+
+// writeBasicChallenge replies 401 asking for Basic credentials.
+func writeBasicChallenge(w http.ResponseWriter, msg string) {
+	w.Header().Add("WWW-Authenticate", fmt.Sprintf("Basic realm=%q, charset=\"UTF-8\"", basicAuthRealm))
+	writeJSONError(w, http.StatusUnauthorized, msg)
+}
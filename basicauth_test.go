@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestBasicAuth(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("BASIC_AUTH_USERS", "# users\nalice:"+string(hash)+",bob:"+string(hash))
+	defer func() { basicAuthUsers = nil }()
+	if err := loadBasicAuthUsers(); err != nil {
+		t.Fatal(err)
+	}
+
+	var principal string
+	handler := authenticate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		principal = requestInfoFrom(r.Context()).principal
+	}))
+	tests := []struct {
+		name          string
+		user          string
+		password      string
+		want          int
+		wantPrincipal string
+	}{
+		{name: "valid", user: "alice", password: "secret", want: http.StatusOK, wantPrincipal: "user:alice"},
+		{name: "verified before", user: "alice", password: "secret", want: http.StatusOK, wantPrincipal: "user:alice"},
+		{name: "wrong password", user: "alice", password: "guess", want: http.StatusUnauthorized},
+		{name: "unknown user", user: "carol", password: "secret", want: http.StatusUnauthorized},
+		{name: "missing credentials", want: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		principal = ""
+		r := withPrincipal(httptest.NewRequest(http.MethodGet, "/query", nil), "")
+		if tt.user != "" {
+			r.SetBasicAuth(tt.user, tt.password)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != tt.want || principal != tt.wantPrincipal {
+			t.Errorf("%s: status %d as %q, want %d as %q", tt.name, w.Code, principal, tt.want, tt.wantPrincipal)
+		}
+		if w.Code == http.StatusUnauthorized && !strings.HasPrefix(w.Header().Get("WWW-Authenticate"), `Basic realm="go-pgproxy"`) {
+			t.Errorf("%s: WWW-Authenticate %q", tt.name, w.Header().Get("WWW-Authenticate"))
+		}
+	}
+}
+
+func TestLoadBasicAuthUsers(t *testing.T) {
+	defer func() { basicAuthUsers = nil }()
+	tests := []struct {
+		value string
+		ok    bool
+	}{
+		{"", true},
+		{"alice:$2y$10$abcdefghijklmnopqrstuuJ2x3l0a8/4lmGJ6.u3Wjz9Gd1cQmhKW", true},
+		{"alice", false},
+		{":$2y$10$abcdefghijklmnopqrstuuJ2x3l0a8/4lmGJ6.u3Wjz9Gd1cQmhKW", false},
+		{"alice:secret", false},
+	}
+	for _, tt := range tests {
+		t.Setenv("BASIC_AUTH_USERS", tt.value)
+		if err := loadBasicAuthUsers(); (err == nil) != tt.ok {
+			t.Errorf("BASIC_AUTH_USERS=%q: error %v, want ok %v", tt.value, err, tt.ok)
+		}
+	}
+}
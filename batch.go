@@ -0,0 +1,47 @@
+package main
+
+import "net/http"
+
+// batchHandler runs a script of semicolon-separated statements, as sent with
+// the simple query protocol, and returns one result per statement in the
+// same shape as /transaction. Like a multi-statement simple query the script
+// runs in a single transaction. Semicolons inside string literals, quoted
+// identifiers, dollar-quoted bodies and comments don't split statements.
+// Params can't be bound, since it would be ambiguous which statement they
+// belong to.
+func batchHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "Invalid request method")
+		return
+	}
+
+	var sqlQuery SQLQuery
+	if err := decodeBody(w, r, &sqlQuery); err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	if len(sqlQuery.Params) > 0 {
+		writeJSONError(w, http.StatusBadRequest, "Params are not supported in batch scripts")
+		return
+	}
+
+	statements, err := splitScript(sqlQuery.Query)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if len(statements) == 0 {
+		writeJSONError(w, http.StatusBadRequest, "No queries given")
+		return
+	}
+
+	req := TransactionRequest{
+		DB:             sqlQuery.DB,
+		TimeoutMS:      sqlQuery.TimeoutMS,
+		SessionOptions: sqlQuery.SessionOptions,
+	}
+	for _, stmt := range statements {
+		req.Queries = append(req.Queries, SQLQuery{Query: stmt})
+	}
+	runTransaction(w, r, req)
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/jackc/puddle"
+)
+
+// Circuit breaker settings: after breakerFailures consecutive failures to get
+// a connection, set through BREAKER_FAILURES, requests fail fast for
+// breakerCooldown (BREAKER_COOLDOWN) before a single request is let through
+// to probe the database. Zero failures disables the breaker.
+var (
+	breakerFailures = 5
+	breakerCooldown = 30 * time.Second
+)
+
+var errBreakerOpen = errors.New("database unavailable, circuit breaker is open")
+
+// acquireTimeout is how long a request waits for a connection of a pool
+// with none to spare, set through ACQUIRE_TIMEOUT, before failing with
+// errNoConnections. It is separate from the query timeout, so a saturated
+// pool fails fast even for requests allowed to run long. Zero waits for as
+// long as the query timeout allows.
+var acquireTimeout = 5 * time.Second
+
+var errNoConnections = errors.New("no available connections")
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	}
+	return "closed"
+}
+
+// circuitBreaker tracks the connection failures of one pool.
+type circuitBreaker struct {
+	mu       sync.Mutex
+	state    breakerState
+	failures int
+	openedAt time.Time
+}
+
+// breakers holds the circuit breaker of every pool.
+var breakers = struct {
+	sync.Mutex
+	m map[*pgxpool.Pool]*circuitBreaker
+}{m: make(map[*pgxpool.Pool]*circuitBreaker)}
+
+func breakerFor(pool *pgxpool.Pool) *circuitBreaker {
+	breakers.Lock()
+	defer breakers.Unlock()
+	b, ok := breakers.m[pool]
+	if !ok {
+		b = &circuitBreaker{}
+		breakers.m[pool] = b
+	}
+	return b
+}
+
+// acquireConn acquires a connection from pool, failing fast with
+// errBreakerOpen while the pool's circuit breaker is open, and with
+// errNoConnections when none becomes available within acquireTimeout. A
+// pool closed for shutdown fails with errDatabaseUnavailable, which doesn't
+// count against the breaker.
+func acquireConn(ctx context.Context, pool *pgxpool.Pool) (*pgxpool.Conn, error) {
+	b := breakerFor(pool)
+	if err := b.allow(); err != nil {
+		return nil, err
+	}
+	acquireCtx := ctx
+	if acquireTimeout > 0 {
+		var cancel context.CancelFunc
+		acquireCtx, cancel = context.WithTimeoutCause(ctx, acquireTimeout, errNoConnections)
+		defer cancel()
+	}
+	conn, err := pool.Acquire(acquireCtx)
+	if errors.Is(err, puddle.ErrClosedPool) {
+		return nil, errDatabaseUnavailable
+	}
+	b.record(pool, err)
+	if err != nil && ctx.Err() == nil && context.Cause(acquireCtx) == errNoConnections {
+		return nil, errNoConnections
+	}
+	return conn, err
+}
+
+// allow returns errBreakerOpen unless a request may try the database. Once
+// the cooldown has passed one request is let through as a probe while the
+// others keep failing fast.
+func (b *circuitBreaker) allow() error {
+	if breakerFailures <= 0 {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < breakerCooldown {
+			return errBreakerOpen
+		}
+		b.state = breakerHalfOpen
+	case breakerHalfOpen:
+		return errBreakerOpen
+	}
+	return nil
+}
+
+// record updates the breaker with the outcome of a request it allowed.
+func (b *circuitBreaker) record(pool *pgxpool.Pool, err error) {
+	if breakerFailures <= 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch {
+	case err == nil:
+		b.state = breakerClosed
+		b.failures = 0
+	case !connectionFailure(pool, err):
+		// Let the next request probe again.
+		if b.state == breakerHalfOpen {
+			b.state = breakerOpen
+		}
+	case b.state == breakerHalfOpen:
+		b.state = breakerOpen
+		b.openedAt = time.Now()
+	default:
+		b.failures++
+		if b.failures >= breakerFailures {
+			b.state = breakerOpen
+			b.openedAt = time.Now()
+		}
+	}
+}
+
+// connectionFailure reports whether err means the database couldn't be
+// reached. A client that went away says nothing about the database, and
+// neither does a timeout while every connection was in use: the request was
+// waiting for a busy pool, not for a connection attempt.
+func connectionFailure(pool *pgxpool.Pool, err error) bool {
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		stat := pool.Stat()
+		return stat.TotalConns() < stat.MaxConns()
+	}
+	return true
+}
+
+func (b *circuitBreaker) currentState() breakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
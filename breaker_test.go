@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// newUnreachablePool returns a pool whose connection attempts fail.
+func newUnreachablePool(t *testing.T) *pgxpool.Pool {
+	t.Helper()
+	config, err := pgxpool.ParseConfig("postgres://pgproxy@127.0.0.1:1/pgproxy?connect_timeout=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.LazyConnect = true
+	pool, err := pgxpool.ConnectConfig(context.Background(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(pool.Close)
+	return pool
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	pool := newUnreachablePool(t)
+
+	defer func(failures int, cooldown time.Duration) {
+		breakerFailures, breakerCooldown = failures, cooldown
+	}(breakerFailures, breakerCooldown)
+	breakerFailures, breakerCooldown = 2, time.Hour
+	b := &circuitBreaker{}
+	failure := errors.New("connection refused")
+
+	steps := []struct {
+		name  string
+		err   error
+		state breakerState
+	}{
+		{"first failure", failure, breakerClosed},
+		{"canceled request", context.Canceled, breakerClosed},
+		{"second failure", failure, breakerOpen},
+	}
+	for _, step := range steps {
+		if err := b.allow(); err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		b.record(pool, step.err)
+		if got := b.currentState(); got != step.state {
+			t.Errorf("%s: state %v, want %v", step.name, got, step.state)
+		}
+	}
+	if err := b.allow(); !errors.Is(err, errBreakerOpen) {
+		t.Fatalf("open breaker: %v, want %v", err, errBreakerOpen)
+	}
+
+	b.openedAt = time.Now().Add(-2 * time.Hour)
+	if err := b.allow(); err != nil {
+		t.Fatalf("probe after cooldown: %v", err)
+	}
+	if err := b.allow(); !errors.Is(err, errBreakerOpen) {
+		t.Errorf("second request while probing: %v, want %v", err, errBreakerOpen)
+	}
+	b.record(pool, nil)
+	if got := b.currentState(); got != breakerClosed {
+		t.Errorf("successful probe: state %v, want %v", got, breakerClosed)
+	}
+}
+
+func TestAcquireConnBreaker(t *testing.T) {
+	pool := newUnreachablePool(t)
+
+	defer func(failures int) { breakerFailures = failures }(breakerFailures)
+	breakerFailures = 1
+	if _, err := acquireConn(context.Background(), pool); err == nil || errors.Is(err, errBreakerOpen) {
+		t.Fatalf("first acquire: %v, want a connection error", err)
+	}
+	if _, err := acquireConn(context.Background(), pool); !errors.Is(err, errBreakerOpen) {
+		t.Errorf("second acquire: %v, want %v", err, errBreakerOpen)
+	}
+}
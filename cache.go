@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Result caching is opt-in: CACHE_TTL sets how long a response is served from
+// memory and CACHE_MAX_ENTRIES how many responses are kept.
+var (
+	cacheTTL        time.Duration
+	cacheMaxEntries = 1000
+)
+
+// maxCachedBytes is the largest response body that is cached; bigger results
+// are only streamed.
+const maxCachedBytes = 1 << 20
+
+// resultCache holds recent responses to read-only queries. It is nil when
+// caching is disabled.
+var resultCache *responseCache
+
+type cacheEntry struct {
+	key          string
+	contentType  string
+	disposition  string
+	totalCount   string
+	limitApplied string
+	body         []byte
+	expires      time.Time
+}
+
+// responseCache is an LRU cache of response bodies with a fixed TTL.
+type responseCache struct {
+	mu         sync.Mutex
+	ttl        time.Duration
+	maxEntries int
+	order      *list.List
+	entries    map[string]*list.Element
+}
+
+func newResponseCache(ttl time.Duration, maxEntries int) *responseCache {
+	return &responseCache{
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		order:      list.New(),
+		entries:    make(map[string]*list.Element),
+	}
+}
+
+// get returns the unexpired entry for key.
+func (c *responseCache) get(key string) (*cacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*cacheEntry)
+	if time.Now().After(entry.expires) {
+		c.order.Remove(elem)
+		delete(c.entries, key)
+		return nil, false
+	}
+	c.order.MoveToFront(elem)
+	return entry, true
+}
+
+// add stores entry, evicting the least recently used entries when full.
+func (c *responseCache) add(entry *cacheEntry) {
+	entry.expires = time.Now().Add(c.ttl)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[entry.key]; ok {
+		elem.Value = entry
+		c.order.MoveToFront(elem)
+		return
+	}
+	c.entries[entry.key] = c.order.PushFront(entry)
+	for c.order.Len() > c.maxEntries {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+// cacheKey returns the key for a query request, or "" when its response
+// mustn't be cached: the client asked to bypass the cache with
+// Cache-Control: no-cache or ?nocache=true, or the query isn't read-only.
+func cacheKey(r *http.Request, format string, sqlQuery SQLQuery) string {
+	if strings.Contains(r.Header.Get("Cache-Control"), "no-cache") || r.URL.Query().Get("nocache") == "true" {
+		return ""
+	}
+	if checkReadOnly(sqlQuery.Query) != nil {
+		return ""
+	}
+	db := sqlQuery.DB
+	if db == "" {
+		db = r.URL.Query().Get("db")
+	}
+	// Row-level security may give every tenant different rows.
+	var scope []string
+	for _, s := range tenantSettings(r.Context()) {
+		scope = append(scope, s.name+"="+s.value)
+	}
+	key, err := json.Marshal([]interface{}{
+		db,
+		format,
+		r.URL.Query().Get("geom"),
+		r.URL.Query().Get("srid"),
+		rowLimit(sqlQuery.Limit),
+		sqlQuery.Count,
+		sqlQuery.ResultFormat,
+		sqlQuery.BinaryEncoding,
+		sqlQuery.Filename,
+		sqlQuery.SearchPath,
+		normalizeQuery(sqlQuery.Query),
+		sqlQuery.Params,
+		scope,
+	})
+	if err != nil {
+		return ""
+	}
+	return string(key)
+}
+
+// normalizeQuery drops comments and collapses whitespace, so that queries
+// differing only in formatting share a cache entry.
+func normalizeQuery(sql string) string {
+	tokens, err := tokenize(sql)
+	if err != nil {
+		return sql
+	}
+	texts := make([]string, len(tokens))
+	for i, t := range tokens {
+		texts[i] = t.text
+	}
+	return strings.Join(texts, " ")
+}
+
+// writeCached serves a cached response.
+func writeCached(w http.ResponseWriter, r *http.Request, entry *cacheEntry) {
+	w.Header().Set("X-Cache", "HIT")
+	w.Header().Set("Content-Type", entry.contentType)
+	if entry.disposition != "" {
+		w.Header().Set("Content-Disposition", entry.disposition)
+	}
+	if entry.totalCount != "" {
+		w.Header().Set("X-Total-Count", entry.totalCount)
+	}
+	if entry.limitApplied != "" {
+		w.Header().Set("X-Limit-Applied", entry.limitApplied)
+	}
+	body, closeBody := compressResponse(w, r)
+	defer closeBody()
+	body.Write(entry.body)
+}
+
+// cacheCapture records a copy of a response body as it is streamed, giving up
+// once it grows beyond maxCachedBytes.
+type cacheCapture struct {
+	buf      bytes.Buffer
+	overflow bool
+}
+
+func (c *cacheCapture) Write(p []byte) (int, error) {
+	if !c.overflow {
+		if c.buf.Len()+len(p) > maxCachedBytes {
+			c.overflow = true
+			c.buf = bytes.Buffer{}
+		} else {
+			c.buf.Write(p)
+		}
+	}
+	return len(p), nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCacheKey(t *testing.T) {
+	base := SQLQuery{Query: "SELECT * FROM t WHERE id = $1", Params: []interface{}{"1"}}
+	key := func(target string, header http.Header, q SQLQuery) string {
+		r := httptest.NewRequest(http.MethodGet, target, nil)
+		for name, values := range header {
+			r.Header[name] = values
+		}
+		return cacheKey(r, formatJSON, q)
+	}
+	baseKey := key("/query", nil, base)
+	if baseKey == "" {
+		t.Fatal("read-only query has no cache key")
+	}
+
+	reformatted := SQLQuery{Query: "SELECT *\n  FROM t -- by id\n  WHERE id = $1", Params: []interface{}{"1"}}
+	if got := key("/query", nil, reformatted); got != baseKey {
+		t.Errorf("reformatted query: key %q, want %q", got, baseKey)
+	}
+
+	different := []struct {
+		name   string
+		target string
+		q      SQLQuery
+	}{
+		{"other param", "/query", SQLQuery{Query: base.Query, Params: []interface{}{"2"}}},
+		{"other query", "/query", SQLQuery{Query: "SELECT * FROM u WHERE id = $1", Params: base.Params}},
+		{"literal differs", "/query", SQLQuery{Query: "SELECT * FROM t WHERE id = '1'"}},
+		{"other database", "/query?db=other", base},
+		{"limit", "/query", SQLQuery{Query: base.Query, Params: base.Params, Limit: 10}},
+		{"count", "/query", SQLQuery{Query: base.Query, Params: base.Params, Count: true}},
+		{"result format", "/query", SQLQuery{Query: base.Query, Params: base.Params, ResultFormat: "binary"}},
+		{"search_path", "/query", SQLQuery{Query: base.Query, Params: base.Params, SessionOptions: SessionOptions{SearchPath: "other"}}},
+		{"binary encoding", "/query", SQLQuery{Query: base.Query, Params: base.Params, BinaryEncoding: hexEncoding}},
+		{"filename", "/query", SQLQuery{Query: base.Query, Params: base.Params, Filename: "a.json"}},
+		{"geometry column", "/query?geom=geom", base},
+		{"srid", "/query?srid=3857", base},
+	}
+	for _, tt := range different {
+		if got := key(tt.target, nil, tt.q); got == baseKey || got == "" {
+			t.Errorf("%s: key %q, want a key of its own", tt.name, got)
+		}
+	}
+
+	uncached := []struct {
+		name   string
+		target string
+		header http.Header
+		q      SQLQuery
+	}{
+		{"no-cache header", "/query", http.Header{"Cache-Control": {"no-cache"}}, base},
+		{"nocache parameter", "/query?nocache=true", nil, base},
+		{"write", "/query", nil, SQLQuery{Query: "DELETE FROM t"}},
+		{"several statements", "/query", nil, SQLQuery{Query: "SELECT 1; SELECT 2"}},
+	}
+	for _, tt := range uncached {
+		if got := key(tt.target, tt.header, tt.q); got != "" {
+			t.Errorf("%s: key %q, want none", tt.name, got)
+		}
+	}
+}
+
+func TestCacheKeyTenant(t *testing.T) {
+	apiKeyTenants = map[string]string{"acme-key": "acme", "globex-key": "globex"}
+	defer func() { apiKeyTenants = nil }()
+	q := SQLQuery{Query: "SELECT * FROM t"}
+	r := httptest.NewRequest(http.MethodGet, "/query", nil)
+	acme := cacheKey(withPrincipal(r, "acme-key"), formatJSON, q)
+	globex := cacheKey(withPrincipal(r, "globex-key"), formatJSON, q)
+	if acme == "" || acme == globex {
+		t.Errorf("tenants share cache key %q", acme)
+	}
+}
+
+func TestResponseCache(t *testing.T) {
+	c := newResponseCache(time.Hour, 2)
+	c.add(&cacheEntry{key: "a", body: []byte("a")})
+	c.add(&cacheEntry{key: "b", body: []byte("b")})
+	// Using a makes b the least recently used.
+	if _, ok := c.get("a"); !ok {
+		t.Fatal("a missing")
+	}
+	c.add(&cacheEntry{key: "c", body: []byte("c")})
+	for key, want := range map[string]bool{"a": true, "b": false, "c": true} {
+		if _, ok := c.get(key); ok != want {
+			t.Errorf("%s cached %v, want %v", key, ok, want)
+		}
+	}
+
+	expired := newResponseCache(-time.Second, 2)
+	expired.add(&cacheEntry{key: "a"})
+	if _, ok := expired.get("a"); ok {
+		t.Error("expired entry served")
+	}
+}
+
+func TestWriteCached(t *testing.T) {
+	tests := []struct {
+		name   string
+		entry  cacheEntry
+		header map[string]string
+	}{
+		{"plain", cacheEntry{contentType: "application/json"}, map[string]string{"Content-Type": "application/json", "X-Limit-Applied": "", "X-Total-Count": ""}},
+		{"auto-limited", cacheEntry{contentType: "application/json", limitApplied: "1000"}, map[string]string{"X-Limit-Applied": "1000"}},
+		{"counted download", cacheEntry{contentType: "text/csv", disposition: `attachment; filename="query.csv"`, totalCount: "5"},
+			map[string]string{"Content-Disposition": `attachment; filename="query.csv"`, "X-Total-Count": "5"}},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		entry := tt.entry
+		entry.body = []byte("[]")
+		writeCached(w, httptest.NewRequest(http.MethodGet, "/query", nil), &entry)
+		if w.Header().Get("X-Cache") != "HIT" || w.Body.String() != "[]" {
+			t.Errorf("%s: X-Cache %q, body %q", tt.name, w.Header().Get("X-Cache"), w.Body)
+		}
+		for name, want := range tt.header {
+			if got := w.Header().Get(name); got != want {
+				t.Errorf("%s: %s %q, want %q", tt.name, name, got, want)
+			}
+		}
+	}
+}
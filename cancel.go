@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// runningQuery is a query request that /cancel can stop.
+type runningQuery struct {
+	cancel    context.CancelFunc
+	principal string
+}
+
+// runningQueries holds the running query requests by query ID.
+var runningQueries = struct {
+	sync.Mutex
+	queries map[string]runningQuery
+}{queries: make(map[string]runningQuery)}
+
+// trackQuery registers a query request under a new query ID, returned in
+// the X-Query-ID header, so /cancel can stop it. A client may pick the ID
+// itself by sending a well-formed X-Query-ID, so it knows the ID before the
+// response starts. The returned function cancels ctx and unregisters it.
+func trackQuery(ctx context.Context, w http.ResponseWriter, r *http.Request, cancel context.CancelFunc) context.CancelFunc {
+	id := r.Header.Get("X-Query-ID")
+	if id == "" || len(id) > 64 || strings.ContainsAny(id, "\r\n") {
+		id = newQueryID()
+	}
+	principal := requestInfoFrom(ctx).principal
+
+	runningQueries.Lock()
+	if _, ok := runningQueries.queries[id]; ok {
+		id = newQueryID()
+	}
+	runningQueries.queries[id] = runningQuery{cancel: cancel, principal: principal}
+	runningQueries.Unlock()
+	w.Header().Set("X-Query-ID", id)
+
+	return func() {
+		runningQueries.Lock()
+		delete(runningQueries.queries, id)
+		runningQueries.Unlock()
+		cancel()
+	}
+}
+
+func newQueryID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// cancelHandler cancels the running query request with the given ID, which
+// makes pgx send a cancel request to Postgres. Only the client that started
+// a query may cancel it.
+//
+//	POST /cancel?id=<X-Query-ID>
+func cancelHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "Invalid request method")
+		return
+	}
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		writeJSONError(w, http.StatusBadRequest, "Missing query ID")
+		return
+	}
+
+	runningQueries.Lock()
+	q, ok := runningQueries.queries[id]
+	if ok && q.principal != requestInfoFrom(r.Context()).principal {
+		ok = false
+	}
+	runningQueries.Unlock()
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, "Unknown query ID")
+		return
+	}
+	q.cancel()
+	writeStatus(w, http.StatusOK, map[string]interface{}{"cancelled": id})
+}
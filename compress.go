@@ -0,0 +1,123 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// gzipLevel is the gzip compression level, set through GZIP_LEVEL: -2
+// (Huffman only), -1 (the default level), 0 (no compression) or 1 (fastest)
+// to 9 (best compression).
+var gzipLevel = gzip.DefaultCompression
+
+// zstdLevel is the Zstandard compression level, set through ZSTD_LEVEL:
+// 1 (fastest) to 22 (best compression), mapped onto the nearest of the
+// encoder's levels.
+var zstdLevel = 3
+
+// encoders are the content codings responses can be compressed with, in
+// order of preference when a client accepts several equally.
+var encoders = []struct {
+	coding string
+	new    func(io.Writer) io.WriteCloser
+}{
+	{"zstd", func(w io.Writer) io.WriteCloser {
+		// A response is compressed as it streams, so a single goroutine
+		// will do; loadSettings has validated the level.
+		enc, _ := zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(zstdLevel)), zstd.WithEncoderConcurrency(1))
+		return enc
+	}},
+	{"br", func(w io.Writer) io.WriteCloser { return brotli.NewWriter(w) }},
+	{"gzip", func(w io.Writer) io.WriteCloser {
+		// loadSettings has validated the level.
+		gz, _ := gzip.NewWriterLevel(w, gzipLevel)
+		return gz
+	}},
+}
+
+// compressResponse returns the writer to send the response body through,
+// compressed with the coding negotiated by responseEncoder. The returned
+// function flushes the compressor and must be called once the body is
+// complete.
+func compressResponse(w http.ResponseWriter, r *http.Request) (io.Writer, func() error) {
+	w.Header().Add("Vary", "Accept-Encoding")
+	coding, enc := responseEncoder(w, r)
+	if enc == nil {
+		return w, func() error { return nil }
+	}
+	w.Header().Set("Content-Encoding", coding)
+	return enc, enc.Close
+}
+
+// responseEncoder picks the coding the client prefers among encoders and
+// returns a compressor for it writing to w, or a nil writer when the
+// response should be sent uncompressed.
+func responseEncoder(w io.Writer, r *http.Request) (string, io.WriteCloser) {
+	best, bestQ := -1, 0.0
+	for i, e := range encoders {
+		if q := encodingQuality(r, e.coding); q > bestQ {
+			best, bestQ = i, q
+		}
+	}
+	if best < 0 {
+		return "", nil
+	}
+	return encoders[best].coding, encoders[best].new(w)
+}
+
+// flushResponse sends everything written to body so far to the client,
+// flushing the compressor first when body is compressed.
+func flushResponse(w http.ResponseWriter, body io.Writer) error {
+	if f, ok := body.(interface{ Flush() error }); ok {
+		if err := f.Flush(); err != nil {
+			return err
+		}
+	}
+	return http.NewResponseController(w).Flush()
+}
+
+// encodingQuality returns the quality the request's Accept-Encoding header
+// gives the content coding, or 0 when it isn't accepted. Compression is
+// opt-in: a request without the header gets an uncompressed response.
+// Browsers always advertise gzip, so they still receive compressed bodies.
+func encodingQuality(r *http.Request, coding string) float64 {
+	explicit, wildcard := -1.0, -1.0
+	for _, header := range r.Header.Values("Accept-Encoding") {
+		for _, part := range strings.Split(header, ",") {
+			name, q := parseQuality(part)
+			switch {
+			case strings.EqualFold(name, coding):
+				explicit = q
+			case name == "*":
+				wildcard = q
+			}
+		}
+	}
+	if explicit >= 0 {
+		return explicit
+	}
+	return math.Max(wildcard, 0)
+}
+
+// parseQuality splits a header list element like "gzip;q=0.5" into its value
+// and quality, which defaults to 1.
+func parseQuality(part string) (string, float64) {
+	value, params, _ := strings.Cut(part, ";")
+	q := 1.0
+	for _, param := range strings.Split(params, ";") {
+		key, val, ok := strings.Cut(strings.TrimSpace(param), "=")
+		if ok && strings.EqualFold(strings.TrimSpace(key), "q") {
+			if f, err := strconv.ParseFloat(strings.TrimSpace(val), 64); err == nil {
+				q = f
+			}
+		}
+	}
+	return strings.TrimSpace(value), q
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestEncodingQuality(t *testing.T) {
+	tests := []struct {
+		header string
+		want   bool
+	}{
+		{"", false},
+		{"gzip", true},
+		{"deflate, gzip;q=0.5", true},
+		{"GZIP", true},
+		{"identity", false},
+		{"gzip;q=0", false},
+		{"*", true},
+		{"*;q=0", false},
+		{"*, gzip;q=0", false},
+		{"*;q=0, gzip", true},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/query", nil)
+		if tt.header != "" {
+			r.Header.Set("Accept-Encoding", tt.header)
+		}
+		if got := encodingQuality(r, "gzip") > 0; got != tt.want {
+			t.Errorf("encodingQuality(%q) > 0 = %v, want %v", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestResponseEncoder(t *testing.T) {
+	tests := []struct {
+		header string
+		want   string
+	}{
+		{"", ""},
+		{"gzip", "gzip"},
+		{"br", "br"},
+		{"zstd", "zstd"},
+		{"gzip, br", "br"},
+		{"gzip, br, zstd", "zstd"},
+		{"br, zstd;q=0.5", "br"},
+		{"br;q=0.5, gzip", "gzip"},
+		{"br;q=0, gzip;q=0.1", "gzip"},
+		{"*", "zstd"},
+		{"*, zstd;q=0, br;q=0", "gzip"},
+		{"identity", ""},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/query", nil)
+		if tt.header != "" {
+			r.Header.Set("Accept-Encoding", tt.header)
+		}
+		var buf bytes.Buffer
+		if got, _ := responseEncoder(&buf, r); got != tt.want {
+			t.Errorf("responseEncoder(%q) = %q, want %q", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestCompressResponse(t *testing.T) {
+	body := bytes.Repeat([]byte(`{"id":1,"name":"row"},`), 1000)
+	tests := []struct {
+		accept string
+		coding string
+		decode func(io.Reader) ([]byte, error)
+	}{
+		{"gzip, br", "br", func(r io.Reader) ([]byte, error) { return io.ReadAll(brotli.NewReader(r)) }},
+		{"gzip, zstd", "zstd", func(r io.Reader) ([]byte, error) {
+			dec, err := zstd.NewReader(r)
+			if err != nil {
+				return nil, err
+			}
+			defer dec.Close()
+			return io.ReadAll(dec)
+		}},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/query", nil)
+		r.Header.Set("Accept-Encoding", tt.accept)
+		w := httptest.NewRecorder()
+		out, done := compressResponse(w, r)
+		if _, err := out.Write(body); err != nil {
+			t.Fatal(err)
+		}
+		if err := done(); err != nil {
+			t.Fatal(err)
+		}
+		if got := w.Header().Get("Content-Encoding"); got != tt.coding {
+			t.Errorf("%s: Content-Encoding %q, want %s", tt.accept, got, tt.coding)
+		}
+		if got, err := tt.decode(w.Body); err != nil || !bytes.Equal(got, body) {
+			t.Errorf("%s: body doesn't round-trip: %v", tt.accept, err)
+		}
+	}
+}
+
+func TestGzipLevel(t *testing.T) {
+	defer func(level int) { gzipLevel = level }(gzipLevel)
+	body := bytes.Repeat([]byte(`{"id":1,"name":"row"},`), 1000)
+
+	sizes := make(map[int]int)
+	for _, level := range []int{gzip.NoCompression, gzip.BestSpeed, gzip.BestCompression} {
+		gzipLevel = level
+		r := httptest.NewRequest("GET", "/query", nil)
+		r.Header.Set("Accept-Encoding", "gzip")
+		w := httptest.NewRecorder()
+		out, done := compressResponse(w, r)
+		if _, err := out.Write(body); err != nil {
+			t.Fatal(err)
+		}
+		if err := done(); err != nil {
+			t.Fatal(err)
+		}
+		sizes[level] = w.Body.Len()
+		zr, err := gzip.NewReader(w.Body)
+		if err != nil {
+			t.Fatalf("level %d: %v", level, err)
+		}
+		if got, err := io.ReadAll(zr); err != nil || !bytes.Equal(got, body) {
+			t.Errorf("level %d: body doesn't round-trip: %v", level, err)
+		}
+	}
+	if sizes[gzip.NoCompression] <= sizes[gzip.BestSpeed] || sizes[gzip.BestSpeed] < sizes[gzip.BestCompression] {
+		t.Errorf("compressed sizes by level %v don't shrink", sizes)
+	}
+}
+
+func TestCompressionLevelSettings(t *testing.T) {
+	defer func(gzip, zstd int) { gzipLevel, zstdLevel = gzip, zstd }(gzipLevel, zstdLevel)
+	tests := []struct {
+		name  string
+		value string
+		ok    bool
+	}{
+		{"GZIP_LEVEL", "-2", true},
+		{"GZIP_LEVEL", "0", true},
+		{"GZIP_LEVEL", "9", true},
+		{"GZIP_LEVEL", "-3", false},
+		{"GZIP_LEVEL", "10", false},
+		{"GZIP_LEVEL", "fast", false},
+		{"ZSTD_LEVEL", "1", true},
+		{"ZSTD_LEVEL", "22", true},
+		{"ZSTD_LEVEL", "0", false},
+		{"ZSTD_LEVEL", "23", false},
+	}
+	for _, tt := range tests {
+		gzipLevel, zstdLevel = gzip.DefaultCompression, 3
+		t.Setenv("GZIP_LEVEL", "")
+		t.Setenv("ZSTD_LEVEL", "")
+		t.Setenv(tt.name, tt.value)
+		if err := loadSettings(); (err == nil) != tt.ok {
+			t.Errorf("%s=%s: error %v, want ok %v", tt.name, tt.value, err, tt.ok)
+		}
+	}
+}
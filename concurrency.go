@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sync/semaphore"
+)
+
+// Concurrency limit: at most maxConcurrentQueries requests run queries at
+// once, set through MAX_CONCURRENT_QUERIES, independent of the pool size.
+// Others wait up to queueTimeout (QUEUE_TIMEOUT) for a slot, or not at all
+// when it is zero, before failing with 503. Zero disables the limit. They
+// are served in the order they arrived; at most maxQueueLength wait at once,
+// set through MAX_QUEUE_LENGTH, and any more fail with 503 straight away.
+// Zero leaves the queue unbounded.
+var (
+	maxConcurrentQueries int64
+	queueTimeout         time.Duration
+	maxQueueLength       int64
+)
+
+// querySlots holds a unit per running query when the limit is enabled.
+var querySlots *semaphore.Weighted
+
+// queueLength is the number of requests waiting for a query slot.
+var queueLength atomic.Int64
+
+// limitConcurrency runs next only once it holds a query slot. The long-lived
+// /listen and /ws sessions aren't wrapped, since they would hold a slot for
+// as long as they stay open.
+func limitConcurrency(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if querySlots == nil {
+			next(w, r)
+			return
+		}
+		if !acquireSlot(r.Context()) {
+			w.Header().Set("Retry-After", "1")
+			writeJSONError(w, http.StatusServiceUnavailable, "Too many concurrent queries")
+			return
+		}
+		defer querySlots.Release(1)
+		next(w, r)
+	}
+}
+
+// acquireSlot takes a query slot, waiting up to queueTimeout for one unless
+// the queue is full.
+func acquireSlot(ctx context.Context) bool {
+	if querySlots.TryAcquire(1) {
+		return true
+	}
+	if queueTimeout <= 0 {
+		return false
+	}
+	if n := queueLength.Add(1); maxQueueLength > 0 && n > maxQueueLength {
+		queueLength.Add(-1)
+		return false
+	}
+	queuedRequests.Inc()
+	defer func() {
+		queueLength.Add(-1)
+		queuedRequests.Dec()
+	}()
+	ctx, cancel := context.WithTimeout(ctx, queueTimeout)
+	defer cancel()
+	return querySlots.Acquire(ctx, 1) == nil
+}
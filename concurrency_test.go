@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/sync/semaphore"
+)
+
+func TestLimitConcurrency(t *testing.T) {
+	defer func(slots *semaphore.Weighted, timeout time.Duration) {
+		querySlots, queueTimeout = slots, timeout
+	}(querySlots, queueTimeout)
+	querySlots = semaphore.NewWeighted(1)
+	handler := limitConcurrency(func(w http.ResponseWriter, r *http.Request) {})
+
+	tests := []struct {
+		name       string
+		timeout    time.Duration
+		release    time.Duration
+		wantStatus int
+	}{
+		{"no queue", 0, 0, http.StatusServiceUnavailable},
+		{"queue times out", 10 * time.Millisecond, 0, http.StatusServiceUnavailable},
+		{"slot freed while queued", time.Second, 10 * time.Millisecond, http.StatusOK},
+	}
+	for _, tt := range tests {
+		queueTimeout = tt.timeout
+		if !querySlots.TryAcquire(1) {
+			t.Fatalf("%s: slot still taken", tt.name)
+		}
+		if tt.release > 0 {
+			time.AfterFunc(tt.release, func() { querySlots.Release(1) })
+		}
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest(http.MethodPost, "/query", nil))
+		if tt.release == 0 {
+			querySlots.Release(1)
+		}
+		if w.Code != tt.wantStatus {
+			t.Errorf("%s: status %d, want %d", tt.name, w.Code, tt.wantStatus)
+		}
+		if w.Code == http.StatusServiceUnavailable && w.Header().Get("Retry-After") == "" {
+			t.Errorf("%s: no Retry-After header", tt.name)
+		}
+	}
+	if !querySlots.TryAcquire(1) {
+		t.Error("handler didn't release its slot")
+	}
+}
+
+func TestMaxQueueLength(t *testing.T) {
+	defer func(slots *semaphore.Weighted, timeout time.Duration, length int64) {
+		querySlots, queueTimeout, maxQueueLength = slots, timeout, length
+	}(querySlots, queueTimeout, maxQueueLength)
+	querySlots, queueTimeout, maxQueueLength = semaphore.NewWeighted(1), time.Minute, 1
+	handler := limitConcurrency(func(w http.ResponseWriter, r *http.Request) {})
+
+	querySlots.TryAcquire(1)
+	queued := make(chan int)
+	go func() {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest(http.MethodPost, "/query", nil))
+		queued <- w.Code
+	}()
+	for queueLength.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	start := time.Now()
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest(http.MethodPost, "/query", nil))
+	if w.Code != http.StatusServiceUnavailable || time.Since(start) > time.Second {
+		t.Errorf("request beyond the queue: status %d after %s, want %d at once", w.Code, time.Since(start), http.StatusServiceUnavailable)
+	}
+
+	querySlots.Release(1)
+	if code := <-queued; code != http.StatusOK {
+		t.Errorf("queued request: status %d, want %d", code, http.StatusOK)
+	}
+	if n := queueLength.Load(); n != 0 {
+		t.Errorf("queue length %d after the queue emptied", n)
+	}
+}
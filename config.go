@@ -0,0 +1,483 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgconn/stmtcache"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"golang.org/x/sync/semaphore"
+)
+
+// loadSettings reads the server settings from the environment into the
+// package variables they configure. Unset variables keep their defaults.
+func loadSettings() error {
+	var err error
+	if err := loadQueryAllowlist(); err != nil {
+		return err
+	}
+	if err := loadResultFormat(); err != nil {
+		return err
+	}
+	if err := loadDefaultFormat(); err != nil {
+		return err
+	}
+	if name := os.Getenv("GEOJSON_GEOMETRY_COLUMN"); name != "" {
+		geometryColumnName = name
+	}
+	if value := os.Getenv("GEOJSON_SRID"); value != "" {
+		if geoJSONSRID, err = parseSRID(value); err != nil {
+			return fmt.Errorf("invalid GEOJSON_SRID %q: %v", value, err)
+		}
+	}
+	if queryTimeout, err = envDuration("QUERY_TIMEOUT", queryTimeout); err != nil {
+		return err
+	}
+	if maxQueryTimeout, err = envDuration("MAX_QUERY_TIMEOUT", maxQueryTimeout); err != nil {
+		return err
+	}
+	if maxByteaBytes, err = envInt("MAX_BYTEA_BYTES", maxByteaBytes); err != nil {
+		return err
+	}
+	bodyBytes, err := envInt("MAX_BODY_BYTES", int(maxBodyBytes))
+	if err != nil {
+		return err
+	}
+	maxBodyBytes = int64(bodyBytes)
+	rows, err := envInt("MAX_ROWS", int(maxRows))
+	if err != nil {
+		return err
+	}
+	maxRows = int64(rows)
+	if databaseReloadInterval, err = envDuration("DATABASE_RELOAD_INTERVAL", 0); err != nil {
+		return err
+	}
+	if idempotencyTTL, err = envDuration("IDEMPOTENCY_TTL", idempotencyTTL); err != nil {
+		return err
+	}
+	if quotaWindow, err = envDuration("QUOTA_WINDOW", quotaWindow); err != nil {
+		return err
+	}
+	if quotaWindow <= 0 {
+		return fmt.Errorf("invalid QUOTA_WINDOW: must be positive")
+	}
+	if tileCacheTTL, err = envDuration("TILE_CACHE_TTL", tileCacheTTL); err != nil {
+		return err
+	}
+	if cursorIdleTimeout, err = envDuration("CURSOR_IDLE_TIMEOUT", cursorIdleTimeout); err != nil {
+		return err
+	}
+	if breakerFailures, err = envInt("BREAKER_FAILURES", breakerFailures); err != nil {
+		return err
+	}
+	if breakerCooldown, err = envDuration("BREAKER_COOLDOWN", breakerCooldown); err != nil {
+		return err
+	}
+	if acquireTimeout, err = envDuration("ACQUIRE_TIMEOUT", acquireTimeout); err != nil {
+		return err
+	}
+	if startupTimeout, err = envDuration("STARTUP_TIMEOUT", startupTimeout); err != nil {
+		return err
+	}
+	if startupAttempts, err = envInt("STARTUP_ATTEMPTS", 0); err != nil {
+		return err
+	}
+	if queryRetries, err = envInt("QUERY_RETRIES", queryRetries); err != nil {
+		return err
+	}
+	if retryBaseDelay, err = envDuration("QUERY_RETRY_DELAY", retryBaseDelay); err != nil {
+		return err
+	}
+	if streamDeadline, err = envDuration("STREAM_DEADLINE", 0); err != nil {
+		return err
+	}
+	if maxStreamDeadline, err = envDuration("MAX_STREAM_DEADLINE", 0); err != nil {
+		return err
+	}
+	if maxStatementTimeout, err = envDuration("MAX_STATEMENT_TIMEOUT", 0); err != nil {
+		return err
+	}
+	if value := os.Getenv("MAX_WORK_MEM"); value != "" {
+		if maxWorkMemKB, err = parseMemory(value); err != nil {
+			return fmt.Errorf("invalid MAX_WORK_MEM %q: must be a size such as 64MB", value)
+		}
+	}
+	limit, err := envInt("AUTO_LIMIT", 0)
+	if err != nil {
+		return err
+	}
+	if autoLimit = int64(limit); autoLimit < 0 {
+		return fmt.Errorf("invalid AUTO_LIMIT %d: must not be negative", autoLimit)
+	}
+	flushRows, err := envInt("STREAM_FLUSH_ROWS", int(streamFlushRows))
+	if err != nil {
+		return err
+	}
+	if streamFlushRows = int64(flushRows); streamFlushRows <= 0 {
+		return fmt.Errorf("invalid STREAM_FLUSH_ROWS %d: must be positive", streamFlushRows)
+	}
+	if multiQueryConcurrency, err = envInt("MULTI_QUERY_CONCURRENCY", multiQueryConcurrency); err != nil {
+		return err
+	}
+	if multiQueryConcurrency <= 0 {
+		return fmt.Errorf("invalid MULTI_QUERY_CONCURRENCY %d: must be positive", multiQueryConcurrency)
+	}
+	if maxColumns, err = envInt("MAX_COLUMNS", 0); err != nil {
+		return err
+	}
+	if maxQueryLen, err = envInt("MAX_QUERY_LEN", maxQueryLen); err != nil {
+		return err
+	}
+	responseBytes, err := envInt("MAX_RESPONSE_BYTES", 0)
+	if err != nil {
+		return err
+	}
+	if maxResponseBytes = int64(responseBytes); maxResponseBytes < 0 {
+		return fmt.Errorf("invalid MAX_RESPONSE_BYTES %d: must not be negative", maxResponseBytes)
+	}
+	concurrent, err := envInt("MAX_CONCURRENT_QUERIES", 0)
+	if err != nil {
+		return err
+	}
+	if maxConcurrentQueries = int64(concurrent); maxConcurrentQueries > 0 {
+		querySlots = semaphore.NewWeighted(maxConcurrentQueries)
+	}
+	if readHeaderTimeout, err = envDuration("READ_HEADER_TIMEOUT", readHeaderTimeout); err != nil {
+		return err
+	}
+	if readTimeout, err = envDuration("READ_TIMEOUT", 0); err != nil {
+		return err
+	}
+	if writeTimeout, err = envDuration("WRITE_TIMEOUT", 0); err != nil {
+		return err
+	}
+	if idleTimeout, err = envDuration("IDLE_TIMEOUT", idleTimeout); err != nil {
+		return err
+	}
+	if routePrefix, err = parseRoutePrefix(os.Getenv("ROUTE_PREFIX")); err != nil {
+		return err
+	}
+	if value := os.Getenv("HTTP2"); value != "" {
+		if http2Enabled, err = strconv.ParseBool(value); err != nil {
+			return fmt.Errorf("invalid HTTP2 %q: must be true or false", value)
+		}
+	}
+	if queueTimeout, err = envDuration("QUEUE_TIMEOUT", 0); err != nil {
+		return err
+	}
+	queueMax, err := envInt("MAX_QUEUE_LENGTH", 0)
+	if err != nil {
+		return err
+	}
+	if queueMax < 0 {
+		return fmt.Errorf("invalid MAX_QUEUE_LENGTH %d: must not be negative", queueMax)
+	}
+	maxQueueLength = int64(queueMax)
+	if schemaCacheTTL, err = envDuration("SCHEMA_CACHE_TTL", schemaCacheTTL); err != nil {
+		return err
+	}
+	if gzipLevel, err = envInt("GZIP_LEVEL", gzipLevel); err != nil {
+		return err
+	}
+	if gzipLevel < gzip.HuffmanOnly || gzipLevel > gzip.BestCompression {
+		return fmt.Errorf("invalid GZIP_LEVEL %d: must be between %d and %d", gzipLevel, gzip.HuffmanOnly, gzip.BestCompression)
+	}
+	if zstdLevel, err = envInt("ZSTD_LEVEL", zstdLevel); err != nil {
+		return err
+	}
+	if zstdLevel < 1 || zstdLevel > 22 {
+		return fmt.Errorf("invalid ZSTD_LEVEL %d: must be between 1 and 22", zstdLevel)
+	}
+	slowQueryMS, err := envInt("SLOW_QUERY_MS", 0)
+	if err != nil {
+		return err
+	}
+	if slowQueryMS < 0 {
+		return fmt.Errorf("invalid SLOW_QUERY_MS %d: must not be negative", slowQueryMS)
+	}
+	slowQueryThreshold = time.Duration(slowQueryMS) * time.Millisecond
+	if cacheTTL, err = envDuration("CACHE_TTL", 0); err != nil {
+		return err
+	}
+	if cacheMaxEntries, err = envInt("CACHE_MAX_ENTRIES", cacheMaxEntries); err != nil {
+		return err
+	}
+	if cursorIdleTimeout == 0 {
+		return fmt.Errorf("invalid CURSOR_IDLE_TIMEOUT: must be positive")
+	}
+	if maxCursors, err = envInt("MAX_CURSORS", maxCursors); err != nil {
+		return err
+	}
+	if maxCursorsPerPrincipal, err = envInt("MAX_CURSORS_PER_PRINCIPAL", maxCursorsPerPrincipal); err != nil {
+		return err
+	}
+	if maxCursors < 0 || maxCursorsPerPrincipal < 0 {
+		return fmt.Errorf("invalid MAX_CURSORS or MAX_CURSORS_PER_PRINCIPAL: must not be negative")
+	}
+
+	readOnly = os.Getenv("READ_ONLY") == "true"
+	redactErrors = os.Getenv("REDACT_ERRORS") == "true"
+	etagsEnabled = os.Getenv("ETAGS") == "true"
+	readsToReplica = os.Getenv("READS_TO_REPLICA") == "true"
+	if value, ok := os.LookupEnv("APPLICATION_NAME"); ok {
+		applicationName = value
+	}
+	switch applicationNameDetail = os.Getenv("APPLICATION_NAME_DETAIL"); applicationNameDetail {
+	case "", "request_id", "principal":
+	default:
+		return fmt.Errorf("invalid APPLICATION_NAME_DETAIL %q: must be request_id or principal", applicationNameDetail)
+	}
+	apiKeys = splitList(os.Getenv("API_KEYS"))
+	adminKeys = splitList(os.Getenv("ADMIN_KEYS"))
+	if err := loadBasicAuthUsers(); err != nil {
+		return err
+	}
+	if err := loadPreQuerySQL(); err != nil {
+		return err
+	}
+	if err := loadTenants(); err != nil {
+		return err
+	}
+	schemaAllowlist = splitList(os.Getenv("SCHEMA_ALLOWLIST"))
+	if value := os.Getenv("SEARCH_PATH"); value != "" {
+		if defaultSearchPath, err = parseSearchPath(value); err != nil {
+			return fmt.Errorf("invalid SEARCH_PATH %q", value)
+		}
+	}
+	trustProxyHeaders = os.Getenv("TRUST_PROXY_HEADERS") == "true"
+	if rateLimitRPS, err = envFloat("RATE_LIMIT_RPS", 0); err != nil {
+		return err
+	}
+	if rateLimitBurst, err = envInt("RATE_LIMIT_BURST", 0); err != nil {
+		return err
+	}
+	return nil
+}
+
+// splitList splits a comma-separated setting, dropping empty entries.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// envDuration reads a duration such as "30s" or "1m30s" from the environment,
+// returning def when the variable is unset.
+func envDuration(name string, def time.Duration) (time.Duration, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q: %v", name, value, err)
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("invalid %s %q: must not be negative", name, value)
+	}
+	return d, nil
+}
+
+// listenAddr returns the address to bind: LISTEN_ADDR when set (e.g.
+// "127.0.0.1:9000" or ":9000"), otherwise ":$PORT", defaulting to ":8080".
+func listenAddr() (string, error) {
+	addr := os.Getenv("LISTEN_ADDR")
+	name := "LISTEN_ADDR"
+	if addr == "" {
+		port := os.Getenv("PORT")
+		if port == "" {
+			return ":8080", nil
+		}
+		addr, name = ":"+port, "PORT"
+	}
+
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", fmt.Errorf("invalid %s %q: %v", name, addr, err)
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+		return "", fmt.Errorf("invalid %s %q: port must be a number between 0 and 65535", name, addr)
+	}
+	return addr, nil
+}
+
+// envInt reads an integer from the environment, returning def when the
+// variable is unset.
+func envInt(name string, def int) (int, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q: must be an integer", name, value)
+	}
+	return n, nil
+}
+
+// applicationName is the application_name of the proxy's connections, set
+// through APPLICATION_NAME, unless a connection string sets its own. With
+// applicationNameDetail, set through APPLICATION_NAME_DETAIL, each query's
+// transaction appends "/" and the request ID ("request_id") or the
+// authenticated principal ("principal") to it, so pg_stat_activity shows
+// which request a backend is running. That puts every query in a
+// transaction.
+var (
+	applicationName       = "go-pgproxy"
+	applicationNameDetail string
+)
+
+// poolConfig parses the connection string of the named database and applies
+// the PGPROXY_* pool overrides on top of the pgxpool defaults and any pool_*
+// parameters in the URL itself.
+func poolConfig(name, dbURL string) (*pgxpool.Config, error) {
+	config, err := pgxpool.ParseConfig(socketURL(dbURL))
+	if err != nil {
+		return nil, fmt.Errorf("invalid connection string for database %q: %v", name, err)
+	}
+
+	maxConns, err := envInt("PGPROXY_MAX_CONNS", int(config.MaxConns))
+	if err != nil {
+		return nil, err
+	}
+	minConns, err := envInt("PGPROXY_MIN_CONNS", int(config.MinConns))
+	if err != nil {
+		return nil, err
+	}
+	if maxConns < 1 {
+		return nil, fmt.Errorf("invalid PGPROXY_MAX_CONNS %d: must be at least 1", maxConns)
+	}
+	if minConns < 0 || minConns > maxConns {
+		return nil, fmt.Errorf("invalid PGPROXY_MIN_CONNS %d: must be between 0 and %d", minConns, maxConns)
+	}
+	config.MaxConns = int32(maxConns)
+	config.MinConns = int32(minConns)
+
+	if config.MaxConnLifetime, err = envDuration("PGPROXY_MAX_CONN_LIFETIME", config.MaxConnLifetime); err != nil {
+		return nil, err
+	}
+	if config.MaxConnIdleTime, err = envDuration("PGPROXY_MAX_CONN_IDLE_TIME", config.MaxConnIdleTime); err != nil {
+		return nil, err
+	}
+	if mode := os.Getenv("PGPROXY_QUERY_EXEC_MODE"); mode != "" {
+		if err := setQueryExecMode(config.ConnConfig, mode); err != nil {
+			return nil, err
+		}
+	}
+	if _, ok := config.ConnConfig.RuntimeParams["application_name"]; !ok && applicationName != "" {
+		config.ConnConfig.RuntimeParams["application_name"] = applicationName
+	}
+	config.AfterConnect = registerJSONTypes
+	config.ConnConfig.OnNotice = collectNotice
+	config.AfterRelease = discardNotices
+	return config, nil
+}
+
+// statementCacheCapacity is the size of the statement cache of the
+// PGPROXY_QUERY_EXEC_MODE modes that have one, pgx's default.
+const statementCacheCapacity = 512
+
+// setQueryExecMode sets how connections run queries, overriding the
+// statement_cache_mode and prefer_simple_protocol parameters of the
+// connection string:
+//
+//   - cache_statement, pgx's default, prepares each query once per
+//     connection and reuses the statement, which fails with "cached plan
+//     must not change result type" once DDL changes what it returns
+//   - describe caches only the description of each query, run through the
+//     unnamed statement, which also suits PgBouncer in transaction mode
+//   - exec caches nothing and describes every query anew
+//   - simple_protocol sends queries as text with their parameters
+//     interpolated by pgx, for poolers and proxies that only speak the
+//     simple query protocol
+func setQueryExecMode(config *pgx.ConnConfig, mode string) error {
+	var cacheMode int
+	switch mode {
+	case "cache_statement":
+		cacheMode = stmtcache.ModePrepare
+	case "describe":
+		cacheMode = stmtcache.ModeDescribe
+	case "exec", "simple_protocol":
+		config.BuildStatementCache = nil
+		config.PreferSimpleProtocol = mode == "simple_protocol"
+		return nil
+	default:
+		return fmt.Errorf("invalid PGPROXY_QUERY_EXEC_MODE %q: must be cache_statement, describe, exec or simple_protocol", mode)
+	}
+	config.BuildStatementCache = func(conn *pgconn.PgConn) stmtcache.Cache {
+		return stmtcache.New(conn, cacheMode, statementCacheCapacity)
+	}
+	config.PreferSimpleProtocol = false
+	return nil
+}
+
+// socketURL rewrites a URL whose host is a percent-encoded socket directory,
+// as libpq accepts, e.g. postgresql://user@%2Fvar%2Frun%2Fpostgresql/db, to
+// the equivalent postgresql://user@/db?host=%2Fvar%2Frun%2Fpostgresql. Go's
+// URL parser rejects an escaped slash in a host. Other connection strings
+// are returned unchanged.
+func socketURL(dbURL string) string {
+	var scheme string
+	for _, prefix := range []string{"postgres://", "postgresql://"} {
+		if strings.HasPrefix(dbURL, prefix) {
+			scheme = prefix
+		}
+	}
+	if scheme == "" {
+		return dbURL
+	}
+
+	rest := dbURL[len(scheme):]
+	end := strings.IndexAny(rest, "/?")
+	if end < 0 {
+		end = len(rest)
+	}
+	authority, tail := rest[:end], rest[end:]
+	userinfo := ""
+	if at := strings.LastIndexByte(authority, '@'); at >= 0 {
+		userinfo, authority = authority[:at+1], authority[at+1:]
+	}
+	if !strings.HasPrefix(strings.ToLower(authority), "%2f") {
+		return dbURL
+	}
+
+	host, port := authority, ""
+	if colon := strings.LastIndexByte(authority, ':'); colon >= 0 {
+		host, port = authority[:colon], authority[colon:]
+	}
+	dir, err := url.PathUnescape(host)
+	if err != nil {
+		return dbURL
+	}
+	sep := "?"
+	if strings.Contains(tail, "?") {
+		sep = "&"
+	}
+	return scheme + userinfo + port + tail + sep + "host=" + url.QueryEscape(dir)
+}
+
+// envFloat reads a floating point number from the environment, returning def
+// when the variable is unset.
+func envFloat(name string, def float64) (float64, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return def, nil
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q: must be a number", name, value)
+	}
+	return f, nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/jackc/pgconn/stmtcache"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+func TestListenAddr(t *testing.T) {
+	tests := []struct {
+		listenAddr string
+		port       string
+		want       string
+		ok         bool
+	}{
+		{"", "", ":8080", true},
+		{"", "3000", ":3000", true},
+		{"127.0.0.1:9000", "3000", "127.0.0.1:9000", true},
+		{":9000", "", ":9000", true},
+		{"[::1]:9000", "", "[::1]:9000", true},
+		{"localhost", "", "", false},
+		{":http", "", "", false},
+		{":70000", "", "", false},
+		{"", "abc", "", false},
+		{"", "-1", "", false},
+	}
+	for _, tt := range tests {
+		t.Setenv("LISTEN_ADDR", tt.listenAddr)
+		t.Setenv("PORT", tt.port)
+		got, err := listenAddr()
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("LISTEN_ADDR=%q PORT=%q: %q, %v, want %q, ok %v", tt.listenAddr, tt.port, got, err, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestListenAddrBinds(t *testing.T) {
+	t.Setenv("LISTEN_ADDR", "127.0.0.1:0")
+	addr, err := listenAddr()
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if host, _, _ := net.SplitHostPort(l.Addr().String()); host != "127.0.0.1" {
+		t.Errorf("bound %s, want 127.0.0.1", l.Addr())
+	}
+}
+
+func TestSocketURL(t *testing.T) {
+	tests := []struct {
+		dbURL string
+		want  string
+		host  string
+	}{
+		{"postgresql://user@%2Fvar%2Frun%2Fpostgresql/db", "postgresql://user@/db?host=%2Fvar%2Frun%2Fpostgresql", "/var/run/postgresql"},
+		{"postgres://%2ftmp:5433/db?sslmode=disable", "postgres://:5433/db?sslmode=disable&host=%2Ftmp", "/tmp"},
+		{"postgres:///db?host=/var/run/postgresql", "postgres:///db?host=/var/run/postgresql", "/var/run/postgresql"},
+		{"postgres://user:pw@db.example:5432/db", "postgres://user:pw@db.example:5432/db", "db.example"},
+		{"host=/tmp dbname=db", "host=/tmp dbname=db", "/tmp"},
+	}
+	for _, tt := range tests {
+		got := socketURL(tt.dbURL)
+		if got != tt.want {
+			t.Errorf("socketURL(%q) = %q, want %q", tt.dbURL, got, tt.want)
+			continue
+		}
+		config, err := pgxpool.ParseConfig(got)
+		if err != nil {
+			t.Errorf("ParseConfig(%q): %v", got, err)
+			continue
+		}
+		if config.ConnConfig.Host != tt.host {
+			t.Errorf("%q: host %q, want %q", tt.dbURL, config.ConnConfig.Host, tt.host)
+		}
+	}
+}
+
+func TestSetQueryExecMode(t *testing.T) {
+	tests := []struct {
+		mode   string
+		cache  bool
+		simple bool
+	}{
+		{"cache_statement", true, false},
+		{"describe", true, false},
+		{"exec", false, false},
+		{"simple_protocol", false, true},
+	}
+	for _, tt := range tests {
+		config, err := pgx.ParseConfig("postgres://localhost/db")
+		if err != nil {
+			t.Fatal(err)
+		}
+		config.PreferSimpleProtocol = !tt.simple
+		if err := setQueryExecMode(config, tt.mode); err != nil {
+			t.Errorf("%s: %v", tt.mode, err)
+			continue
+		}
+		if (config.BuildStatementCache != nil) != tt.cache {
+			t.Errorf("%s: statement cache %v, want %v", tt.mode, config.BuildStatementCache != nil, tt.cache)
+		}
+		if config.PreferSimpleProtocol != tt.simple {
+			t.Errorf("%s: simple protocol %v, want %v", tt.mode, config.PreferSimpleProtocol, tt.simple)
+		}
+	}
+	config, _ := pgx.ParseConfig("postgres://localhost/db")
+	if err := setQueryExecMode(config, "describe"); err != nil {
+		t.Fatal(err)
+	}
+	if mode := config.BuildStatementCache(nil).Mode(); mode != stmtcache.ModeDescribe {
+		t.Errorf("describe: cache mode %v", mode)
+	}
+	if err := setQueryExecMode(config, "prepare"); err == nil {
+		t.Error("prepare accepted")
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// copyHandler bulk loads the request body into a table with COPY, e.g.
+// POST /copy?table=public.points&columns=id,name,geom&format=csv.
+//
+// format=csv streams the body to COPY ... FROM STDIN as is, with header=true
+// skipping a header record. format=ndjson expects one JSON object per line,
+// keyed by column name; missing keys load as NULL. The format defaults to
+// the Content-Type of the body. Identifiers are quoted, so table and column
+// names can't inject SQL.
+//
+// The load runs in a transaction of its own with the session options of GET
+// /query, such as statement_timeout_ms, and the tenant's setting applied.
+// The body is streamed rather than buffered, so MAX_BODY_BYTES doesn't apply.
+func copyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "Invalid request method")
+		return
+	}
+	if readOnly {
+		writeJSONError(w, http.StatusForbidden, "COPY is not allowed in read-only mode")
+		return
+	}
+	if len(queryAllowlist) > 0 {
+		writeJSONError(w, http.StatusForbidden, "COPY is not allowed with the query allowlist")
+		return
+	}
+
+	params := r.URL.Query()
+	table, err := parseIdentifier(params.Get("table"))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	columns := splitList(params.Get("columns"))
+
+	format := params.Get("format")
+	if format == "" {
+		format = formatCSV
+		if strings.Contains(r.Header.Get("Content-Type"), "ndjson") {
+			format = formatNDJSON
+		}
+	}
+	if format == formatNDJSON && len(columns) == 0 {
+		writeJSONError(w, http.StatusBadRequest, "Missing columns parameter")
+		return
+	}
+
+	if format != formatCSV && format != formatNDJSON {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("Unsupported format %q", format))
+		return
+	}
+
+	// timeout_ms and the session options are read as for GET /query.
+	sqlQuery, err := queryFromURL(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	ctx, cancel := requestContext(w, r, sqlQuery.TimeoutMS)
+	defer cancel()
+
+	pool, err := requestPool(r, "")
+	if err != nil {
+		writePoolError(w, err)
+		return
+	}
+	settings, err := sessionSettings(ctx, sqlQuery.SessionOptions)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	conn, err := acquireConn(ctx, pool)
+	if err != nil {
+		writeAcquireFailure(ctx, w, err)
+		return
+	}
+	defer conn.Release()
+
+	// The load runs in a transaction with the request's settings, so that
+	// PRE_QUERY_SQL, the statement timeout and the tenant apply, and a
+	// failure halfway leaves nothing behind.
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		writeQueryFailure(ctx, w, err)
+		return
+	}
+	defer tx.Rollback(context.Background())
+	if err := applySettings(ctx, tx, settings); err != nil {
+		writeQueryFailure(ctx, w, err)
+		return
+	}
+
+	sql := "COPY " + table.Sanitize()
+	if len(columns) > 0 {
+		sql += " (" + quoteIdentifiers(columns) + ")"
+	}
+	sql += " FROM STDIN"
+	if format == formatCSV {
+		sql += " WITH (FORMAT csv, HEADER " + strconv.FormatBool(params.Get("header") == "true") + ")"
+	}
+	recordQuery(ctx, sql)
+	start := time.Now()
+	defer func() {
+		elapsed := time.Since(start)
+		requestInfoFrom(ctx).queryDuration = elapsed
+		queryDuration.Observe(elapsed.Seconds())
+	}()
+
+	var copied int64
+	if format == formatCSV {
+		tag, cerr := tx.Conn().PgConn().CopyFrom(ctx, r.Body, sql)
+		copied, err = tag.RowsAffected(), cerr
+	} else {
+		copied, err = tx.CopyFrom(ctx, table, columns, newNDJSONSource(r.Body, columns))
+	}
+	if err == nil {
+		err = tx.Commit(ctx)
+	}
+	if err != nil {
+		writeQueryFailure(ctx, w, err)
+		return
+	}
+
+	requestInfoFrom(ctx).rows = copied
+	writeStatus(w, http.StatusOK, map[string]interface{}{"rowsCopied": copied})
+}
+
+// parseIdentifier parses a possibly schema-qualified name such as
+// "public.points".
+func parseIdentifier(name string) (pgx.Identifier, error) {
+	if name == "" {
+		return nil, errors.New("Missing table parameter")
+	}
+	ident := pgx.Identifier(strings.Split(name, "."))
+	for _, part := range ident {
+		if part == "" {
+			return nil, fmt.Errorf("Invalid table name %q", name)
+		}
+	}
+	return ident, nil
+}
+
+// quoteIdentifiers quotes names for use as a column list.
+func quoteIdentifiers(names []string) string {
+	quoted := make([]string, len(names))
+	for i, name := range names {
+		quoted[i] = pgx.Identifier{name}.Sanitize()
+	}
+	return strings.Join(quoted, ", ")
+}
+
+// ndjsonSource feeds newline-delimited JSON objects to CopyFrom as rows.
+// Values are converted like query params, so the target column types must
+// accept JSON numbers, strings and booleans.
+type ndjsonSource struct {
+	dec     *json.Decoder
+	columns []string
+	values  []interface{}
+	line    int
+	err     error
+}
+
+func newNDJSONSource(r io.Reader, columns []string) *ndjsonSource {
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+	return &ndjsonSource{dec: dec, columns: columns, values: make([]interface{}, len(columns))}
+}
+
+func (s *ndjsonSource) Next() bool {
+	if s.err != nil || !s.dec.More() {
+		return false
+	}
+	s.line++
+	var row map[string]interface{}
+	if err := s.dec.Decode(&row); err != nil {
+		s.err = fmt.Errorf("row %d: %v", s.line, err)
+		return false
+	}
+	for i, column := range s.columns {
+		s.values[i] = convertParam(row[column])
+	}
+	return true
+}
+
+func (s *ndjsonSource) Values() ([]interface{}, error) { return s.values, nil }
+
+func (s *ndjsonSource) Err() error { return s.err }
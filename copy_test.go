@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// TestCopyTenant loads and exports a table with row-level security as a
+// tenant, through a role the policy applies to.
+func TestCopyTenant(t *testing.T) {
+	pool := useTestDatabase(t)
+	ctx := context.Background()
+	setup := []string{
+		"DROP TABLE IF EXISTS pgproxy_copy_test",
+		"CREATE TABLE pgproxy_copy_test (id int, tenant text NOT NULL DEFAULT current_setting('app.tenant_id'))",
+		"INSERT INTO pgproxy_copy_test VALUES (1, 'acme'), (2, 'globex')",
+		"ALTER TABLE pgproxy_copy_test ENABLE ROW LEVEL SECURITY",
+		"CREATE POLICY tenant ON pgproxy_copy_test USING (tenant = current_setting('app.tenant_id')) WITH CHECK (tenant = current_setting('app.tenant_id'))",
+		"DO $$ BEGIN CREATE ROLE pgproxy_copy_tenant NOLOGIN; EXCEPTION WHEN duplicate_object THEN NULL; END $$",
+		"GRANT pgproxy_copy_tenant TO current_user",
+		"GRANT SELECT, INSERT ON pgproxy_copy_test TO pgproxy_copy_tenant",
+	}
+	for _, sql := range setup {
+		if _, err := pool.Exec(ctx, sql); err != nil {
+			t.Fatalf("%s: %v", sql, err)
+		}
+	}
+	t.Cleanup(func() { pool.Exec(context.Background(), "DROP TABLE pgproxy_copy_test") })
+
+	preQuerySettings = []sessionSetting{{statement: "SET LOCAL ROLE pgproxy_copy_tenant"}}
+	apiKeyTenants = map[string]string{"acme-key": "acme"}
+	defer func() { preQuerySettings, apiKeyTenants = nil, nil }()
+
+	r := httptest.NewRequest(http.MethodPost, "/copy?table=pgproxy_copy_test&columns=id,tenant&format=csv", strings.NewReader("3,globex\n"))
+	w := httptest.NewRecorder()
+	copyHandler(w, withPrincipal(r, "acme-key"))
+	if w.Code == http.StatusOK {
+		t.Errorf("COPY FROM into another tenant's rows succeeded: %s", w.Body)
+	}
+	var globex int
+	if err := pool.QueryRow(ctx, "SELECT count(*) FROM pgproxy_copy_test WHERE tenant = 'globex'").Scan(&globex); err != nil {
+		t.Fatal(err)
+	}
+	if globex != 1 {
+		t.Errorf("globex has %d rows after acme's COPY, want 1", globex)
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/export?header=false&q=SELECT+id,+tenant+FROM+pgproxy_copy_test+ORDER+BY+id", nil)
+	w = httptest.NewRecorder()
+	exportHandler(w, withPrincipal(r, "acme-key"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("export status %d: %s", w.Code, w.Body)
+	}
+	if got, want := w.Body.String(), "1,acme\n"; got != want {
+		t.Errorf("export = %q, want %q", got, want)
+	}
+}
+
+func TestCopyWithAllowlist(t *testing.T) {
+	useUnreachablePool(t)
+	queryAllowlist = []*regexp.Regexp{regexp.MustCompile(`^(?:SELECT 1)$`)}
+	defer func() { queryAllowlist = nil }()
+	r := httptest.NewRequest(http.MethodPost, "/copy?table=points&format=csv", strings.NewReader("1\n"))
+	w := httptest.NewRecorder()
+	copyHandler(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("status %d, want %d: %s", w.Code, http.StatusForbidden, w.Body)
+	}
+}
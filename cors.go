@@ -0,0 +1,53 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/rs/cors"
+)
+
+// newCORS builds the CORS middleware from CORS_ALLOWED_ORIGINS,
+// CORS_ALLOWED_METHODS (default GET, POST and HEAD) and
+// CORS_ALLOW_CREDENTIALS. When none of them is set every origin is allowed,
+// which suits development but not a production API.
+func newCORS() (*cors.Cors, error) {
+	origins := splitList(os.Getenv("CORS_ALLOWED_ORIGINS"))
+	methods := splitList(os.Getenv("CORS_ALLOWED_METHODS"))
+	credentials := os.Getenv("CORS_ALLOW_CREDENTIALS")
+	if len(origins) == 0 && len(methods) == 0 && credentials == "" {
+		return cors.Default(), nil
+	}
+
+	allowCredentials := false
+	if credentials != "" {
+		var err error
+		if allowCredentials, err = strconv.ParseBool(credentials); err != nil {
+			return nil, errors.New("invalid CORS_ALLOW_CREDENTIALS: must be true or false")
+		}
+	}
+	if allowCredentials {
+		for _, origin := range origins {
+			if strings.Contains(origin, "*") {
+				return nil, errors.New("CORS_ALLOW_CREDENTIALS can't be combined with a wildcard origin")
+			}
+		}
+		if len(origins) == 0 {
+			return nil, errors.New("CORS_ALLOW_CREDENTIALS requires CORS_ALLOWED_ORIGINS")
+		}
+	}
+	if len(methods) == 0 {
+		methods = []string{http.MethodGet, http.MethodPost, http.MethodHead}
+	}
+
+	return cors.New(cors.Options{
+		AllowedOrigins:   origins,
+		AllowedMethods:   methods,
+		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-API-Key", "X-Request-ID", "X-Query-ID", "Idempotency-Key"},
+		ExposedHeaders:   []string{"X-Request-ID", "X-Cache", "X-Total-Count", "X-Query-ID", "Idempotent-Replayed"},
+		AllowCredentials: allowCredentials,
+	}), nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNewCORSErrors(t *testing.T) {
+	tests := []struct {
+		name        string
+		origins     string
+		credentials string
+	}{
+		{"invalid credentials", "https://a.example", "maybe"},
+		{"credentials with wildcard", "https://*.example", "true"},
+		{"credentials without origins", "", "true"},
+	}
+	for _, tt := range tests {
+		t.Setenv("CORS_ALLOWED_ORIGINS", tt.origins)
+		t.Setenv("CORS_ALLOW_CREDENTIALS", tt.credentials)
+		if _, err := newCORS(); err == nil {
+			t.Errorf("%s: expected an error", tt.name)
+		}
+	}
+}
+
+func TestNewCORS(t *testing.T) {
+	t.Setenv("CORS_ALLOWED_ORIGINS", "https://a.example")
+	t.Setenv("CORS_ALLOW_CREDENTIALS", "true")
+	c, err := newCORS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := c.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	tests := []struct {
+		origin      string
+		allowOrigin string
+		credentials string
+	}{
+		{"https://a.example", "https://a.example", "true"},
+		{"https://b.example", "", ""},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/query", nil)
+		r.Header.Set("Origin", tt.origin)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if got := w.Header().Get("Access-Control-Allow-Origin"); got != tt.allowOrigin {
+			t.Errorf("%s: Access-Control-Allow-Origin %q, want %q", tt.origin, got, tt.allowOrigin)
+		}
+		if got := w.Header().Get("Access-Control-Allow-Credentials"); got != tt.credentials {
+			t.Errorf("%s: Access-Control-Allow-Credentials %q, want %q", tt.origin, got, tt.credentials)
+		}
+	}
+}
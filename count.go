@@ -0,0 +1,75 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// countStatements are the leading keywords of queries that can be counted
+// or exported.
+var countStatements = map[string]bool{
+	"SELECT": true,
+	"WITH":   true,
+	"VALUES": true,
+	"TABLE":  true,
+}
+
+// countQuery returns a query counting the rows sql returns, for count=true.
+// sql must be a single query that is safe to run twice: counting a
+// data-modifying CTE would apply its writes twice.
+func countQuery(sql string) (string, error) {
+	query, err := singleQuery(sql, "count")
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("SELECT count(*) FROM (%s) AS pgproxy_count", query), nil
+}
+
+var errUnbalancedParens = errors.New("Query has unbalanced parentheses")
+
+// singleQuery returns the text of sql when it is a single query without
+// writes that can be used as a subquery, for the named feature.
+func singleQuery(sql, feature string) (string, error) {
+	tokens, err := tokenize(sql)
+	if err != nil {
+		return "", err
+	}
+	statements := splitStatements(tokens)
+	switch {
+	case len(statements) == 0:
+		return "", errEmptyQuery
+	case len(statements) > 1:
+		return "", fmt.Errorf("%s is only supported for a single statement", feature)
+	}
+
+	stmt := statements[0]
+	first := 0
+	for first < len(stmt) && stmt[first].kind == tokenPunct && stmt[first].text == "(" {
+		first++
+	}
+	if first == len(stmt) || stmt[first].kind != tokenWord || !countStatements[strings.ToUpper(stmt[first].text)] {
+		return "", fmt.Errorf("%s is only supported for SELECT, WITH, VALUES and TABLE queries", feature)
+	}
+	depth := 0
+	for _, t := range stmt {
+		switch {
+		case t.kind == tokenPunct && t.text == "(":
+			depth++
+		case t.kind == tokenPunct && t.text == ")":
+			// A parenthesis closing what the query didn't open would close
+			// the subquery it is wrapped in.
+			if depth--; depth < 0 {
+				return "", errUnbalancedParens
+			}
+		case t.kind == tokenWord && writeKeywords[strings.ToUpper(t.text)]:
+			return "", fmt.Errorf("%s is not supported for queries containing %s", feature, strings.ToUpper(t.text))
+		}
+	}
+	if depth != 0 {
+		return "", errUnbalancedParens
+	}
+	// Slicing the statement from its tokens leaves out trailing comments,
+	// which would otherwise swallow a closing parenthesis.
+	return sql[stmt[0].pos:stmt[len(stmt)-1].end], nil
+}
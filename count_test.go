@@ -0,0 +1,40 @@
+package main
+
+import "testing"
+
+func TestCountQuery(t *testing.T) {
+	tests := []struct {
+		sql     string
+		want    string
+		wantErr bool
+	}{
+		{sql: "SELECT * FROM t", want: "SELECT count(*) FROM (SELECT * FROM t) AS pgproxy_count"},
+		{sql: "  select 1;  ", want: "SELECT count(*) FROM (select 1) AS pgproxy_count"},
+		{sql: "(SELECT 1) UNION (SELECT 2)", want: "SELECT count(*) FROM ((SELECT 1) UNION (SELECT 2)) AS pgproxy_count"},
+		{sql: "WITH a AS (SELECT 1) SELECT * FROM a", want: "SELECT count(*) FROM (WITH a AS (SELECT 1) SELECT * FROM a) AS pgproxy_count"},
+		{sql: "SELECT ')' FROM t -- )", want: "SELECT count(*) FROM (SELECT ')' FROM t) AS pgproxy_count"},
+		{sql: `SELECT ")(" FROM t`, want: `SELECT count(*) FROM (SELECT ")(" FROM t) AS pgproxy_count`},
+		{sql: "VALUES (1), (2)", want: "SELECT count(*) FROM (VALUES (1), (2)) AS pgproxy_count"},
+		{sql: "TABLE t", want: "SELECT count(*) FROM (TABLE t) AS pgproxy_count"},
+		{sql: "", wantErr: true},
+		{sql: "SELECT 1; SELECT 2", wantErr: true},
+		{sql: "SHOW work_mem", wantErr: true},
+		{sql: "WITH d AS (DELETE FROM t RETURNING *) SELECT * FROM d", wantErr: true},
+		{sql: "SELECT * INTO u FROM t", wantErr: true},
+		{sql: "SELECT 1) AS x, (SELECT 2", wantErr: true},
+		{sql: "SELECT 1) AS x CROSS JOIN pg_sleep(10) --", wantErr: true},
+		{sql: "SELECT (1", wantErr: true},
+		{sql: "(SELECT 1", wantErr: true},
+		{sql: "SELECT 1)", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := countQuery(tt.sql)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("countQuery(%q) error = %v, want error %v", tt.sql, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("countQuery(%q) = %q, want %q", tt.sql, got, tt.want)
+		}
+	}
+}
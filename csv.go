@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/jackc/pgtype"
+)
+
+// csvWriter emits the column names as a header record followed by one record
+// per row. NULLs become empty fields, values are rendered as normalized by
+// normalizeValue and JSON values as JSON text. Arrays keep the Postgres array
+// syntax, such as {1,2,NULL} or {{a,b},{"c d",e}}, which COPY can load back.
+type csvWriter struct {
+	csv            *csv.Writer
+	record         []string
+	columns        []column
+	binaryEncoding binaryEncoding
+}
+
+func (c *csvWriter) contentType() string { return "text/csv; charset=utf-8" }
+
+func (c *csvWriter) writeHeader(w io.Writer, columns []column) error {
+	c.csv = csv.NewWriter(w)
+	c.record = make([]string, len(columns))
+	c.columns = columns
+	return c.csv.Write(columnNames(columns))
+}
+
+// rawRows makes streamRows pass arrays before normalizeValue turns them into
+// slices, so they can be written in their Postgres text form.
+func (c *csvWriter) rawRows() {}
+
+func (c *csvWriter) writeRow(w io.Writer, values []interface{}) error {
+	for i, v := range values {
+		field, err := c.formatValue(v, c.columns[i].OID)
+		if err != nil {
+			return fmt.Errorf("column %q: %v", c.columns[i].Name, err)
+		}
+		c.record[i] = field
+	}
+	return c.csv.Write(c.record)
+}
+
+// writeFooter flushes the buffered records. CSV has no way to carry an error
+// or the truncated flag in-band, so a mid-stream failure is returned to the
+// caller to be logged.
+func (c *csvWriter) writeFooter(w io.Writer, summary resultSummary) error {
+	if err := c.flushRecords(); err != nil {
+		return err
+	}
+	return summary.err
+}
+
+// flushRecords writes the records csv.Writer buffered so far.
+func (c *csvWriter) flushRecords() error {
+	c.csv.Flush()
+	return c.csv.Error()
+}
+
+func (c *csvWriter) formatValue(v interface{}, oid uint32) (string, error) {
+	if _, ok := arrayElements(v); ok {
+		buf, err := v.(pgtype.TextEncoder).EncodeText(textConnInfo, nil)
+		return string(buf), err
+	}
+	v, err := normalizeValue(v, oid, c.binaryEncoding)
+	if err != nil {
+		return "", err
+	}
+	switch v := v.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case map[string]interface{}, []interface{}:
+		buf, err := json.Marshal(v)
+		if err != nil {
+			return "", err
+		}
+		return string(buf), nil
+	default:
+		return fmt.Sprint(v), nil
+	}
+}
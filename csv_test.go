@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgtype"
+)
+
+func TestCSVWriter(t *testing.T) {
+	var array pgtype.Int4Array
+	if err := array.Set([]int32{1, 2}); err != nil {
+		t.Fatal(err)
+	}
+	columns := []column{{Name: "id", Type: "int4"}, {Name: "name", Type: "text"}, {Name: "data"}}
+	values := [][]interface{}{
+		{int32(1), "plain", nil},
+		{int32(2), `a "quoted", field`, []byte{0xde, 0xad}},
+		{int32(3), "multi\nline", &array},
+		{int32(4), "", time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)},
+		{int32(5), "json", map[string]interface{}{"a": []interface{}{1.5, "b"}}},
+	}
+	want := `id,name,data
+1,plain,
+2,"a ""quoted"", field",3q0=
+3,"multi
+line","{1,2}"
+4,,2024-01-02T03:04:05Z
+5,json,"{""a"":[1.5,""b""]}"
+`
+	if got := string(streamValues(t, &csvWriter{}, columns, values)); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestCSVStreamFlushesBatches(t *testing.T) {
+	rows := &fakeRows{values: [][]interface{}{{int32(1), "a"}, {int32(2), "b,c"}, {int32(3), nil}}}
+	columns := []column{{Name: "id", OID: pgtype.Int4OID}, {Name: "name", OID: pgtype.TextOID}}
+	var body bytes.Buffer
+	// What the client has received at every flush.
+	var flushed []string
+	opts := streamOptions{
+		flushRows: 2,
+		flush: func() error {
+			flushed = append(flushed, body.String())
+			return nil
+		},
+	}
+	if _, err := streamResult(context.Background(), &body, rows, columns, &csvWriter{}, opts); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"id,name\n",
+		"id,name\n1,a\n2,\"b,c\"\n",
+	}
+	if len(flushed) != len(want) {
+		t.Fatalf("flushed %q, want %q", flushed, want)
+	}
+	for i := range want {
+		if flushed[i] != want[i] {
+			t.Errorf("flush %d sent %q, want %q", i, flushed[i], want[i])
+		}
+	}
+	if got, want := body.String(), "id,name\n1,a\n2,\"b,c\"\n3,\n"; got != want {
+		t.Errorf("body %q, want %q", got, want)
+	}
+}
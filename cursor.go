@@ -0,0 +1,410 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// cursorIdleTimeout is how long an open cursor is kept between pages, set
+// through CURSOR_IDLE_TIMEOUT. Once it expires the cursor's transaction is
+// rolled back and its connection returned to the pool.
+var cursorIdleTimeout = 5 * time.Minute
+
+// Every open cursor holds a connection out of its pool, so at most
+// maxCursors may be open at once, set through MAX_CURSORS, and at most
+// maxCursorsPerPrincipal of them by the same principal, set through
+// MAX_CURSORS_PER_PRINCIPAL. Zero disables a limit.
+var (
+	maxCursors             = 16
+	maxCursorsPerPrincipal = 4
+)
+
+// defaultPageSize is the page size when neither limit nor maxRows is set.
+const defaultPageSize = 1000
+
+// cursorName is the name of the cursor declared in a session's transaction.
+// Every session has a connection of its own, so it needn't be unique.
+const cursorName = "pgproxy_cursor"
+
+var (
+	errUnknownCursor  = errors.New("Unknown or expired cursor")
+	errCursorBusy     = errors.New("Cursor is in use by another request")
+	errTooManyCursors = errors.New("Too many open cursors")
+)
+
+// cursorSession is a paginated query: a connection held out of the pool with
+// a transaction in which the query's cursor is declared, for the principal
+// that opened it. total is the counted number of rows when count=true was
+// set, formats the result formats every page is fetched in and columns the
+// columns of every page.
+type cursorSession struct {
+	principal string
+	conn      *pgxpool.Conn
+	tx        pgx.Tx
+	total     *int64
+	formats   pgx.QueryResultFormats
+	columns   []column
+	timer     *time.Timer
+	busy      bool
+}
+
+// cursorStore holds the open cursor sessions by token. A session is checked
+// out while a request fetches a page from it and expires after sitting idle
+// for cursorIdleTimeout. open counts the sessions reserved for each
+// principal, including those still being opened.
+type cursorStore struct {
+	mu       sync.Mutex
+	sessions map[string]*cursorSession
+	open     map[string]int
+	total    int
+}
+
+var cursors = &cursorStore{sessions: make(map[string]*cursorSession), open: make(map[string]int)}
+
+// reserve counts a session about to be opened for principal against the
+// limits, before it takes a connection. Each reservation is given back with
+// unreserve, which closing a stored session does.
+func (cs *cursorStore) reserve(principal string) error {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if maxCursors > 0 && cs.total >= maxCursors {
+		return errTooManyCursors
+	}
+	if maxCursorsPerPrincipal > 0 && cs.open[principal] >= maxCursorsPerPrincipal {
+		return errTooManyCursors
+	}
+	cs.total++
+	cs.open[principal]++
+	return nil
+}
+
+func (cs *cursorStore) unreserve(principal string) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.unreserveLocked(principal)
+}
+
+func (cs *cursorStore) unreserveLocked(principal string) {
+	cs.total--
+	if cs.open[principal]--; cs.open[principal] <= 0 {
+		delete(cs.open, principal)
+	}
+}
+
+// add stores a new session, checked out to the caller, and returns its token.
+func (cs *cursorStore) add(s *cursorSession) string {
+	var b [16]byte
+	rand.Read(b[:])
+	token := hex.EncodeToString(b[:])
+
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	s.busy = true
+	cs.sessions[token] = s
+	return token
+}
+
+// checkout reserves the session for token for the calling request of
+// principal. Another principal's token is treated as unknown.
+func (cs *cursorStore) checkout(token, principal string) (*cursorSession, error) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	s, ok := cs.sessions[token]
+	if !ok || s.principal != principal {
+		return nil, errUnknownCursor
+	}
+	if s.busy {
+		return nil, errCursorBusy
+	}
+	s.busy = true
+	s.timer.Stop()
+	return s, nil
+}
+
+// checkin makes a checked out session available for the next page and
+// starts its idle timer.
+func (cs *cursorStore) checkin(token string, s *cursorSession) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	s.busy = false
+	if s.timer == nil {
+		s.timer = time.AfterFunc(cursorIdleTimeout, func() { cs.expire(token) })
+	} else {
+		s.timer.Reset(cursorIdleTimeout)
+	}
+}
+
+// expire closes the session for token unless a request checked it out in the
+// meantime.
+func (cs *cursorStore) expire(token string) {
+	cs.mu.Lock()
+	s, ok := cs.sessions[token]
+	if !ok || s.busy {
+		cs.mu.Unlock()
+		return
+	}
+	delete(cs.sessions, token)
+	cs.unreserveLocked(s.principal)
+	cs.mu.Unlock()
+
+	slog.Info("Cursor expired", "idle_timeout", cursorIdleTimeout.String())
+	s.close()
+}
+
+// discard removes a checked out session and closes it.
+func (cs *cursorStore) discard(token string, s *cursorSession) {
+	cs.mu.Lock()
+	delete(cs.sessions, token)
+	cs.unreserveLocked(s.principal)
+	cs.mu.Unlock()
+	s.close()
+}
+
+// closeAll closes every idle session so the pools can shut down. Sessions
+// that are checked out are closed by their request.
+func (cs *cursorStore) closeAll() {
+	cs.mu.Lock()
+	var idle []*cursorSession
+	for token, s := range cs.sessions {
+		if !s.busy {
+			s.timer.Stop()
+			idle = append(idle, s)
+			delete(cs.sessions, token)
+			cs.unreserveLocked(s.principal)
+		}
+	}
+	cs.mu.Unlock()
+
+	for _, s := range idle {
+		s.close()
+	}
+}
+
+// close rolls back the session's transaction, which also closes the cursor,
+// and releases the connection. The pool discards a connection whose rollback
+// failed.
+func (s *cursorSession) close() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	s.tx.Rollback(ctx)
+	s.conn.Release()
+}
+
+// pageWriter hands out the cursor token for the next page once a full page
+// has been written. A short page means the cursor is exhausted.
+type pageWriter struct {
+	resultWriter
+	token    string
+	pageSize int64
+	rows     int64
+}
+
+func (p *pageWriter) writeRow(w io.Writer, values []interface{}) error {
+	if err := p.resultWriter.writeRow(w, values); err != nil {
+		return err
+	}
+	p.rows++
+	return nil
+}
+
+func (p *pageWriter) writeFooter(w io.Writer, summary resultSummary) error {
+	if p.more(summary.err) {
+		summary.cursor = p.token
+	}
+	return p.resultWriter.writeFooter(w, summary)
+}
+
+func (p *pageWriter) more(err error) bool {
+	return err == nil && p.rows == p.pageSize
+}
+
+// queryPage serves a paginated query. A request with paginate set declares a
+// cursor for its query and returns the first page; the "cursor" token in the
+// response fetches the next one. The last page has no token.
+func queryPage(ctx context.Context, w http.ResponseWriter, r *http.Request, sqlQuery SQLQuery, format string) {
+	var out resultWriter
+	switch format {
+	case formatJSON:
+		out = &jsonWriter{}
+	case formatObjects:
+		out = &jsonWriter{objects: true}
+	default:
+		queryErrors.WithLabelValues(errorBadRequest).Inc()
+		writeJSONError(w, http.StatusBadRequest, "Cursors are only supported for JSON output")
+		return
+	}
+
+	token := sqlQuery.Cursor
+	principal := requestInfoFrom(ctx).principal
+	var s *cursorSession
+	if token == "" {
+		if err := cursors.reserve(principal); err != nil {
+			queryErrors.WithLabelValues(errorBadRequest).Inc()
+			writeJSONError(w, http.StatusTooManyRequests, err.Error())
+			return
+		}
+		if s = openCursor(ctx, w, r, sqlQuery); s == nil {
+			cursors.unreserve(principal)
+			return
+		}
+		s.principal = principal
+		token = cursors.add(s)
+	} else {
+		var err error
+		if s, err = cursors.checkout(token, principal); err != nil {
+			queryErrors.WithLabelValues(errorBadRequest).Inc()
+			status := http.StatusNotFound
+			if err == errCursorBusy {
+				status = http.StatusConflict
+			}
+			writeJSONError(w, status, err.Error())
+			return
+		}
+	}
+
+	pageSize := rowLimit(sqlQuery.Limit)
+	if pageSize <= 0 {
+		pageSize = defaultPageSize
+	}
+	rows, err := s.tx.Query(ctx, fmt.Sprintf("FETCH FORWARD %d FROM %s", pageSize, cursorName), queryArgs(s.formats, nil)...)
+	if err != nil {
+		cursors.discard(token, s)
+		writeQueryFailure(ctx, w, err)
+		return
+	}
+	if err := checkColumns(len(rows.FieldDescriptions())); err != nil {
+		rows.Close()
+		cursors.discard(token, s)
+		queryErrors.WithLabelValues(errorBadRequest).Inc()
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", out.contentType())
+	if s.total != nil {
+		w.Header().Set("X-Total-Count", strconv.FormatInt(*s.total, 10))
+	}
+	body, closeBody := compressResponse(w, r)
+	defer closeBody()
+
+	page := &pageWriter{resultWriter: out, token: token, pageSize: pageSize}
+	summary, err := streamResult(ctx, body, rows, s.columns, page, streamOptions{
+		total:          s.total,
+		binaryEncoding: sqlQuery.BinaryEncoding,
+		notices:        func() []notice { return takeNotices(s.conn.Conn().PgConn()) },
+	})
+	rows.Close()
+	if err != nil {
+		queryErrors.WithLabelValues(errorQuery).Inc()
+		slog.WarnContext(ctx, "Error writing response", "error", err)
+	}
+
+	if err == nil && page.more(summary.err) {
+		cursors.checkin(token, s)
+	} else {
+		cursors.discard(token, s)
+	}
+}
+
+// openCursor declares a cursor for the request's query in a new transaction
+// on a connection of its own. It writes the error response and returns nil
+// on failure.
+func openCursor(ctx context.Context, w http.ResponseWriter, r *http.Request, sqlQuery SQLQuery) *cursorSession {
+	pool, err := requestPool(r, sqlQuery.DB)
+	if err != nil {
+		queryErrors.WithLabelValues(errorBadRequest).Inc()
+		writePoolError(w, err)
+		return nil
+	}
+
+	var opts pgx.TxOptions
+	if readOnly || r.Method == http.MethodGet {
+		if err := checkReadOnly(sqlQuery.Query); err != nil {
+			queryErrors.WithLabelValues(errorBadRequest).Inc()
+			writeJSONError(w, http.StatusForbidden, err.Error())
+			return nil
+		}
+		opts.AccessMode = pgx.ReadOnly
+	}
+
+	settings, err := sessionSettings(ctx, sqlQuery.SessionOptions)
+	if err != nil {
+		queryErrors.WithLabelValues(errorBadRequest).Inc()
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return nil
+	}
+	formats, err := resultFormats(sqlQuery.ResultFormat)
+	if err != nil {
+		queryErrors.WithLabelValues(errorBadRequest).Inc()
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return nil
+	}
+	var countSQL string
+	if sqlQuery.Count {
+		if countSQL, err = countQuery(sqlQuery.Query); err != nil {
+			queryErrors.WithLabelValues(errorBadRequest).Inc()
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return nil
+		}
+		// Every page must agree with the count.
+		opts.IsoLevel = pgx.RepeatableRead
+	}
+
+	conn, err := acquireConn(ctx, pool)
+	if err != nil {
+		writeAcquireFailure(ctx, w, err)
+		return nil
+	}
+	tx, err := conn.BeginTx(ctx, opts)
+	if err != nil {
+		conn.Release()
+		writeQueryFailure(ctx, w, err)
+		return nil
+	}
+
+	s := &cursorSession{conn: conn, tx: tx, formats: formats}
+	if err := applySettings(ctx, tx, settings); err != nil {
+		s.close()
+		writeQueryFailure(ctx, w, err)
+		return nil
+	}
+	args := convertParams(sqlQuery.Params)
+	if countSQL != "" {
+		var total int64
+		if err := tx.QueryRow(ctx, countSQL, args...).Scan(&total); err != nil {
+			s.close()
+			writeQueryFailure(ctx, w, err)
+			return nil
+		}
+		s.total = &total
+	}
+	query := trimQuery(sqlQuery.Query)
+	declare := fmt.Sprintf("DECLARE %s NO SCROLL CURSOR FOR %s", cursorName, query)
+	if _, err := tx.Exec(ctx, declare, args...); err != nil {
+		s.close()
+		writeQueryFailure(ctx, w, err)
+		return nil
+	}
+	// Every page has the query's columns. They are described now, as pages
+	// are streamed while the connection is busy fetching them.
+	sd, err := tx.Conn().PgConn().Prepare(ctx, "", query, nil)
+	if err != nil {
+		s.close()
+		writeQueryFailure(ctx, w, err)
+		return nil
+	}
+	s.columns = resultColumns(ctx, tx, pool, tx.Conn().ConnInfo(), sd.Fields)
+	return s
+}
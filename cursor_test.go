@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCursorLimits(t *testing.T) {
+	defer func(total, perPrincipal int) {
+		maxCursors, maxCursorsPerPrincipal = total, perPrincipal
+	}(maxCursors, maxCursorsPerPrincipal)
+	maxCursors, maxCursorsPerPrincipal = 3, 2
+	cs := &cursorStore{sessions: make(map[string]*cursorSession), open: make(map[string]int)}
+
+	steps := []struct {
+		principal string
+		wantErr   bool
+	}{
+		{"alice", false},
+		{"alice", false},
+		{"alice", true},
+		{"bob", false},
+		{"carol", true},
+	}
+	for i, step := range steps {
+		if err := cs.reserve(step.principal); (err != nil) != step.wantErr {
+			t.Fatalf("step %d: reserve(%q) error = %v, want error %v", i, step.principal, err, step.wantErr)
+		}
+	}
+	cs.unreserve("alice")
+	if err := cs.reserve("carol"); err != nil {
+		t.Fatalf("reserve after unreserve: %v", err)
+	}
+	if cs.total != 3 || cs.open["alice"] != 1 || cs.open["bob"] != 1 || cs.open["carol"] != 1 {
+		t.Errorf("total %d, open %v", cs.total, cs.open)
+	}
+}
+
+func TestCursorCheckoutPrincipal(t *testing.T) {
+	cs := &cursorStore{sessions: make(map[string]*cursorSession), open: make(map[string]int)}
+	token := cs.add(&cursorSession{principal: "alice"})
+	cs.checkin(token, cs.sessions[token])
+	defer cs.sessions[token].timer.Stop()
+
+	if _, err := cs.checkout(token, "bob"); err != errUnknownCursor {
+		t.Errorf("checkout by another principal: error = %v, want %v", err, errUnknownCursor)
+	}
+	s, err := cs.checkout(token, "alice")
+	if err != nil {
+		t.Fatalf("checkout by its principal: %v", err)
+	}
+	if _, err := cs.checkout(token, "alice"); err != errCursorBusy {
+		t.Errorf("second checkout: error = %v, want %v", err, errCursorBusy)
+	}
+	cs.checkin(token, s)
+}
+
+func TestQueryPageTooManyCursors(t *testing.T) {
+	useUnreachablePool(t)
+	defer func(total int) { maxCursors = total }(maxCursors)
+	maxCursors = 1
+	query := SQLQuery{Query: "SELECT 1", Paginate: true}
+
+	cursors.reserve("other")
+	r := httptest.NewRequest(http.MethodGet, "/query?paginate=true&q=SELECT+1", nil)
+	w := httptest.NewRecorder()
+	queryPage(r.Context(), w, r, query, formatJSON)
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("status %d, want %d: %s", w.Code, http.StatusTooManyRequests, w.Body)
+	}
+	cursors.unreserve("other")
+
+	// A cursor that fails to open gives its reservation back.
+	w = httptest.NewRecorder()
+	queryPage(r.Context(), w, r, query, formatJSON)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("status %d, want %d: %s", w.Code, http.StatusServiceUnavailable, w.Body)
+	}
+	if err := cursors.reserve("other"); err != nil {
+		t.Errorf("reserve after a failed open: %v", err)
+	}
+	cursors.unreserve("other")
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// Database connection pools, keyed by the name clients use to select them,
+// and the connection strings they were opened with. reloadDatabases replaces
+// both maps as a whole under poolsMu, so a map is never modified once it is
+// in use; callers take the current one with currentPools.
+var (
+	poolsMu  sync.RWMutex
+	pools    map[string]*pgxpool.Pool
+	poolURLs map[string]string
+)
+
+// reloadMu keeps reloads from running concurrently.
+var reloadMu sync.Mutex
+
+func currentPools() map[string]*pgxpool.Pool {
+	poolsMu.RLock()
+	defer poolsMu.RUnlock()
+	return pools
+}
+
+// defaultDB is the database used when a request doesn't name one.
+var defaultDB string
+
+// databaseURLs collects the configured connection strings. DATABASES holds a
+// JSON object of named connection strings, e.g.
+//
+//	DATABASES={"analytics":"postgres://...","gis":"postgres://..."}
+//
+// and DATABASE_URL, when set, adds a database named after DEFAULT_DB (or
+// "default"). DEFAULT_DB may be omitted when there is only one database.
+//
+// Connection strings are URLs or key=value DSNs as accepted by libpq. A
+// Unix domain socket is selected by giving its directory as host:
+//
+//	postgres:///dbname?host=/var/run/postgresql
+//	postgresql://user@%2Fvar%2Frun%2Fpostgresql/dbname
+//	host=/var/run/postgresql dbname=dbname
+//
+// Without any host pgx tries the usual socket directories before localhost.
+//
+// REPLICA_DATABASE_URL adds a read replica of the default database, see
+// replicaSuffix.
+//
+// DATABASES_FILE and DATABASE_URL_FILE name files to read the values from
+// instead, such as secrets written by a Vault agent. They are read again on
+// every reload.
+func databaseURLs() (map[string]string, string, error) {
+	urls := make(map[string]string)
+	value, err := envOrFile("DATABASES")
+	if err != nil {
+		return nil, "", err
+	}
+	if value != "" {
+		if err := json.Unmarshal([]byte(value), &urls); err != nil {
+			return nil, "", fmt.Errorf("invalid DATABASES: %v", err)
+		}
+	}
+
+	def := os.Getenv("DEFAULT_DB")
+	dbURL, err := envOrFile("DATABASE_URL")
+	if err != nil {
+		return nil, "", err
+	}
+	if dbURL != "" {
+		if def == "" {
+			def = "default"
+		}
+		if _, ok := urls[def]; ok {
+			return nil, "", fmt.Errorf("database %q is configured by both DATABASE_URL and DATABASES", def)
+		}
+		urls[def] = dbURL
+	}
+	replicaURL, err := envOrFile("REPLICA_DATABASE_URL")
+	if err != nil {
+		return nil, "", err
+	}
+
+	switch {
+	case len(urls) == 0:
+		return nil, "", errors.New("DATABASE_URL or DATABASES environment variable is required")
+	case def == "" && len(urls) == 1:
+		for name := range urls {
+			def = name
+		}
+	case def == "":
+		return nil, "", errors.New("DEFAULT_DB is required when more than one database is configured")
+	}
+	if _, ok := urls[def]; !ok {
+		return nil, "", fmt.Errorf("DEFAULT_DB %q is not a configured database", def)
+	}
+	if replicaURL != "" {
+		if _, ok := urls[def+replicaSuffix]; ok {
+			return nil, "", fmt.Errorf("database %q is configured by both REPLICA_DATABASE_URL and DATABASES", def+replicaSuffix)
+		}
+		urls[def+replicaSuffix] = replicaURL
+	}
+	return urls, def, nil
+}
+
+// envOrFile returns the value of the environment variable name, or the
+// contents of the file named by name_FILE when that is set instead.
+func envOrFile(name string) (string, error) {
+	path := os.Getenv(name + "_FILE")
+	if path == "" {
+		return os.Getenv(name), nil
+	}
+	if os.Getenv(name) != "" {
+		return "", fmt.Errorf("set either %s or %s_FILE, not both", name, name)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("invalid %s_FILE: %v", name, err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// Startup retries: a database that can't be reached at startup, such as one
+// still starting next to the proxy in docker-compose, is tried again with
+// exponential backoff from startupRetryDelay up to maxStartupRetryDelay,
+// for up to startupTimeout (STARTUP_TIMEOUT) and startupAttempts attempts
+// (STARTUP_ATTEMPTS) in all, rather than exiting into a crash loop. Zero
+// attempts means no limit but the timeout, and a zero timeout gives up
+// after the first attempt.
+var (
+	startupTimeout  = time.Minute
+	startupAttempts int
+)
+
+const (
+	startupRetryDelay    = 500 * time.Millisecond
+	maxStartupRetryDelay = 10 * time.Second
+)
+
+// connectDatabases opens a pool for every database in urls, retrying as
+// configured for startup. A pool is ready to use once opened: pgxpool has
+// established its MinConns connections and checked that one works.
+func connectDatabases(ctx context.Context, urls map[string]string) error {
+	opened := make(map[string]*pgxpool.Pool, len(urls))
+	for _, name := range sortedNames(urls) {
+		pool, err := connectWithRetry(ctx, name, urls[name])
+		if err != nil {
+			for _, pool := range opened {
+				pool.Close()
+			}
+			return err
+		}
+		opened[name] = pool
+	}
+	poolsMu.Lock()
+	pools, poolURLs = opened, urls
+	poolsMu.Unlock()
+	return nil
+}
+
+// connectWithRetry opens the pool of a database at startup, see
+// startupTimeout.
+func connectWithRetry(ctx context.Context, name, dbURL string) (*pgxpool.Pool, error) {
+	if _, err := poolConfig(name, dbURL); err != nil {
+		// A configuration error won't go away by waiting.
+		return nil, err
+	}
+	deadline := time.Now().Add(startupTimeout)
+	delay := startupRetryDelay
+	for attempt := 1; ; attempt++ {
+		pool, err := connectDatabase(ctx, name, dbURL)
+		if err == nil {
+			return pool, nil
+		}
+		if (startupAttempts > 0 && attempt >= startupAttempts) || time.Now().Add(delay).After(deadline) {
+			return nil, err
+		}
+		slog.Warn("Database not reachable yet, retrying", "database", name, "attempt", attempt, "retry_in", delay, "error", err)
+		if !sleepContext(ctx, delay) {
+			return nil, err
+		}
+		delay = min(delay*2, maxStartupRetryDelay)
+	}
+}
+
+func connectDatabase(ctx context.Context, name, dbURL string) (*pgxpool.Pool, error) {
+	config, err := poolConfig(name, dbURL)
+	if err != nil {
+		return nil, err
+	}
+	pool, err := pgxpool.ConnectConfig(ctx, config)
+	if err != nil {
+		return nil, fmt.Errorf("database %q: %v", name, err)
+	}
+	slog.Info("Connected to database", "database", name,
+		"host", config.ConnConfig.Host, "port", config.ConnConfig.Port)
+	return pool, nil
+}
+
+// reloadDatabases reads the connection strings again and opens a new pool
+// for every database whose connection string changed, e.g. after rotated
+// credentials were written to DATABASE_URL_FILE. New requests use the new
+// pools right away, while the old ones are closed in the background once
+// their in-flight requests have released their connections. Databases may
+// be added and removed, but the default database must stay the same. On
+// error the current pools are kept.
+func reloadDatabases(ctx context.Context) error {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	urls, def, err := databaseURLs()
+	if err != nil {
+		return err
+	}
+	if def != defaultDB {
+		return fmt.Errorf("the default database can't change from %q to %q without a restart", defaultDB, def)
+	}
+	if audit != nil {
+		if _, ok := urls[audit.db]; !ok {
+			return fmt.Errorf("AUDIT_DB %q is not a configured database", audit.db)
+		}
+	}
+
+	poolsMu.RLock()
+	oldPools, oldURLs := pools, poolURLs
+	poolsMu.RUnlock()
+
+	newPools := make(map[string]*pgxpool.Pool, len(urls))
+	var opened []*pgxpool.Pool
+	for _, name := range sortedNames(urls) {
+		if pool, ok := oldPools[name]; ok && oldURLs[name] == urls[name] {
+			newPools[name] = pool
+			continue
+		}
+		pool, err := connectDatabase(ctx, name, urls[name])
+		if err != nil {
+			for _, pool := range opened {
+				pool.Close()
+			}
+			return err
+		}
+		newPools[name] = pool
+		opened = append(opened, pool)
+	}
+	if len(opened) == 0 && len(newPools) == len(oldPools) {
+		return nil
+	}
+
+	poolsMu.Lock()
+	pools, poolURLs = newPools, urls
+	poolsMu.Unlock()
+
+	for name, pool := range oldPools {
+		if newPools[name] != pool {
+			go drainPool(name, pool)
+		}
+	}
+	slog.Info("Reloaded databases", "opened", len(opened))
+	return nil
+}
+
+// drainPool closes a pool that was replaced, which waits until every
+// connection acquired from it has been released.
+func drainPool(name string, pool *pgxpool.Pool) {
+	pool.Close()
+	breakers.Lock()
+	delete(breakers.m, pool)
+	breakers.Unlock()
+	typeNameCache.Lock()
+	delete(typeNameCache.names, pool)
+	typeNameCache.Unlock()
+	serverVersions.Lock()
+	delete(serverVersions.m, pool)
+	serverVersions.Unlock()
+	slog.Info("Closed replaced database pool", "database", name)
+}
+
+// Database reloads: reloadDatabases runs on SIGHUP and, when
+// DATABASE_RELOAD_INTERVAL is set, at that interval, which suits secrets
+// files that are rewritten in place.
+var databaseReloadInterval time.Duration
+
+// watchDatabases reloads the databases on SIGHUP and at
+// databaseReloadInterval until ctx is done.
+func watchDatabases(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	var tick <-chan time.Time
+	if databaseReloadInterval > 0 {
+		ticker := time.NewTicker(databaseReloadInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+		case <-tick:
+		}
+		if err := reloadDatabases(ctx); err != nil {
+			slog.Error("Unable to reload databases", "error", err)
+		}
+	}
+}
+
+func closeDatabases() {
+	for _, pool := range currentPools() {
+		pool.Close()
+	}
+}
+
+// errDatabaseUnavailable is returned for a database whose pool isn't open,
+// because it failed to start or has been closed for shutdown.
+var errDatabaseUnavailable = errors.New("database unavailable")
+
+// selectPool returns the pool for the named database, or the default one when
+// name is empty.
+func selectPool(name string) (*pgxpool.Pool, error) {
+	current := currentPools()
+	if current == nil {
+		return nil, errDatabaseUnavailable
+	}
+	if name == "" {
+		name = defaultDB
+	}
+	pool, ok := current[name]
+	switch {
+	case !ok:
+		return nil, fmt.Errorf("unknown database %q", name)
+	case pool == nil:
+		return nil, errDatabaseUnavailable
+	}
+	return pool, nil
+}
+
+// writePoolError reports an error returned by selectPool.
+func writePoolError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errDatabaseUnavailable) {
+		writeJSONError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	writeJSONError(w, http.StatusBadRequest, err.Error())
+}
+
+func sortedNames[V any](m map[string]V) []string {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
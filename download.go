@@ -0,0 +1,52 @@
+package main
+
+import "strings"
+
+// formatExtensions are the file extensions of downloads per output format.
+var formatExtensions = map[string]string{
+	formatJSON:    ".json",
+	formatObjects: ".json",
+	formatGeoJSON: ".geojson",
+	formatCSV:     ".csv",
+	formatMsgpack: ".msgpack",
+	formatNDJSON:  ".ndjson",
+	formatArrow:   ".arrow",
+}
+
+// maxFilenameLength caps the length of a client-supplied filename.
+const maxFilenameLength = 200
+
+// attachmentName returns the filename to download a response as: name, a
+// request's filename, made safe for a Content-Disposition header and ending
+// in ext, or def when name has nothing usable left. Control characters,
+// quotes, backslashes and path separators are dropped and characters
+// outside printable ASCII replaced with _, so name can't break out of the
+// header or the quoted string, or point into another directory.
+func attachmentName(name, ext, def string) string {
+	var b strings.Builder
+	for _, c := range name {
+		switch {
+		case c < 0x20 || c == 0x7f || c == '"' || c == '\\' || c == '/':
+		case c > 0x7e:
+			b.WriteByte('_')
+		default:
+			b.WriteRune(c)
+		}
+	}
+	safe := strings.Trim(b.String(), " .")
+	if len(safe) > maxFilenameLength {
+		safe = safe[:maxFilenameLength]
+	}
+	if safe == "" {
+		return def
+	}
+	if !strings.HasSuffix(strings.ToLower(safe), ext) {
+		safe += ext
+	}
+	return safe
+}
+
+// contentDisposition is the Content-Disposition header of a download.
+func contentDisposition(filename string) string {
+	return `attachment; filename="` + filename + `"`
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestAttachmentName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"report", "report.csv"},
+		{"report.csv", "report.csv"},
+		{"Report.CSV", "Report.CSV"},
+		{"report.txt", "report.txt.csv"},
+		{"../../etc/passwd", "etcpasswd.csv"},
+		{`a"; filename="evil.exe`, "a; filename=evil.exe.csv"},
+		{"a\r\nSet-Cookie: x=1", "aSet-Cookie: x=1.csv"},
+		{`C:\temp\x`, "C:tempx.csv"},
+		{"résumé", "r_sum_.csv"},
+		{"  .hidden. ", "hidden.csv"},
+		{"", "export.csv"},
+		{"/..", "export.csv"},
+		{"\x00\x7f", "export.csv"},
+		{strings.Repeat("a", 300), strings.Repeat("a", maxFilenameLength) + ".csv"},
+	}
+	for _, tt := range tests {
+		if got := attachmentName(tt.name, ".csv", "export.csv"); got != tt.want {
+			t.Errorf("attachmentName(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
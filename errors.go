@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+	"strings"
+
+	"github.com/jackc/pgconn"
+)
+
+// errorResponse is the JSON body written for every failed request. The
+// Postgres fields are only set for errors reported by the server, so clients
+// can tell e.g. a syntax error (42601) from a unique violation (23505).
+type errorResponse struct {
+	Error  string `json:"error"`
+	Status int    `json:"status"`
+	Code   string `json:"code,omitempty"`
+	Detail string `json:"detail,omitempty"`
+	Hint   string `json:"hint,omitempty"`
+
+	// Constraint, Table and Column name the object involved in the error,
+	// Position the character of the query it points at, counting from 1.
+	Constraint string `json:"constraint,omitempty"`
+	Table      string `json:"table,omitempty"`
+	Column     string `json:"column,omitempty"`
+	Position   int32  `json:"position,omitempty"`
+
+	Quota *quotaExceeded `json:"quota,omitempty"`
+}
+
+// writeJSONError replies to the request with a JSON error body.
+func writeJSONError(w http.ResponseWriter, status int, msg string) {
+	writeErrorResponse(w, errorResponse{Error: msg, Status: status})
+}
+
+// writeQueryError replies with a JSON error body for err, adding the Postgres
+// error fields when err came from the server.
+func writeQueryError(w http.ResponseWriter, status int, msg string, err error) {
+	writeErrorResponse(w, queryError(status, msg, err))
+}
+
+// redactErrors makes error bodies leave out the values an error message may
+// quote, such as the offending literal of an invalid input, set through
+// REDACT_ERRORS=true. The Postgres detail, which typically repeats them, is
+// dropped altogether.
+var redactErrors bool
+
+// queryError builds the error body for err, see writeQueryError.
+func queryError(status int, msg string, err error) errorResponse {
+	text := err.Error()
+	var pgErr *pgconn.PgError
+	isPgErr := errors.As(err, &pgErr)
+	if redactErrors {
+		if isPgErr {
+			text = strings.Replace(text, pgErr.Message, redactMessage(pgErr.Message), 1)
+		} else {
+			text = redactMessage(text)
+		}
+	}
+
+	resp := errorResponse{Error: msg + ": " + text, Status: status}
+	if isPgErr {
+		resp.Code = pgErr.Code
+		resp.Hint = pgErr.Hint
+		resp.Constraint = pgErr.ConstraintName
+		resp.Table = pgErr.TableName
+		resp.Column = pgErr.ColumnName
+		resp.Position = pgErr.Position
+		if !redactErrors {
+			resp.Detail = pgErr.Detail
+		}
+	}
+	return resp
+}
+
+// pgErrorAttrs returns the log attributes of a failed query: the error, and
+// for a Postgres error its SQLSTATE along with the constraint, table, column
+// and position it names, so a unique violation (23505) can be told from a
+// check violation (23514) and traced to the offending constraint.
+func pgErrorAttrs(err error) []any {
+	attrs := []any{"error", err}
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) {
+		return attrs
+	}
+	attrs = append(attrs, "code", pgErr.Code)
+	for _, field := range []struct{ key, value string }{
+		{"constraint", pgErr.ConstraintName},
+		{"table", pgErr.TableName},
+		{"column", pgErr.ColumnName},
+	} {
+		if field.value != "" {
+			attrs = append(attrs, field.key, field.value)
+		}
+	}
+	if pgErr.Position > 0 {
+		attrs = append(attrs, "position", pgErr.Position)
+	}
+	return attrs
+}
+
+func writeErrorResponse(w http.ResponseWriter, resp errorResponse) {
+	w.Header().Del("Content-Encoding")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(resp.Status)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// recoverPanics turns a panicking handler into a logged error and a 500 JSON
+// error body, instead of net/http's stack trace in the server log and a
+// dropped connection. A panic after the response has started can't change
+// its status any more, so the connection is aborted as before so the client
+// doesn't take the partial response for a whole one.
+func recoverPanics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &startedRecorder{ResponseWriter: w}
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			if v == http.ErrAbortHandler {
+				panic(v)
+			}
+			slog.ErrorContext(r.Context(), "Handler panic", "panic", v, "stack", string(debug.Stack()))
+			if rec.started {
+				panic(http.ErrAbortHandler)
+			}
+			writeJSONError(w, http.StatusInternalServerError, "Internal server error")
+		}()
+		next.ServeHTTP(rec, r)
+	})
+}
+
+// startedRecorder records whether the response has started.
+type startedRecorder struct {
+	http.ResponseWriter
+	started bool
+}
+
+func (s *startedRecorder) WriteHeader(status int) {
+	s.started = true
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *startedRecorder) Write(p []byte) (int, error) {
+	s.started = true
+	return s.ResponseWriter.Write(p)
+}
+
+func (s *startedRecorder) Flush() {
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		s.started = true
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (s *startedRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+// etagsEnabled makes GET query responses carry an ETag, set through
+// ETAGS=true, so pollers and CDNs can revalidate with If-None-Match instead
+// of downloading an unchanged result again.
+var etagsEnabled bool
+
+// conditionalGET sets an ETag, a hash of the response body, on successful
+// responses to GET requests, and replies 304 Not Modified instead when it
+// matches the request's If-None-Match. GET requests always run read-only, so
+// the hash only changes with the data. Computing it holds back the response
+// until it is complete, for bodies up to maxCachedBytes; bigger ones are
+// streamed as they come without an ETag.
+func conditionalGET(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !etagsEnabled || r.Method != http.MethodGet {
+			next(w, r)
+			return
+		}
+		buf := &etagBuffer{ResponseWriter: w, status: http.StatusOK}
+		next(buf, r)
+		buf.finish(r)
+	}
+}
+
+// etagBuffer holds back a response until finish, unless it turns out not to
+// need an ETag: a response that isn't 200 OK or outgrows maxCachedBytes is
+// passed through from then on.
+type etagBuffer struct {
+	http.ResponseWriter
+	status      int
+	body        bytes.Buffer
+	passthrough bool
+}
+
+func (e *etagBuffer) WriteHeader(status int) {
+	if e.passthrough {
+		e.ResponseWriter.WriteHeader(status)
+		return
+	}
+	e.status = status
+	if status != http.StatusOK {
+		e.startPassthrough()
+	}
+}
+
+func (e *etagBuffer) Write(p []byte) (int, error) {
+	if !e.passthrough && e.body.Len()+len(p) > maxCachedBytes {
+		e.startPassthrough()
+	}
+	if e.passthrough {
+		return e.ResponseWriter.Write(p)
+	}
+	return e.body.Write(p)
+}
+
+// startPassthrough sends what was held back and passes the rest through.
+func (e *etagBuffer) startPassthrough() {
+	e.passthrough = true
+	e.ResponseWriter.WriteHeader(e.status)
+	if e.body.Len() > 0 {
+		e.ResponseWriter.Write(e.body.Bytes())
+		e.body = bytes.Buffer{}
+	}
+}
+
+// Flush only flushes a response that is passed through; one held back goes
+// out at once when it is complete.
+func (e *etagBuffer) Flush() {
+	if !e.passthrough {
+		return
+	}
+	if f, ok := e.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (e *etagBuffer) Unwrap() http.ResponseWriter {
+	return e.ResponseWriter
+}
+
+// finish sends the held back response with its ETag, or 304 when the client
+// already has it.
+func (e *etagBuffer) finish(r *http.Request) {
+	if e.passthrough {
+		return
+	}
+	sum := sha256.Sum256(e.body.Bytes())
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+	h := e.ResponseWriter.Header()
+	h.Set("ETag", etag)
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		h.Del("Content-Length")
+		e.ResponseWriter.WriteHeader(http.StatusNotModified)
+		return
+	}
+	e.ResponseWriter.WriteHeader(e.status)
+	e.ResponseWriter.Write(e.body.Bytes())
+}
+
+// etagMatches reports whether an If-None-Match header matches etag, using
+// the weak comparison RFC 9110 prescribes for it.
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
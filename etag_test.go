@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestEtagMatches(t *testing.T) {
+	const etag = `"abc"`
+	tests := []struct {
+		header string
+		want   bool
+	}{
+		{`"abc"`, true},
+		{`W/"abc"`, true},
+		{`"x", "abc"`, true},
+		{`*`, true},
+		{``, false},
+		{`"abcd"`, false},
+		{`abc`, false},
+	}
+	for _, tt := range tests {
+		if got := etagMatches(tt.header, etag); got != tt.want {
+			t.Errorf("etagMatches(%q) = %v, want %v", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestConditionalGET(t *testing.T) {
+	defer func(enabled bool) { etagsEnabled = enabled }(etagsEnabled)
+	etagsEnabled = true
+	status, body := http.StatusOK, "result"
+	handler := conditionalGET(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	})
+	serve := func(method, ifNoneMatch string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "/query?q=SELECT+1", nil)
+		if ifNoneMatch != "" {
+			r.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		w := httptest.NewRecorder()
+		handler(w, r)
+		return w
+	}
+
+	first := serve(http.MethodGet, "")
+	etag := first.Header().Get("ETag")
+	if first.Code != http.StatusOK || etag == "" || first.Body.String() != body {
+		t.Fatalf("first response %d, ETag %q, body %q", first.Code, etag, first.Body)
+	}
+	if w := serve(http.MethodGet, etag); w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		t.Errorf("revalidation: %d %q, want 304 without a body", w.Code, w.Body)
+	}
+
+	body = "changed"
+	if w := serve(http.MethodGet, etag); w.Code != http.StatusOK || w.Header().Get("ETag") == etag {
+		t.Errorf("changed result: %d with ETag %q", w.Code, w.Header().Get("ETag"))
+	}
+	if w := serve(http.MethodPost, ""); w.Header().Get("ETag") != "" {
+		t.Error("POST response has an ETag")
+	}
+
+	status = http.StatusBadRequest
+	if w := serve(http.MethodGet, ""); w.Code != http.StatusBadRequest || w.Header().Get("ETag") != "" {
+		t.Errorf("error response: %d with ETag %q", w.Code, w.Header().Get("ETag"))
+	}
+
+	status, body = http.StatusOK, strings.Repeat("x", maxCachedBytes+1)
+	if w := serve(http.MethodGet, ""); w.Header().Get("ETag") != "" || w.Body.Len() != len(body) {
+		t.Errorf("large response: ETag %q, %d bytes", w.Header().Get("ETag"), w.Body.Len())
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// explainHandler returns the plan of the query in the request body, as
+// produced by EXPLAIN (FORMAT JSON). With ?analyze=true the query is also
+// executed to report actual timings, so it must pass checkReadOnly and runs
+// in a READ ONLY transaction whatever the server mode. The request's session
+// options apply as for a query, so that statement_timeout_ms also bounds
+// the analyzed run.
+func explainHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "Invalid request method")
+		return
+	}
+
+	var sqlQuery SQLQuery
+	if err := decodeBody(w, r, &sqlQuery); err != nil {
+		queryErrors.WithLabelValues(errorBadRequest).Inc()
+		writeBodyError(w, err)
+		return
+	}
+	if err := checkQueryLength(sqlQuery.Query); err != nil {
+		queryErrors.WithLabelValues(errorBadRequest).Inc()
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := checkExplainable(sqlQuery.Query); err != nil {
+		queryErrors.WithLabelValues(errorBadRequest).Inc()
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := checkParamCount(sqlQuery.Query, sqlQuery.Params); err != nil {
+		queryErrors.WithLabelValues(errorBadRequest).Inc()
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if err := checkClientQuery(r.Context(), sqlQuery.Query); err != nil {
+		queryErrors.WithLabelValues(errorBadRequest).Inc()
+		writeJSONError(w, http.StatusForbidden, err.Error())
+		return
+	}
+
+	analyze := r.URL.Query().Get("analyze") == "true"
+	if analyze {
+		if err := checkReadOnly(sqlQuery.Query); err != nil {
+			queryErrors.WithLabelValues(errorBadRequest).Inc()
+			writeJSONError(w, http.StatusForbidden, err.Error())
+			return
+		}
+	}
+
+	ctx, cancel := requestContext(w, r, sqlQuery.TimeoutMS)
+	defer cancel()
+	recordQuery(ctx, sqlQuery.Query)
+
+	pool, err := requestPool(r, sqlQuery.DB)
+	if err != nil {
+		queryErrors.WithLabelValues(errorBadRequest).Inc()
+		writePoolError(w, err)
+		return
+	}
+	settings, err := sessionSettings(ctx, sqlQuery.SessionOptions)
+	if err != nil {
+		queryErrors.WithLabelValues(errorBadRequest).Inc()
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	conn, err := acquireConn(ctx, pool)
+	if err != nil {
+		writeAcquireFailure(ctx, w, err)
+		return
+	}
+	defer conn.Release()
+
+	explain := "EXPLAIN (FORMAT JSON) "
+	if analyze {
+		explain = "EXPLAIN (ANALYZE, FORMAT JSON) "
+	}
+
+	// Plain EXPLAIN only plans the query and is allowed in a READ ONLY
+	// transaction even for writes; with ANALYZE the transaction stops any
+	// write that slipped past checkReadOnly.
+	tx, err := conn.BeginTx(ctx, pgx.TxOptions{AccessMode: pgx.ReadOnly})
+	if err != nil {
+		writeQueryFailure(ctx, w, err)
+		return
+	}
+	defer tx.Rollback(context.Background())
+	if err := applySettings(ctx, tx, settings); err != nil {
+		writeQueryFailure(ctx, w, err)
+		return
+	}
+
+	start := time.Now()
+	defer func() {
+		elapsed := time.Since(start)
+		requestInfoFrom(ctx).queryDuration = elapsed
+		queryDuration.Observe(elapsed.Seconds())
+	}()
+
+	var plan string
+	params := convertParams(sqlQuery.Params)
+	if err := tx.QueryRow(ctx, explain+sqlQuery.Query, params...).Scan(&plan); err != nil {
+		writeQueryFailure(ctx, w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(plan))
+	w.Write([]byte("\n"))
+}
+
+// checkExplainable returns an error unless sql is a single statement that
+// doesn't already start with EXPLAIN.
+func checkExplainable(sql string) error {
+	tokens, err := tokenize(sql)
+	if err != nil {
+		return err
+	}
+	statements := splitStatements(tokens)
+	switch {
+	case len(statements) == 0:
+		return errEmptyQuery
+	case len(statements) > 1:
+		return errors.New("only a single statement can be explained")
+	}
+	if statements[0][0].is("EXPLAIN") {
+		return errors.New("query already starts with EXPLAIN; send the statement itself")
+	}
+	return nil
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// exportHandler streams the result of a query as CSV using COPY (query) TO
+// STDOUT, which leaves the formatting to Postgres and skips decoding rows
+// altogether:
+//
+//	GET /export?q=SELECT+*+FROM+points
+//
+// POST takes the same body as /query. The first record holds the column
+// names unless header=false. COPY can't bind parameters, so the query must
+// not have any, and it has to be a read-only SELECT, WITH, VALUES or TABLE
+// query; it runs in a read-only transaction.
+func exportHandler(w http.ResponseWriter, r *http.Request) {
+	header := r.URL.Query().Get("header") != "false"
+	serveExport(w, r, copyFormat{
+		options:     "FORMAT csv, HEADER " + strconv.FormatBool(header),
+		contentType: "text/csv; charset=utf-8",
+		filename:    "export.csv",
+	})
+}
+
+// binaryExportHandler is exportHandler streaming the result in the binary
+// COPY format instead, for clients that speak Postgres themselves, such as
+// another database loading it with COPY ... FROM STDIN WITH (FORMAT binary)
+// without parsing it at all:
+//
+//	GET /export/binary?q=SELECT+*+FROM+points
+func binaryExportHandler(w http.ResponseWriter, r *http.Request) {
+	serveExport(w, r, copyFormat{
+		options:     "FORMAT binary",
+		contentType: "application/vnd.postgresql.copy-binary",
+		filename:    "export.pgcopy",
+	})
+}
+
+// copyFormat describes the output of an export: the options of its COPY
+// statement and how the response is labeled.
+type copyFormat struct {
+	options     string
+	contentType string
+	filename    string
+}
+
+// serveExport exports the query of the request with COPY in format.
+func serveExport(w http.ResponseWriter, r *http.Request, format copyFormat) {
+	queriesTotal.Inc()
+	requestsInFlight.Inc()
+	defer requestsInFlight.Dec()
+
+	sqlQuery, ok := readQuery(w, r)
+	if !ok {
+		return
+	}
+	query, err := singleQuery(sqlQuery.Query, "export")
+	if err == nil && len(sqlQuery.Params) > 0 {
+		err = errExportParams
+	}
+	if err != nil {
+		queryErrors.WithLabelValues(errorBadRequest).Inc()
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := checkClientQuery(r.Context(), sqlQuery.Query); err != nil {
+		queryErrors.WithLabelValues(errorBadRequest).Inc()
+		writeJSONError(w, http.StatusForbidden, err.Error())
+		return
+	}
+
+	ctx, cancel := requestContext(w, r, sqlQuery.TimeoutMS)
+	defer cancel()
+	start := time.Now()
+	defer func() {
+		elapsed := time.Since(start)
+		requestInfoFrom(ctx).queryDuration = elapsed
+		queryDuration.Observe(elapsed.Seconds())
+	}()
+	recordQuery(ctx, sqlQuery.Query)
+
+	pool, err := requestPool(r, sqlQuery.DB)
+	if err != nil {
+		queryErrors.WithLabelValues(errorBadRequest).Inc()
+		writePoolError(w, err)
+		return
+	}
+	settings, err := sessionSettings(ctx, sqlQuery.SessionOptions)
+	if err != nil {
+		queryErrors.WithLabelValues(errorBadRequest).Inc()
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	conn, err := acquireRead(ctx, pool, replicaPool(r, sqlQuery.DB))
+	if err != nil {
+		writeAcquireFailure(ctx, w, err)
+		return
+	}
+	defer conn.Release()
+	tx, err := conn.BeginTx(ctx, pgx.TxOptions{AccessMode: pgx.ReadOnly})
+	if err != nil {
+		writeQueryFailure(ctx, w, err)
+		return
+	}
+	defer tx.Rollback(ctx)
+	if err := applySettings(ctx, tx, settings); err != nil {
+		writeQueryFailure(ctx, w, err)
+		return
+	}
+
+	if sqlQuery.Filename != "" {
+		format.filename = attachmentName(sqlQuery.Filename, path.Ext(format.filename), format.filename)
+	}
+	sql := "COPY (" + query + ") TO STDOUT WITH (" + format.options + ")"
+	out := &exportWriter{w: w, r: r, format: format}
+	tag, err := conn.Conn().PgConn().CopyTo(ctx, out, sql)
+	if err != nil && out.body == nil {
+		writeQueryFailure(ctx, w, err)
+		return
+	}
+	requestInfoFrom(ctx).rows = tag.RowsAffected()
+	if err != nil {
+		// The status is already sent, so all that's left is to log why and
+		// cut the response short. Closing the body would end it with a
+		// valid trailer, passing off the truncated export as complete.
+		queryErrors.WithLabelValues(errorQuery).Inc()
+		slog.WarnContext(ctx, "Error exporting query", "error", err)
+		panic(http.ErrAbortHandler)
+	}
+	if out.body != nil {
+		out.close()
+	}
+}
+
+var errExportParams = errors.New("export doesn't support query parameters")
+
+// exportWriter starts the response on the first write, so a query that fails
+// before producing any output still gets an error response.
+type exportWriter struct {
+	w      http.ResponseWriter
+	r      *http.Request
+	format copyFormat
+	body   io.Writer
+	close  func() error
+}
+
+func (e *exportWriter) Write(p []byte) (int, error) {
+	if e.body == nil {
+		e.w.Header().Set("Content-Type", e.format.contentType)
+		e.w.Header().Set("Content-Disposition", contentDisposition(e.format.filename))
+		e.body, e.close = compressResponse(e.w, e.r)
+	}
+	return e.body.Write(p)
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestExportRejectsQuery(t *testing.T) {
+	useUnreachablePool(t)
+	tests := []struct {
+		name  string
+		query string
+	}{
+		{"closes the COPY subquery", "SELECT 1) TO STDOUT WITH (FORMAT text); --"},
+		{"injects COPY options", "SELECT 1) TO PROGRAM 'id' --"},
+		{"leaves a parenthesis open", "SELECT (1"},
+		{"writes", "WITH d AS (DELETE FROM t RETURNING *) SELECT * FROM d"},
+		{"has several statements", "SELECT 1; SELECT 2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/export?q="+url.QueryEscape(tt.query), nil)
+			w := httptest.NewRecorder()
+			exportHandler(w, r)
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("status %d, want %d: %s", w.Code, http.StatusBadRequest, w.Body)
+			}
+		})
+	}
+}
+
+// TestExportAbortsOnError checks that an export failing after its output
+// started is cut short rather than ended as if complete.
+func TestExportAbortsOnError(t *testing.T) {
+	useTestDatabase(t)
+	query := "SELECT CASE WHEN g = 50000 THEN 1 / 0 ELSE g END FROM generate_series(1, 100000) g"
+	r := httptest.NewRequest(http.MethodGet, "/export?q="+url.QueryEscape(query), nil)
+	w := httptest.NewRecorder()
+	defer func() {
+		if v := recover(); v != http.ErrAbortHandler {
+			t.Errorf("recovered %v, want http.ErrAbortHandler", v)
+		}
+		if w.Code != http.StatusOK || w.Body.Len() == 0 {
+			t.Errorf("export failed before its output started: %d %s", w.Code, w.Body)
+		}
+	}()
+	exportHandler(w, r)
+}
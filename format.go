@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// defaultFormat is the output format of requests that don't ask for one, set
+// through DEFAULT_FORMAT.
+var defaultFormat = formatJSON
+
+// formatMediaTypes are the media types an Accept header can ask for each
+// output format by, the first being the one it is served as. The objects
+// format is only available through ?format=objects.
+var formatMediaTypes = []struct {
+	format string
+	types  []string
+}{
+	{formatJSON, []string{"application/json"}},
+	{formatGeoJSON, []string{"application/geo+json"}},
+	{formatCSV, []string{"text/csv"}},
+	{formatMsgpack, []string{"application/msgpack", "application/x-msgpack"}},
+	{formatNDJSON, []string{"application/x-ndjson", "application/ndjson"}},
+	{formatArrow, []string{"application/vnd.apache.arrow.stream"}},
+}
+
+// validFormat reports whether format names an output format.
+func validFormat(format string) bool {
+	if format == formatObjects {
+		return true
+	}
+	for _, f := range formatMediaTypes {
+		if f.format == format {
+			return true
+		}
+	}
+	return false
+}
+
+// notAcceptableError is returned by negotiateFormat when the Accept header
+// rules out every output format.
+type notAcceptableError struct{}
+
+func (notAcceptableError) Error() string {
+	var types []string
+	for _, f := range formatMediaTypes {
+		types = append(types, f.types[0])
+	}
+	return "None of the accepted media types can be served; supported are " + strings.Join(types, ", ")
+}
+
+// negotiateFormat picks the output format of a request: the format query
+// parameter when set, otherwise the format the Accept header gives the
+// highest quality, otherwise defaultFormat. Between formats of the same
+// quality, one named outright beats one matched by a wildcard, and
+// defaultFormat beats the others.
+func negotiateFormat(r *http.Request) (string, error) {
+	if format := r.URL.Query().Get("format"); format != "" {
+		if !validFormat(format) {
+			return "", fmt.Errorf("Unknown format %q", format)
+		}
+		return format, nil
+	}
+	accept := strings.Join(r.Header.Values("Accept"), ",")
+	if strings.TrimSpace(accept) == "" {
+		return defaultFormat, nil
+	}
+
+	best, bestQ, bestSpecificity := "", 0.0, 0
+	for _, format := range candidateFormats() {
+		q, specificity := acceptQuality(accept, format)
+		if q > bestQ || q == bestQ && q > 0 && specificity > bestSpecificity {
+			best, bestQ, bestSpecificity = format, q, specificity
+		}
+	}
+	if best == "" {
+		return "", notAcceptableError{}
+	}
+	return best, nil
+}
+
+// candidateFormats lists the formats an Accept header can select, with
+// defaultFormat first so that it wins ties.
+func candidateFormats() []string {
+	formats := []string{defaultFormat}
+	for _, f := range formatMediaTypes {
+		if f.format != defaultFormat {
+			formats = append(formats, f.format)
+		}
+	}
+	return formats
+}
+
+// acceptQuality returns the quality accept gives format through its most
+// specific matching media range, or 0 when none matches, along with how
+// specific that range is: 2 for the media type itself, 1 for type/* and 0
+// for */*.
+func acceptQuality(accept, format string) (float64, int) {
+	types := []string{"application/json"} // for formatObjects
+	for _, f := range formatMediaTypes {
+		if f.format == format {
+			types = f.types
+		}
+	}
+	q, specificity := 0.0, -1
+	for _, part := range strings.Split(accept, ",") {
+		name, partQ := parseQuality(part)
+		name = strings.ToLower(name)
+		for _, t := range types {
+			major, _, _ := strings.Cut(t, "/")
+			s := -1
+			switch {
+			case name == t:
+				s = 2
+			case name == major+"/*":
+				s = 1
+			case name == "*/*" || name == "*":
+				s = 0
+			}
+			if s > specificity {
+				q, specificity = partQ, s
+			}
+		}
+	}
+	return q, specificity
+}
+
+// writeFormatError replies to a request whose output format couldn't be
+// negotiated.
+func writeFormatError(w http.ResponseWriter, err error) {
+	queryErrors.WithLabelValues(errorBadRequest).Inc()
+	status := http.StatusBadRequest
+	if _, ok := err.(notAcceptableError); ok {
+		status = http.StatusNotAcceptable
+	}
+	writeJSONError(w, status, err.Error())
+}
+
+// loadDefaultFormat reads DEFAULT_FORMAT.
+func loadDefaultFormat() error {
+	value := strings.ToLower(strings.TrimSpace(os.Getenv("DEFAULT_FORMAT")))
+	if value == "" {
+		return nil
+	}
+	if !validFormat(value) {
+		return fmt.Errorf("invalid DEFAULT_FORMAT %q", value)
+	}
+	defaultFormat = value
+	return nil
+}
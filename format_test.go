@@ -0,0 +1,58 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNegotiateFormat(t *testing.T) {
+	defer func(format string) { defaultFormat = format }(defaultFormat)
+	tests := []struct {
+		name          string
+		target        string
+		accept        string
+		defaultFormat string
+		want          string
+		notAcceptable bool
+		wantErr       bool
+	}{
+		{name: "no header", target: "/query", want: formatJSON},
+		{name: "media type", target: "/query", accept: "application/geo+json", want: formatGeoJSON},
+		{name: "alias", target: "/query", accept: "application/x-msgpack", want: formatMsgpack},
+		{name: "higher quality", target: "/query", accept: "text/csv;q=0.5, application/json", want: formatJSON},
+		{name: "higher quality second", target: "/query", accept: "text/csv, application/json;q=0.5", want: formatCSV},
+		{name: "wildcard", target: "/query", accept: "*/*", want: formatJSON},
+		{name: "type wildcard", target: "/query", accept: "text/*", want: formatCSV},
+		{name: "named beats wildcard", target: "/query", accept: "*/*;q=0.1, application/x-ndjson;q=0.1", want: formatNDJSON},
+		{name: "browser", target: "/query", accept: "text/html,application/xhtml+xml,*/*;q=0.8", want: formatJSON},
+		{name: "default format", target: "/query", accept: "*/*", defaultFormat: formatCSV, want: formatCSV},
+		{name: "default format without header", target: "/query", defaultFormat: formatNDJSON, want: formatNDJSON},
+		{name: "parameter overrides header", target: "/query?format=csv", accept: "application/json", want: formatCSV},
+		{name: "objects parameter", target: "/query?format=objects", want: formatObjects},
+		{name: "unknown parameter", target: "/query?format=xml", wantErr: true},
+		{name: "unsupported type", target: "/query", accept: "image/png", notAcceptable: true},
+		{name: "refused", target: "/query", accept: "application/json;q=0, */*;q=0", notAcceptable: true},
+	}
+	for _, tt := range tests {
+		defaultFormat = formatJSON
+		if tt.defaultFormat != "" {
+			defaultFormat = tt.defaultFormat
+		}
+		r := httptest.NewRequest(http.MethodGet, tt.target, nil)
+		if tt.accept != "" {
+			r.Header.Set("Accept", tt.accept)
+		}
+		got, err := negotiateFormat(r)
+		if tt.notAcceptable || tt.wantErr {
+			if err == nil || errors.As(err, &notAcceptableError{}) != tt.notAcceptable {
+				t.Errorf("%s: format %q, error %v, want not acceptable %v", tt.name, got, err, tt.notAcceptable)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("%s: format %q, error %v, want %q", tt.name, got, err, tt.want)
+		}
+	}
+}
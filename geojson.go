@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgproto3/v2"
+	"github.com/jackc/pgx/v4"
+)
+
+// geometryColumnName is the column used as feature geometry when the result
+// has no geometry/geography typed column, e.g. for views that cast it away.
+var geometryColumnName = "geom"
+
+// geoJSONSRID is the SRID GeoJSON geometries are transformed to, set through
+// GEOJSON_SRID and per request with ?srid=. It defaults to 4326, WGS 84, the
+// only coordinate reference system RFC 7946 allows; zero leaves geometries
+// in the SRID they are stored in.
+var geoJSONSRID int32 = 4326
+
+// parseSRID parses an SRID for geoJSONSRID.
+func parseSRID(value string) (int32, error) {
+	srid, err := strconv.ParseInt(value, 10, 32)
+	if err != nil || srid < 0 {
+		return 0, errors.New("must be a non-negative integer")
+	}
+	return int32(srid), nil
+}
+
+// requestSRID returns the SRID to transform the GeoJSON of r to.
+func requestSRID(r *http.Request) (int32, error) {
+	value := r.URL.Query().Get("srid")
+	if value == "" {
+		return geoJSONSRID, nil
+	}
+	srid, err := parseSRID(value)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid srid %q: %v", value, err)
+	}
+	return srid, nil
+}
+
+// geoJSONWriter emits a GeoJSON FeatureCollection. The client's query is
+// wrapped so that PostGIS converts the geometry column with ST_AsGeoJSON and
+// reports its SRID and extent; these are appended as extra last columns and
+// every other column, except the raw geometry, becomes a feature property.
+// With a target SRID the geometry is first transformed to it with
+// ST_Transform, which fails for a geometry of unknown SRID 0.
+//
+// The collection gets the bbox of all features and, for a non-zero SRID, a
+// named crs member. Features must share an SRID: the stream fails at the
+// first feature with a different one, since its coordinates couldn't be
+// interpreted alongside the others.
+type geoJSONWriter struct {
+	query        string
+	geomIndex    int
+	targetSRID   int32
+	properties   []string
+	featureCount int
+
+	srid     int32
+	sridSeen bool
+	bbox     []float64 // minx, miny, maxx, maxy
+}
+
+// geoJSONExtraColumns is the number of columns the wrapping query appends:
+// ST_AsGeoJSON, ST_SRID and the four bounds of the output geometry, and the
+// SRID of the geometry as the query returned it.
+const geoJSONExtraColumns = 7
+
+func newGeoJSONWriter(ctx context.Context, q querier, query, geomColumn string, srid int32) (*geoJSONWriter, error) {
+	fields, geomIndex, err := describeGeometry(ctx, q, query, geomColumn)
+	if err != nil {
+		return nil, err
+	}
+	geom := "q." + pgx.Identifier{string(fields[geomIndex].Name)}.Sanitize() + "::geometry"
+	output := geom
+	if srid != 0 {
+		// Left out rather than failing the query, so that writeRow can
+		// report which geometry is at fault.
+		output = fmt.Sprintf("CASE ST_SRID(%s) WHEN 0 THEN NULL ELSE ST_Transform(%[1]s, %d) END", geom, srid)
+	}
+	return &geoJSONWriter{
+		query: fmt.Sprintf("SELECT q.*, ST_AsGeoJSON(t.g), ST_SRID(t.g), ST_XMin(t.g), ST_YMin(t.g), ST_XMax(t.g), ST_YMax(t.g), ST_SRID(%s) "+
+			"FROM (%s\n) AS q, LATERAL (SELECT %s AS g) AS t", geom, trimQuery(query), output),
+		geomIndex:  geomIndex,
+		targetSRID: srid,
+	}, nil
+}
+
+// describeGeometry describes query without executing it and returns its
+// result columns along with the index of the geometry column, as chosen by
+// findGeometryColumn.
+func describeGeometry(ctx context.Context, q querier, query, geomColumn string) ([]pgproto3.FieldDescription, int, error) {
+	sd, err := q.Prepare(ctx, "", query)
+	if err != nil {
+		return nil, 0, err
+	}
+	oids, err := geometryOIDs(ctx, q)
+	if err != nil {
+		return nil, 0, err
+	}
+	geomIndex := findGeometryColumn(sd.Fields, oids, geomColumn)
+	if geomIndex < 0 {
+		if geomColumn != "" {
+			return nil, 0, fmt.Errorf("geometry column %q not found in result", geomColumn)
+		}
+		return nil, 0, fmt.Errorf("no geometry column found in result")
+	}
+	return sd.Fields, geomIndex, nil
+}
+
+// geometryOIDs looks up the type OIDs of the PostGIS geometry and geography
+// types. They are assigned when the extension is created, so they differ per
+// database.
+func geometryOIDs(ctx context.Context, q querier) (map[uint32]bool, error) {
+	rows, err := q.Query(ctx, "SELECT oid FROM pg_type WHERE typname IN ('geometry', 'geography')")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	oids := make(map[uint32]bool)
+	for rows.Next() {
+		var oid uint32
+		if err := rows.Scan(&oid); err != nil {
+			return nil, err
+		}
+		oids[oid] = true
+	}
+	return oids, rows.Err()
+}
+
+// findGeometryColumn returns the index of the column named name when given.
+// Otherwise it returns the first geometry/geography column, falling back to a
+// column called geometryColumnName. It returns -1 when there is no match.
+func findGeometryColumn(fields []pgproto3.FieldDescription, oids map[uint32]bool, name string) int {
+	if name != "" {
+		for i, f := range fields {
+			if string(f.Name) == name {
+				return i
+			}
+		}
+		return -1
+	}
+	for i, f := range fields {
+		if oids[f.DataTypeOID] {
+			return i
+		}
+	}
+	for i, f := range fields {
+		if string(f.Name) == geometryColumnName {
+			return i
+		}
+	}
+	return -1
+}
+
+// trimQuery strips trailing whitespace and semicolons so the query can be
+// used as a subquery.
+func trimQuery(query string) string {
+	return strings.TrimRight(query, "; \t\r\n")
+}
+
+func (g *geoJSONWriter) contentType() string { return "application/geo+json" }
+
+func (g *geoJSONWriter) writeHeader(w io.Writer, columns []column) error {
+	for i, c := range columns[:len(columns)-geoJSONExtraColumns] {
+		if i != g.geomIndex {
+			g.properties = append(g.properties, c.Name)
+		}
+	}
+	_, err := w.Write([]byte(`{"type":"FeatureCollection","features":[`))
+	return err
+}
+
+func (g *geoJSONWriter) writeRow(w io.Writer, values []interface{}) error {
+	extra := values[len(values)-geoJSONExtraColumns:]
+	values = values[:len(values)-geoJSONExtraColumns]
+	if srid, ok := extra[6].(int32); ok && srid == 0 && g.targetSRID != 0 {
+		return fmt.Errorf("feature %d has a geometry of unknown SRID 0, which can't be transformed to SRID %d; set its SRID with ST_SetSRID, or pass srid=0 to leave geometries untransformed", g.featureCount+1, g.targetSRID)
+	}
+	geometry := []byte("null")
+	if s, ok := extra[0].(string); ok {
+		geometry = []byte(s)
+		if err := g.extend(extra[1:6]); err != nil {
+			return err
+		}
+	}
+
+	props := make([]interface{}, 0, len(g.properties))
+	for i, v := range values {
+		if i != g.geomIndex {
+			props = append(props, v)
+		}
+	}
+	properties, err := marshalObject(g.properties, props)
+	if err != nil {
+		return err
+	}
+
+	feature, err := json.Marshal(struct {
+		Type       string          `json:"type"`
+		Geometry   json.RawMessage `json:"geometry"`
+		Properties json.RawMessage `json:"properties"`
+	}{"Feature", geometry, properties})
+	if err != nil {
+		return err
+	}
+	if g.featureCount > 0 {
+		feature = append([]byte(","), feature...)
+	}
+	if _, err := w.Write(feature); err != nil {
+		return err
+	}
+	g.featureCount++
+	return nil
+}
+
+// extend adds a feature's SRID and bounds to the collection's. Empty
+// geometries have no bounds.
+func (g *geoJSONWriter) extend(values []interface{}) error {
+	srid, _ := values[0].(int32)
+	if !g.sridSeen {
+		g.srid, g.sridSeen = srid, true
+	} else if srid != g.srid {
+		return fmt.Errorf("features have different SRIDs %d and %d; use ST_Transform to convert them to one", g.srid, srid)
+	}
+
+	var bounds [4]float64
+	for i, v := range values[1:] {
+		f, ok := v.(float64)
+		if !ok {
+			return nil
+		}
+		bounds[i] = f
+	}
+	if g.bbox == nil {
+		g.bbox = bounds[:]
+		return nil
+	}
+	g.bbox[0] = min(g.bbox[0], bounds[0])
+	g.bbox[1] = min(g.bbox[1], bounds[1])
+	g.bbox[2] = max(g.bbox[2], bounds[2])
+	g.bbox[3] = max(g.bbox[3], bounds[3])
+	return nil
+}
+
+// crsName returns the name of the coordinate reference system of an SRID,
+// assuming the SRIDs of PostGIS' spatial_ref_sys, which are EPSG codes.
+// WGS 84 gets the OGC CRS84 name used by RFC 7946, whose axis order is
+// longitude first, as ST_AsGeoJSON writes it.
+func crsName(srid int32) string {
+	if srid == 4326 {
+		return "urn:ogc:def:crs:OGC:1.3:CRS84"
+	}
+	return fmt.Sprintf("urn:ogc:def:crs:EPSG::%d", srid)
+}
+
+func (g *geoJSONWriter) writeFooter(w io.Writer, summary resultSummary) error {
+	if _, err := w.Write([]byte("]")); err != nil {
+		return err
+	}
+	if g.bbox != nil {
+		bbox, err := json.Marshal(g.bbox)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, `,"bbox":%s`, bbox); err != nil {
+			return err
+		}
+	}
+	if g.srid != 0 {
+		if _, err := fmt.Fprintf(w, `,"crs":{"type":"name","properties":{"name":%q}}`, crsName(g.srid)); err != nil {
+			return err
+		}
+	}
+	if err := writeSummaryFields(w, summary); err != nil {
+		return err
+	}
+	_, err := w.Write([]byte("}\n"))
+	return err
+}
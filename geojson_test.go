@@ -0,0 +1,32 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequestSRID(t *testing.T) {
+	tests := []struct {
+		query string
+		want  int32
+		ok    bool
+	}{
+		{"", geoJSONSRID, true},
+		{"srid=3857", 3857, true},
+		{"srid=0", 0, true},
+		{"srid=-1", 0, false},
+		{"srid=abc", 0, false},
+		{"srid=99999999999", 0, false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/query?"+tt.query, nil)
+		got, err := requestSRID(r)
+		if (err == nil) != tt.ok {
+			t.Errorf("%q: error %v, want ok %v", tt.query, err, tt.ok)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%q: %d, want %d", tt.query, got, tt.want)
+		}
+	}
+}
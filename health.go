@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// readyTimeout bounds how long /ready waits for the database to answer.
+const readyTimeout = 2 * time.Second
+
+// healthHandler is the liveness probe: it only reports that the process is
+// serving requests, plus the circuit breaker state per database, and never
+// touches the database.
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	pools := currentPools()
+	states := make(map[string]string, len(pools))
+	for name, pool := range pools {
+		states[name] = breakerFor(pool).currentState().String()
+	}
+	writeStatus(w, http.StatusOK, map[string]interface{}{"status": "ok", "circuitBreakers": states})
+}
+
+// readyHandler is the readiness probe: it succeeds only when every pool can
+// reach its database. Replicas are reported too, but an unreachable one
+// doesn't fail the probe, as reads fall back to the primary.
+func readyHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), readyTimeout)
+	defer cancel()
+
+	status := http.StatusOK
+	pools := currentPools()
+	databases := make(map[string]string, len(pools))
+	for name, pool := range pools {
+		if err := pingPool(ctx, pool); err != nil {
+			if !strings.HasSuffix(name, replicaSuffix) {
+				status = http.StatusServiceUnavailable
+			}
+			databases[name] = err.Error()
+			continue
+		}
+		databases[name] = "ok"
+	}
+
+	body := map[string]interface{}{"status": "ok", "databases": databases}
+	if status != http.StatusOK {
+		body["status"] = "unavailable"
+	}
+	writeStatus(w, status, body)
+}
+
+// pingPool pings the database through the pool's circuit breaker.
+func pingPool(ctx context.Context, pool *pgxpool.Pool) error {
+	conn, err := acquireConn(ctx, pool)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+	return conn.Ping(ctx)
+}
+
+func writeStatus(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
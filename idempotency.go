@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// idempotencyTTL is how long the response to a request with an
+// Idempotency-Key header is kept for replay, set through IDEMPOTENCY_TTL.
+// Zero disables idempotency keys.
+var idempotencyTTL = 24 * time.Hour
+
+// idempotencySweepInterval is how often expired responses are dropped.
+const idempotencySweepInterval = time.Minute
+
+// idempotentResponse is a recorded response, or one still being produced
+// while running is set.
+type idempotentResponse struct {
+	running bool
+	status  int
+	header  http.Header
+	body    []byte
+	stored  bool
+	expires time.Time
+}
+
+// idempotentResponses holds the recorded responses by client and key. They
+// are kept in memory, so retries must reach the same instance.
+var idempotentResponses = struct {
+	sync.Mutex
+	entries map[string]*idempotentResponse
+}{entries: make(map[string]*idempotentResponse)}
+
+// idempotent makes POST requests carrying an Idempotency-Key header safe to
+// retry: the first request with a key runs next and its response is
+// recorded, and repeats of it within idempotencyTTL get the recorded
+// response, marked Idempotent-Replayed: true, without running again. A
+// repeat arriving while the first is still running gets 409. Keys are
+// scoped per client and path. Server errors and panics aren't recorded, so
+// a request that failed that way runs again; neither are responses bigger than
+// maxCachedBytes, whose repeats get 409 instead.
+func idempotent(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if idempotencyTTL <= 0 || key == "" || r.Method != http.MethodPost {
+			next(w, r)
+			return
+		}
+		if len(key) > 255 {
+			writeJSONError(w, http.StatusBadRequest, "Idempotency-Key is too long")
+			return
+		}
+		scoped := clientKey(r) + "\x00" + r.URL.Path + "\x00" + key
+
+		now := time.Now()
+		idempotentResponses.Lock()
+		entry, ok := idempotentResponses.entries[scoped]
+		if ok && !entry.running && now.After(entry.expires) {
+			ok = false
+		}
+		if ok {
+			running := entry.running
+			idempotentResponses.Unlock()
+			replayResponse(w, entry, running)
+			return
+		}
+		entry = &idempotentResponse{running: true}
+		idempotentResponses.entries[scoped] = entry
+		idempotentResponses.Unlock()
+
+		rec := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		completed := false
+		defer func() {
+			idempotentResponses.Lock()
+			defer idempotentResponses.Unlock()
+			// A handler that panicked didn't finish its response, whatever
+			// rec holds, so it isn't recorded either.
+			if !completed || rec.status >= 500 {
+				delete(idempotentResponses.entries, scoped)
+			} else {
+				entry.status, entry.header = rec.status, rec.header
+				entry.body, entry.stored = rec.body.Bytes(), !rec.overflow
+				entry.expires = time.Now().Add(idempotencyTTL)
+			}
+			entry.running = false
+		}()
+		next(rec, r)
+		completed = true
+	}
+}
+
+// sweepIdempotentResponses drops expired responses every
+// idempotencySweepInterval until ctx is done. Keys are up to the client, so
+// the map would otherwise keep growing; sweeping in the background keeps
+// the scan out of the requests.
+func sweepIdempotentResponses(ctx context.Context) {
+	ticker := time.NewTicker(idempotencySweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			dropExpiredResponses(now)
+		}
+	}
+}
+
+// dropExpiredResponses removes the finished responses expired at now.
+func dropExpiredResponses(now time.Time) {
+	idempotentResponses.Lock()
+	defer idempotentResponses.Unlock()
+	for k, e := range idempotentResponses.entries {
+		if !e.running && now.After(e.expires) {
+			delete(idempotentResponses.entries, k)
+		}
+	}
+}
+
+// replayResponse writes a recorded response, or 409 when there is none to
+// replay. A finished entry is no longer modified, so it is read unlocked.
+func replayResponse(w http.ResponseWriter, entry *idempotentResponse, running bool) {
+	switch {
+	case running:
+		writeJSONError(w, http.StatusConflict, "A request with this Idempotency-Key is still in progress")
+		return
+	case !entry.stored:
+		writeJSONError(w, http.StatusConflict, "The response to this Idempotency-Key is too large to replay")
+		return
+	}
+	for name, values := range entry.header {
+		w.Header()[name] = values
+	}
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.WriteHeader(entry.status)
+	w.Write(entry.body)
+}
+
+// responseRecorder passes a response through while recording a copy of its
+// status, headers and up to maxCachedBytes of its body.
+type responseRecorder struct {
+	http.ResponseWriter
+	status   int
+	header   http.Header
+	body     bytes.Buffer
+	overflow bool
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	if rec.header == nil {
+		rec.status = status
+		rec.captureHeader()
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *responseRecorder) Write(p []byte) (int, error) {
+	if rec.header == nil {
+		rec.captureHeader()
+	}
+	if !rec.overflow {
+		if rec.body.Len()+len(p) > maxCachedBytes {
+			rec.overflow = true
+			rec.body.Reset()
+		} else {
+			rec.body.Write(p)
+		}
+	}
+	return rec.ResponseWriter.Write(p)
+}
+
+// captureHeader copies the headers about to be sent, except those that
+// identify this particular request.
+func (rec *responseRecorder) captureHeader() {
+	rec.header = rec.ResponseWriter.Header().Clone()
+	rec.header.Del("X-Request-ID")
+	rec.header.Del("X-Query-ID")
+}
+
+func (rec *responseRecorder) Flush() {
+	if f, ok := rec.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (rec *responseRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// resetIdempotency empties the recorded responses for the test.
+func resetIdempotency(t *testing.T) {
+	idempotentResponses.Lock()
+	idempotentResponses.entries = make(map[string]*idempotentResponse)
+	idempotentResponses.Unlock()
+	t.Cleanup(func() {
+		idempotentResponses.Lock()
+		idempotentResponses.entries = make(map[string]*idempotentResponse)
+		idempotentResponses.Unlock()
+	})
+}
+
+func TestIdempotent(t *testing.T) {
+	resetIdempotency(t)
+	runs := 0
+	handler := idempotent(func(w http.ResponseWriter, r *http.Request) {
+		runs++
+		status := http.StatusCreated
+		if r.URL.Path == "/fail" {
+			status = http.StatusServiceUnavailable
+		}
+		w.WriteHeader(status)
+		w.Write([]byte("run"))
+	})
+	request := func(path, key string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, path, strings.NewReader("{}"))
+		r.RemoteAddr = "192.0.2.1:1234"
+		if key != "" {
+			r.Header.Set("Idempotency-Key", key)
+		}
+		w := httptest.NewRecorder()
+		handler(w, r)
+		return w
+	}
+
+	tests := []struct {
+		name     string
+		path     string
+		key      string
+		wantRuns int
+		replayed bool
+	}{
+		{"first request", "/query", "a", 1, false},
+		{"repeat", "/query", "a", 1, true},
+		{"other key", "/query", "b", 2, false},
+		{"other path", "/transaction", "a", 3, false},
+		{"no key", "/query", "", 4, false},
+		{"server error", "/fail", "a", 5, false},
+		{"repeat of a server error", "/fail", "a", 6, false},
+	}
+	for _, tt := range tests {
+		w := request(tt.path, tt.key)
+		if runs != tt.wantRuns {
+			t.Errorf("%s: %d runs, want %d", tt.name, runs, tt.wantRuns)
+		}
+		if replayed := w.Header().Get("Idempotent-Replayed") == "true"; replayed != tt.replayed {
+			t.Errorf("%s: replayed %v, want %v", tt.name, replayed, tt.replayed)
+		}
+		if tt.replayed && (w.Code != http.StatusCreated || w.Body.String() != "run") {
+			t.Errorf("%s: replayed %d %q", tt.name, w.Code, w.Body)
+		}
+	}
+}
+
+func TestDropExpiredResponses(t *testing.T) {
+	resetIdempotency(t)
+	now := time.Now()
+	idempotentResponses.entries["expired"] = &idempotentResponse{expires: now.Add(-time.Second)}
+	idempotentResponses.entries["fresh"] = &idempotentResponse{expires: now.Add(time.Hour)}
+	idempotentResponses.entries["running"] = &idempotentResponse{running: true}
+
+	dropExpiredResponses(now)
+	for key, want := range map[string]bool{"expired": false, "fresh": true, "running": true} {
+		if _, ok := idempotentResponses.entries[key]; ok != want {
+			t.Errorf("%s kept %v, want %v", key, ok, want)
+		}
+	}
+}
+
+func TestIdempotentPanic(t *testing.T) {
+	resetIdempotency(t)
+	runs := 0
+	handler := recoverPanics(idempotent(func(w http.ResponseWriter, r *http.Request) {
+		runs++
+		if runs == 1 {
+			panic("boom")
+		}
+		w.Write([]byte("run"))
+	}))
+	for i, want := range []int{http.StatusInternalServerError, http.StatusOK, http.StatusOK} {
+		r := httptest.NewRequest(http.MethodPost, "/query", strings.NewReader("{}"))
+		r.RemoteAddr = "192.0.2.1:1234"
+		r.Header.Set("Idempotency-Key", "a")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != want {
+			t.Errorf("request %d: status %d, want %d", i+1, w.Code, want)
+		}
+	}
+	if runs != 2 {
+		t.Errorf("%d runs, want 2", runs)
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// jsonWriter emits a single JSON document:
+// {"columns":[...],"columnTypes":[...],"rows":[[...],[...],...]}
+//
+// With objects set each row is instead an object keyed by column name:
+// {"columns":[...],"columnTypes":[...],"rows":[{"id":1,...},...]}
+type jsonWriter struct {
+	objects  bool
+	keys     []string
+	rowCount int
+}
+
+func (j *jsonWriter) contentType() string { return "application/json" }
+
+func (j *jsonWriter) writeHeader(w io.Writer, columns []column) error {
+	names, err := json.Marshal(columnNames(columns))
+	if err != nil {
+		return err
+	}
+	types, err := json.Marshal(columnTypeNames(columns))
+	if err != nil {
+		return err
+	}
+	if j.objects {
+		j.keys = uniqueKeys(columnNames(columns))
+	}
+	_, err = fmt.Fprintf(w, `{"columns":%s,"columnTypes":%s,"rows":[`, names, types)
+	return err
+}
+
+func (j *jsonWriter) writeRow(w io.Writer, values []interface{}) error {
+	var row []byte
+	var err error
+	if j.objects {
+		row, err = marshalObject(j.keys, values)
+	} else {
+		row, err = json.Marshal(values)
+	}
+	if err != nil {
+		return err
+	}
+	// The separator goes out with the row, so a row that is left out
+	// doesn't leave a dangling comma.
+	if j.rowCount > 0 {
+		row = append([]byte(","), row...)
+	}
+	if _, err := w.Write(row); err != nil {
+		return err
+	}
+	j.rowCount++
+	return nil
+}
+
+func (j *jsonWriter) writeFooter(w io.Writer, summary resultSummary) error {
+	if _, err := w.Write([]byte("]")); err != nil {
+		return err
+	}
+	if err := writeSummaryFields(w, summary); err != nil {
+		return err
+	}
+	_, err := w.Write([]byte("}\n"))
+	return err
+}
+
+// writeSummaryFields appends the "cursor", "truncated", "total",
+// "limitApplied" and "error" members describing how streaming ended to an
+// open JSON object.
+func writeSummaryFields(w io.Writer, summary resultSummary) error {
+	if summary.cursor != "" {
+		if _, err := fmt.Fprintf(w, `,"cursor":%q`, summary.cursor); err != nil {
+			return err
+		}
+	}
+	if summary.truncated {
+		if _, err := w.Write([]byte(`,"truncated":true`)); err != nil {
+			return err
+		}
+	}
+	if summary.total != nil {
+		if _, err := fmt.Fprintf(w, `,"total":%d`, *summary.total); err != nil {
+			return err
+		}
+	}
+	if summary.limitApplied > 0 {
+		if _, err := fmt.Fprintf(w, `,"limitApplied":%d`, summary.limitApplied); err != nil {
+			return err
+		}
+	}
+	if summary.notices != nil {
+		notices, err := json.Marshal(summary.notices)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, `,"notices":%s`, notices); err != nil {
+			return err
+		}
+	}
+	return writeErrorField(w, summary.err)
+}
+
+// writeErrorField appends an "error" member to an open JSON object when err is
+// set.
+func writeErrorField(w io.Writer, err error) error {
+	if err == nil {
+		return nil
+	}
+	msg, merr := json.Marshal(err.Error())
+	if merr != nil {
+		return merr
+	}
+	_, werr := fmt.Fprintf(w, `,"error":%s`, msg)
+	return werr
+}
+
+// marshalObject encodes keys and values as a JSON object, preserving the
+// order of the keys.
+func marshalObject(keys []string, values []interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, key := range keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		k, err := json.Marshal(key)
+		if err != nil {
+			return nil, err
+		}
+		v, err := json.Marshal(values[i])
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(k)
+		buf.WriteByte(':')
+		buf.Write(v)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// uniqueKeys makes column names usable as object keys. Repeated names, as
+// produced by e.g. a join selecting two id columns, get a _2, _3, ... suffix.
+func uniqueKeys(names []string) []string {
+	seen := make(map[string]bool, len(names))
+	for _, name := range names {
+		seen[name] = true
+	}
+	keys := make([]string, len(names))
+	used := make(map[string]bool, len(names))
+	for i, name := range names {
+		key := name
+		// Skip suffixed names that another column already has.
+		for n := 2; used[key] || (key != name && seen[key]); n++ {
+			key = fmt.Sprintf("%s_%d", name, n)
+		}
+		used[key] = true
+		keys[i] = key
+	}
+	return keys
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestJSONWriterFormats(t *testing.T) {
+	columns := []column{{Name: "id", Type: "int4"}, {Name: "id", Type: "int4"}, {Name: "name", Type: "text"}}
+	values := [][]interface{}{{int32(1), int32(2), "a"}, {int32(3), int32(4), nil}}
+	header := `{"columns":["id","id","name"],"columnTypes":["int4","int4","text"],"rows":[`
+	tests := []struct {
+		name string
+		out  *jsonWriter
+		want string
+	}{
+		{"arrays", &jsonWriter{}, header + `[1,2,"a"],[3,4,null]]}` + "\n"},
+		{"objects", &jsonWriter{objects: true}, header + `{"id":1,"id_2":2,"name":"a"},{"id":3,"id_2":4,"name":null}]}` + "\n"},
+	}
+	for _, tt := range tests {
+		if got := string(streamValues(t, tt.out, columns, values)); got != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestUniqueKeys(t *testing.T) {
+	tests := []struct {
+		names []string
+		want  []string
+	}{
+		{[]string{"id", "name"}, []string{"id", "name"}},
+		{[]string{"id", "id", "id"}, []string{"id", "id_2", "id_3"}},
+		{[]string{"id", "id", "id_2"}, []string{"id", "id_3", "id_2"}},
+		{[]string{"", ""}, []string{"", "_2"}},
+	}
+	for _, tt := range tests {
+		if got := uniqueKeys(tt.names); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("uniqueKeys(%q) = %q, want %q", tt.names, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/MicahParks/keyfunc/v3"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// JWT authentication is enabled by setting one of JWT_SECRET (an HMAC key),
+// JWT_PUBLIC_KEY (a PEM encoded RSA, ECDSA or Ed25519 public key) or
+// JWT_JWKS_URL (a JSON Web Key Set, refreshed in the background). Tokens must
+// carry an expiry, and must match JWT_ISSUER and JWT_AUDIENCE when set.
+var (
+	jwtKeyfunc jwt.Keyfunc
+	jwtOptions []jwt.ParserOption
+)
+
+// jwtTenantClaim, set through JWT_TENANT_CLAIM, names the claim holding the
+// tenant of a token, see tenantSetting. Tokens without the claim are
+// rejected.
+var jwtTenantClaim string
+
+// setupJWT configures JWT verification from the environment. ctx ends the
+// background refresh of a JWKS.
+func setupJWT(ctx context.Context) error {
+	secret := os.Getenv("JWT_SECRET")
+	publicKey := os.Getenv("JWT_PUBLIC_KEY")
+	jwksURL := os.Getenv("JWT_JWKS_URL")
+
+	set := 0
+	for _, v := range []string{secret, publicKey, jwksURL} {
+		if v != "" {
+			set++
+		}
+	}
+	switch {
+	case set == 0:
+		return nil
+	case set > 1:
+		return errors.New("set only one of JWT_SECRET, JWT_PUBLIC_KEY and JWT_JWKS_URL")
+	}
+
+	var methods []string
+	switch {
+	case secret != "":
+		key := []byte(secret)
+		jwtKeyfunc = func(*jwt.Token) (interface{}, error) { return key, nil }
+		methods = []string{"HS256", "HS384", "HS512"}
+	case publicKey != "":
+		key, keyMethods, err := parsePublicKey(publicKey)
+		if err != nil {
+			return fmt.Errorf("invalid JWT_PUBLIC_KEY: %v", err)
+		}
+		jwtKeyfunc = func(*jwt.Token) (interface{}, error) { return key, nil }
+		methods = keyMethods
+	default:
+		k, err := keyfunc.NewDefaultCtx(ctx, []string{jwksURL})
+		if err != nil {
+			return fmt.Errorf("invalid JWT_JWKS_URL: %v", err)
+		}
+		jwtKeyfunc = k.Keyfunc
+		methods = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512", "EdDSA"}
+	}
+
+	jwtOptions = []jwt.ParserOption{
+		jwt.WithValidMethods(methods),
+		jwt.WithExpirationRequired(),
+		jwt.WithJSONNumber(),
+	}
+	if issuer := os.Getenv("JWT_ISSUER"); issuer != "" {
+		jwtOptions = append(jwtOptions, jwt.WithIssuer(issuer))
+	}
+	if audience := os.Getenv("JWT_AUDIENCE"); audience != "" {
+		jwtOptions = append(jwtOptions, jwt.WithAudience(audience))
+	}
+
+	jwtTenantClaim = os.Getenv("JWT_TENANT_CLAIM")
+	return nil
+}
+
+// parsePublicKey parses a PEM encoded public key and returns the signing
+// methods it can verify.
+func parsePublicKey(data string) (interface{}, []string, error) {
+	block, _ := pem.Decode([]byte(data))
+	if block == nil {
+		return nil, nil, errors.New("no PEM data found")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch key.(type) {
+	case *rsa.PublicKey:
+		return key, []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512"}, nil
+	case *ecdsa.PublicKey:
+		return key, []string{"ES256", "ES384", "ES512"}, nil
+	case ed25519.PublicKey:
+		return key, []string{"EdDSA"}, nil
+	}
+	return nil, nil, fmt.Errorf("unsupported key type %T", key)
+}
+
+// parseJWT verifies a token and returns its claims.
+func parseJWT(token string) (jwt.MapClaims, error) {
+	claims := jwt.MapClaims{}
+	if _, err := jwt.ParseWithClaims(token, claims, jwtKeyfunc, jwtOptions...); err != nil {
+		return nil, err
+	}
+	if jwtTenantClaim != "" {
+		if _, ok := claims[jwtTenantClaim]; !ok {
+			return nil, fmt.Errorf("token has no %s claim", jwtTenantClaim)
+		}
+	}
+	return claims, nil
+}
+
+type claimsKey struct{}
+
+// withClaims returns a copy of ctx carrying the claims of the request's token.
+func withClaims(ctx context.Context, claims jwt.MapClaims) context.Context {
+	return context.WithValue(ctx, claimsKey{}, claims)
+}
+
+// claimsFrom returns the claims of the request's token, or nil when the
+// request wasn't authenticated with a JWT.
+func claimsFrom(ctx context.Context) jwt.MapClaims {
+	claims, _ := ctx.Value(claimsKey{}).(jwt.MapClaims)
+	return claims
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestJWTAuthentication(t *testing.T) {
+	t.Setenv("JWT_SECRET", "secret")
+	t.Setenv("JWT_TENANT_CLAIM", "tenant")
+	defer func() { jwtKeyfunc, jwtOptions, jwtTenantClaim = nil, nil, "" }()
+	if err := setupJWT(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	sign := func(claims jwt.MapClaims, key string) string {
+		token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	exp := time.Now().Add(time.Hour).Unix()
+	valid := sign(jwt.MapClaims{"tenant": "acme", "exp": exp}, "secret")
+
+	var tenant []sessionSetting
+	handler := authenticate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tenant = tenantSettings(r.Context())
+	}))
+
+	tests := []struct {
+		name  string
+		token string
+		want  int
+	}{
+		{"valid", valid, http.StatusOK},
+		{"expired", sign(jwt.MapClaims{"tenant": "acme", "exp": time.Now().Add(-time.Hour).Unix()}, "secret"), http.StatusUnauthorized},
+		{"no expiry", sign(jwt.MapClaims{"tenant": "acme"}, "secret"), http.StatusUnauthorized},
+		{"other key", sign(jwt.MapClaims{"tenant": "acme", "exp": exp}, "other"), http.StatusUnauthorized},
+		{"tampered", valid[:len(valid)-2] + "xx", http.StatusUnauthorized},
+		{"no tenant claim", sign(jwt.MapClaims{"exp": exp}, "secret"), http.StatusUnauthorized},
+		{"not a token", "abc", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		tenant = nil
+		r := httptest.NewRequest(http.MethodGet, "/query", nil)
+		r.Header.Set("Authorization", "Bearer "+tt.token)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != tt.want {
+			t.Errorf("%s: status %d, want %d", tt.name, w.Code, tt.want)
+		}
+		if w.Code == http.StatusOK {
+			if len(tenant) != 1 || tenant[0] != (sessionSetting{name: "app.tenant_id", value: "acme"}) {
+				t.Errorf("%s: settings %v, want app.tenant_id=acme", tt.name, tenant)
+			}
+		} else if w.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("%s: no WWW-Authenticate header", tt.name)
+		}
+	}
+}
+
+func TestSetupJWTErrors(t *testing.T) {
+	defer func() { jwtKeyfunc, jwtOptions, jwtTenantClaim = nil, nil, "" }()
+	tests := []struct {
+		name string
+		env  map[string]string
+	}{
+		{"two keys", map[string]string{"JWT_SECRET": "secret", "JWT_PUBLIC_KEY": "key"}},
+		{"invalid public key", map[string]string{"JWT_PUBLIC_KEY": "key"}},
+	}
+	for _, tt := range tests {
+		for _, name := range []string{"JWT_SECRET", "JWT_PUBLIC_KEY", "JWT_JWKS_URL"} {
+			t.Setenv(name, tt.env[name])
+		}
+		if err := setupJWT(context.Background()); err == nil {
+			t.Errorf("%s: expected an error", tt.name)
+		}
+	}
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// Per-request resource limits: a request may set statement_timeout_ms and
+// work_mem for its own queries, capped at maxStatementTimeout, set through
+// MAX_STATEMENT_TIMEOUT, and maxWorkMemKB, set through MAX_WORK_MEM in kB or
+// with a unit such as 64MB. Zero leaves the requested value uncapped.
+var (
+	maxStatementTimeout time.Duration
+	maxWorkMemKB        int64
+)
+
+// defaultSearchPath is the search_path of requests that don't set one, set
+// through SEARCH_PATH. Empty leaves the connection's search_path alone.
+var defaultSearchPath []string
+
+// SessionOptions are the settings a request may ask for its own queries.
+// search_path is a comma-separated list of schema names, taken literally
+// rather than folded to lower case, and limited to schemaAllowlist when
+// that is set.
+type SessionOptions struct {
+	StatementTimeoutMS int64  `json:"statement_timeout_ms,omitempty"`
+	WorkMem            string `json:"work_mem,omitempty"`
+	SearchPath         string `json:"search_path,omitempty"`
+}
+
+// maxQueryLen is the longest SQL text accepted, in characters, set through
+// MAX_QUERY_LEN. Anything longer is most likely generated junk or abuse.
+// Zero disables the check.
+var maxQueryLen = 1000000
+
+// checkQueryLength rejects SQL longer than maxQueryLen.
+func checkQueryLength(sql string) error {
+	if maxQueryLen <= 0 || len(sql) <= maxQueryLen {
+		return nil
+	}
+	if n := utf8.RuneCountInString(sql); n > maxQueryLen {
+		return fmt.Errorf("Query of %d characters exceeds the limit of %d", n, maxQueryLen)
+	}
+	return nil
+}
+
+// autoLimit is appended as a LIMIT to read-only queries without one of their
+// own, set through AUTO_LIMIT, guarding against an accidental SELECT * of a
+// huge table. Unlike maxRows, which stops streaming, it keeps Postgres from
+// producing the rest of the result at all. Zero disables it.
+var autoLimit int64
+
+// withAutoLimit returns sql with LIMIT autoLimit appended when it is a single
+// SELECT, WITH, VALUES or TABLE query without a LIMIT, FETCH or locking
+// clause of its outer query, along with the limit applied; otherwise it
+// returns sql and 0. Only the outer query counts: a LIMIT inside a CTE or a
+// subquery doesn't bound the result.
+func withAutoLimit(sql string) (string, int64) {
+	if autoLimit <= 0 {
+		return sql, 0
+	}
+	query, err := singleQuery(sql, "LIMIT")
+	if err != nil {
+		return sql, 0
+	}
+	tokens, err := tokenize(query)
+	if err != nil {
+		return sql, 0
+	}
+	depth := 0
+	for _, t := range tokens {
+		switch {
+		case t.kind == tokenPunct && t.text == "(":
+			depth++
+		case t.kind == tokenPunct && t.text == ")":
+			depth--
+		case depth == 0 && (t.is("LIMIT") || t.is("FETCH") || t.is("FOR")):
+			// A locking clause has to come after the LIMIT, so leave the
+			// query alone rather than rearrange it.
+			return sql, 0
+		}
+	}
+	return fmt.Sprintf("%s LIMIT %d", query, autoLimit), autoLimit
+}
+
+// maxColumns is the most columns a result may have, set through
+// MAX_COLUMNS, so a query generating thousands of them is rejected before
+// any row is built. Zero disables the check.
+var maxColumns int
+
+// checkColumns rejects a result with more than maxColumns columns.
+func checkColumns(n int) error {
+	if maxColumns > 0 && n > maxColumns {
+		return fmt.Errorf("Result of %d columns exceeds the limit of %d", n, maxColumns)
+	}
+	return nil
+}
+
+// maxResponseBytes caps the size of a query result, set through
+// MAX_RESPONSE_BYTES and counted before compression. A result that would
+// grow past it ends after the last row that fits, marked as truncated the
+// same way as a result cut off by the row limit. Zero disables the cap.
+var maxResponseBytes int64
+
+var errResponseTooLarge = errors.New("response size limit exceeded")
+
+// limitedWriter fails any write that would take the total written past
+// limit, so a row is either written whole or not at all by result writers
+// that write each row at once.
+type limitedWriter struct {
+	w     io.Writer
+	n     int64
+	limit int64
+}
+
+func (l *limitedWriter) Write(p []byte) (int, error) {
+	if l.limit > 0 && l.n+int64(len(p)) > l.limit {
+		return 0, errResponseTooLarge
+	}
+	n, err := l.w.Write(p)
+	l.n += int64(n)
+	return n, err
+}
+
+// sessionSetting is a server setting applied to a single transaction, or
+// with statement set, a SET LOCAL statement run as is, see preQuerySettings.
+type sessionSetting struct {
+	name, value string
+	statement   string
+}
+
+// sessionSettings returns the settings a request asked for, clamped to the
+// server maximums, along with those scoping it to its tenant, after the
+// preQuerySettings.
+func sessionSettings(ctx context.Context, opts SessionOptions) ([]sessionSetting, error) {
+	settings := append(append([]sessionSetting{}, preQuerySettings...), tenantSettings(ctx)...)
+	if opts.StatementTimeoutMS < 0 {
+		return nil, fmt.Errorf("Invalid statement_timeout_ms %d", opts.StatementTimeoutMS)
+	}
+	if opts.StatementTimeoutMS > 0 {
+		timeout := time.Duration(opts.StatementTimeoutMS) * time.Millisecond
+		if maxStatementTimeout > 0 && timeout > maxStatementTimeout {
+			timeout = maxStatementTimeout
+		}
+		settings = append(settings, sessionSetting{name: "statement_timeout", value: strconv.FormatInt(timeout.Milliseconds(), 10)})
+	}
+	if opts.WorkMem != "" {
+		kb, err := parseMemory(opts.WorkMem)
+		if err != nil || kb <= 0 {
+			return nil, fmt.Errorf("Invalid work_mem %q", opts.WorkMem)
+		}
+		if maxWorkMemKB > 0 && kb > maxWorkMemKB {
+			kb = maxWorkMemKB
+		}
+		settings = append(settings, sessionSetting{name: "work_mem", value: strconv.FormatInt(kb, 10) + "kB"})
+	}
+	schemas := defaultSearchPath
+	if opts.SearchPath != "" {
+		var err error
+		if schemas, err = parseSearchPath(opts.SearchPath); err != nil {
+			return nil, err
+		}
+		for _, schema := range schemas {
+			if len(schemaAllowlist) > 0 && !slices.Contains(schemaAllowlist, schema) {
+				return nil, fmt.Errorf("Schema %q is not allowed", schema)
+			}
+		}
+	}
+	if len(schemas) > 0 {
+		settings = append(settings, sessionSetting{name: "search_path", value: formatSearchPath(schemas)})
+	}
+	if name := requestApplicationName(ctx); name != "" {
+		settings = append(settings, sessionSetting{name: "application_name", value: name})
+	}
+	return settings, nil
+}
+
+// requestApplicationName returns the application_name identifying the
+// request, or "" unless applicationNameDetail asks for one.
+func requestApplicationName(ctx context.Context) string {
+	info := requestInfoFrom(ctx)
+	var detail string
+	switch applicationNameDetail {
+	case "request_id":
+		detail = info.id
+	case "principal":
+		detail = info.principal
+	}
+	if detail == "" {
+		return ""
+	}
+	return applicationName + "/" + detail
+}
+
+// parseSearchPath splits a comma-separated list of schema names.
+func parseSearchPath(value string) ([]string, error) {
+	var schemas []string
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			return nil, fmt.Errorf("Invalid search_path %q", value)
+		}
+		schemas = append(schemas, name)
+	}
+	return schemas, nil
+}
+
+// formatSearchPath quotes schema names as a search_path value, so a name
+// can't smuggle in other schemas or syntax.
+func formatSearchPath(schemas []string) string {
+	quoted := make([]string, len(schemas))
+	for i, schema := range schemas {
+		quoted[i] = pgx.Identifier{schema}.Sanitize()
+	}
+	return strings.Join(quoted, ", ")
+}
+
+// applySettings sets settings for the rest of the transaction q runs in.
+// set_config with is_local set is SET LOCAL taking its value as a parameter.
+func applySettings(ctx context.Context, q querier, settings []sessionSetting) error {
+	for _, s := range settings {
+		if s.statement != "" {
+			if _, err := q.Exec(ctx, s.statement); err != nil {
+				return err
+			}
+			continue
+		}
+		if _, err := q.Exec(ctx, "SELECT set_config($1, $2, true)", s.name, s.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// memoryUnits are the units Postgres accepts for memory settings, in kB.
+var memoryUnits = []struct {
+	suffix string
+	kb     int64
+}{
+	{"kB", 1},
+	{"MB", 1 << 10},
+	{"GB", 1 << 20},
+	{"TB", 1 << 30},
+}
+
+// parseMemory parses a memory size the way Postgres does for work_mem: a
+// number of kB, or a number followed by kB, MB, GB or TB.
+func parseMemory(value string) (int64, error) {
+	value = strings.TrimSpace(value)
+	unit := int64(1)
+	for _, u := range memoryUnits {
+		if strings.HasSuffix(value, u.suffix) {
+			value, unit = strings.TrimSpace(strings.TrimSuffix(value, u.suffix)), u.kb
+			break
+		}
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if n > (1<<62)/unit {
+		return 0, fmt.Errorf("memory size %q out of range", value)
+	}
+	return n * unit, nil
+}
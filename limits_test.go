@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestParseMemory(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    int64
+		wantErr bool
+	}{
+		{value: "1024", want: 1024},
+		{value: "64kB", want: 64},
+		{value: " 64 MB ", want: 64 << 10},
+		{value: "2GB", want: 2 << 20},
+		{value: "1TB", want: 1 << 30},
+		{value: "-1", want: -1},
+		{value: "", wantErr: true},
+		{value: "64mb", wantErr: true},
+		{value: "1.5GB", wantErr: true},
+		{value: "9999999999999TB", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseMemory(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseMemory(%q) error = %v, want error %v", tt.value, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseMemory(%q) = %d, want %d", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestSessionSettingsLimits(t *testing.T) {
+	defer func(timeout time.Duration, workMem int64) {
+		maxStatementTimeout, maxWorkMemKB = timeout, workMem
+	}(maxStatementTimeout, maxWorkMemKB)
+	maxStatementTimeout, maxWorkMemKB = 30*time.Second, 256<<10
+
+	tests := []struct {
+		name    string
+		opts    SessionOptions
+		want    map[string]string
+		wantErr bool
+	}{
+		{name: "none", opts: SessionOptions{}, want: map[string]string{}},
+		{name: "within limits", opts: SessionOptions{StatementTimeoutMS: 5000, WorkMem: "64MB"},
+			want: map[string]string{"statement_timeout": "5000", "work_mem": "65536kB"}},
+		{name: "capped", opts: SessionOptions{StatementTimeoutMS: 3600000, WorkMem: "1TB"},
+			want: map[string]string{"statement_timeout": "30000", "work_mem": "262144kB"}},
+		{name: "negative timeout", opts: SessionOptions{StatementTimeoutMS: -1}, wantErr: true},
+		{name: "zero work_mem", opts: SessionOptions{WorkMem: "0"}, wantErr: true},
+		{name: "invalid work_mem", opts: SessionOptions{WorkMem: "lots"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		settings, err := sessionSettings(context.Background(), tt.opts)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: error = %v, want error %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if tt.wantErr {
+			continue
+		}
+		got := make(map[string]string)
+		for _, s := range settings {
+			got[s.name] = s.value
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: settings %v, want %v", tt.name, got, tt.want)
+		}
+		for name, value := range tt.want {
+			if got[name] != value {
+				t.Errorf("%s: %s = %q, want %q", tt.name, name, got[name], value)
+			}
+		}
+	}
+}
+func TestMaxResponseBytes(t *testing.T) {
+	defer func(max int64) { maxResponseBytes = max }(maxResponseBytes)
+	columns := []column{{Name: "v", Type: "text"}}
+	values := [][]interface{}{{"aaaaaaaaaa"}, {"bbbbbbbbbb"}, {"cccccccccc"}}
+
+	tests := []struct {
+		max       int64
+		rows      int
+		truncated bool
+	}{
+		{0, 3, false},
+		{1000, 3, false},
+		{85, 2, true},
+		{70, 1, true},
+		{55, 0, true},
+	}
+	for _, tt := range tests {
+		maxResponseBytes = tt.max
+		var buf bytes.Buffer
+		summary, err := streamResult(context.Background(), &buf, &fakeRows{values: values}, columns, &jsonWriter{}, streamOptions{})
+		if err != nil {
+			t.Errorf("max %d: %v", tt.max, err)
+			continue
+		}
+		var doc struct {
+			Rows      []interface{} `json:"rows"`
+			Truncated bool          `json:"truncated"`
+		}
+		if err := json.Unmarshal(buf.Bytes(), &doc); err != nil {
+			t.Errorf("max %d: invalid JSON %s: %v", tt.max, buf.Bytes(), err)
+			continue
+		}
+		if len(doc.Rows) != tt.rows || doc.Truncated != tt.truncated || summary.truncated != tt.truncated {
+			t.Errorf("max %d: %d rows, truncated %v, want %d rows, truncated %v", tt.max, len(doc.Rows), doc.Truncated, tt.rows, tt.truncated)
+		}
+	}
+}
+
+func TestSearchPath(t *testing.T) {
+	defer func(path, allowlist []string) {
+		defaultSearchPath, schemaAllowlist = path, allowlist
+	}(defaultSearchPath, schemaAllowlist)
+	defaultSearchPath, schemaAllowlist = []string{"public"}, []string{"public", "Sales"}
+
+	tests := []struct {
+		searchPath string
+		want       string
+		wantErr    bool
+	}{
+		{searchPath: "", want: `"public"`},
+		{searchPath: "Sales, public", want: `"Sales", "public"`},
+		{searchPath: "sales", wantErr: true},
+		{searchPath: "public,", wantErr: true},
+		{searchPath: `public", pg_temp`, wantErr: true},
+	}
+	for _, tt := range tests {
+		settings, err := sessionSettings(context.Background(), SessionOptions{SearchPath: tt.searchPath})
+		if (err != nil) != tt.wantErr {
+			t.Errorf("search_path %q: error = %v, want error %v", tt.searchPath, err, tt.wantErr)
+			continue
+		}
+		var got string
+		for _, s := range settings {
+			if s.name == "search_path" {
+				got = s.value
+			}
+		}
+		if got != tt.want {
+			t.Errorf("search_path %q: set to %q, want %q", tt.searchPath, got, tt.want)
+		}
+	}
+}
+
+func TestFormatSearchPath(t *testing.T) {
+	if got, want := formatSearchPath([]string{"public", `we"ird`, "a, b"}), `"public", "we""ird", "a, b"`; got != want {
+		t.Errorf("formatSearchPath = %q, want %q", got, want)
+	}
+}
+
+func TestCheckQueryLength(t *testing.T) {
+	defer func(max int) { maxQueryLen = max }(maxQueryLen)
+	maxQueryLen = 10
+	tests := []struct {
+		sql string
+		ok  bool
+	}{
+		{"SELECT 1", true},
+		{"SELECT 100", true},
+		{"SELECT 1000", false},
+		{"SELECT 'é'", true},
+		{"SELECT 'éé'", false},
+	}
+	for _, tt := range tests {
+		if err := checkQueryLength(tt.sql); (err == nil) != tt.ok {
+			t.Errorf("checkQueryLength(%q) = %v, want ok %v", tt.sql, err, tt.ok)
+		}
+	}
+	maxQueryLen = 0
+	if err := checkQueryLength("SELECT 1000"); err != nil {
+		t.Errorf("disabled limit: %v", err)
+	}
+}
+
+func TestWithAutoLimit(t *testing.T) {
+	defer func(limit int64) { autoLimit = limit }(autoLimit)
+	autoLimit = 100
+
+	tests := []struct {
+		sql       string
+		want      string
+		wantLimit int64
+	}{
+		{"SELECT * FROM t", "SELECT * FROM t LIMIT 100", 100},
+		{"SELECT * FROM t; -- all", "SELECT * FROM t LIMIT 100", 100},
+		{"WITH a AS (SELECT * FROM t LIMIT 5) SELECT * FROM a", "WITH a AS (SELECT * FROM t LIMIT 5) SELECT * FROM a LIMIT 100", 100},
+		{"SELECT * FROM (SELECT 1 LIMIT 1) s", "SELECT * FROM (SELECT 1 LIMIT 1) s LIMIT 100", 100},
+		{"SELECT * FROM t LIMIT 10", "SELECT * FROM t LIMIT 10", 0},
+		{"select * from t fetch first 5 rows only", "select * from t fetch first 5 rows only", 0},
+		{"SELECT * FROM t FOR UPDATE", "SELECT * FROM t FOR UPDATE", 0},
+		{"SHOW work_mem", "SHOW work_mem", 0},
+		{"DELETE FROM t", "DELETE FROM t", 0},
+		{"SELECT 1; SELECT 2", "SELECT 1; SELECT 2", 0},
+		{"SELECT (1", "SELECT (1", 0},
+		{"SELECT 1) UNION (SELECT 2", "SELECT 1) UNION (SELECT 2", 0},
+	}
+	for _, tt := range tests {
+		got, limit := withAutoLimit(tt.sql)
+		if got != tt.want || limit != tt.wantLimit {
+			t.Errorf("withAutoLimit(%q) = %q, %d, want %q, %d", tt.sql, got, limit, tt.want, tt.wantLimit)
+		}
+	}
+
+	autoLimit = 0
+	if got, limit := withAutoLimit("SELECT * FROM t"); got != "SELECT * FROM t" || limit != 0 {
+		t.Errorf("withAutoLimit disabled = %q, %d", got, limit)
+	}
+}
+
+func TestCheckColumns(t *testing.T) {
+	defer func(max int) { maxColumns = max }(maxColumns)
+	tests := []struct {
+		max     int
+		columns int
+		ok      bool
+	}{
+		{0, 5000, true},
+		{10, 0, true},
+		{10, 10, true},
+		{10, 11, false},
+	}
+	for _, tt := range tests {
+		maxColumns = tt.max
+		if err := checkColumns(tt.columns); (err == nil) != tt.ok {
+			t.Errorf("checkColumns(%d) with MAX_COLUMNS=%d = %v, want ok %v", tt.columns, tt.max, err, tt.ok)
+		}
+	}
+}
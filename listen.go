@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// channelName restricts LISTEN channels to plain identifiers. The name is
+// also quoted when building the statement, so this is defense in depth.
+var channelName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]{0,62}$`)
+
+// listenKeepAlive is how often an SSE comment is sent on an idle stream, so
+// proxies and load balancers don't drop the connection.
+const listenKeepAlive = 15 * time.Second
+
+// listenHandler streams the notifications sent on a channel as Server-Sent
+// Events: /listen?channel=foo holds a dedicated connection that has run
+// LISTEN foo, and writes the payload of every NOTIFY foo as an SSE "data:"
+// line until the client disconnects.
+func listenHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "Invalid request method")
+		return
+	}
+
+	channel := r.URL.Query().Get("channel")
+	if !channelName.MatchString(channel) {
+		writeJSONError(w, http.StatusBadRequest, "Invalid channel name")
+		return
+	}
+
+	pool, err := requestPool(r, "")
+	if err != nil {
+		writePoolError(w, err)
+		return
+	}
+
+	ctx := r.Context()
+	conn, err := acquireConn(ctx, pool)
+	if err != nil {
+		writeAcquireFailure(ctx, w, err)
+		return
+	}
+	defer conn.Release()
+
+	ident := pgx.Identifier{channel}.Sanitize()
+	if _, err := conn.Exec(ctx, "LISTEN "+ident); err != nil {
+		writeQueryFailure(ctx, w, err)
+		return
+	}
+	defer func() {
+		// The request context is done by now; use a fresh one so the
+		// connection goes back to the pool without the subscription.
+		unlistenCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if _, err := conn.Exec(unlistenCtx, "UNLISTEN "+ident); err != nil {
+			conn.Conn().Close(unlistenCtx)
+		}
+	}()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	rc := http.NewResponseController(w)
+	rc.Flush()
+
+	for {
+		waitCtx, cancel := context.WithTimeout(ctx, listenKeepAlive)
+		n, err := conn.Conn().WaitForNotification(waitCtx)
+		cancel()
+		switch {
+		case ctx.Err() != nil:
+			return
+		case errors.Is(err, context.DeadlineExceeded):
+			_, err = io.WriteString(w, ": keepalive\n\n")
+		case err != nil:
+			slog.WarnContext(ctx, "Error waiting for notification", "channel", channel, "error", err)
+			return
+		default:
+			err = writeEvent(w, n.Channel, n.Payload)
+		}
+		if err == nil {
+			err = rc.Flush()
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// writeEvent writes an SSE event. Each line of a multi-line payload needs
+// its own data: field.
+func writeEvent(w io.Writer, event, payload string) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "event: %s\n", event)
+	for _, line := range strings.Split(payload, "\n") {
+		fmt.Fprintf(&b, "data: %s\n", line)
+	}
+	b.WriteByte('\n')
+	_, err := io.WriteString(w, b.String())
+	return err
+}
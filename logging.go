@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// logQueries controls the SQL included in the access log, set through
+// LOG_QUERIES: "off" (the default) leaves it out, "redacted" replaces
+// literals with ? and "full" logs statements as is.
+var logQueries = "off"
+
+// slowQueryThreshold, set in milliseconds through SLOW_QUERY_MS, logs a
+// warning for every request whose queries took longer, whatever
+// LOG_QUERIES says. Its SQL is redacted unless LOG_QUERIES is "full". Zero,
+// the default, disables it.
+var slowQueryThreshold time.Duration
+
+// setupLogging installs a JSON slog logger as the default, at the level named
+// by LOG_LEVEL (debug, info, warn or error; default info).
+func setupLogging() error {
+	level := slog.LevelInfo
+	if value := os.Getenv("LOG_LEVEL"); value != "" {
+		if err := level.UnmarshalText([]byte(value)); err != nil {
+			return fmt.Errorf("invalid LOG_LEVEL %q: %v", value, err)
+		}
+	}
+	switch logQueries = os.Getenv("LOG_QUERIES"); logQueries {
+	case "":
+		logQueries = "off"
+	case "off", "redacted", "full":
+	default:
+		return fmt.Errorf("invalid LOG_QUERIES %q: must be off, redacted or full", logQueries)
+	}
+	handler := slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: level})
+	slog.SetDefault(slog.New(contextHandler{handler}))
+	return nil
+}
+
+// fatal logs msg at error level and exits, like log.Fatal.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// contextHandler adds the request ID to every record logged with a request
+// context, so handlers don't need to pass it explicitly.
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if info := requestInfoFrom(ctx); info.id != "" {
+		r.AddAttrs(slog.String("request_id", info.id))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+// requestInfo collects the per-request details reported in the access log.
+// Handlers fill it in through the request context.
+type requestInfo struct {
+	id            string
+	rows          int64
+	queryDuration time.Duration
+	queries       []string
+	principal     string
+
+	// perMessage is set by handlers that, like /ws, charge quotas and log
+	// slow queries per message rather than once for the whole request.
+	perMessage bool
+}
+
+type requestInfoKey struct{}
+
+// requestInfoFrom returns the request's info, or a throwaway value outside of
+// logRequests so callers never need a nil check.
+func requestInfoFrom(ctx context.Context) *requestInfo {
+	if info, ok := ctx.Value(requestInfoKey{}).(*requestInfo); ok {
+		return info
+	}
+	return &requestInfo{}
+}
+
+// recordQuery adds sql to the statements run for the request, which the
+// access log and the audit log report.
+func recordQuery(ctx context.Context, sql string) {
+	info := requestInfoFrom(ctx)
+	info.queries = append(info.queries, sql)
+}
+
+// formatQueries joins the statements of a request for logging, redacted or
+// left out according to mode: "full", "redacted" or "off".
+func formatQueries(queries []string, mode string) string {
+	switch mode {
+	case "off":
+		return ""
+	case "redacted":
+		redacted := make([]string, len(queries))
+		for i, sql := range queries {
+			redacted[i] = redactSQL(sql)
+		}
+		queries = redacted
+	}
+	return strings.Join(queries, "; ")
+}
+
+// logRequests assigns each request an ID, returned in the X-Request-ID
+// header, and writes one access log line per request.
+func logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		info := &requestInfo{id: requestID(r)}
+		w.Header().Set("X-Request-ID", info.id)
+
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		ctx := context.WithValue(r.Context(), requestInfoKey{}, info)
+		next.ServeHTTP(rec, r.WithContext(ctx))
+
+		attrs := []any{
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", rec.status,
+			"duration_ms", float64(time.Since(start).Microseconds()) / 1000,
+			"query_duration_ms", float64(info.queryDuration.Microseconds()) / 1000,
+			"rows", info.rows,
+		}
+		if query := formatQueries(info.queries, logQueries); query != "" {
+			attrs = append(attrs, "query", query)
+		}
+		slog.InfoContext(ctx, "request", attrs...)
+
+		if !info.perMessage {
+			logSlowQuery(ctx, info)
+		}
+
+		if audit != nil && len(info.queries) > 0 {
+			audit.add(auditRecord{
+				at:        start,
+				requestID: info.id,
+				principal: info.principal,
+				clientIP:  clientIP(r),
+				method:    r.Method,
+				path:      r.URL.Path,
+				query:     strings.Join(info.queries, "; "),
+				rows:      info.rows,
+				duration:  time.Since(start),
+				status:    rec.status,
+			})
+		}
+	})
+}
+
+// logSlowQuery logs the statements recorded in info when they took longer
+// than slowQueryThreshold to run.
+func logSlowQuery(ctx context.Context, info *requestInfo) {
+	if slowQueryThreshold <= 0 || info.queryDuration <= slowQueryThreshold {
+		return
+	}
+	mode := "redacted"
+	if logQueries == "full" {
+		mode = "full"
+	}
+	slog.WarnContext(ctx, "Slow query",
+		"query", formatQueries(info.queries, mode),
+		"query_duration_ms", float64(info.queryDuration.Microseconds())/1000,
+		"rows", info.rows,
+	)
+}
+
+// requestID reuses a well-formed incoming X-Request-ID, so IDs can be
+// correlated across services, and generates a new one otherwise.
+func requestID(r *http.Request) string {
+	if id := r.Header.Get("X-Request-ID"); id != "" && len(id) <= 64 && !strings.ContainsAny(id, "\r\n") {
+		return id
+	}
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// statusRecorder captures the status code written by a handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusRecorder) Flush() {
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
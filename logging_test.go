@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// captureLogs sends the default logger's output to the returned buffer
+// until the test ends.
+func captureLogs(t *testing.T) *bytes.Buffer {
+	var buf bytes.Buffer
+	old := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(&buf, nil)))
+	t.Cleanup(func() { slog.SetDefault(old) })
+	return &buf
+}
+
+func TestSlowQueryLog(t *testing.T) {
+	defer func(threshold time.Duration, mode string) {
+		slowQueryThreshold, logQueries = threshold, mode
+	}(slowQueryThreshold, logQueries)
+
+	tests := []struct {
+		name      string
+		threshold time.Duration
+		mode      string
+		duration  time.Duration
+		want      string
+	}{
+		{"fast", 50 * time.Millisecond, "off", 10 * time.Millisecond, ""},
+		{"slow", 50 * time.Millisecond, "off", 100 * time.Millisecond, "SELECT * FROM t WHERE id = ?"},
+		{"slow with full logging", 50 * time.Millisecond, "full", 100 * time.Millisecond, "SELECT * FROM t WHERE id = 42"},
+		{"disabled", 0, "off", time.Hour, ""},
+	}
+	for _, tt := range tests {
+		slowQueryThreshold, logQueries = tt.threshold, tt.mode
+		logs := captureLogs(t)
+		handler := logRequests(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			recordQuery(r.Context(), "SELECT * FROM t WHERE id = 42")
+			requestInfoFrom(r.Context()).queryDuration = tt.duration
+		}))
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/query", nil))
+
+		var got string
+		for _, line := range strings.Split(logs.String(), "\n") {
+			if strings.Contains(line, `msg="Slow query"`) {
+				got = line
+			}
+		}
+		if (got != "") != (tt.want != "") || !strings.Contains(got, tt.want) {
+			t.Errorf("%s: slow query log %q, want query %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSlowQueryLogEndpoints(t *testing.T) {
+	useTestDatabase(t)
+	slowQueryThreshold = 50 * time.Millisecond
+	defer func() { slowQueryThreshold = 0 }()
+
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		method  string
+		target  string
+		body    string
+	}{
+		{"query", queryHandler, http.MethodGet, "/query?q=SELECT+pg_sleep(0.1)", ""},
+		{"transaction", transactionHandler, http.MethodPost, "/transaction", `{"queries":[{"query":"SELECT pg_sleep(0.1)"}]}`},
+		{"batch", batchHandler, http.MethodPost, "/batch", `{"query":"SELECT 1; SELECT pg_sleep(0.1)"}`},
+		{"explain", explainHandler, http.MethodPost, "/explain?analyze=true", `{"query":"SELECT pg_sleep(0.1)"}`},
+		{"fast query", queryHandler, http.MethodGet, "/query?q=SELECT+1", ""},
+	}
+	for _, tt := range tests {
+		logs := captureLogs(t)
+		r := httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body))
+		w := httptest.NewRecorder()
+		logRequests(tt.handler).ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: status %d: %s", tt.name, w.Code, w.Body)
+			continue
+		}
+		slow := strings.Contains(logs.String(), `msg="Slow query"`)
+		if want := tt.name != "fast query"; slow != want {
+			t.Errorf("%s: slow query logged %v, want %v:\n%s", tt.name, slow, want, logs)
+		}
+	}
+}
+
+func TestFinishWSMessage(t *testing.T) {
+	logs := captureLogs(t)
+	slowQueryThreshold = 50 * time.Millisecond
+	quotas = map[string]quotaLimits{"*": {Queries: 2}}
+	resetQuotaUsage(t)
+	defer func() { slowQueryThreshold, quotas = 0, nil }()
+
+	session := &requestInfo{principal: "key:abc"}
+	finishWSMessage(context.Background(), session, &requestInfo{queries: []string{"SELECT 1"}, rows: 1, queryDuration: time.Millisecond})
+	if strings.Contains(logs.String(), "Slow query") {
+		t.Errorf("fast message logged as slow:\n%s", logs)
+	}
+	finishWSMessage(context.Background(), session, &requestInfo{queries: []string{"SELECT pg_sleep(1)"}, rows: 1, queryDuration: time.Second})
+	if !strings.Contains(logs.String(), "Slow query") {
+		t.Error("slow message not logged")
+	}
+	if session.rows != 2 || session.queryDuration != time.Second+time.Millisecond {
+		t.Errorf("session has %d rows and %s query time", session.rows, session.queryDuration)
+	}
+	if exceeded := checkQuota("key:abc", quotas["*"], time.Now()); exceeded == nil || exceeded.Used != 2 {
+		t.Errorf("quota after two messages: %+v", exceeded)
+	}
+}
@@ -1,114 +1,1071 @@
 package main
 
 import (
-	"compress/gzip"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
+	"math"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
+	"github.com/jackc/pgconn"
 	"github.com/jackc/pgproto3/v2"
+	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
-	"github.com/rs/cors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel/trace"
 )
 
-// Database connection pool
-var db *pgxpool.Pool
+// maxBodyBytes caps the size of JSON request bodies, set through
+// MAX_BODY_BYTES. Zero disables the limit.
+var maxBodyBytes int64 = 1 << 20
 
-// SQLQuery represents the structure of a query request
+// Query timeouts. queryTimeout applies when a request doesn't set timeout_ms;
+// per-request timeouts are capped at maxQueryTimeout. Zero disables the limit.
+var (
+	queryTimeout    = 30 * time.Second
+	maxQueryTimeout = 5 * time.Minute
+)
+
+// Stream deadlines: unlike a timeout, which fails the request, a deadline
+// ends the result early, marked as truncated, once the request has run for
+// that long. streamDeadline applies when a request doesn't set deadline_ms,
+// set through STREAM_DEADLINE; per-request deadlines are capped at
+// maxStreamDeadline, set through MAX_STREAM_DEADLINE. Zero disables either.
+// The query is canceled when the deadline passes, so a query that isn't
+// read-only has its writes rolled back.
+var (
+	streamDeadline    time.Duration
+	maxStreamDeadline time.Duration
+)
+
+// errStreamDeadline is the cause of a request context canceled by its stream
+// deadline.
+var errStreamDeadline = errors.New("stream deadline exceeded")
+
+// maxRows caps the number of rows streamed for a single query, set through
+// MAX_ROWS. Larger results are cut off and flagged as truncated. Zero
+// disables the limit.
+var maxRows int64 = 100000
+
+// streamFlushRows is how many rows /query/stream sends per batch, set through
+// STREAM_FLUSH_ROWS.
+var streamFlushRows int64 = 100
+
+// SQLQuery represents the structure of a query request.
+//
+// DB names the database to query; the ?db= URL parameter is used when it is
+// empty, and the default database when both are.
+//
+// Params are bound to the $1, $2, ... placeholders in Query. When the number
+// of placeholders doesn't match len(Params), the query is rejected with a 400.
+// NamedParams are bound to @name placeholders instead, see bindNamedParams.
+//
+// DeadlineMS ends the result once the request has run that long, see
+// streamDeadline.
+//
+// Limit caps the number of rows returned; it can only lower maxRows. With
+// Paginate set the result is instead returned in pages of Limit rows, and
+// Cursor carries the token for fetching the next page, see queryPage.
+//
+// BinaryEncoding renders bytea values as base64 (the default), hex or
+// escape, the latter two as Postgres' bytea_output would.
+//
+// Filename makes the response a download of that name, see attachmentName;
+// CSV results are downloads as query.csv by default.
 type SQLQuery struct {
-	Query string `json:"query"`
+	DB         string        `json:"db,omitempty"`
+	Query      string        `json:"query"`
+	Params     []interface{} `json:"params"`
+	TimeoutMS  int64         `json:"timeout_ms,omitempty"`
+	DeadlineMS int64         `json:"deadline_ms,omitempty"`
+	Limit      int64         `json:"limit,omitempty"`
+	Paginate   bool          `json:"paginate,omitempty"`
+	Cursor     string        `json:"cursor,omitempty"`
+
+	SessionOptions
+	Count          bool                   `json:"count,omitempty"`
+	ResultFormat   string                 `json:"result_format,omitempty"`
+	NamedParams    map[string]interface{} `json:"namedParams,omitempty"`
+	BinaryEncoding binaryEncoding         `json:"binaryEncoding,omitempty"`
+	Filename       string                 `json:"filename,omitempty"`
 }
 
 func main() {
-	var err error
-	dbURL := os.Getenv("DATABASE_URL")
-	if dbURL == "" {
-		log.Fatal("DATABASE_URL environment variable is required")
+	if err := setupLogging(); err != nil {
+		fatal("Invalid configuration", "error", err)
 	}
 
-	db, err = pgxpool.Connect(context.Background(), dbURL)
+	dbURLs, def, err := databaseURLs()
 	if err != nil {
-		log.Fatalf("Unable to connect to database: %v\n", err)
+		fatal("Invalid configuration", "error", err)
+	}
+	defaultDB = def
+
+	if err := loadSettings(); err != nil {
+		fatal("Invalid configuration", "error", err)
+	}
+
+	addr, err := listenAddr()
+	if err != nil {
+		fatal("Invalid configuration", "error", err)
+	}
+
+	shutdownTimeout, err := envDuration("SHUTDOWN_TIMEOUT", 30*time.Second)
+	if err != nil {
+		fatal("Invalid configuration", "error", err)
+	}
+
+	tlsConf, err := tlsConfig()
+	if err != nil {
+		fatal("Invalid configuration", "error", err)
+	}
+
+	corsHandler, err := newCORS()
+	if err != nil {
+		fatal("Invalid configuration", "error", err)
+	}
+
+	shutdownTracing, err := setupTracing(context.Background())
+	if err != nil {
+		fatal("Invalid configuration", "error", err)
+	}
+
+	if err := setupJWT(context.Background()); err != nil {
+		fatal("Invalid configuration", "error", err)
+	}
+
+	if namedQueries, err = loadNamedQueries(os.Getenv("QUERIES_FILE")); err != nil {
+		fatal("Invalid configuration", "error", err)
+	}
+	if quotas, err = loadQuotas(os.Getenv("QUOTAS_FILE")); err != nil {
+		fatal("Invalid configuration", "error", err)
+	}
+
+	if err := connectDatabases(context.Background(), dbURLs); err != nil {
+		fatal("Unable to connect to database", "error", err)
+	}
+
+	if err := setupAudit(); err != nil {
+		fatal("Invalid configuration", "error", err)
 	}
-	defer db.Close()
+
+	prometheus.MustRegister(newPoolCollector())
 
 	mux := http.NewServeMux()
-	mux.HandleFunc("/query", queryHandler)
+	mux.HandleFunc("/query", withoutTimeouts(conditionalGET(idempotent(limitConcurrency(queryHandler)))))
+	mux.HandleFunc("/query/stream", withoutTimeouts(idempotent(limitConcurrency(streamQueryHandler))))
+	mux.HandleFunc("/transaction", idempotent(limitConcurrency(transactionHandler)))
+	mux.HandleFunc("/batch", idempotent(limitConcurrency(batchHandler)))
+	mux.HandleFunc("/queries", idempotent(limitConcurrency(multiQueryHandler)))
+	mux.HandleFunc("/copy", withoutTimeouts(idempotent(limitConcurrency(copyHandler))))
+	mux.HandleFunc("/named/{name}", withoutTimeouts(conditionalGET(idempotent(limitConcurrency(namedQueryHandler)))))
+	mux.HandleFunc("/explain", limitConcurrency(explainHandler))
+	mux.HandleFunc("/validate", limitConcurrency(validateHandler))
+	mux.HandleFunc("/schema", limitConcurrency(schemaHandler))
+	mux.HandleFunc("/tiles/{z}/{x}/{tile}", conditionalGET(limitConcurrency(tileHandler)))
+	mux.HandleFunc("/export", withoutTimeouts(limitConcurrency(exportHandler)))
+	mux.HandleFunc("/export/binary", withoutTimeouts(limitConcurrency(binaryExportHandler)))
+	mux.HandleFunc("/cancel", cancelHandler)
+	mux.HandleFunc("/listen", withoutTimeouts(listenHandler))
+	mux.HandleFunc("/ws", withoutTimeouts(wsHandler))
+	mux.HandleFunc("/health", healthHandler)
+	mux.HandleFunc("/ready", readyHandler)
+	mux.HandleFunc("/stats", statsHandler)
+	mux.HandleFunc("/version", versionHandler)
+	mux.HandleFunc("/admin/activity", requireAdmin(activityHandler))
+	mux.HandleFunc("/admin/terminate", requireAdmin(terminateHandler))
+	mux.Handle("/metrics", promhttp.Handler())
+
+	handler := logRequests(recoverPanics(stripRoutePrefix(traceRequests(corsHandler.Handler(authenticate(rateLimit(enforceQuotas(mux))))))))
+	server := newServer(addr, handler, tlsConf)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go watchDatabases(ctx)
+	if idempotencyTTL > 0 {
+		go sweepIdempotentResponses(ctx)
+	}
 
-	handler := cors.Default().Handler(mux)
-	log.Println("Starting server on :8080...")
-	log.Fatal(http.ListenAndServe(":8080", handler))
+	if cacheTTL > 0 {
+		resultCache = newResponseCache(cacheTTL, cacheMaxEntries)
+	}
+	if tileCacheTTL > 0 {
+		tileCache = newResponseCache(tileCacheTTL, cacheMaxEntries)
+	}
+
+	slog.Info("Starting server", "addr", addr, "tls", tlsConf != nil)
+	err = serve(ctx, server, shutdownTimeout)
+	cursors.closeAll()
+	if audit != nil {
+		audit.close()
+	}
+	closeDatabases()
+	flushCtx, cancelFlush := context.WithTimeout(context.Background(), 5*time.Second)
+	shutdownTracing(flushCtx)
+	cancelFlush()
+	if err != nil {
+		fatal("Server error", "error", err)
+	}
+}
+
+// serve runs server until ctx is canceled, then gives in-flight requests up to
+// drainTimeout to finish before the remaining connections are closed. It
+// serves HTTPS when server.TLSConfig is set.
+func serve(ctx context.Context, server *http.Server, drainTimeout time.Duration) error {
+	errc := make(chan error, 1)
+	go func() {
+		if server.TLSConfig != nil {
+			// The certificate is already in TLSConfig.
+			errc <- server.ListenAndServeTLS("", "")
+			return
+		}
+		errc <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+
+	slog.Info("Shutting down server", "drain_timeout", drainTimeout.String())
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		server.Close()
+		return fmt.Errorf("Error draining connections: %v", err)
+	}
+	return nil
 }
 
 func queryHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+	serveQuery(w, r, 0)
+}
+
+// streamQueryHandler is queryHandler sending the result to the client in
+// batches of streamFlushRows rows as they are produced, rather than
+// whenever the response buffers happen to fill up, for clients that render
+// large results progressively.
+func streamQueryHandler(w http.ResponseWriter, r *http.Request) {
+	serveQuery(w, r, streamFlushRows)
+}
+
+// serveQuery serves a query request, flushing the response every flushRows
+// rows when positive.
+func serveQuery(w http.ResponseWriter, r *http.Request, flushRows int64) {
+	queriesTotal.Inc()
+	requestsInFlight.Inc()
+	defer requestsInFlight.Dec()
+
+	sqlQuery, ok := readQuery(w, r)
+	if !ok {
+		return
+	}
+	if r.Method == http.MethodGet && sqlQuery.Query == "" && sqlQuery.Cursor == "" {
+		queryErrors.WithLabelValues(errorBadRequest).Inc()
+		writeJSONError(w, http.StatusBadRequest, "Missing q parameter")
 		return
 	}
+	if sqlQuery.Query != "" {
+		if err := checkClientQuery(r.Context(), sqlQuery.Query); err != nil {
+			queryErrors.WithLabelValues(errorBadRequest).Inc()
+			writeJSONError(w, http.StatusForbidden, err.Error())
+			return
+		}
+	}
+	runQuery(w, r, sqlQuery, flushRows)
+}
 
+// readQuery reads the query of a request from the JSON body of a POST or the
+// URL of a GET. It writes the error response and returns false on failure.
+func readQuery(w http.ResponseWriter, r *http.Request) (SQLQuery, bool) {
 	var sqlQuery SQLQuery
-	err := json.NewDecoder(r.Body).Decode(&sqlQuery)
+	switch r.Method {
+	case http.MethodPost:
+		if err := decodeBody(w, r, &sqlQuery); err != nil {
+			queryErrors.WithLabelValues(errorBadRequest).Inc()
+			writeBodyError(w, err)
+			return sqlQuery, false
+		}
+	case http.MethodGet:
+		var err error
+		if sqlQuery, err = queryFromURL(r); err != nil {
+			queryErrors.WithLabelValues(errorBadRequest).Inc()
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return sqlQuery, false
+		}
+	default:
+		queryErrors.WithLabelValues(errorBadRequest).Inc()
+		writeJSONError(w, http.StatusMethodNotAllowed, "Invalid request method")
+		return sqlQuery, false
+	}
+	if err := checkQueryLength(sqlQuery.Query); err != nil {
+		queryErrors.WithLabelValues(errorBadRequest).Inc()
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return sqlQuery, false
+	}
+	if err := bindNamedParams(&sqlQuery); err != nil {
+		queryErrors.WithLabelValues(errorBadRequest).Inc()
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return sqlQuery, false
+	}
+	// Named queries and the pages of a cursor come without SQL, and are
+	// checked once it's known.
+	if sqlQuery.Query != "" {
+		if err := checkParamCount(sqlQuery.Query, sqlQuery.Params); err != nil {
+			queryErrors.WithLabelValues(errorBadRequest).Inc()
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return sqlQuery, false
+		}
+	}
+	return sqlQuery, true
+}
+
+// runQuery runs a query and streams its result in the requested format,
+// flushing the response every flushRows rows when positive.
+func runQuery(w http.ResponseWriter, r *http.Request, sqlQuery SQLQuery, flushRows int64) {
+	ctx, cancel := requestContext(w, r, sqlQuery.TimeoutMS)
+	defer cancel()
+	if deadline := requestDeadline(sqlQuery.DeadlineMS); deadline > 0 {
+		var cancelDeadline context.CancelFunc
+		ctx, cancelDeadline = context.WithTimeoutCause(ctx, deadline, errStreamDeadline)
+		defer cancelDeadline()
+	}
+
+	start := time.Now()
+	defer func() {
+		elapsed := time.Since(start)
+		requestInfoFrom(ctx).queryDuration = elapsed
+		queryDuration.Observe(elapsed.Seconds())
+	}()
+
+	if sqlQuery.Query != "" {
+		recordQuery(ctx, sqlQuery.Query)
+	}
+
+	format, err := negotiateFormat(r)
 	if err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		writeFormatError(w, err)
+		return
+	}
+	if err := checkBinaryEncoding(sqlQuery.BinaryEncoding); err != nil {
+		queryErrors.WithLabelValues(errorBadRequest).Inc()
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if sqlQuery.Paginate || sqlQuery.Cursor != "" {
+		queryPage(ctx, w, r, sqlQuery, format)
 		return
 	}
 
-	rows, err := db.Query(context.Background(), sqlQuery.Query)
+	var key string
+	if resultCache != nil {
+		if key = cacheKey(r, format, sqlQuery); key != "" {
+			if entry, ok := resultCache.get(key); ok {
+				writeCached(w, r, entry)
+				return
+			}
+		}
+		w.Header().Set("X-Cache", "MISS")
+	}
+
+	pool, err := requestPool(r, sqlQuery.DB)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Query error: %v", err), http.StatusBadRequest)
+		queryErrors.WithLabelValues(errorBadRequest).Inc()
+		writePoolError(w, err)
+		return
+	}
+
+	// GET requests must be free of side effects, whatever the server mode.
+	inReadOnlyTx := readOnly || r.Method == http.MethodGet
+	readOnlyErr := checkReadOnly(sqlQuery.Query)
+	if inReadOnlyTx && readOnlyErr != nil {
+		queryErrors.WithLabelValues(errorBadRequest).Inc()
+		writeJSONError(w, http.StatusForbidden, readOnlyErr.Error())
+		return
+	}
+	var limitApplied int64
+	if readOnlyErr == nil {
+		sqlQuery.Query, limitApplied = withAutoLimit(sqlQuery.Query)
+	}
+
+	opts := queryOptions{readOnlyTx: inReadOnlyTx, format: format, binaryEncoding: sqlQuery.BinaryEncoding}
+	if readOnlyErr == nil {
+		opts.replica = replicaPool(r, sqlQuery.DB)
+	}
+	if opts.resultFormats, err = resultFormats(sqlQuery.ResultFormat); err != nil {
+		queryErrors.WithLabelValues(errorBadRequest).Inc()
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if format == formatGeoJSON {
+		if opts.srid, err = requestSRID(r); err != nil {
+			queryErrors.WithLabelValues(errorBadRequest).Inc()
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	if opts.settings, err = sessionSettings(ctx, sqlQuery.SessionOptions); err != nil {
+		queryErrors.WithLabelValues(errorBadRequest).Inc()
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if sqlQuery.Count {
+		if opts.countSQL, err = countQuery(sqlQuery.Query); err != nil {
+			queryErrors.WithLabelValues(errorBadRequest).Inc()
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	// A read-only query that failed on a broken connection is safe to run
+	// again; anything else could apply its writes twice.
+	var sq *startedQuery
+	for attempt := 0; ; attempt++ {
+		if sq, err = startQuery(ctx, r, pool, sqlQuery, opts); err == nil {
+			break
+		}
+		if attempt >= queryRetries || readOnlyErr != nil || !transientError(ctx, err) {
+			writeStartFailure(ctx, w, err)
+			return
+		}
+		slog.WarnContext(ctx, "Retrying query after connection error", "attempt", attempt+1, "error", err)
+		if !sleepContext(ctx, retryBackoff(attempt)) {
+			writeStartFailure(ctx, w, err)
+			return
+		}
+	}
+	defer sq.close()
+
+	conn, rows, out, span := sq.conn, sq.rows, sq.out, sq.span
+	if len(rows.FieldDescriptions()) == 0 {
+		writeCommandResult(ctx, w, r, conn, rows, span)
+		return
+	}
+	if err := checkColumns(len(rows.FieldDescriptions())); err != nil {
+		endQuerySpan(span, err)
+		// Nothing was returned, so don't commit whatever the query wrote.
+		sq.commit = false
+		queryErrors.WithLabelValues(errorBadRequest).Inc()
+		writeJSONError(w, http.StatusBadRequest, err.Error())
 		return
 	}
-	defer rows.Close()
+	if _, ok := out.(*csvWriter); ok || sqlQuery.Filename != "" {
+		ext := formatExtensions[format]
+		w.Header().Set("Content-Disposition", contentDisposition(attachmentName(sqlQuery.Filename, ext, "query"+ext)))
+	}
+	if sq.total != nil {
+		w.Header().Set("X-Total-Count", strconv.FormatInt(*sq.total, 10))
+	}
+	if limitApplied > 0 {
+		w.Header().Set("X-Limit-Applied", strconv.FormatInt(limitApplied, 10))
+	}
 
-	// Retrieve column names
-	fieldDescriptions := rows.FieldDescriptions()
-	columns := getColumnNames(fieldDescriptions)
+	w.Header().Set("Content-Type", out.contentType())
+	body, closeBody := compressResponse(w, r)
+	defer closeBody()
+	if nd, ok := out.(*ndjsonWriter); ok {
+		compressed := body
+		nd.flush = func() error { return flushResponse(w, compressed) }
+	}
+
+	columns := sq.columns
+	var capture *cacheCapture
+	if key != "" {
+		capture = &cacheCapture{}
+		body = io.MultiWriter(body, capture)
+	}
+
+	stream := streamOptions{
+		limit:          rowLimit(sqlQuery.Limit),
+		total:          sq.total,
+		limitApplied:   limitApplied,
+		binaryEncoding: sqlQuery.BinaryEncoding,
+		notices:        func() []notice { return takeNotices(conn.Conn().PgConn()) },
+	}
+	if flushRows > 0 {
+		compressed := body
+		stream.flushRows = flushRows
+		stream.flush = func() error { return flushResponse(w, compressed) }
+	}
+	summary, err := streamResult(ctx, body, rows, columns, out, stream)
+	endQuerySpan(span, summary.err)
+	// Postgres may only report an error once rows have been streamed.
+	var pgErr *pgconn.PgError
+	if errors.As(summary.err, &pgErr) {
+		slog.WarnContext(ctx, "Query failed", pgErrorAttrs(summary.err)...)
+	}
+	if err != nil {
+		queryErrors.WithLabelValues(errorQuery).Inc()
+		slog.WarnContext(ctx, "Error writing response", "error", err)
+	}
+	// A result cut off by the deadline depends on how fast it happened to
+	// stream, so it isn't worth caching.
+	if capture != nil && err == nil && summary.err == nil && !capture.overflow && context.Cause(ctx) != errStreamDeadline {
+		resultCache.add(&cacheEntry{
+			key:          key,
+			contentType:  out.contentType(),
+			disposition:  w.Header().Get("Content-Disposition"),
+			totalCount:   w.Header().Get("X-Total-Count"),
+			limitApplied: w.Header().Get("X-Limit-Applied"),
+			body:         capture.buf.Bytes(),
+		})
+	}
+	if summary.truncated && inReadOnlyTx {
+		// Closing rows reads the rest of the result; stop the query on the
+		// server instead of draining it. Only read-only queries are
+		// canceled, as canceling a write would undo it.
+		cancelCtx, cancelDone := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancelDone()
+		if err := conn.Conn().PgConn().CancelRequest(cancelCtx); err != nil {
+			slog.WarnContext(ctx, "Error canceling truncated query", "error", err)
+		}
+	}
+}
+
+// writeCommandResult replies to a statement that returns no result set, such
+// as an UPDATE without RETURNING, with its command and the number of rows it
+// affected, e.g. {"command":"UPDATE","rowsAffected":5}.
+func writeCommandResult(ctx context.Context, w http.ResponseWriter, r *http.Request, conn *pgxpool.Conn, rows pgx.Rows, span trace.Span) {
+	for rows.Next() {
+	}
+	rows.Close()
+	endQuerySpan(span, rows.Err())
+	if err := rows.Err(); err != nil {
+		writeQueryFailure(ctx, w, err)
+		return
+	}
 
-	// Prepare the response writer for gzip compression
-	w.Header().Set("Content-Encoding", "gzip")
+	tag := rows.CommandTag()
+	requestInfoFrom(ctx).rows += tag.RowsAffected()
 	w.Header().Set("Content-Type", "application/json")
-	gz := gzip.NewWriter(w)
-	defer gz.Close()
+	body, closeBody := compressResponse(w, r)
+	defer closeBody()
+	result := map[string]interface{}{
+		"command":      commandName(tag),
+		"rowsAffected": tag.RowsAffected(),
+	}
+	if notices := takeNotices(conn.Conn().PgConn()); notices != nil {
+		result["notices"] = notices
+	}
+	json.NewEncoder(body).Encode(result)
+}
+
+// commandName returns the command of a tag without its row counts: "INSERT"
+// for "INSERT 0 5" and "CREATE TABLE" for itself.
+func commandName(tag pgconn.CommandTag) string {
+	words := strings.Fields(string(tag))
+	for len(words) > 1 {
+		if _, err := strconv.ParseInt(words[len(words)-1], 10, 64); err != nil {
+			break
+		}
+		words = words[:len(words)-1]
+	}
+	return strings.Join(words, " ")
+}
+
+// queryOptions are the checked options a request's query runs with.
+type queryOptions struct {
+	// readOnlyTx runs the query in a read-only transaction.
+	readOnlyTx bool
+	// settings are applied to the query's transaction.
+	settings []sessionSetting
+	// countSQL, when set, counts the rows of the query first.
+	countSQL string
+	// resultFormats are the result formats to request, if not pgx's own.
+	resultFormats pgx.QueryResultFormats
+	// format is the output format of the response.
+	format string
+	// binaryEncoding is how bytea values are rendered.
+	binaryEncoding binaryEncoding
+	// srid is the SRID GeoJSON geometries are transformed to, if not zero.
+	srid int32
+	// replica, when set, is the read replica to run the query on.
+	replica *pgxpool.Pool
+}
+
+// startedQuery is a query whose result is ready to be streamed, along with
+// the connection and the transaction it runs in, if any. Read-only requests
+// and requests with session settings or a count run in a transaction;
+// commit is set when it holds writes. total is the counted number of rows.
+type startedQuery struct {
+	conn    *pgxpool.Conn
+	tx      pgx.Tx
+	commit  bool
+	rows    pgx.Rows
+	columns []column
+	out     resultWriter
+	span    trace.Span
+	total   *int64
+}
+
+// startQuery acquires a connection from pool, or from opts.replica when set,
+// and starts the request's query on it. A failure to acquire the connection
+// is returned as an acquireError.
+func startQuery(ctx context.Context, r *http.Request, pool *pgxpool.Pool, sqlQuery SQLQuery, opts queryOptions) (*startedQuery, error) {
+	conn, err := acquireRead(ctx, pool, opts.replica)
+	if err != nil {
+		return nil, acquireError{err}
+	}
+	sq := &startedQuery{conn: conn}
+
+	var q querier = conn.Conn()
+	if opts.readOnlyTx || len(opts.settings) > 0 || opts.countSQL != "" {
+		var txOptions pgx.TxOptions
+		if opts.readOnlyTx {
+			txOptions.AccessMode = pgx.ReadOnly
+		}
+		if opts.countSQL != "" {
+			// The count and the query must see the same snapshot.
+			txOptions.IsoLevel = pgx.RepeatableRead
+		}
+		if sq.tx, err = conn.BeginTx(ctx, txOptions); err != nil {
+			sq.close()
+			return nil, err
+		}
+		sq.commit = !opts.readOnlyTx
+		q = sq.tx
+		if err := applySettings(ctx, q, opts.settings); err != nil {
+			sq.close()
+			return nil, err
+		}
+	}
+
+	args := convertParams(sqlQuery.Params)
+	if opts.countSQL != "" {
+		var total int64
+		if err := q.QueryRow(ctx, opts.countSQL, args...).Scan(&total); err != nil {
+			sq.close()
+			return nil, err
+		}
+		sq.total = &total
+	}
+
+	query := sqlQuery.Query
+	if sq.out, query, err = newResultWriter(ctx, q, r, query, opts); err != nil {
+		sq.close()
+		return nil, err
+	}
+	// The columns are described while the connection is still free to look
+	// up the types pgx doesn't know.
+	fields, err := describeQuery(ctx, conn.Conn(), query)
+	if err != nil {
+		sq.close()
+		return nil, err
+	}
+	sq.columns = resultColumns(ctx, q, pool, conn.Conn().ConnInfo(), fields)
+
+	queryCtx, span := startQuerySpan(ctx, query)
+	if sq.rows, err = q.Query(queryCtx, query, queryArgs(opts.resultFormats, args)...); err != nil {
+		endQuerySpan(span, err)
+		sq.close()
+		return nil, err
+	}
+	sq.span = span
+	return sq, nil
+}
+
+// close releases everything held by the query, committing the writes of a
+// query that succeeded. Nothing can have been written in a read-only
+// transaction, so rolling it back is as good as committing.
+func (sq *startedQuery) close() {
+	if sq.rows != nil {
+		sq.rows.Close()
+	}
+	if sq.tx != nil {
+		if sq.commit && sq.rows != nil && sq.rows.Err() == nil {
+			if err := sq.tx.Commit(context.Background()); err != nil {
+				slog.Warn("Error committing query", "error", err)
+			}
+		} else {
+			sq.tx.Rollback(context.Background())
+		}
+	}
+	sq.conn.Release()
+}
+
+// newResultWriter returns the writer for an output format and the query to
+// run for it, which differs from query for GeoJSON.
+func newResultWriter(ctx context.Context, q querier, r *http.Request, query string, opts queryOptions) (resultWriter, string, error) {
+	switch opts.format {
+	case formatGeoJSON:
+		geo, err := newGeoJSONWriter(ctx, q, query, r.URL.Query().Get("geom"), opts.srid)
+		if err != nil {
+			return nil, "", err
+		}
+		return geo, geo.query, nil
+	case formatCSV:
+		return &csvWriter{binaryEncoding: opts.binaryEncoding}, query, nil
+	case formatObjects:
+		return &jsonWriter{objects: true}, query, nil
+	case formatMsgpack:
+		return &msgpackWriter{}, query, nil
+	case formatNDJSON:
+		return &ndjsonWriter{}, query, nil
+	case formatArrow:
+		return &arrowWriter{binaryEncoding: opts.binaryEncoding}, query, nil
+	}
+	return &jsonWriter{}, query, nil
+}
+
+// querier is the subset of methods shared by *pgx.Conn and pgx.Tx, so a
+// request can run either directly on its connection or inside a transaction.
+type querier interface {
+	Exec(ctx context.Context, sql string, arguments ...interface{}) (pgconn.CommandTag, error)
+	Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row
+	Prepare(ctx context.Context, name, sql string) (*pgconn.StatementDescription, error)
+}
+
+// queryFromURL builds a query from the URL parameters of a GET request:
+// q holds the SQL, each repeated param binds the next placeholder, and
+// timeout_ms and limit are optional, e.g. /query?q=SELECT+*+FROM+t+WHERE+id=$1&param=42.
+// Parameters are sent as text and converted by Postgres to the placeholder's
+// type. paginate=true and cursor work as in the JSON body; q isn't needed
+// when fetching the next page of a cursor.
+func queryFromURL(r *http.Request) (SQLQuery, error) {
+	values := r.URL.Query()
+	q := SQLQuery{
+		Query:    values.Get("q"),
+		Paginate: values.Get("paginate") == "true",
+		Cursor:   values.Get("cursor"),
+	}
+	for _, p := range values["param"] {
+		q.Params = append(q.Params, p)
+	}
+	if timeout := values.Get("timeout_ms"); timeout != "" {
+		ms, err := strconv.ParseInt(timeout, 10, 64)
+		if err != nil {
+			return q, fmt.Errorf("Invalid timeout_ms %q", timeout)
+		}
+		q.TimeoutMS = ms
+	}
+	if deadline := values.Get("deadline_ms"); deadline != "" {
+		ms, err := strconv.ParseInt(deadline, 10, 64)
+		if err != nil {
+			return q, fmt.Errorf("Invalid deadline_ms %q", deadline)
+		}
+		q.DeadlineMS = ms
+	}
+	if limit := values.Get("limit"); limit != "" {
+		n, err := strconv.ParseInt(limit, 10, 64)
+		if err != nil {
+			return q, fmt.Errorf("Invalid limit %q", limit)
+		}
+		q.Limit = n
+	}
+	if timeout := values.Get("statement_timeout_ms"); timeout != "" {
+		ms, err := strconv.ParseInt(timeout, 10, 64)
+		if err != nil {
+			return q, fmt.Errorf("Invalid statement_timeout_ms %q", timeout)
+		}
+		q.StatementTimeoutMS = ms
+	}
+	q.WorkMem = values.Get("work_mem")
+	q.SearchPath = values.Get("search_path")
+	q.Count = values.Get("count") == "true"
+	q.ResultFormat = values.Get("result_format")
+	q.BinaryEncoding = binaryEncoding(values.Get("binaryEncoding"))
+	q.Filename = values.Get("filename")
+	return q, nil
+}
+
+// decodeBody decodes the JSON request body into v, reading at most
+// maxBodyBytes. Numbers are kept as json.Number so convertParams can bind
+// integers exactly.
+func decodeBody(w http.ResponseWriter, r *http.Request, v interface{}) error {
+	body := r.Body
+	if maxBodyBytes > 0 {
+		body = http.MaxBytesReader(w, r.Body, maxBodyBytes)
+	}
+	decoder := json.NewDecoder(body)
+	decoder.UseNumber()
+	return decoder.Decode(v)
+}
+
+// writeBodyError reports a request body decodeBody couldn't read.
+func writeBodyError(w http.ResponseWriter, err error) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		writeJSONError(w, http.StatusRequestEntityTooLarge,
+			fmt.Sprintf("Request body exceeds the %d byte limit", tooLarge.Limit))
+		return
+	}
+	writeJSONError(w, http.StatusBadRequest, "Invalid request body")
+}
 
-	// Stream the JSON response
-	encoder := json.NewEncoder(gz)
+// requestContext derives the context for running a request's queries. It is
+// a child of the request context, so a client disconnect cancels the query
+// on the server as well, and carries the request's timeout. It can also be
+// cancelled through /cancel until the returned function is called.
+func requestContext(w http.ResponseWriter, r *http.Request, timeoutMS int64) (context.Context, context.CancelFunc) {
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if timeout := requestTimeout(timeoutMS); timeout > 0 {
+		ctx, cancel = context.WithTimeout(r.Context(), timeout)
+	} else {
+		ctx, cancel = context.WithCancel(r.Context())
+	}
+	return ctx, trackQuery(ctx, w, r, cancel)
+}
 
-	// Write column names first
-	queryResponse := map[string]interface{}{
-		"columns": columns,
-		"rows":    [][]interface{}{},
+// requestTimeout returns the timeout for a request: timeoutMS when set,
+// capped at maxQueryTimeout, or the server default.
+func requestTimeout(timeoutMS int64) time.Duration {
+	if timeoutMS <= 0 {
+		return queryTimeout
+	}
+	timeout := time.Duration(timeoutMS) * time.Millisecond
+	if maxQueryTimeout > 0 && timeout > maxQueryTimeout {
+		return maxQueryTimeout
 	}
+	return timeout
+}
 
-	if err := encoder.Encode(queryResponse); err != nil {
-		http.Error(w, fmt.Sprintf("Error encoding response: %v", err), http.StatusInternalServerError)
+// requestDeadline returns the stream deadline for a request: deadlineMS when
+// set, capped at maxStreamDeadline, or the server default.
+func requestDeadline(deadlineMS int64) time.Duration {
+	if deadlineMS <= 0 {
+		return streamDeadline
+	}
+	deadline := time.Duration(deadlineMS) * time.Millisecond
+	if maxStreamDeadline > 0 && deadline > maxStreamDeadline {
+		return maxStreamDeadline
+	}
+	return deadline
+}
+
+// rowLimit returns the row limit for a request: limit when set, capped at
+// maxRows, or maxRows itself. Zero means unlimited.
+func rowLimit(limit int64) int64 {
+	if limit <= 0 || (maxRows > 0 && limit > maxRows) {
+		return maxRows
+	}
+	return limit
+}
+
+// requestPool returns the pool for the database named in the request body,
+// falling back to the ?db= URL parameter and then the default database.
+func requestPool(r *http.Request, name string) (*pgxpool.Pool, error) {
+	if name == "" {
+		name = r.URL.Query().Get("db")
+	}
+	return selectPool(name)
+}
+
+// writeStartFailure reports an error returned by startQuery.
+func writeStartFailure(ctx context.Context, w http.ResponseWriter, err error) {
+	var acquireErr acquireError
+	if errors.As(err, &acquireErr) {
+		writeAcquireFailure(ctx, w, acquireErr.err)
 		return
 	}
+	writeQueryFailure(ctx, w, err)
+}
+
+// writeAcquireFailure reports that no connection could be acquired.
+func writeAcquireFailure(ctx context.Context, w http.ResponseWriter, err error) {
+	if errors.Is(err, errBreakerOpen) {
+		queryErrors.WithLabelValues(errorQuery).Inc()
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(breakerCooldown.Seconds()))))
+		writeJSONError(w, http.StatusServiceUnavailable, "Database unavailable")
+		return
+	}
+	if errors.Is(err, errDatabaseUnavailable) {
+		queryErrors.WithLabelValues(errorQuery).Inc()
+		writeJSONError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	if errors.Is(err, errNoConnections) {
+		queryErrors.WithLabelValues(errorQuery).Inc()
+		w.Header().Set("Retry-After", "1")
+		writeJSONError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		queryErrors.WithLabelValues(errorTimeout).Inc()
+		writeJSONError(w, http.StatusGatewayTimeout, "Query timed out")
+		return
+	}
+	queryErrors.WithLabelValues(errorQuery).Inc()
+	writeQueryError(w, http.StatusServiceUnavailable, "Unable to acquire connection", err)
+}
+
+// writeQueryFailure reports a failed query, distinguishing a query that ran
+// past its deadline (and was canceled by pgx) from one Postgres rejected.
+func writeQueryFailure(ctx context.Context, w http.ResponseWriter, err error) {
+	if ctx.Err() == context.DeadlineExceeded {
+		queryErrors.WithLabelValues(errorTimeout).Inc()
+		slog.WarnContext(ctx, "Query timed out")
+		writeJSONError(w, http.StatusGatewayTimeout, "Query timed out")
+		return
+	}
+	queryErrors.WithLabelValues(errorQuery).Inc()
+	slog.WarnContext(ctx, "Query failed", pgErrorAttrs(err)...)
+	writeQueryError(w, http.StatusBadRequest, "Query error", err)
+}
+
+// Output formats a client can request via the Accept header or the format
+// query parameter, see negotiateFormat.
+const (
+	formatJSON    = "json"
+	formatGeoJSON = "geojson"
+	formatCSV     = "csv"
+	formatObjects = "objects"
+	formatMsgpack = "msgpack"
+	formatNDJSON  = "ndjson"
+	formatArrow   = "arrow"
+)
+
+// resultWriter renders a result set in a single output format. The header is
+// written before the first row and the footer after the last one; once the
+// body has started the status code can no longer change, so the footer is
+// also responsible for reporting a failure that happened mid-stream.
+type resultWriter interface {
+	contentType() string
+	writeHeader(w io.Writer, columns []column) error
+	writeRow(w io.Writer, values []interface{}) error
+	writeFooter(w io.Writer, summary resultSummary) error
+}
+
+// rawRowWriter is a resultWriter that is passed rows as pgx decoded them
+// rather than normalized, because its encoding has typed values of its own.
+type rawRowWriter interface {
+	resultWriter
+	rawRows()
+}
+
+// bufferedWriter is a resultWriter that holds back what it writes until
+// flushRecords, which streamResult calls before every flush.
+type bufferedWriter interface {
+	resultWriter
+	flushRecords() error
+}
+
+// resultSummary describes how streaming a result ended.
+type resultSummary struct {
+	// cursor is the token for fetching the next page of a paginated query.
+	cursor string
+	// limitApplied is the LIMIT added to the query by withAutoLimit, if any.
+	limitApplied int64
+	// notices are the notices Postgres sent while the query ran.
+	notices []notice
+	// truncated is set when rows were left out because of the row limit,
+	// the response size limit or the stream deadline.
+	truncated bool
+	// total is the number of rows the query returns in all, when counted.
+	total *int64
+	// err is the failure that stopped streaming, if any.
+	err error
+}
+
+// streamOptions control how streamResult writes a result.
+type streamOptions struct {
+	// limit is the most rows written, when positive.
+	limit int64
+	// total and limitApplied are passed on to the footer.
+	total        *int64
+	limitApplied int64
+	// flush, when set, sends what was written so far to the client after
+	// the header and every flushRows rows.
+	flushRows int64
+	flush     func() error
+	// binaryEncoding is how normalized bytea values are rendered.
+	binaryEncoding binaryEncoding
+	// notices, when set, takes the notices for the footer once the rows
+	// have been written.
+	notices func() []notice
+}
+
+// streamResult writes rows to w one at a time without buffering the result.
+// The summary tells how streaming ended; the error is a failure to write the
+// response, which for formats that can't report a mid-stream failure
+// includes summary.err.
+func streamResult(ctx context.Context, w io.Writer, rows pgx.Rows, columns []column, out resultWriter, opts streamOptions) (resultSummary, error) {
+	if b, ok := out.(bufferedWriter); ok && opts.flush != nil {
+		flush := opts.flush
+		opts.flush = func() error {
+			if err := b.flushRecords(); err != nil {
+				return err
+			}
+			return flush()
+		}
+	}
+	lw := &limitedWriter{w: w, limit: maxResponseBytes}
+	if err := out.writeHeader(lw, columns); err != nil {
+		return resultSummary{err: err}, err
+	}
+	if opts.flush != nil {
+		if err := opts.flush(); err != nil {
+			return resultSummary{err: err}, err
+		}
+	}
+	truncated, err := streamRows(ctx, lw, rows, columns, out, opts)
+	summary := resultSummary{truncated: truncated, total: opts.total, limitApplied: opts.limitApplied, err: err}
+	if opts.notices != nil {
+		summary.notices = opts.notices()
+	}
+	// The footer is written regardless, to end the document properly.
+	lw.limit = 0
+	return summary, out.writeFooter(lw, summary)
+}
 
-	// Stream rows
+func streamRows(ctx context.Context, w io.Writer, rows pgx.Rows, columns []column, out resultWriter, opts streamOptions) (bool, error) {
+	info := requestInfoFrom(ctx)
+	_, raw := out.(rawRowWriter)
+	var n int64
 	for rows.Next() {
+		if err := ctx.Err(); err != nil {
+			if context.Cause(ctx) == errStreamDeadline {
+				return true, nil
+			}
+			return false, fmt.Errorf("Query canceled: %v", err)
+		}
+		if opts.limit > 0 && n >= opts.limit {
+			return true, nil
+		}
+
 		values, err := rows.Values()
 		if err != nil {
-			http.Error(w, fmt.Sprintf("Error reading row: %v", err), http.StatusInternalServerError)
-			return
+			return false, fmt.Errorf("Error reading row: %v", err)
 		}
-
-		// Encode each row individually
-		row := map[string]interface{}{
-			"rows": [][]interface{}{values},
+		if !raw {
+			if err := normalizeRow(values, columns, opts.binaryEncoding); err != nil {
+				return false, fmt.Errorf("Error encoding row: %v", err)
+			}
 		}
-		if err := encoder.Encode(row); err != nil {
-			http.Error(w, fmt.Sprintf("Error encoding row: %v", err), http.StatusInternalServerError)
-			return
+		if err := out.writeRow(w, values); err != nil {
+			if errors.Is(err, errResponseTooLarge) {
+				return true, nil
+			}
+			return false, fmt.Errorf("Error encoding row: %v", err)
+		}
+		n++
+		info.rows++
+		if opts.flush != nil && n%opts.flushRows == 0 {
+			if err := opts.flush(); err != nil {
+				return false, fmt.Errorf("Error flushing response: %v", err)
+			}
 		}
 	}
 
 	if rows.Err() != nil {
-		http.Error(w, fmt.Sprintf("Query error: %v", rows.Err()), http.StatusInternalServerError)
-		return
+		if context.Cause(ctx) == errStreamDeadline {
+			return true, nil
+		}
+		return false, fmt.Errorf("Query error: %w", rows.Err())
 	}
+	return false, nil
 }
 
 func getColumnNames(columns []pgproto3.FieldDescription) []string {
@@ -118,3 +1075,30 @@ func getColumnNames(columns []pgproto3.FieldDescription) []string {
 	}
 	return names
 }
+
+// convertParams turns decoded JSON values into types pgx can bind. Numbers are
+// decoded as json.Number so integers stay int64 instead of becoming float64.
+func convertParams(params []interface{}) []interface{} {
+	args := make([]interface{}, len(params))
+	for i, p := range params {
+		args[i] = convertParam(p)
+	}
+	return args
+}
+
+func convertParam(p interface{}) interface{} {
+	switch v := p.(type) {
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return n
+		}
+		if f, err := v.Float64(); err == nil {
+			return f
+		}
+		return v.String()
+	case []interface{}:
+		return convertParams(v)
+	default:
+		return v
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgproto3/v2"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// useUnreachablePool makes a pool that never connects the default database
+// for the rest of the test, so handlers can run up to acquiring a
+// connection without a server.
+func useUnreachablePool(t *testing.T) *pgxpool.Pool {
+	t.Helper()
+	pool := newUnreachablePool(t)
+	setTestPool(t, pool)
+	return pool
+}
+
+// useTestDatabase makes the database at PGPROXY_TEST_DATABASE_URL the
+// default database for the rest of the test, skipping the test when it
+// isn't set.
+func useTestDatabase(t *testing.T) *pgxpool.Pool {
+	t.Helper()
+	dbURL := os.Getenv("PGPROXY_TEST_DATABASE_URL")
+	if dbURL == "" {
+		t.Skip("PGPROXY_TEST_DATABASE_URL not set")
+	}
+	config, err := poolConfig("test", dbURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool, err := pgxpool.ConnectConfig(context.Background(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setTestPool(t, pool)
+	return pool
+}
+
+// setTestPool makes pool the default database until the test ends.
+func setTestPool(t *testing.T, pool *pgxpool.Pool) {
+	poolsMu.Lock()
+	oldPools, oldDefault := pools, defaultDB
+	pools, defaultDB = map[string]*pgxpool.Pool{"test": pool}, "test"
+	poolsMu.Unlock()
+	t.Cleanup(func() {
+		poolsMu.Lock()
+		pools, defaultDB = oldPools, oldDefault
+		poolsMu.Unlock()
+		pool.Close()
+	})
+}
+
+// withPrincipal returns r as authenticated as principal.
+func withPrincipal(r *http.Request, principal string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), requestInfoKey{}, &requestInfo{principal: principal}))
+}
+
+// fakeRows is a result of already decoded values, for streaming without a
+// database.
+type fakeRows struct {
+	fields []pgproto3.FieldDescription
+	values [][]interface{}
+	tag    pgconn.CommandTag
+	i      int
+	err    error
+}
+
+func (r *fakeRows) Close()                                         {}
+func (r *fakeRows) Err() error                                     { return r.err }
+func (r *fakeRows) CommandTag() pgconn.CommandTag                  { return r.tag }
+func (r *fakeRows) FieldDescriptions() []pgproto3.FieldDescription { return r.fields }
+func (r *fakeRows) RawValues() [][]byte                            { return nil }
+
+func (r *fakeRows) Next() bool {
+	r.i++
+	return r.i <= len(r.values)
+}
+
+func (r *fakeRows) Values() ([]interface{}, error) { return r.values[r.i-1], nil }
+
+func (r *fakeRows) Scan(dest ...interface{}) error {
+	for i, d := range dest {
+		reflect.ValueOf(d).Elem().Set(reflect.ValueOf(r.values[r.i-1][i]))
+	}
+	return nil
+}
+
+func TestConvertParams(t *testing.T) {
+	tests := []struct {
+		json string
+		want []interface{}
+	}{
+		{`[1, -2, 9007199254740993]`, []interface{}{int64(1), int64(-2), int64(9007199254740993)}},
+		{`[1.5, 1e3, 1e400]`, []interface{}{1.5, float64(1000), "1e400"}},
+		{`["a", true, null]`, []interface{}{"a", true, nil}},
+		{`[[1, 2.5], []]`, []interface{}{[]interface{}{int64(1), 2.5}, []interface{}{}}},
+		{`[{"a": 1}]`, []interface{}{map[string]interface{}{"a": json.Number("1")}}},
+	}
+	for _, tt := range tests {
+		dec := json.NewDecoder(strings.NewReader(tt.json))
+		dec.UseNumber()
+		var params []interface{}
+		if err := dec.Decode(&params); err != nil {
+			t.Fatal(err)
+		}
+		if got := convertParams(params); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("convertParams(%s) = %#v, want %#v", tt.json, got, tt.want)
+		}
+	}
+}
+
+// streamValues streams values as the rows of a result with columns through
+// out and returns the response body.
+func streamValues(t *testing.T, out resultWriter, columns []column, values [][]interface{}) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if _, err := streamResult(context.Background(), &buf, &fakeRows{values: values}, columns, out, streamOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestStreamResult(t *testing.T) {
+	columns := []column{{Name: "id", Type: "int4"}, {Name: "v", Type: "text"}}
+	tests := []struct {
+		name   string
+		values [][]interface{}
+		want   []interface{}
+	}{
+		{"no rows", nil, []interface{}{}},
+		{"one row", [][]interface{}{{1, "a"}}, []interface{}{[]interface{}{1.0, "a"}}},
+		{"several rows", [][]interface{}{{1, nil}, {2, true}, {3, "c,d"}}, []interface{}{
+			[]interface{}{1.0, nil}, []interface{}{2.0, true}, []interface{}{3.0, "c,d"},
+		}},
+	}
+	for _, tt := range tests {
+		body := streamValues(t, &jsonWriter{}, columns, tt.values)
+		var doc struct {
+			Columns []string      `json:"columns"`
+			Rows    []interface{} `json:"rows"`
+		}
+		if err := json.Unmarshal(body, &doc); err != nil {
+			t.Errorf("%s: invalid JSON %s: %v", tt.name, body, err)
+			continue
+		}
+		if !reflect.DeepEqual(doc.Columns, []string{"id", "v"}) || !reflect.DeepEqual(doc.Rows, tt.want) {
+			t.Errorf("%s: columns %v, rows %v, want %v", tt.name, doc.Columns, doc.Rows, tt.want)
+		}
+	}
+}
+
+func TestDecodeBody(t *testing.T) {
+	defer func(max int64) { maxBodyBytes = max }(maxBodyBytes)
+	maxBodyBytes = 64
+	query := `{"query":"SELECT 1"}`
+	tests := []struct {
+		name string
+		body string
+		want int
+	}{
+		{"under the limit", query, http.StatusOK},
+		{"at the limit", query + strings.Repeat(" ", 64-len(query)), http.StatusOK},
+		{"over the limit", `{"query":"SELECT '` + strings.Repeat("x", 64) + `'"}`, http.StatusRequestEntityTooLarge},
+		{"invalid JSON", `{"query":`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodPost, "/query", strings.NewReader(tt.body))
+		w := httptest.NewRecorder()
+		var q SQLQuery
+		if err := decodeBody(w, r, &q); err != nil {
+			writeBodyError(w, err)
+		}
+		if w.Code != tt.want {
+			t.Errorf("%s: status %d, want %d", tt.name, w.Code, tt.want)
+		}
+	}
+}
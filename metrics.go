@@ -0,0 +1,77 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Error categories for queryErrors.
+const (
+	errorBadRequest = "bad_request"
+	errorQuery      = "query_error"
+	errorTimeout    = "timeout"
+)
+
+var (
+	queriesTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "pgproxy_queries_total",
+		Help: "Total number of query requests received.",
+	})
+	queryErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "pgproxy_query_errors_total",
+		Help: "Total number of failed query requests by category.",
+	}, []string{"category"})
+	queryDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "pgproxy_query_duration_seconds",
+		Help:    "Time spent running a query and streaming its result.",
+		Buckets: prometheus.ExponentialBuckets(0.001, 4, 10),
+	})
+	requestsInFlight = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "pgproxy_requests_in_flight",
+		Help: "Number of query requests currently being served.",
+	})
+	queuedRequests = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "pgproxy_queued_requests",
+		Help: "Number of requests waiting for a query slot.",
+	})
+)
+
+// poolCollector exports the statistics of every database pool, read from
+// the pools on every scrape.
+type poolCollector struct {
+	acquired *prometheus.Desc
+	idle     *prometheus.Desc
+	total    *prometheus.Desc
+	max      *prometheus.Desc
+	breaker  *prometheus.Desc
+}
+
+func newPoolCollector() *poolCollector {
+	labels := []string{"database"}
+	return &poolCollector{
+		acquired: prometheus.NewDesc("pgproxy_pool_acquired_conns", "Number of connections currently in use.", labels, nil),
+		idle:     prometheus.NewDesc("pgproxy_pool_idle_conns", "Number of idle connections in the pool.", labels, nil),
+		total:    prometheus.NewDesc("pgproxy_pool_total_conns", "Total number of connections in the pool.", labels, nil),
+		max:      prometheus.NewDesc("pgproxy_pool_max_conns", "Maximum size of the pool.", labels, nil),
+		breaker:  prometheus.NewDesc("pgproxy_circuit_breaker_state", "Circuit breaker state: 0 closed, 1 open, 2 half-open.", labels, nil),
+	}
+}
+
+func (c *poolCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.acquired
+	ch <- c.idle
+	ch <- c.total
+	ch <- c.max
+	ch <- c.breaker
+}
+
+func (c *poolCollector) Collect(ch chan<- prometheus.Metric) {
+	for name, pool := range currentPools() {
+		stat := pool.Stat()
+		ch <- prometheus.MustNewConstMetric(c.acquired, prometheus.GaugeValue, float64(stat.AcquiredConns()), name)
+		ch <- prometheus.MustNewConstMetric(c.idle, prometheus.GaugeValue, float64(stat.IdleConns()), name)
+		ch <- prometheus.MustNewConstMetric(c.total, prometheus.GaugeValue, float64(stat.TotalConns()), name)
+		ch <- prometheus.MustNewConstMetric(c.max, prometheus.GaugeValue, float64(stat.MaxConns()), name)
+		ch <- prometheus.MustNewConstMetric(c.breaker, prometheus.GaugeValue, float64(breakerFor(pool).currentState()), name)
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// msgpackWriter emits the same {"columns","columnTypes","rows"} document as
+// jsonWriter, encoded as MessagePack. A MessagePack array is prefixed with its
+// length, so the encoded rows are buffered until the row count is known; the
+// buffer holds the compact encoding only, and its size is bounded by the row
+// limit and maxResponseBytes.
+type msgpackWriter struct {
+	columns  []column
+	rows     bytes.Buffer
+	enc      *msgpack.Encoder
+	rowCount int
+}
+
+func (m *msgpackWriter) contentType() string { return "application/msgpack" }
+
+func (m *msgpackWriter) writeHeader(w io.Writer, columns []column) error {
+	m.columns = columns
+	m.enc = msgpack.NewEncoder(&m.rows)
+	m.enc.SetSortMapKeys(true)
+	return nil
+}
+
+func (m *msgpackWriter) writeRow(w io.Writer, values []interface{}) error {
+	for i, v := range values {
+		values[i] = msgpackNumbers(v)
+	}
+	size := m.rows.Len()
+	if err := m.enc.Encode(values); err != nil {
+		return err
+	}
+	if maxResponseBytes > 0 && int64(m.rows.Len()) > maxResponseBytes {
+		m.rows.Truncate(size)
+		return errResponseTooLarge
+	}
+	m.rowCount++
+	return nil
+}
+
+func (m *msgpackWriter) writeFooter(w io.Writer, summary resultSummary) error {
+	fields := 3
+	if summary.truncated {
+		fields++
+	}
+	if summary.total != nil {
+		fields++
+	}
+	if summary.limitApplied > 0 {
+		fields++
+	}
+	if summary.notices != nil {
+		fields++
+	}
+	if summary.err != nil {
+		fields++
+	}
+
+	enc := msgpack.NewEncoder(w)
+	if err := enc.EncodeMapLen(fields); err != nil {
+		return err
+	}
+	if err := encodeField(enc, "columns", columnNames(m.columns)); err != nil {
+		return err
+	}
+	if err := encodeField(enc, "columnTypes", columnTypeNames(m.columns)); err != nil {
+		return err
+	}
+	if err := enc.EncodeString("rows"); err != nil {
+		return err
+	}
+	if err := enc.EncodeArrayLen(m.rowCount); err != nil {
+		return err
+	}
+	if _, err := w.Write(m.rows.Bytes()); err != nil {
+		return err
+	}
+	if summary.truncated {
+		if err := encodeField(enc, "truncated", true); err != nil {
+			return err
+		}
+	}
+	if summary.total != nil {
+		if err := encodeField(enc, "total", *summary.total); err != nil {
+			return err
+		}
+	}
+	if summary.limitApplied > 0 {
+		if err := encodeField(enc, "limitApplied", summary.limitApplied); err != nil {
+			return err
+		}
+	}
+	if summary.notices != nil {
+		if err := encodeField(enc, "notices", summary.notices); err != nil {
+			return err
+		}
+	}
+	if summary.err != nil {
+		return encodeField(enc, "error", summary.err.Error())
+	}
+	return nil
+}
+
+// encodeField writes a key and its value into a MessagePack map.
+func encodeField(enc *msgpack.Encoder, key string, value interface{}) error {
+	if err := enc.EncodeString(key); err != nil {
+		return err
+	}
+	return enc.Encode(value)
+}
+
+// msgpackNumbers replaces the json.Number values of decoded json with
+// MessagePack integers or floats, which would otherwise be encoded as
+// strings.
+func msgpackNumbers(v interface{}) interface{} {
+	switch v := v.(type) {
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return n
+		}
+		if f, err := v.Float64(); err == nil {
+			return f
+		}
+		return string(v)
+	case map[string]interface{}:
+		for k, e := range v {
+			v[k] = msgpackNumbers(e)
+		}
+	case []interface{}:
+		for i, e := range v {
+			v[i] = msgpackNumbers(e)
+		}
+	}
+	return v
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// namedQueries maps the names clients may call through /named/{name} to the
+// SQL they run, loaded from QUERIES_FILE.
+var namedQueries map[string]string
+
+// loadNamedQueries reads a file mapping query names to parameterized SQL, as
+// YAML when its extension is .yaml or .yml and as JSON otherwise:
+//
+//	parcels_in_municipality: |
+//	  SELECT id, geom FROM parcels WHERE municipality = $1
+//
+// An empty path loads no queries.
+func loadNamedQueries(path string) (map[string]string, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("invalid QUERIES_FILE: %v", err)
+	}
+
+	var queries map[string]string
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &queries)
+	default:
+		err = json.Unmarshal(data, &queries)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid QUERIES_FILE %q: %v", path, err)
+	}
+	for name, sql := range queries {
+		if strings.TrimSpace(sql) == "" {
+			return nil, fmt.Errorf("invalid QUERIES_FILE %q: query %q is empty", path, name)
+		}
+	}
+	return queries, nil
+}
+
+// namedQueryHandler runs one of the pre-approved namedQueries. The request is
+// a /query request without the SQL: a POST body with params and the other
+// SQLQuery options, or a GET with repeated param values. Clients can't send
+// SQL of their own, which makes it suitable for a public API.
+func namedQueryHandler(w http.ResponseWriter, r *http.Request) {
+	queriesTotal.Inc()
+	requestsInFlight.Inc()
+	defer requestsInFlight.Dec()
+
+	name := r.PathValue("name")
+	sql, ok := namedQueries[name]
+	if !ok {
+		queryErrors.WithLabelValues(errorBadRequest).Inc()
+		writeJSONError(w, http.StatusNotFound, fmt.Sprintf("Unknown query %q", name))
+		return
+	}
+
+	sqlQuery, ok := readQuery(w, r)
+	if !ok {
+		return
+	}
+	if sqlQuery.Query != "" {
+		queryErrors.WithLabelValues(errorBadRequest).Inc()
+		writeJSONError(w, http.StatusBadRequest, "Named queries don't accept SQL")
+		return
+	}
+	sqlQuery.Query = sql
+	if err := checkParamCount(sqlQuery.Query, sqlQuery.Params); err != nil {
+		queryErrors.WithLabelValues(errorBadRequest).Inc()
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	runQuery(w, r, sqlQuery, 0)
+}
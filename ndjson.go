@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+)
+
+// ndjsonWriter emits newline-delimited JSON: a first line with the column
+// metadata, {"columns":[...],"columnTypes":[...]}, followed by one object per
+// row keyed by column name. Every line can be decoded on its own, and each is
+// flushed to the client as soon as it is written. A last line with "error"
+// and/or "truncated" is added when streaming didn't run to completion.
+type ndjsonWriter struct {
+	keys  []string
+	flush func() error
+}
+
+func (n *ndjsonWriter) contentType() string { return "application/x-ndjson" }
+
+func (n *ndjsonWriter) writeHeader(w io.Writer, columns []column) error {
+	n.keys = uniqueKeys(columnNames(columns))
+	header, err := json.Marshal(map[string]interface{}{
+		"columns":     columnNames(columns),
+		"columnTypes": columnTypeNames(columns),
+	})
+	if err != nil {
+		return err
+	}
+	return n.writeLine(w, header)
+}
+
+func (n *ndjsonWriter) writeRow(w io.Writer, values []interface{}) error {
+	row, err := marshalObject(n.keys, values)
+	if err != nil {
+		return err
+	}
+	return n.writeLine(w, row)
+}
+
+func (n *ndjsonWriter) writeFooter(w io.Writer, summary resultSummary) error {
+	if !summary.truncated && summary.total == nil && summary.limitApplied == 0 && summary.notices == nil && summary.err == nil {
+		return nil
+	}
+	footer := make(map[string]interface{})
+	if summary.truncated {
+		footer["truncated"] = true
+	}
+	if summary.total != nil {
+		footer["total"] = *summary.total
+	}
+	if summary.limitApplied > 0 {
+		footer["limitApplied"] = summary.limitApplied
+	}
+	if summary.notices != nil {
+		footer["notices"] = summary.notices
+	}
+	if summary.err != nil {
+		footer["error"] = summary.err.Error()
+	}
+	line, err := json.Marshal(footer)
+	if err != nil {
+		return err
+	}
+	return n.writeLine(w, line)
+}
+
+func (n *ndjsonWriter) writeLine(w io.Writer, line []byte) error {
+	if _, err := w.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	if n.flush != nil {
+		return n.flush()
+	}
+	return nil
+}
@@ -0,0 +1,572 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgtype"
+	"github.com/jackc/pgx/v4"
+)
+
+// textConnInfo is used to render pgtype values in their Postgres text format.
+var textConnInfo = pgtype.NewConnInfo()
+
+// maxByteaBytes caps the size of a single bytea value in a response, set
+// through MAX_BYTEA_BYTES. Zero disables the limit.
+var maxByteaBytes = 16 << 20
+
+// binaryEncoding is how bytea values are rendered in a response, chosen
+// per request with "binaryEncoding". The zero value is base64.
+type binaryEncoding string
+
+const (
+	// base64Encoding is standard, padded base64.
+	base64Encoding binaryEncoding = "base64"
+	// hexEncoding is Postgres' hex format, e.g. \xdeadbeef.
+	hexEncoding binaryEncoding = "hex"
+	// escapeEncoding is Postgres' escape format: printable ASCII as is, a
+	// backslash doubled and any other byte as a backslash and three octal
+	// digits.
+	escapeEncoding binaryEncoding = "escape"
+)
+
+// checkBinaryEncoding checks a request's binaryEncoding.
+func checkBinaryEncoding(e binaryEncoding) error {
+	switch e {
+	case "", base64Encoding, hexEncoding, escapeEncoding:
+		return nil
+	}
+	return fmt.Errorf("Invalid binaryEncoding %q: must be base64, hex or escape", e)
+}
+
+// encode renders a bytea value.
+func (e binaryEncoding) encode(b []byte) string {
+	switch e {
+	case hexEncoding:
+		return `\x` + hex.EncodeToString(b)
+	case escapeEncoding:
+		var s strings.Builder
+		for _, c := range b {
+			switch {
+			case c == '\\':
+				s.WriteString(`\\`)
+			case c >= 0x20 && c < 0x7f:
+				s.WriteByte(c)
+			default:
+				fmt.Fprintf(&s, `\%03o`, c)
+			}
+		}
+		return s.String()
+	}
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+// normalizeRow replaces the values of a row, as returned by rows.Values(),
+// with their normalized form so every output format renders them the same.
+func normalizeRow(values []interface{}, columns []column, enc binaryEncoding) error {
+	for i, v := range values {
+		var n interface{}
+		var err error
+		if text, ok := v.(string); ok && columns[i].Fields != nil {
+			n, err = normalizeComposite(text, columns[i].Fields, enc)
+		} else {
+			n, err = normalizeValue(v, columns[i].OID, enc)
+		}
+		if err != nil {
+			return fmt.Errorf("column %q: %v", columns[i].Name, err)
+		}
+		values[i] = n
+	}
+	return nil
+}
+
+// normalizeValue converts a value decoded by pgx into a plain value that
+// encodes predictably as JSON:
+//
+//   - timestamptz becomes an RFC 3339 string with its offset; timestamp, which
+//     has no time zone, the same without one
+//   - date becomes YYYY-MM-DD and time becomes HH:MM:SS[.ffffff]
+//   - interval becomes an ISO 8601 duration such as P1Y2M3DT4H5M6S
+//   - numeric becomes its exact decimal string, avoiding float rounding
+//   - infinite dates, timestamps and numerics become "infinity"/"-infinity",
+//     and non-finite floats "NaN", "Infinity" or "-Infinity", which JSON
+//     can't represent as numbers
+//   - uuid and inet become their usual text form
+//   - bytea becomes a string in enc, by default standard, padded base64;
+//     values larger than maxByteaBytes are an error rather than silently
+//     bloating the response
+//   - json and jsonb become the nested value they hold, with numbers kept
+//     exact as json.Number; text that fails to parse is returned as is
+//   - arrays become arrays of their normalized elements, nested for
+//     multi-dimensional arrays, with NULL elements as nil; lower bounds other
+//     than 1 are not preserved
+//   - ranges become objects with their bounds, see normalizeRange, and
+//     anonymous records objects keyed f1, f2, ...; composite types with a
+//     name are decoded by normalizeRow, which knows their fields
+//
+// oid is the column's type OID, needed where pgx decodes different types
+// into the same Go type.
+func normalizeValue(v interface{}, oid uint32, enc binaryEncoding) (interface{}, error) {
+	switch v := v.(type) {
+	case []byte:
+		if maxByteaBytes > 0 && len(v) > maxByteaBytes {
+			return nil, fmt.Errorf("binary value of %d bytes exceeds the %d byte limit", len(v), maxByteaBytes)
+		}
+		return enc.encode(v), nil
+	case time.Time:
+		switch oid {
+		case pgtype.DateOID:
+			return v.Format("2006-01-02"), nil
+		case pgtype.TimestampOID:
+			return v.Format("2006-01-02T15:04:05.999999"), nil
+		default:
+			return v.Format("2006-01-02T15:04:05.999999Z07:00"), nil
+		}
+	case int64:
+		if oid == pgtype.TimeOID {
+			return formatTimeOfDay(v), nil
+		}
+		return v, nil
+	case float32:
+		return normalizeFloat(float64(v)), nil
+	case float64:
+		return normalizeFloat(v), nil
+	case pgtype.InfinityModifier:
+		return v.String(), nil
+	case pgtype.Numeric:
+		return formatNumeric(v), nil
+	case pgtype.Interval:
+		return formatInterval(v), nil
+	case [16]byte:
+		return fmt.Sprintf("%x-%x-%x-%x-%x", v[0:4], v[4:6], v[6:8], v[8:10], v[10:16]), nil
+	case *net.IPNet:
+		return formatIPNet(v), nil
+	case pgtype.JSON:
+		return decodeJSON(v.Bytes, v.Status), nil
+	case pgtype.JSONB:
+		return decodeJSON(v.Bytes, v.Status), nil
+	case []pgtype.Value:
+		return normalizeRecord(v, enc)
+	case pgtype.TextEncoder:
+		if elements, ok := arrayElements(v); ok {
+			return normalizeArray(elements, oid, enc)
+		}
+		if rv, ok := rangeValue(v); ok {
+			return normalizeRange(rv, oid, enc)
+		}
+		buf, err := v.EncodeText(textConnInfo, nil)
+		if err != nil {
+			return nil, err
+		}
+		return string(buf), nil
+	default:
+		return v, nil
+	}
+}
+
+// decodeJSON parses the text of a json or jsonb value.
+func decodeJSON(text []byte, status pgtype.Status) interface{} {
+	if status != pgtype.Present {
+		return nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(text))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return string(text)
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return string(text)
+	}
+	return v
+}
+
+// jsonValue and jsonbValue replace pgtype's json and jsonb types on every
+// connection, see registerJSONTypes. Their Get returns the value itself
+// rather than pgtype's decoding of it, which turns every number into a
+// float64, so normalizeValue can decode it exactly.
+type (
+	jsonValue  struct{ pgtype.JSON }
+	jsonbValue struct{ pgtype.JSONB }
+)
+
+func (v jsonValue) Get() interface{}  { return v.JSON }
+func (v jsonbValue) Get() interface{} { return v.JSONB }
+
+// registerJSONTypes is the AfterConnect hook of every pool.
+func registerJSONTypes(ctx context.Context, conn *pgx.Conn) error {
+	conn.ConnInfo().RegisterDataType(pgtype.DataType{Value: &jsonValue{}, Name: "json", OID: pgtype.JSONOID})
+	conn.ConnInfo().RegisterDataType(pgtype.DataType{Value: &jsonbValue{}, Name: "jsonb", OID: pgtype.JSONBOID})
+	return nil
+}
+
+func normalizeFloat(f float64) interface{} {
+	switch {
+	case math.IsNaN(f):
+		return "NaN"
+	case math.IsInf(f, 1):
+		return "Infinity"
+	case math.IsInf(f, -1):
+		return "-Infinity"
+	default:
+		return f
+	}
+}
+
+// formatNumeric renders a numeric as a plain decimal string. pgtype keeps it
+// as an integer and a base-10 exponent, and its own text encoding uses
+// scientific notation.
+func formatNumeric(n pgtype.Numeric) string {
+	if n.NaN {
+		return "NaN"
+	}
+	if n.Int == nil {
+		return "0"
+	}
+	digits := n.Int.String()
+	sign := ""
+	if strings.HasPrefix(digits, "-") {
+		sign, digits = "-", digits[1:]
+	}
+	if n.Exp >= 0 {
+		return sign + digits + strings.Repeat("0", int(n.Exp))
+	}
+	scale := int(-n.Exp)
+	if len(digits) <= scale {
+		digits = strings.Repeat("0", scale-len(digits)+1) + digits
+	}
+	return sign + digits[:len(digits)-scale] + "." + digits[len(digits)-scale:]
+}
+
+// formatTimeOfDay formats microseconds since midnight as HH:MM:SS[.ffffff].
+func formatTimeOfDay(us int64) string {
+	t := time.Unix(0, us*int64(time.Microsecond)).UTC()
+	return t.Format("15:04:05.999999")
+}
+
+// formatInterval renders an interval in ISO 8601 duration format, matching
+// Postgres' IntervalStyle iso_8601 (each field carries its own sign).
+func formatInterval(iv pgtype.Interval) string {
+	if iv.Months == 0 && iv.Days == 0 && iv.Microseconds == 0 {
+		return "PT0S"
+	}
+
+	var b strings.Builder
+	b.WriteByte('P')
+	if years := iv.Months / 12; years != 0 {
+		fmt.Fprintf(&b, "%dY", years)
+	}
+	if months := iv.Months % 12; months != 0 {
+		fmt.Fprintf(&b, "%dM", months)
+	}
+	if iv.Days != 0 {
+		fmt.Fprintf(&b, "%dD", iv.Days)
+	}
+
+	if us := iv.Microseconds; us != 0 {
+		b.WriteByte('T')
+		hours := us / int64(time.Hour/time.Microsecond)
+		us -= hours * int64(time.Hour/time.Microsecond)
+		minutes := us / int64(time.Minute/time.Microsecond)
+		us -= minutes * int64(time.Minute/time.Microsecond)
+		if hours != 0 {
+			fmt.Fprintf(&b, "%dH", hours)
+		}
+		if minutes != 0 {
+			fmt.Fprintf(&b, "%dM", minutes)
+		}
+		if us != 0 {
+			seconds := strconv.FormatFloat(float64(us)/1e6, 'f', -1, 64)
+			fmt.Fprintf(&b, "%sS", seconds)
+		}
+	}
+	return b.String()
+}
+
+// formatIPNet renders an inet/cidr value like Postgres does, omitting the
+// prefix length for a single host address.
+func formatIPNet(n *net.IPNet) string {
+	ones, bits := n.Mask.Size()
+	if ones == bits {
+		return n.IP.String()
+	}
+	return n.String()
+}
+
+// arrayDimensionsType is the type of the Dimensions field of pgtype arrays.
+var arrayDimensionsType = reflect.TypeOf([]pgtype.ArrayDimension(nil))
+
+// arrayElements returns the elements and dimensions of a pgtype array such
+// as pgtype.Int4Array. Each of them has an Elements slice and a Dimensions
+// field of the same shape, but no common interface to get at them.
+func arrayElements(v interface{}) (reflect.Value, bool) {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Struct {
+		return reflect.Value{}, false
+	}
+	dims, elements := rv.FieldByName("Dimensions"), rv.FieldByName("Elements")
+	if !dims.IsValid() || dims.Type() != arrayDimensionsType || !elements.IsValid() || elements.Kind() != reflect.Slice {
+		return reflect.Value{}, false
+	}
+	return rv, true
+}
+
+// normalizeArray converts an array found by arrayElements into nested
+// []interface{}, normalizing each element. oid is the OID of the array type.
+func normalizeArray(array reflect.Value, oid uint32, enc binaryEncoding) (interface{}, error) {
+	elemOID := arrayElementOID(oid)
+	elements := array.FieldByName("Elements")
+	values := make([]interface{}, elements.Len())
+	for i := range values {
+		elem := elements.Index(i).Interface()
+		switch e := elem.(type) {
+		case pgtype.JSON, pgtype.JSONB:
+			// Decoded by normalizeValue, see jsonValue.
+		case interface{ Get() interface{} }:
+			elem = e.Get()
+		default:
+			return nil, fmt.Errorf("unsupported array element %s", elements.Index(i).Type())
+		}
+		v, err := normalizeValue(elem, elemOID, enc)
+		if err != nil {
+			return nil, err
+		}
+		if _, isStatus := v.(pgtype.Status); isStatus {
+			v = nil
+		}
+		values[i] = v
+	}
+	return nestArray(values, array.FieldByName("Dimensions").Interface().([]pgtype.ArrayDimension)), nil
+}
+
+// nestArray splits the flat elements of a multi-dimensional array into one
+// slice per dimension.
+func nestArray(values []interface{}, dims []pgtype.ArrayDimension) []interface{} {
+	if len(dims) <= 1 || dims[0].Length == 0 {
+		return values
+	}
+	n := int(dims[0].Length)
+	size := len(values) / n
+	nested := make([]interface{}, n)
+	for i := range nested {
+		nested[i] = nestArray(values[i*size:(i+1)*size], dims[1:])
+	}
+	return nested
+}
+
+// arrayElementOID returns the OID of the element type of an array type,
+// which Postgres names after the element type with a leading underscore.
+// It returns 0 for types pgx doesn't know.
+func arrayElementOID(oid uint32) uint32 {
+	dt, ok := textConnInfo.DataTypeForOID(oid)
+	if !ok || !strings.HasPrefix(dt.Name, "_") {
+		return 0
+	}
+	if elem, ok := textConnInfo.DataTypeForName(dt.Name[1:]); ok {
+		return elem.OID
+	}
+	return 0
+}
+
+// rangeElementOIDs maps the built-in range types to their element types.
+var rangeElementOIDs = map[uint32]uint32{
+	pgtype.Int4rangeOID: pgtype.Int4OID,
+	pgtype.Int8rangeOID: pgtype.Int8OID,
+	pgtype.NumrangeOID:  pgtype.NumericOID,
+	pgtype.DaterangeOID: pgtype.DateOID,
+	pgtype.TsrangeOID:   pgtype.TimestampOID,
+	pgtype.TstzrangeOID: pgtype.TimestamptzOID,
+}
+
+// boundType is the type of the LowerType and UpperType fields of pgtype
+// ranges.
+var boundType = reflect.TypeOf(pgtype.BoundType(0))
+
+// rangeValue returns v if it is a pgtype range such as pgtype.Int4range.
+// Like arrays, they share a shape but no interface.
+func rangeValue(v interface{}) (reflect.Value, bool) {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Struct {
+		return reflect.Value{}, false
+	}
+	for _, name := range []string{"LowerType", "UpperType"} {
+		if f := rv.FieldByName(name); !f.IsValid() || f.Type() != boundType {
+			return reflect.Value{}, false
+		}
+	}
+	for _, name := range []string{"Lower", "Upper"} {
+		if _, ok := rv.FieldByName(name).Interface().(interface{ Get() interface{} }); !ok {
+			return reflect.Value{}, false
+		}
+	}
+	return rv, true
+}
+
+// normalizeRange converts a range found by rangeValue into an object:
+//
+//	{"lower": 1, "upper": 10, "lowerInclusive": true, "upperInclusive": false}
+//
+// An unbounded side has a nil bound and isn't inclusive; an empty range is
+// {"empty": true}. oid is the OID of the range type.
+func normalizeRange(rv reflect.Value, oid uint32, enc binaryEncoding) (interface{}, error) {
+	lowerType := rv.FieldByName("LowerType").Interface().(pgtype.BoundType)
+	upperType := rv.FieldByName("UpperType").Interface().(pgtype.BoundType)
+	if lowerType == pgtype.Empty || upperType == pgtype.Empty {
+		return map[string]interface{}{"empty": true}, nil
+	}
+	result := make(map[string]interface{}, 4)
+	for _, side := range []struct {
+		name  string
+		bound pgtype.BoundType
+	}{{"lower", lowerType}, {"upper", upperType}} {
+		var v interface{}
+		if side.bound != pgtype.Unbounded {
+			var err error
+			field := strings.ToUpper(side.name[:1]) + side.name[1:]
+			bound := rv.FieldByName(field).Interface().(interface{ Get() interface{} }).Get()
+			if v, err = normalizeValue(bound, rangeElementOIDs[oid], enc); err != nil {
+				return nil, err
+			}
+		}
+		result[side.name] = v
+		result[side.name+"Inclusive"] = side.bound == pgtype.Inclusive
+	}
+	return result, nil
+}
+
+// normalizeRecord converts the fields of an anonymous record, such as
+// ROW(1, 'a'), into an object. Postgres doesn't name them, so they are
+// keyed f1, f2, ... as by row_to_json.
+func normalizeRecord(fields []pgtype.Value, enc binaryEncoding) (interface{}, error) {
+	result := make(map[string]interface{}, len(fields))
+	for i, f := range fields {
+		var oid uint32
+		if dt, ok := textConnInfo.DataTypeForValue(f); ok {
+			oid = dt.OID
+		}
+		v, err := normalizeValue(f.Get(), oid, enc)
+		if err != nil {
+			return nil, err
+		}
+		if _, isStatus := v.(pgtype.Status); isStatus {
+			v = nil
+		}
+		result["f"+strconv.Itoa(i+1)] = v
+	}
+	return result, nil
+}
+
+// normalizeComposite converts the text of a composite type value, such as
+// (1,"a b",), into an object keyed by the type's fields. Postgres sends
+// composite types pgx doesn't know about as text; each field is decoded
+// from its text by the field's type and normalized, or left as text if pgx
+// doesn't know that either.
+func normalizeComposite(text string, fields []compositeField, enc binaryEncoding) (interface{}, error) {
+	if len(fields) == 0 {
+		return map[string]interface{}{}, nil
+	}
+	values, err := splitComposite(text)
+	if err != nil {
+		return nil, err
+	}
+	if len(values) != len(fields) {
+		return nil, fmt.Errorf("composite value has %d fields, expected %d", len(values), len(fields))
+	}
+	result := make(map[string]interface{}, len(fields))
+	for i, f := range fields {
+		if values[i] == nil {
+			result[f.Name] = nil
+			continue
+		}
+		v, err := decodeText(*values[i], f.OID)
+		if err != nil {
+			return nil, fmt.Errorf("field %q: %v", f.Name, err)
+		}
+		if result[f.Name], err = normalizeValue(v, f.OID, enc); err != nil {
+			return nil, fmt.Errorf("field %q: %v", f.Name, err)
+		}
+	}
+	return result, nil
+}
+
+// decodeText decodes the text form of a value of type oid as pgx would.
+func decodeText(text string, oid uint32) (interface{}, error) {
+	switch oid {
+	case pgtype.JSONOID, pgtype.JSONBOID:
+		return pgtype.JSON{Bytes: []byte(text), Status: pgtype.Present}, nil
+	}
+	dt, ok := textConnInfo.DataTypeForOID(oid)
+	if !ok {
+		return text, nil
+	}
+	value := pgtype.NewValue(dt.Value)
+	decoder, ok := value.(pgtype.TextDecoder)
+	if !ok {
+		return text, nil
+	}
+	if err := decoder.DecodeText(textConnInfo, []byte(text)); err != nil {
+		return nil, err
+	}
+	return value.Get(), nil
+}
+
+// splitComposite splits the text of a composite value into the text of its
+// fields, with nil for NULL. A field may be double-quoted, with "" for a
+// quote, and any character may be escaped with a backslash.
+func splitComposite(text string) ([]*string, error) {
+	if len(text) < 2 || text[0] != '(' || text[len(text)-1] != ')' {
+		return nil, fmt.Errorf("malformed composite value %q", text)
+	}
+	body := text[1 : len(text)-1]
+	var (
+		fields   []*string
+		field    strings.Builder
+		present  bool
+		inQuotes bool
+	)
+	for i := 0; i < len(body); i++ {
+		switch c := body[i]; {
+		case c == '\\' && i+1 < len(body):
+			i++
+			field.WriteByte(body[i])
+			present = true
+		case c == '"' && inQuotes && i+1 < len(body) && body[i+1] == '"':
+			i++
+			field.WriteByte('"')
+		case c == '"':
+			inQuotes = !inQuotes
+			present = true
+		case c == ',' && !inQuotes:
+			fields = append(fields, fieldText(field.String(), present))
+			field.Reset()
+			present = false
+		default:
+			field.WriteByte(c)
+			present = true
+		}
+	}
+	if inQuotes {
+		return nil, fmt.Errorf("malformed composite value %q", text)
+	}
+	return append(fields, fieldText(field.String(), present)), nil
+}
+
+// fieldText returns the text of a composite field, or nil for NULL: a field
+// that is empty rather than "".
+func fieldText(text string, present bool) *string {
+	if !present {
+		return nil
+	}
+	return &text
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/jackc/pgtype"
+)
+
+func TestBinaryEncoding(t *testing.T) {
+	value := []byte("a\\b\x00\xff ")
+	tests := []struct {
+		enc  binaryEncoding
+		want string
+	}{
+		{"", "YVxiAP8g"},
+		{base64Encoding, "YVxiAP8g"},
+		{hexEncoding, `\x615c6200ff20`},
+		{escapeEncoding, `a\\b\000\377 `},
+	}
+	for _, tt := range tests {
+		if err := checkBinaryEncoding(tt.enc); err != nil {
+			t.Errorf("checkBinaryEncoding(%q): %v", tt.enc, err)
+		}
+		got, err := normalizeValue(value, pgtype.ByteaOID, tt.enc)
+		if err != nil {
+			t.Errorf("%q: %v", tt.enc, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%q: %q, want %q", tt.enc, got, tt.want)
+		}
+	}
+	if err := checkBinaryEncoding("base32"); err == nil {
+		t.Error("base32 accepted")
+	}
+}
+
+func TestSplitComposite(t *testing.T) {
+	tests := []struct {
+		text string
+		want []interface{}
+	}{
+		{`()`, []interface{}{nil}},
+		{`(1,"a b",)`, []interface{}{"1", "a b", nil}},
+		{`(,"")`, []interface{}{nil, ""}},
+		{`("say ""hi""",a\,b)`, []interface{}{`say "hi"`, "a,b"}},
+	}
+	for _, tt := range tests {
+		fields, err := splitComposite(tt.text)
+		if err != nil {
+			t.Errorf("%s: %v", tt.text, err)
+			continue
+		}
+		got := make([]interface{}, len(fields))
+		for i, f := range fields {
+			if f != nil {
+				got[i] = *f
+			}
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: %q, want %q", tt.text, got, tt.want)
+		}
+	}
+	for _, text := range []string{``, `1,2`, `("a)`} {
+		if _, err := splitComposite(text); err == nil {
+			t.Errorf("%q accepted", text)
+		}
+	}
+}
+
+func TestNormalizeComposite(t *testing.T) {
+	fields := []compositeField{
+		{Name: "id", OID: pgtype.Int4OID},
+		{Name: "name", OID: pgtype.TextOID},
+		{Name: "note", OID: pgtype.TextOID},
+	}
+	got, err := normalizeComposite(`(7,"a b",)`, fields, base64Encoding)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{"id": int32(7), "name": "a b", "note": nil}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("%v, want %v", got, want)
+	}
+	if _, err := normalizeComposite(`(7)`, fields, base64Encoding); err == nil {
+		t.Error("short composite accepted")
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+)
+
+// maxNotices caps the notices kept for a request, so a function raising one
+// per row can't grow the response without bound.
+const maxNotices = 100
+
+// notice is a message Postgres sent along with a query's result, such as
+// one raised with RAISE NOTICE or a WARNING, returned in the response's
+// "notices".
+type notice struct {
+	Severity string `json:"severity" msgpack:"severity"`
+	Message  string `json:"message" msgpack:"message"`
+	Detail   string `json:"detail,omitempty" msgpack:"detail,omitempty"`
+	Hint     string `json:"hint,omitempty" msgpack:"hint,omitempty"`
+}
+
+// pendingNotices holds the notices each connection received while acquired,
+// until the request using it takes them.
+var pendingNotices = struct {
+	sync.Mutex
+	m map[*pgconn.PgConn][]notice
+}{m: make(map[*pgconn.PgConn][]notice)}
+
+// collectNotice is the OnNotice hook of every connection.
+func collectNotice(conn *pgconn.PgConn, n *pgconn.Notice) {
+	pendingNotices.Lock()
+	defer pendingNotices.Unlock()
+	if _, ok := pendingNotices.m[conn]; !ok {
+		// A connection the pool destroys instead of releasing never reaches
+		// discardNotices, so drop what closed ones left behind.
+		for c := range pendingNotices.m {
+			if c.IsClosed() {
+				delete(pendingNotices.m, c)
+			}
+		}
+	}
+	if len(pendingNotices.m[conn]) < maxNotices {
+		pendingNotices.m[conn] = append(pendingNotices.m[conn], notice{
+			Severity: n.Severity,
+			Message:  n.Message,
+			Detail:   n.Detail,
+			Hint:     n.Hint,
+		})
+	}
+}
+
+// takeNotices returns the notices conn received since they were last taken.
+func takeNotices(conn *pgconn.PgConn) []notice {
+	pendingNotices.Lock()
+	defer pendingNotices.Unlock()
+	notices := pendingNotices.m[conn]
+	delete(pendingNotices.m, conn)
+	return notices
+}
+
+// discardNotices is the AfterRelease hook of every pool: notices the
+// request didn't take are dropped, so they can't show up in the response
+// to the next request using the connection.
+func discardNotices(conn *pgx.Conn) bool {
+	takeNotices(conn.PgConn())
+	return true
+}
+
+// querierNotices takes the notices of the connection q runs on.
+func querierNotices(q querier) []notice {
+	switch q := q.(type) {
+	case *pgx.Conn:
+		return takeNotices(q.PgConn())
+	case interface{ Conn() *pgx.Conn }:
+		return takeNotices(q.Conn().PgConn())
+	}
+	return nil
+}
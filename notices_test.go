@@ -0,0 +1,24 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/jackc/pgconn"
+)
+
+func TestNotices(t *testing.T) {
+	conn := &pgconn.PgConn{}
+	for i := 0; i < maxNotices+10; i++ {
+		collectNotice(conn, &pgconn.Notice{Severity: "NOTICE", Message: "row", Hint: "h"})
+	}
+	notices := takeNotices(conn)
+	if len(notices) != maxNotices {
+		t.Fatalf("%d notices, want %d", len(notices), maxNotices)
+	}
+	if n := notices[0]; n != (notice{Severity: "NOTICE", Message: "row", Hint: "h"}) {
+		t.Errorf("notice %+v", n)
+	}
+	if notices := takeNotices(conn); notices != nil {
+		t.Errorf("notices taken twice: %v", notices)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// paramName is the form of a named parameter. Names are only ever looked up,
+// never put into the SQL, but rejecting anything else catches a name that
+// could never match its placeholder.
+var paramName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// checkParamCount returns an error unless sql has placeholders $1 up to $n
+// for the n params, so a mismatch is reported as a bad request before the
+// query is sent rather than as a bind error from Postgres.
+func checkParamCount(sql string, params []interface{}) error {
+	tokens, err := tokenize(sql)
+	if err != nil {
+		return err
+	}
+	placeholders := 0
+	for _, t := range tokens {
+		if t.kind != tokenParam {
+			continue
+		}
+		n, err := strconv.Atoi(t.text[1:])
+		if err != nil {
+			return fmt.Errorf("Invalid placeholder %s", t.text)
+		}
+		placeholders = max(placeholders, n)
+	}
+	if placeholders != len(params) {
+		return fmt.Errorf("Query has %d placeholders but %d params were given", placeholders, len(params))
+	}
+	return nil
+}
+
+// bindNamedParams rewrites the @name placeholders of q.Query to positional
+// ones and sets q.Params to the values of q.NamedParams in their order, e.g.
+//
+//	{"query": "SELECT * FROM t WHERE a = @id OR b = @id", "namedParams": {"id": 42}}
+//
+// runs SELECT * FROM t WHERE a = $1 OR b = $1 with 42 for $1. A name used
+// more than once binds the same parameter each time. Placeholders in string
+// literals, quoted identifiers and comments are left alone, as are @
+// operators such as @> and <@. Every placeholder needs a value and every
+// value a placeholder.
+func bindNamedParams(q *SQLQuery) error {
+	if q.NamedParams == nil {
+		return nil
+	}
+	if len(q.Params) > 0 {
+		return errors.New("Set either params or namedParams, not both")
+	}
+	for name := range q.NamedParams {
+		if !paramName.MatchString(name) {
+			return fmt.Errorf("Invalid parameter name %q", name)
+		}
+	}
+	tokens, err := tokenize(q.Query)
+	if err != nil {
+		return err
+	}
+
+	var sql strings.Builder
+	positions := make(map[string]int)
+	var params []interface{}
+	last := 0
+	for i, t := range tokens {
+		if t.kind == tokenParam {
+			return errors.New("Positional placeholders can't be combined with namedParams")
+		}
+		if !isNamedPlaceholder(tokens, i) {
+			continue
+		}
+		name := tokens[i+1].text
+		value, ok := q.NamedParams[name]
+		if !ok {
+			return fmt.Errorf("Missing value for parameter @%s", name)
+		}
+		n, ok := positions[name]
+		if !ok {
+			params = append(params, value)
+			n = len(params)
+			positions[name] = n
+		}
+		sql.WriteString(q.Query[last:t.pos])
+		sql.WriteString("$" + strconv.Itoa(n))
+		last = tokens[i+1].end
+	}
+	if len(positions) < len(q.NamedParams) {
+		var unused []string
+		for name := range q.NamedParams {
+			if _, ok := positions[name]; !ok {
+				unused = append(unused, name)
+			}
+		}
+		sort.Strings(unused)
+		return fmt.Errorf("Unused parameters: %s", strings.Join(unused, ", "))
+	}
+	sql.WriteString(q.Query[last:])
+	q.Query, q.Params, q.NamedParams = sql.String(), params, nil
+	return nil
+}
+
+// isNamedPlaceholder reports whether tokens[i] is the @ of an @name
+// placeholder: an @ directly followed by a name but not directly preceded
+// by another operator character, which would make it part of an operator.
+func isNamedPlaceholder(tokens []token, i int) bool {
+	t := tokens[i]
+	if t.kind != tokenPunct || t.text != "@" || i+1 == len(tokens) {
+		return false
+	}
+	next := tokens[i+1]
+	if next.kind != tokenWord || next.pos != t.end {
+		return false
+	}
+	if i > 0 {
+		prev := tokens[i-1]
+		if prev.kind == tokenPunct && prev.end == t.pos && strings.ContainsAny(prev.text, "+-*/<>=~!@#%^&|`?") {
+			return false
+		}
+	}
+	return true
+}
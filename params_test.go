@@ -0,0 +1,93 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestBindNamedParams(t *testing.T) {
+	tests := []struct {
+		name       string
+		query      string
+		named      map[string]interface{}
+		params     []interface{}
+		wantQuery  string
+		wantParams []interface{}
+		wantErr    bool
+	}{
+		{
+			name:      "no named params",
+			query:     "SELECT $1",
+			params:    []interface{}{1},
+			wantQuery: "SELECT $1", wantParams: []interface{}{1},
+		},
+		{
+			name:      "repeated name",
+			query:     "SELECT * FROM t WHERE a = @id OR b = @id AND c = @name",
+			named:     map[string]interface{}{"id": 42, "name": "x"},
+			wantQuery: "SELECT * FROM t WHERE a = $1 OR b = $1 AND c = $2", wantParams: []interface{}{42, "x"},
+		},
+		{
+			name:      "literals, identifiers and comments",
+			query:     `SELECT '@id', "@id", @id -- @id` + "\n/* @id */",
+			named:     map[string]interface{}{"id": 1},
+			wantQuery: `SELECT '@id', "@id", $1 -- @id` + "\n/* @id */", wantParams: []interface{}{1},
+		},
+		{
+			name:      "operators",
+			query:     "SELECT tags @> @tags, @tags <@ tags, @ -5, a@@b",
+			named:     map[string]interface{}{"tags": "{a}"},
+			wantQuery: "SELECT tags @> $1, $1 <@ tags, @ -5, a@@b", wantParams: []interface{}{"{a}"},
+		},
+		{
+			name:      "type cast",
+			query:     "SELECT @n::int",
+			named:     map[string]interface{}{"n": "1"},
+			wantQuery: "SELECT $1::int", wantParams: []interface{}{"1"},
+		},
+		{name: "missing value", query: "SELECT @a, @b", named: map[string]interface{}{"a": 1}, wantErr: true},
+		{name: "unused value", query: "SELECT @a", named: map[string]interface{}{"a": 1, "b": 2}, wantErr: true},
+		{name: "invalid name", query: "SELECT 1", named: map[string]interface{}{"a-b": 1}, wantErr: true},
+		{name: "with params", query: "SELECT @a", named: map[string]interface{}{"a": 1}, params: []interface{}{1}, wantErr: true},
+		{name: "with placeholders", query: "SELECT @a, $1", named: map[string]interface{}{"a": 1}, wantErr: true},
+		{name: "unterminated", query: "SELECT '@a", named: map[string]interface{}{"a": 1}, wantErr: true},
+	}
+	for _, tt := range tests {
+		q := SQLQuery{Query: tt.query, NamedParams: tt.named, Params: tt.params}
+		err := bindNamedParams(&q)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: error = %v, want error %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if tt.wantErr {
+			continue
+		}
+		if q.Query != tt.wantQuery || !reflect.DeepEqual(q.Params, tt.wantParams) || q.NamedParams != nil {
+			t.Errorf("%s: got %q %v %v, want %q %v", tt.name, q.Query, q.Params, q.NamedParams, tt.wantQuery, tt.wantParams)
+		}
+	}
+}
+
+func TestCheckParamCount(t *testing.T) {
+	tests := []struct {
+		query  string
+		params []interface{}
+		ok     bool
+	}{
+		{"SELECT 1", nil, true},
+		{"SELECT $1, $2", []interface{}{1, 2}, true},
+		{"SELECT $1 WHERE a = $1", []interface{}{1}, true},
+		{"SELECT $2, $1", []interface{}{1, 2}, true},
+		{"SELECT '$1', \"$2\" -- $3", nil, true},
+		{"SELECT $$ $1 $$", nil, true},
+		{"SELECT $1", nil, false},
+		{"SELECT $1", []interface{}{1, 2}, false},
+		{"SELECT $3", []interface{}{1}, false},
+		{"SELECT 1", []interface{}{1}, false},
+	}
+	for _, tt := range tests {
+		if err := checkParamCount(tt.query, tt.params); (err == nil) != tt.ok {
+			t.Errorf("checkParamCount(%q, %v) = %v, want ok %v", tt.query, tt.params, err, tt.ok)
+		}
+	}
+}
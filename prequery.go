@@ -0,0 +1,57 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// preQuerySettings are the SET statements of PRE_QUERY_SQL, run as SET LOCAL
+// at the start of every request's transaction before its own settings, so a
+// deployment can set a time zone, statement timeout or role for all queries:
+//
+//	PRE_QUERY_SQL="SET timezone = 'UTC'; SET ROLE reporting"
+var preQuerySettings []sessionSetting
+
+// loadPreQuerySQL reads preQuerySettings from PRE_QUERY_SQL, or the file
+// named by PRE_QUERY_SQL_FILE.
+func loadPreQuerySQL() error {
+	sql, err := envOrFile("PRE_QUERY_SQL")
+	if err != nil || sql == "" {
+		return err
+	}
+	tokens, err := tokenize(sql)
+	if err != nil {
+		return fmt.Errorf("invalid PRE_QUERY_SQL: %v", err)
+	}
+	var settings []sessionSetting
+	for _, stmt := range splitStatements(tokens) {
+		local, err := localSet(sql, stmt)
+		if err != nil {
+			return fmt.Errorf("invalid PRE_QUERY_SQL statement %q: %v", sql[stmt[0].pos:stmt[len(stmt)-1].end], err)
+		}
+		settings = append(settings, sessionSetting{statement: local})
+	}
+	preQuerySettings = settings
+	return nil
+}
+
+// localSet returns the SET statement stmt of sql as SET LOCAL, so that it
+// only lasts for the transaction. Anything but a plain SET is refused, and
+// so are SET SESSION, which would outlive it, and SET TRANSACTION, which
+// has to come before any query.
+func localSet(sql string, stmt []token) (string, error) {
+	if !stmt[0].is("set") {
+		return "", errors.New("only SET statements are allowed")
+	}
+	rest := stmt[1:]
+	if len(rest) > 0 && rest[0].is("local") {
+		rest = rest[1:]
+	}
+	if len(rest) == 0 {
+		return "", errors.New("incomplete SET statement")
+	}
+	if rest[0].is("session") || rest[0].is("transaction") {
+		return "", fmt.Errorf("SET %s is not allowed", rest[0].text)
+	}
+	return "SET LOCAL " + sql[rest[0].pos:rest[len(rest)-1].end], nil
+}
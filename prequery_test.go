@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestLocalSet(t *testing.T) {
+	tests := []struct {
+		sql     string
+		want    string
+		wantErr bool
+	}{
+		{sql: "SET timezone = 'UTC'", want: "SET LOCAL timezone = 'UTC'"},
+		{sql: "set local work_mem to '64MB'", want: "SET LOCAL work_mem to '64MB'"},
+		{sql: "SET ROLE reporting", want: "SET LOCAL ROLE reporting"},
+		{sql: "SET search_path = a, \"B\"", want: "SET LOCAL search_path = a, \"B\""},
+		{sql: "SET", wantErr: true},
+		{sql: "SET LOCAL", wantErr: true},
+		{sql: "SET SESSION timezone = 'UTC'", wantErr: true},
+		{sql: "SET TRANSACTION ISOLATION LEVEL SERIALIZABLE", wantErr: true},
+		{sql: "RESET ROLE", wantErr: true},
+		{sql: "SELECT set_config('a.b', 'c', true)", wantErr: true},
+	}
+	for _, tt := range tests {
+		tokens, err := tokenize(tt.sql)
+		if err != nil {
+			t.Fatalf("tokenize(%q): %v", tt.sql, err)
+		}
+		got, err := localSet(tt.sql, tokens)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("localSet(%q) error = %v, want error %v", tt.sql, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("localSet(%q) = %q, want %q", tt.sql, got, tt.want)
+		}
+	}
+}
+
+func TestLoadPreQuerySQL(t *testing.T) {
+	tests := []struct {
+		sql     string
+		want    []string
+		wantErr bool
+	}{
+		{sql: "SET timezone = 'UTC'; SET ROLE reporting;", want: []string{"SET LOCAL timezone = 'UTC'", "SET LOCAL ROLE reporting"}},
+		{sql: "SET application_name = 'a;b'", want: []string{"SET LOCAL application_name = 'a;b'"}},
+		{sql: "SET", wantErr: true},
+		{sql: "SET;", wantErr: true},
+		{sql: "SET timezone = 'UTC'; DROP TABLE t", wantErr: true},
+		{sql: "SET timezone = 'UTC", wantErr: true},
+	}
+	defer func() { preQuerySettings = nil }()
+	for _, tt := range tests {
+		t.Setenv("PRE_QUERY_SQL", tt.sql)
+		preQuerySettings = nil
+		err := loadPreQuerySQL()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("PRE_QUERY_SQL=%q: error = %v, want error %v", tt.sql, err, tt.wantErr)
+			continue
+		}
+		var got []string
+		for _, s := range preQuerySettings {
+			got = append(got, s.statement)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("PRE_QUERY_SQL=%q: statements %q, want %q", tt.sql, got, tt.want)
+		}
+	}
+}
+
+func TestSessionSettingsPreQuery(t *testing.T) {
+	preQuerySettings = []sessionSetting{{statement: "SET LOCAL ROLE reporting"}}
+	defer func() { preQuerySettings = nil }()
+	settings, err := sessionSettings(context.Background(), SessionOptions{StatementTimeoutMS: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(settings) < 2 || settings[0].statement != "SET LOCAL ROLE reporting" {
+		t.Fatalf("settings %+v don't start with PRE_QUERY_SQL", settings)
+	}
+	// The request's own settings come after, so they win over the defaults.
+	if last := settings[len(settings)-1]; last.name != "statement_timeout" || last.value != "1000" {
+		t.Errorf("settings %+v don't end with the request's statement_timeout", settings)
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"golang.org/x/sync/semaphore"
+)
+
+// multiQueryConcurrency is how many queries of a /queries request run at
+// once, each on a connection of its own, set through
+// MULTI_QUERY_CONCURRENCY.
+var multiQueryConcurrency = 4
+
+// MultiQueryRequest is the body of a /queries request: independent queries
+// keyed by name, e.g. the queries a dashboard runs on load.
+type MultiQueryRequest struct {
+	DB        string       `json:"db,omitempty"`
+	Queries   []MultiQuery `json:"queries"`
+	TimeoutMS int64        `json:"timeout_ms,omitempty"`
+
+	SessionOptions
+}
+
+// MultiQuery is a query of a MultiQueryRequest.
+type MultiQuery struct {
+	Name           string         `json:"name"`
+	Query          string         `json:"query"`
+	Params         []interface{}  `json:"params"`
+	ResultFormat   string         `json:"result_format,omitempty"`
+	BinaryEncoding binaryEncoding `json:"binaryEncoding,omitempty"`
+}
+
+// multiQueryHandler runs the queries of the request concurrently, at most
+// multiQueryConcurrency at a time, and replies with their results by name:
+//
+//	{"results": {"a": {"columns": [...], "rows": [...]}, "b": {"error": ...}}}
+//
+// Unlike /transaction the queries are independent: each runs and commits in
+// a transaction of its own, and one that fails gets an error body in place
+// of its result without affecting the others. The request timeout covers
+// all of them together.
+func multiQueryHandler(w http.ResponseWriter, r *http.Request) {
+	queriesTotal.Inc()
+	requestsInFlight.Inc()
+	defer requestsInFlight.Dec()
+
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "Invalid request method")
+		return
+	}
+	var req MultiQueryRequest
+	if err := decodeBody(w, r, &req); err != nil {
+		queryErrors.WithLabelValues(errorBadRequest).Inc()
+		writeBodyError(w, err)
+		return
+	}
+	if len(req.Queries) == 0 {
+		queryErrors.WithLabelValues(errorBadRequest).Inc()
+		writeJSONError(w, http.StatusBadRequest, "No queries given")
+		return
+	}
+	names := make(map[string]bool, len(req.Queries))
+	for i, q := range req.Queries {
+		if q.Name == "" || names[q.Name] {
+			queryErrors.WithLabelValues(errorBadRequest).Inc()
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("Query %d: name must be set and unique", i+1))
+			return
+		}
+		names[q.Name] = true
+	}
+
+	ctx, cancel := requestContext(w, r, req.TimeoutMS)
+	defer cancel()
+	start := time.Now()
+	defer func() {
+		elapsed := time.Since(start)
+		requestInfoFrom(ctx).queryDuration = elapsed
+		queryDuration.Observe(elapsed.Seconds())
+	}()
+
+	settings, err := sessionSettings(ctx, req.SessionOptions)
+	if err != nil {
+		queryErrors.WithLabelValues(errorBadRequest).Inc()
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	pool, err := requestPool(r, req.DB)
+	if err != nil {
+		queryErrors.WithLabelValues(errorBadRequest).Inc()
+		writePoolError(w, err)
+		return
+	}
+
+	var (
+		mu      sync.Mutex
+		wg      sync.WaitGroup
+		results = make(map[string]interface{}, len(req.Queries))
+		info    = requestInfoFrom(ctx)
+		slots   = semaphore.NewWeighted(int64(multiQueryConcurrency))
+	)
+	// Every query is checked before any starts, so results is only written
+	// to concurrently under mu.
+	var valid []MultiQuery
+	for _, q := range req.Queries {
+		if status, err := checkMultiQuery(ctx, q); err != nil {
+			queryErrors.WithLabelValues(errorBadRequest).Inc()
+			results[q.Name] = errorResponse{Error: err.Error(), Status: status}
+			continue
+		}
+		valid = append(valid, q)
+	}
+	for _, q := range valid {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// The request info isn't safe for concurrent use, so each query
+			// records into its own and the totals are added up below.
+			sub := &requestInfo{id: info.id, principal: info.principal}
+			qctx := context.WithValue(ctx, requestInfoKey{}, sub)
+			var result interface{}
+			if err := slots.Acquire(qctx, 1); err != nil {
+				result = multiQueryError(qctx, err)
+			} else {
+				recordQuery(qctx, q.Query)
+				var err error
+				if result, err = runIndependent(qctx, pool, settings, q); err != nil {
+					result = multiQueryError(qctx, err)
+				}
+				slots.Release(1)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			results[q.Name] = result
+			info.rows += sub.rows
+			info.queries = append(info.queries, sub.queries...)
+		}()
+	}
+	wg.Wait()
+
+	w.Header().Set("Content-Type", "application/json")
+	body, closeBody := compressResponse(w, r)
+	defer closeBody()
+	json.NewEncoder(body).Encode(map[string]interface{}{"results": results})
+}
+
+// checkMultiQuery checks a query of a /queries request before it runs,
+// returning the status to report it with when it can't.
+func checkMultiQuery(ctx context.Context, q MultiQuery) (int, error) {
+	if err := checkQueryLength(q.Query); err != nil {
+		return http.StatusBadRequest, err
+	}
+	if err := checkParamCount(q.Query, q.Params); err != nil {
+		return http.StatusBadRequest, err
+	}
+	if err := checkClientQuery(ctx, q.Query); err != nil {
+		return http.StatusForbidden, err
+	}
+	if readOnly {
+		if err := checkReadOnly(q.Query); err != nil {
+			return http.StatusForbidden, err
+		}
+	}
+	if _, err := resultFormats(q.ResultFormat); err != nil {
+		return http.StatusBadRequest, err
+	}
+	if err := checkBinaryEncoding(q.BinaryEncoding); err != nil {
+		return http.StatusBadRequest, err
+	}
+	return 0, nil
+}
+
+// runIndependent runs q in a transaction of its own on a connection from
+// pool. A failure to acquire the connection is returned as an acquireError.
+func runIndependent(ctx context.Context, pool *pgxpool.Pool, settings []sessionSetting, q MultiQuery) (map[string]interface{}, error) {
+	conn, err := acquireConn(ctx, pool)
+	if err != nil {
+		return nil, acquireError{err}
+	}
+	defer conn.Release()
+
+	txOptions := pgx.TxOptions{}
+	if readOnly {
+		txOptions.AccessMode = pgx.ReadOnly
+	}
+	tx, err := conn.BeginTx(ctx, txOptions)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(context.Background())
+	if err := applySettings(ctx, tx, settings); err != nil {
+		return nil, err
+	}
+	result, err := runStatement(ctx, tx, SQLQuery{Query: q.Query, Params: q.Params, ResultFormat: q.ResultFormat, BinaryEncoding: q.BinaryEncoding})
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// multiQueryError builds the error body for a query of a /queries request,
+// telling the same failures apart as writeStartFailure.
+func multiQueryError(ctx context.Context, err error) errorResponse {
+	var acquireErr acquireError
+	switch {
+	case ctx.Err() == context.DeadlineExceeded:
+		queryErrors.WithLabelValues(errorTimeout).Inc()
+		return errorResponse{Error: "Query timed out", Status: http.StatusGatewayTimeout}
+	case errors.Is(err, errBreakerOpen):
+		queryErrors.WithLabelValues(errorQuery).Inc()
+		return errorResponse{Error: "Database unavailable", Status: http.StatusServiceUnavailable}
+	case errors.Is(err, errDatabaseUnavailable), errors.Is(err, errNoConnections):
+		queryErrors.WithLabelValues(errorQuery).Inc()
+		return errorResponse{Error: err.Error(), Status: http.StatusServiceUnavailable}
+	case errors.As(err, &acquireErr):
+		queryErrors.WithLabelValues(errorQuery).Inc()
+		return queryError(http.StatusServiceUnavailable, "Unable to acquire connection", err)
+	}
+	queryErrors.WithLabelValues(errorQuery).Inc()
+	slog.WarnContext(ctx, "Query failed", pgErrorAttrs(err)...)
+	return queryError(http.StatusBadRequest, "Query error", err)
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMultiQueryHandlerInvalidQuery(t *testing.T) {
+	useUnreachablePool(t)
+	// The valid queries start before the results of the invalid ones would
+	// have been written, which used to race with them.
+	body := `{"queries": [
+		{"name": "a", "query": "SELECT 1"},
+		{"name": "b", "query": "SELECT 2"},
+		{"name": "c", "query": "SELECT 3", "result_format": "octal"},
+		{"name": "d", "query": "SELECT 4", "binaryEncoding": "base32"}
+	]}`
+	r := httptest.NewRequest(http.MethodPost, "/queries", strings.NewReader(body))
+	w := httptest.NewRecorder()
+	multiQueryHandler(w, r)
+
+	var resp struct {
+		Results map[string]errorResponse `json:"results"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		status int
+	}{
+		{"a", http.StatusServiceUnavailable},
+		{"b", http.StatusServiceUnavailable},
+		{"c", http.StatusBadRequest},
+		{"d", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		result, ok := resp.Results[tt.name]
+		if !ok {
+			t.Errorf("no result for %s", tt.name)
+			continue
+		}
+		if result.Status != tt.status {
+			t.Errorf("%s: status %d, want %d (%s)", tt.name, result.Status, tt.status, result.Error)
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// quotaWindow is the period quotas are counted over, set through
+// QUOTA_WINDOW. Windows are aligned to multiples of it since the Unix epoch,
+// so the default of 24h resets every day at midnight UTC.
+var quotaWindow = 24 * time.Hour
+
+// quotaLimits caps the usage of an API key per quotaWindow. Zero leaves a
+// measure unlimited.
+type quotaLimits struct {
+	Queries  int64  `json:"queries" yaml:"queries"`
+	Rows     int64  `json:"rows" yaml:"rows"`
+	Duration string `json:"duration" yaml:"duration"`
+
+	duration time.Duration
+}
+
+// quotas holds the limits by the keyFingerprint of an API key, with the
+// limits of keys not listed under "*". It is nil when quotas are disabled.
+var quotas map[string]quotaLimits
+
+// loadQuotas reads the quotas of API keys from QUOTAS_FILE, as YAML when its
+// extension is .yaml or .yml and as JSON otherwise, keyed by API key:
+//
+//	"*":
+//	  queries: 10000
+//	reporting-key:
+//	  queries: 100000
+//	  rows: 50000000
+//	  duration: 2h
+//
+// duration caps the time spent running queries. An empty path disables
+// quotas.
+func loadQuotas(path string) (map[string]quotaLimits, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("invalid QUOTAS_FILE: %v", err)
+	}
+
+	var byKey map[string]quotaLimits
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &byKey)
+	default:
+		err = json.Unmarshal(data, &byKey)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid QUOTAS_FILE %q: %v", path, err)
+	}
+	loaded := make(map[string]quotaLimits, len(byKey))
+	for key, limits := range byKey {
+		if limits.Queries < 0 || limits.Rows < 0 {
+			return nil, fmt.Errorf("invalid QUOTAS_FILE %q: quotas of %q must not be negative", path, key)
+		}
+		if limits.Duration != "" {
+			if limits.duration, err = time.ParseDuration(limits.Duration); err != nil || limits.duration < 0 {
+				return nil, fmt.Errorf("invalid QUOTAS_FILE %q: invalid duration %q", path, limits.Duration)
+			}
+		}
+		if key != "*" {
+			key = keyFingerprint(key)
+		}
+		loaded[key] = limits
+	}
+	return loaded, nil
+}
+
+// quotaUsage is what an API key used in the window starting at start.
+type quotaUsage struct {
+	start    time.Time
+	queries  int64
+	rows     int64
+	duration time.Duration
+}
+
+// quotaUsages holds the usage of the current window by key fingerprint.
+var quotaUsages = struct {
+	sync.Mutex
+	keys map[string]*quotaUsage
+}{keys: make(map[string]*quotaUsage)}
+
+// quotaExceeded details the quota a rejected request ran out of.
+type quotaExceeded struct {
+	Limit    string    `json:"limit"`
+	Max      int64     `json:"max"`
+	Used     int64     `json:"used"`
+	ResetsAt time.Time `json:"resets_at"`
+}
+
+// enforceQuotas rejects requests of API keys that used up one of their
+// quotas in the current window with 429 Too Many Requests, the quota in the
+// error body and a Retry-After header until the window resets. Every
+// statement a request runs counts towards the queries quota once the request
+// is done, so requests already running when a quota runs out still finish
+// and may take it past its limit; /ws sessions are checked and charged per
+// message instead. Requests authenticated otherwise than by API key aren't
+// limited.
+func enforceQuotas(next http.Handler) http.Handler {
+	if quotas == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		info := requestInfoFrom(r.Context())
+		key, limits, ok := requestQuota(info)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if exceeded := checkQuota(key, limits, time.Now()); exceeded != nil {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(time.Until(exceeded.ResetsAt).Seconds()))))
+			writeErrorResponse(w, quotaError(exceeded))
+			return
+		}
+		next.ServeHTTP(w, r)
+		if !info.perMessage && (len(info.queries) > 0 || info.queryDuration > 0) {
+			addQuotaUsage(key, int64(len(info.queries)), info.rows, info.queryDuration, time.Now())
+		}
+	})
+}
+
+// requestQuota returns the API key of the request described by info and
+// the quotas that apply to it, or false when its usage isn't limited.
+func requestQuota(info *requestInfo) (string, quotaLimits, bool) {
+	if quotas == nil || !strings.HasPrefix(info.principal, "key:") {
+		return "", quotaLimits{}, false
+	}
+	limits, ok := quotas[info.principal]
+	if !ok {
+		limits, ok = quotas["*"]
+	}
+	return info.principal, limits, ok
+}
+
+// quotaError is the body of the response to a request rejected for
+// exceeding a quota.
+func quotaError(exceeded *quotaExceeded) errorResponse {
+	return errorResponse{
+		Error:  fmt.Sprintf("Quota of %d %s per %s exceeded", exceeded.Max, exceeded.Limit, quotaWindow),
+		Status: http.StatusTooManyRequests,
+		Quota:  exceeded,
+	}
+}
+
+// currentUsage returns the usage of key in the window containing now,
+// starting a new one at a window boundary. quotaUsages must be locked.
+func currentUsage(key string, now time.Time) *quotaUsage {
+	start := now.UTC().Truncate(quotaWindow)
+	usage, ok := quotaUsages.keys[key]
+	if !ok || usage.start.Before(start) {
+		// Drop the other keys' usage of past windows while at it.
+		for k, u := range quotaUsages.keys {
+			if u.start.Before(start) {
+				delete(quotaUsages.keys, k)
+			}
+		}
+		usage = &quotaUsage{start: start}
+		quotaUsages.keys[key] = usage
+	}
+	return usage
+}
+
+// checkQuota returns the quota of key that's used up at now, if any.
+func checkQuota(key string, limits quotaLimits, now time.Time) *quotaExceeded {
+	quotaUsages.Lock()
+	defer quotaUsages.Unlock()
+	usage := currentUsage(key, now)
+	resets := usage.start.Add(quotaWindow)
+	switch {
+	case limits.Queries > 0 && usage.queries >= limits.Queries:
+		return &quotaExceeded{Limit: "queries", Max: limits.Queries, Used: usage.queries, ResetsAt: resets}
+	case limits.Rows > 0 && usage.rows >= limits.Rows:
+		return &quotaExceeded{Limit: "rows", Max: limits.Rows, Used: usage.rows, ResetsAt: resets}
+	case limits.duration > 0 && usage.duration >= limits.duration:
+		return &quotaExceeded{Limit: "duration_ms", Max: limits.duration.Milliseconds(), Used: usage.duration.Milliseconds(), ResetsAt: resets}
+	}
+	return nil
+}
+
+// addQuotaUsage counts queries statements that returned rows and spent
+// duration running towards the quotas of key.
+func addQuotaUsage(key string, queries, rows int64, duration time.Duration, now time.Time) {
+	quotaUsages.Lock()
+	defer quotaUsages.Unlock()
+	usage := currentUsage(key, now)
+	usage.queries += queries
+	usage.rows += rows
+	usage.duration += duration
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// resetQuotaUsage empties the quota usage for the test.
+func resetQuotaUsage(t *testing.T) {
+	quotaUsages.Lock()
+	quotaUsages.keys = make(map[string]*quotaUsage)
+	quotaUsages.Unlock()
+	t.Cleanup(func() {
+		quotaUsages.Lock()
+		quotaUsages.keys = make(map[string]*quotaUsage)
+		quotaUsages.Unlock()
+	})
+}
+
+func TestCheckQuota(t *testing.T) {
+	resetQuotaUsage(t)
+	defer func(window time.Duration) { quotaWindow = window }(quotaWindow)
+	quotaWindow = time.Hour
+	limits := quotaLimits{Queries: 2, Rows: 100, duration: time.Minute}
+	start := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		queries  int64
+		rows     int64
+		duration time.Duration
+		at       time.Duration
+		want     string
+	}{
+		{"unused", 0, 0, 0, 0, ""},
+		{"one query", 1, 10, time.Second, time.Minute, ""},
+		{"queries used up", 1, 10, time.Second, 2 * time.Minute, "queries"},
+		{"next window", 0, 0, 0, time.Hour, ""},
+		{"rows used up", 1, 100, 0, time.Hour + time.Minute, "rows"},
+		{"third window", 0, 0, 0, 2 * time.Hour, ""},
+		{"duration used up", 1, 0, time.Minute, 2*time.Hour + time.Second, "duration_ms"},
+	}
+	for _, tt := range tests {
+		now := start.Add(tt.at)
+		if tt.queries > 0 {
+			addQuotaUsage("key:abc", tt.queries, tt.rows, tt.duration, now)
+		}
+		got := ""
+		if exceeded := checkQuota("key:abc", limits, now); exceeded != nil {
+			got = exceeded.Limit
+			if want := now.Truncate(time.Hour).Add(time.Hour); !exceeded.ResetsAt.Equal(want) {
+				t.Errorf("%s: resets at %s, want %s", tt.name, exceeded.ResetsAt, want)
+			}
+		}
+		if got != tt.want {
+			t.Errorf("%s: exceeded %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestEnforceQuotas(t *testing.T) {
+	resetQuotaUsage(t)
+	quotas = map[string]quotaLimits{"*": {Queries: 3}}
+	defer func() { quotas = nil }()
+	handler := enforceQuotas(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		recordQuery(r.Context(), "SELECT 1")
+		recordQuery(r.Context(), "SELECT 2")
+	}))
+
+	for i, want := range []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, withPrincipal(httptest.NewRequest(http.MethodPost, "/transaction", nil), "key:abc"))
+		if w.Code != want {
+			t.Errorf("request %d: status %d, want %d", i+1, w.Code, want)
+		}
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, withPrincipal(httptest.NewRequest(http.MethodPost, "/transaction", nil), "jwt:abc"))
+	if w.Code != http.StatusOK {
+		t.Errorf("request not by API key: status %d", w.Code)
+	}
+}
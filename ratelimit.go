@@ -0,0 +1,140 @@
+package main
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Rate limiting is opt-in: RATE_LIMIT_RPS sets the sustained requests per
+// second allowed per client and RATE_LIMIT_BURST (default: the rate, at least
+// 1) how many may arrive at once.
+var (
+	rateLimitRPS   float64
+	rateLimitBurst int
+)
+
+// trustProxyHeaders makes clientIP use X-Forwarded-For, set through
+// TRUST_PROXY_HEADERS=true when the proxy runs behind a load balancer.
+// Otherwise clients could pick their own rate-limit bucket.
+var trustProxyHeaders bool
+
+// limiterIdleTimeout is how long an unused client bucket is kept around.
+const limiterIdleTimeout = 10 * time.Minute
+
+type clientLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// rateLimiter keeps a token bucket per client.
+type rateLimiter struct {
+	mu       sync.Mutex
+	clients  map[string]*clientLimiter
+	lastScan time.Time
+	limit    rate.Limit
+	burst    int
+}
+
+// rateLimit rejects requests from clients that exceed their token bucket with
+// 429 Too Many Requests and a Retry-After header. Clients are identified by
+// API key when authentication is enabled and by IP address otherwise.
+func rateLimit(next http.Handler) http.Handler {
+	if rateLimitRPS <= 0 {
+		return next
+	}
+	burst := rateLimitBurst
+	if burst <= 0 {
+		burst = int(math.Max(1, math.Ceil(rateLimitRPS)))
+	}
+	rl := &rateLimiter{
+		clients: make(map[string]*clientLimiter),
+		limit:   rate.Limit(rateLimitRPS),
+		burst:   burst,
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if unauthenticatedPaths[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if delay := rl.reserve(clientKey(r)); delay > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(delay.Seconds()))))
+			writeJSONError(w, http.StatusTooManyRequests, "Rate limit exceeded")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// reserve takes a token from the client's bucket. When none is available it
+// returns how long until one will be, without consuming it.
+func (rl *rateLimiter) reserve(key string) time.Duration {
+	now := time.Now()
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	if now.Sub(rl.lastScan) > limiterIdleTimeout {
+		for k, c := range rl.clients {
+			if now.Sub(c.lastSeen) > limiterIdleTimeout {
+				delete(rl.clients, k)
+			}
+		}
+		rl.lastScan = now
+	}
+
+	c, ok := rl.clients[key]
+	if !ok {
+		c = &clientLimiter{limiter: rate.NewLimiter(rl.limit, rl.burst)}
+		rl.clients[key] = c
+	}
+	c.lastSeen = now
+
+	res := c.limiter.ReserveN(now, 1)
+	if delay := res.DelayFrom(now); delay > 0 {
+		res.CancelAt(now)
+		return delay
+	}
+	return 0
+}
+
+// clientKey identifies the client for rate limiting. API keys are only used
+// once requireAPIKey has validated them; without authentication a client
+// could otherwise get a fresh bucket by sending a new made-up key.
+func clientKey(r *http.Request) string {
+	if claims := claimsFrom(r.Context()); claims != nil {
+		if sub, _ := claims.GetSubject(); sub != "" {
+			return "sub:" + sub
+		}
+	}
+	if len(apiKeys) > 0 {
+		if key := requestAPIKey(r); key != "" {
+			return "key:" + key
+		}
+	}
+	return "ip:" + clientIP(r)
+}
+
+// clientIP returns the address of the client, taken from the first entry of
+// X-Forwarded-For when trustProxyHeaders is set.
+func clientIP(r *http.Request) string {
+	if trustProxyHeaders {
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			first, _, _ := strings.Cut(forwarded, ",")
+			if ip := strings.TrimSpace(first); ip != "" {
+				return ip
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
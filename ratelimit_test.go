@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRateLimit(t *testing.T) {
+	rateLimitRPS, rateLimitBurst = 1, 2
+	defer func() { rateLimitRPS, rateLimitBurst = 0, 0 }()
+	handler := rateLimit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	tests := []struct {
+		name string
+		addr string
+		path string
+		want int
+	}{
+		{"first of burst", "192.0.2.1:1000", "/query", http.StatusOK},
+		{"second of burst", "192.0.2.1:1001", "/query", http.StatusOK},
+		{"over the limit", "192.0.2.1:1002", "/query", http.StatusTooManyRequests},
+		{"other client", "192.0.2.2:1000", "/query", http.StatusOK},
+		{"health check", "192.0.2.1:1003", "/health", http.StatusOK},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, tt.path, nil)
+		r.RemoteAddr = tt.addr
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != tt.want {
+			t.Errorf("%s: status %d, want %d", tt.name, w.Code, tt.want)
+		}
+		if tt.want == http.StatusTooManyRequests && w.Header().Get("Retry-After") != "1" {
+			t.Errorf("%s: Retry-After %q, want 1", tt.name, w.Header().Get("Retry-After"))
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		trust     bool
+		forwarded string
+		want      string
+	}{
+		{false, "", "192.0.2.1"},
+		{false, "203.0.113.7", "192.0.2.1"},
+		{true, "", "192.0.2.1"},
+		{true, "203.0.113.7, 10.0.0.1", "203.0.113.7"},
+	}
+	defer func() { trustProxyHeaders = false }()
+	for _, tt := range tests {
+		trustProxyHeaders = tt.trust
+		r := httptest.NewRequest(http.MethodGet, "/query", nil)
+		r.RemoteAddr = "192.0.2.1:1234"
+		if tt.forwarded != "" {
+			r.Header.Set("X-Forwarded-For", tt.forwarded)
+		}
+		if got := clientIP(r); got != tt.want {
+			t.Errorf("trust %v, X-Forwarded-For %q: %q, want %q", tt.trust, tt.forwarded, got, tt.want)
+		}
+	}
+}
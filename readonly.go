@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// readOnly rejects any statement that could modify data when set through
+// READ_ONLY=true. Accepted statements additionally run in a READ ONLY
+// transaction, which also catches writes hidden inside function calls.
+var readOnly bool
+
+// readOnlyStatements are the leading keywords allowed in read-only mode.
+var readOnlyStatements = map[string]bool{
+	"SELECT":  true,
+	"WITH":    true,
+	"EXPLAIN": true,
+	"VALUES":  true,
+	"TABLE":   true,
+	"SHOW":    true,
+}
+
+// writeKeywords may not appear anywhere in a read-only statement. This
+// catches data-modifying CTEs (WITH d AS (DELETE ...) SELECT ...), EXPLAIN
+// ANALYZE of a write and SELECT ... INTO. UPDATE and SHARE also rule out
+// locking reads, FOR [NO KEY] UPDATE and FOR [KEY] SHARE, which take row
+// locks that would block writers.
+var writeKeywords = map[string]bool{
+	"INSERT":   true,
+	"UPDATE":   true,
+	"DELETE":   true,
+	"MERGE":    true,
+	"TRUNCATE": true,
+	"INTO":     true,
+	"COPY":     true,
+	"SHARE":    true,
+}
+
+var errEmptyQuery = errors.New("empty query")
+
+// checkReadOnly returns an error unless sql is a single read-only statement.
+// Keywords are matched on tokens, so words inside string literals, quoted
+// identifiers, and comments (SELECT * FROM t WHERE name='delete') are fine.
+func checkReadOnly(sql string) error {
+	tokens, err := tokenize(sql)
+	if err != nil {
+		return err
+	}
+	statements := splitStatements(tokens)
+	switch {
+	case len(statements) == 0:
+		return errEmptyQuery
+	case len(statements) > 1:
+		return errors.New("only a single statement is allowed in read-only mode")
+	}
+
+	stmt := statements[0]
+	// Skip the parentheses of e.g. (SELECT 1) UNION (SELECT 2).
+	first := 0
+	for first < len(stmt) && stmt[first].kind == tokenPunct && stmt[first].text == "(" {
+		first++
+	}
+	if first == len(stmt) || stmt[first].kind != tokenWord || !readOnlyStatements[strings.ToUpper(stmt[first].text)] {
+		return errors.New("only SELECT, WITH, EXPLAIN, VALUES, TABLE and SHOW statements are allowed in read-only mode")
+	}
+	for _, t := range stmt[first+1:] {
+		if t.kind == tokenWord && writeKeywords[strings.ToUpper(t.text)] {
+			return fmt.Errorf("%s is not allowed in read-only mode", strings.ToUpper(t.text))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,37 @@
+package main
+
+import "testing"
+
+func TestCheckReadOnly(t *testing.T) {
+	tests := []struct {
+		sql     string
+		wantErr bool
+	}{
+		{sql: "SELECT * FROM t WHERE name = 'delete'"},
+		{sql: `SELECT "insert" FROM t -- UPDATE t`},
+		{sql: "(SELECT 1) UNION (SELECT 2)"},
+		{sql: "WITH a AS (SELECT 1) SELECT * FROM a"},
+		{sql: "EXPLAIN SELECT 1"},
+		{sql: "VALUES (1)"},
+		{sql: "TABLE t"},
+		{sql: "show work_mem;"},
+		{sql: "", wantErr: true},
+		{sql: "SELECT 1; SELECT 2", wantErr: true},
+		{sql: "INSERT INTO t VALUES (1)", wantErr: true},
+		{sql: "delete from t", wantErr: true},
+		{sql: "WITH d AS (DELETE FROM t RETURNING *) SELECT * FROM d", wantErr: true},
+		{sql: "SELECT * INTO u FROM t", wantErr: true},
+		{sql: "SELECT * FROM t FOR UPDATE", wantErr: true},
+		{sql: "SELECT * FROM t FOR NO KEY UPDATE", wantErr: true},
+		{sql: "SELECT * FROM t FOR SHARE", wantErr: true},
+		{sql: "SELECT * FROM t FOR KEY SHARE NOWAIT", wantErr: true},
+		{sql: "CREATE TABLE t (a int)", wantErr: true},
+		{sql: "SELECT 1; DROP TABLE t", wantErr: true},
+		{sql: "SELECT 'unterminated", wantErr: true},
+	}
+	for _, tt := range tests {
+		if err := checkReadOnly(tt.sql); (err != nil) != tt.wantErr {
+			t.Errorf("checkReadOnly(%q) error = %v, want error %v", tt.sql, err, tt.wantErr)
+		}
+	}
+}
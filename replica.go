@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// Read replicas: the database named name+replicaSuffix, such as
+// "default:replica", is a read replica of name. REPLICA_DATABASE_URL (or
+// REPLICA_DATABASE_URL_FILE) configures the one of the default database;
+// DATABASES may name others. Read-only queries go to the replica when the
+// request asks for it with ?replica=true, or unless it asks otherwise with
+// ?replica=false when readsToReplica is set through READS_TO_REPLICA=true.
+// Anything that could write always goes to the primary.
+const replicaSuffix = ":replica"
+
+var readsToReplica bool
+
+// replicaPool returns the replica to run a read-only query of the request
+// on, or nil when the request isn't routed to one or the database has none.
+func replicaPool(r *http.Request, name string) *pgxpool.Pool {
+	want := readsToReplica
+	if value := r.URL.Query().Get("replica"); value != "" {
+		want = value == "true"
+	}
+	if !want {
+		return nil
+	}
+	if name == "" {
+		name = r.URL.Query().Get("db")
+	}
+	if name == "" {
+		name = defaultDB
+	}
+	return currentPools()[name+replicaSuffix]
+}
+
+// acquireRead acquires a connection for a read-only query from replica when
+// set, falling back to primary when the replica is unavailable.
+func acquireRead(ctx context.Context, primary, replica *pgxpool.Pool) (*pgxpool.Conn, error) {
+	if replica != nil {
+		conn, err := acquireConn(ctx, replica)
+		if err == nil || ctx.Err() != nil {
+			return conn, err
+		}
+		slog.WarnContext(ctx, "Replica unavailable, reading from the primary", "error", err)
+	}
+	return acquireConn(ctx, primary)
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// Result formats: by default pgx asks Postgres for the binary encoding of
+// every type it can decode, such as numeric, timestamps and arrays, and for
+// the text encoding of any other type. Setting RESULT_FORMAT=text, or
+// "result_format":"text" on a request, asks for text throughout instead;
+// "binary" on a request overrides a text default. Both decode into the same
+// Go values, so numeric stays exact either way.
+var textResults bool
+
+func loadResultFormat() error {
+	switch value := os.Getenv("RESULT_FORMAT"); value {
+	case "", "binary":
+		textResults = false
+	case "text":
+		textResults = true
+	default:
+		return fmt.Errorf("invalid RESULT_FORMAT %q: must be binary or text", value)
+	}
+	return nil
+}
+
+// resultFormats returns the result formats to request for format, a
+// request's result_format, or nil for pgx's own choice.
+func resultFormats(format string) (pgx.QueryResultFormats, error) {
+	text := textResults
+	switch format {
+	case "":
+	case "binary":
+		text = false
+	case "text":
+		text = true
+	default:
+		return nil, fmt.Errorf("Invalid result_format %q: must be binary or text", format)
+	}
+	if !text {
+		return nil, nil
+	}
+	// A single format code applies to every column.
+	return pgx.QueryResultFormats{pgx.TextFormatCode}, nil
+}
+
+// queryArgs returns the arguments for running a query with args in formats.
+func queryArgs(formats pgx.QueryResultFormats, args []interface{}) []interface{} {
+	if formats == nil {
+		return args
+	}
+	return append([]interface{}{formats}, args...)
+}
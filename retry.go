@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"time"
+
+	"github.com/jackc/pgconn"
+)
+
+// Retry settings: a read-only query that fails on a broken connection is run
+// again on a fresh one up to queryRetries times, set through QUERY_RETRIES,
+// waiting retryBaseDelay (QUERY_RETRY_DELAY) before the first retry and twice
+// as long before each next one. Zero retries disables this.
+var (
+	queryRetries   = 2
+	retryBaseDelay = 100 * time.Millisecond
+)
+
+// acquireError wraps a failure to get a connection, as opposed to an error
+// running a query on one.
+type acquireError struct{ err error }
+
+func (e acquireError) Error() string { return e.err.Error() }
+
+func (e acquireError) Unwrap() error { return e.err }
+
+// transientError reports whether err came from the connection rather than
+// from the query: an error reported by the server, an expired or canceled
+// request and an open circuit breaker will fail the same way again.
+func transientError(ctx context.Context, err error) bool {
+	if ctx.Err() != nil || errors.Is(err, errBreakerOpen) {
+		return false
+	}
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return false
+	}
+	var netErr net.Error
+	return pgconn.SafeToRetry(err) || errors.As(err, &netErr) ||
+		errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// retryBackoff returns how long to wait before retry number attempt+1.
+func retryBackoff(attempt int) time.Duration {
+	return retryBaseDelay << attempt
+}
+
+// sleepContext waits for d, returning false if ctx is done first.
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// Schema listing settings: schemaAllowlist, set through SCHEMA_ALLOWLIST,
+// limits /schema and search_path to the listed schemas, and listings are cached for
+// schemaCacheTTL (SCHEMA_CACHE_TTL, zero disables the cache).
+var (
+	schemaAllowlist []string
+	schemaCacheTTL  = 30 * time.Second
+)
+
+// schemaQuery lists the columns of every table and view in the schemas given
+// as $1, or in all user schemas when $1 is NULL. Columns of user-defined
+// types such as geometry report the type name instead of "USER-DEFINED".
+const schemaQuery = `SELECT c.table_schema, c.table_name, t.table_type, c.column_name,
+	CASE WHEN c.data_type = 'USER-DEFINED' THEN c.udt_name ELSE c.data_type END,
+	c.is_nullable = 'YES'
+FROM information_schema.columns c
+JOIN information_schema.tables t USING (table_schema, table_name)
+WHERE c.table_schema NOT IN ('pg_catalog', 'information_schema')
+	AND ($1::text[] IS NULL OR c.table_schema = ANY ($1))
+ORDER BY c.table_schema, c.table_name, c.ordinal_position`
+
+type schemaColumn struct {
+	Name     string `json:"name"`
+	Type     string `json:"type"`
+	Nullable bool   `json:"nullable"`
+}
+
+type schemaTable struct {
+	Name    string         `json:"name"`
+	Type    string         `json:"type"`
+	Columns []schemaColumn `json:"columns"`
+}
+
+type schemaInfo struct {
+	Name   string         `json:"name"`
+	Tables []*schemaTable `json:"tables"`
+}
+
+type schemaCacheKey struct {
+	pool   *pgxpool.Pool
+	schema string
+}
+
+type schemaCacheEntry struct {
+	schemas []*schemaInfo
+	expires time.Time
+}
+
+// schemaCache holds recent /schema listings per pool and ?schema= filter.
+var schemaCache = struct {
+	sync.Mutex
+	entries map[schemaCacheKey]schemaCacheEntry
+}{entries: make(map[schemaCacheKey]schemaCacheEntry)}
+
+// schemaHandler lists the schemas, tables and columns visible to the proxy's
+// database user, so clients can discover the schema without querying
+// information_schema themselves. ?schema=public lists a single schema.
+//
+//	{"schemas":[{"name":"public","tables":[{"name":"points","type":"BASE TABLE",
+//	  "columns":[{"name":"id","type":"integer","nullable":false}]}]}]}
+func schemaHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "Invalid request method")
+		return
+	}
+
+	schema := r.URL.Query().Get("schema")
+	var filter []string
+	switch {
+	case schema != "" && len(schemaAllowlist) > 0 && !slices.Contains(schemaAllowlist, schema):
+		writeJSONError(w, http.StatusForbidden, fmt.Sprintf("Schema %q is not allowed", schema))
+		return
+	case schema != "":
+		filter = []string{schema}
+	case len(schemaAllowlist) > 0:
+		filter = schemaAllowlist
+	}
+
+	ctx, cancel := requestContext(w, r, 0)
+	defer cancel()
+
+	pool, err := requestPool(r, "")
+	if err != nil {
+		writePoolError(w, err)
+		return
+	}
+
+	key := schemaCacheKey{pool, schema}
+	schemaCache.Lock()
+	entry, ok := schemaCache.entries[key]
+	schemaCache.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		writeStatus(w, http.StatusOK, map[string]interface{}{"schemas": entry.schemas})
+		return
+	}
+
+	conn, err := acquireConn(ctx, pool)
+	if err != nil {
+		writeAcquireFailure(ctx, w, err)
+		return
+	}
+	defer conn.Release()
+
+	start := time.Now()
+	defer func() {
+		elapsed := time.Since(start)
+		requestInfoFrom(ctx).queryDuration = elapsed
+		queryDuration.Observe(elapsed.Seconds())
+	}()
+
+	rows, err := conn.Query(ctx, schemaQuery, filter)
+	if err != nil {
+		writeQueryFailure(ctx, w, err)
+		return
+	}
+	defer rows.Close()
+
+	schemas := []*schemaInfo{}
+	var table *schemaTable
+	for rows.Next() {
+		var schemaName, tableName, tableType string
+		var col schemaColumn
+		if err := rows.Scan(&schemaName, &tableName, &tableType, &col.Name, &col.Type, &col.Nullable); err != nil {
+			writeQueryFailure(ctx, w, err)
+			return
+		}
+		if len(schemas) == 0 || schemas[len(schemas)-1].Name != schemaName {
+			schemas = append(schemas, &schemaInfo{Name: schemaName})
+			table = nil
+		}
+		if table == nil || table.Name != tableName {
+			table = &schemaTable{Name: tableName, Type: tableType}
+			s := schemas[len(schemas)-1]
+			s.Tables = append(s.Tables, table)
+		}
+		table.Columns = append(table.Columns, col)
+	}
+	if err := rows.Err(); err != nil {
+		writeQueryFailure(ctx, w, err)
+		return
+	}
+
+	if schemaCacheTTL > 0 {
+		now := time.Now()
+		schemaCache.Lock()
+		// ?schema= is up to the client, so drop expired listings rather
+		// than letting the map grow.
+		for k, e := range schemaCache.entries {
+			if now.After(e.expires) {
+				delete(schemaCache.entries, k)
+			}
+		}
+		schemaCache.entries[key] = schemaCacheEntry{schemas: schemas, expires: now.Add(schemaCacheTTL)}
+		schemaCache.Unlock()
+	}
+	writeStatus(w, http.StatusOK, map[string]interface{}{"schemas": schemas})
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// Server timeouts, set through READ_HEADER_TIMEOUT, READ_TIMEOUT,
+// WRITE_TIMEOUT and IDLE_TIMEOUT, with zero disabling a timeout. Reading
+// the request headers is always bounded, so clients can't hold connections
+// open by sending them slowly; the read and write timeouts are off by
+// default and don't apply to the streaming endpoints, see withoutTimeouts.
+var (
+	readHeaderTimeout = 10 * time.Second
+	readTimeout       time.Duration
+	writeTimeout      time.Duration
+	idleTimeout       = 2 * time.Minute
+)
+
+// http2Enabled serves HTTP/2, set through HTTP2=false to turn it off. Over
+// TLS it is negotiated through ALPN; plain HTTP accepts it as h2c, for
+// clients and load balancers that speak HTTP/2 with prior knowledge.
+var http2Enabled = true
+
+// newServer returns the server for handler, serving HTTPS when tlsConf is
+// set.
+func newServer(addr string, handler http.Handler, tlsConf *tls.Config) *http.Server {
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		TLSConfig:         tlsConf,
+		ReadHeaderTimeout: readHeaderTimeout,
+		ReadTimeout:       readTimeout,
+		WriteTimeout:      writeTimeout,
+		IdleTimeout:       idleTimeout,
+	}
+	switch {
+	case !http2Enabled:
+		// A non-nil, empty map keeps net/http from enabling HTTP/2 over TLS.
+		server.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+	case tlsConf == nil:
+		server.Handler = h2c.NewHandler(handler, &http2.Server{IdleTimeout: idleTimeout})
+	}
+	return server
+}
+
+// withoutTimeouts lifts the server's read and write timeouts for handlers
+// whose requests legitimately outlive them: streamed results, uploads and
+// long-lived event streams, which are bounded by their query timeouts or
+// not at all.
+func withoutTimeouts(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if readTimeout > 0 || writeTimeout > 0 {
+			rc := http.NewResponseController(w)
+			if err := rc.SetReadDeadline(time.Time{}); err != nil {
+				slog.DebugContext(r.Context(), "Error clearing read deadline", "error", err)
+			}
+			if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+				slog.DebugContext(r.Context(), "Error clearing write deadline", "error", err)
+			}
+		}
+		next(w, r)
+	}
+}
+
+// routePrefix is the path all routes are served under, set through
+// ROUTE_PREFIX, for a proxy that forwards a subpath such as /api/pg without
+// stripping it. Empty serves them at the root.
+var routePrefix string
+
+// unprefixedPaths are also served without routePrefix, because probes and
+// scrapers reach the container directly rather than through the proxy.
+var unprefixedPaths = map[string]bool{
+	"/health":  true,
+	"/ready":   true,
+	"/metrics": true,
+}
+
+// parseRoutePrefix normalizes a ROUTE_PREFIX such as "api/pg/" to "/api/pg".
+func parseRoutePrefix(value string) (string, error) {
+	prefix := strings.Trim(value, "/")
+	if prefix == "" {
+		return "", nil
+	}
+	if strings.ContainsAny(prefix, "?#") {
+		return "", fmt.Errorf("invalid ROUTE_PREFIX %q: must be a path", value)
+	}
+	return "/" + prefix, nil
+}
+
+// stripRoutePrefix serves requests under routePrefix with the prefix
+// removed, so the routes and the middleware checking paths see them as at
+// the root, and replies 404 to anything else but unprefixedPaths.
+func stripRoutePrefix(next http.Handler) http.Handler {
+	if routePrefix == "" {
+		return next
+	}
+	stripped := http.StripPrefix(routePrefix, next)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rest, ok := strings.CutPrefix(r.URL.Path, routePrefix)
+		switch {
+		case ok && strings.HasPrefix(rest, "/"):
+			stripped.ServeHTTP(w, r)
+		case unprefixedPaths[r.URL.Path]:
+			next.ServeHTTP(w, r)
+		default:
+			writeJSONError(w, http.StatusNotFound, "Not found")
+		}
+	})
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseRoutePrefix(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+		ok    bool
+	}{
+		{"", "", true},
+		{"/", "", true},
+		{"api/pg/", "/api/pg", true},
+		{"/api", "/api", true},
+		{"/api?x=1", "", false},
+		{"/api#top", "", false},
+	}
+	for _, tt := range tests {
+		got, err := parseRoutePrefix(tt.value)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("parseRoutePrefix(%q) = %q, %v, want %q, ok %v", tt.value, got, err, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestStripRoutePrefix(t *testing.T) {
+	defer func(prefix string) { routePrefix = prefix }(routePrefix)
+	routePrefix = "/api/pg"
+	var path string
+	handler := stripRoutePrefix(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+	}))
+
+	tests := []struct {
+		target string
+		want   int
+		path   string
+	}{
+		{"/api/pg/query", http.StatusOK, "/query"},
+		{"/api/pg/health", http.StatusOK, "/health"},
+		{"/health", http.StatusOK, "/health"},
+		{"/metrics", http.StatusOK, "/metrics"},
+		{"/query", http.StatusNotFound, ""},
+		{"/api/pgquery", http.StatusNotFound, ""},
+		{"/api/pg", http.StatusNotFound, ""},
+	}
+	for _, tt := range tests {
+		path = ""
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.target, nil))
+		if w.Code != tt.want || path != tt.path {
+			t.Errorf("%s: status %d at %q, want %d at %q", tt.target, w.Code, path, tt.want, tt.path)
+		}
+	}
+}
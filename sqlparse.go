@@ -0,0 +1,277 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// tokenKind classifies the lexical tokens of a SQL statement.
+type tokenKind int
+
+const (
+	tokenWord        tokenKind = iota // keyword or unquoted identifier
+	tokenQuotedIdent                  // "identifier"
+	tokenString                       // 'literal', E'literal', $tag$literal$tag$, ...
+	tokenNumber                       // 42, 3.14, 1e10
+	tokenParam                        // $1
+	tokenPunct                        // operators and punctuation
+)
+
+// token is a single lexical token. pos and end are byte offsets into the
+// original SQL, so callers can slice out the source text.
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+	end  int
+}
+
+// is reports whether t is the unquoted keyword kw, compared case-insensitively.
+func (t token) is(kw string) bool {
+	return t.kind == tokenWord && strings.EqualFold(t.text, kw)
+}
+
+// tokenize splits sql into tokens, skipping whitespace and comments. It knows
+// just enough of the Postgres lexical rules to never mistake the contents of
+// a string, quoted identifier, or comment for SQL.
+func tokenize(sql string) ([]token, error) {
+	var tokens []token
+	i := 0
+	for i < len(sql) {
+		c := sql[i]
+		start := i
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f':
+			i++
+			continue
+
+		case c == '-' && strings.HasPrefix(sql[i:], "--"):
+			if nl := strings.IndexByte(sql[i:], '\n'); nl >= 0 {
+				i += nl + 1
+			} else {
+				i = len(sql)
+			}
+			continue
+
+		case c == '/' && strings.HasPrefix(sql[i:], "/*"):
+			// Block comments nest in Postgres.
+			depth := 0
+			for i < len(sql) {
+				if strings.HasPrefix(sql[i:], "/*") {
+					depth++
+					i += 2
+				} else if strings.HasPrefix(sql[i:], "*/") {
+					depth--
+					i += 2
+					if depth == 0 {
+						break
+					}
+				} else {
+					i++
+				}
+			}
+			if depth != 0 {
+				return nil, fmt.Errorf("unterminated comment at position %d", start)
+			}
+			continue
+
+		case c == '\'':
+			end, err := scanQuoted(sql, i, '\'', false)
+			if err != nil {
+				return nil, err
+			}
+			i = end
+			tokens = append(tokens, token{tokenString, sql[start:i], start, i})
+
+		case c == '"':
+			end, err := scanQuoted(sql, i, '"', false)
+			if err != nil {
+				return nil, err
+			}
+			i = end
+			tokens = append(tokens, token{tokenQuotedIdent, sql[start:i], start, i})
+
+		case c == '$' && i+1 < len(sql) && isDigit(sql[i+1]):
+			i++
+			for i < len(sql) && isDigit(sql[i]) {
+				i++
+			}
+			tokens = append(tokens, token{tokenParam, sql[start:i], start, i})
+
+		case c == '$':
+			tag, ok := dollarTag(sql[i:])
+			if !ok {
+				i++
+				tokens = append(tokens, token{tokenPunct, "$", start, i})
+				break
+			}
+			closing := strings.Index(sql[i+len(tag):], tag)
+			if closing < 0 {
+				return nil, fmt.Errorf("unterminated dollar-quoted string at position %d", start)
+			}
+			i += len(tag) + closing + len(tag)
+			tokens = append(tokens, token{tokenString, sql[start:i], start, i})
+
+		case isDigit(c) || (c == '.' && i+1 < len(sql) && isDigit(sql[i+1])):
+			i = scanNumber(sql, i)
+			tokens = append(tokens, token{tokenNumber, sql[start:i], start, i})
+
+		case isIdentStart(c):
+			for i < len(sql) && isIdentChar(sql[i]) {
+				i++
+			}
+			word := sql[start:i]
+			// String constants with a prefix: E'...', B'...', X'...', N'...'
+			if i < len(sql) && sql[i] == '\'' && len(word) == 1 && strings.ContainsAny(word, "eEbBxXnN") {
+				end, err := scanQuoted(sql, i, '\'', word == "e" || word == "E")
+				if err != nil {
+					return nil, err
+				}
+				i = end
+				tokens = append(tokens, token{tokenString, sql[start:i], start, i})
+				break
+			}
+			tokens = append(tokens, token{tokenWord, word, start, i})
+
+		default:
+			i++
+			if c == ':' && i < len(sql) && sql[i] == ':' {
+				i++
+			}
+			tokens = append(tokens, token{tokenPunct, sql[start:i], start, i})
+		}
+	}
+	return tokens, nil
+}
+
+// scanQuoted returns the offset just past the quoted section starting at
+// sql[i]. A doubled quote character is an escaped quote; with backslashes set
+// (E'...' strings) a backslash escapes the next character too.
+func scanQuoted(sql string, i int, quote byte, backslashes bool) (int, error) {
+	start := i
+	i++
+	for i < len(sql) {
+		switch {
+		case backslashes && sql[i] == '\\':
+			i += 2
+		case sql[i] == quote && i+1 < len(sql) && sql[i+1] == quote:
+			i += 2
+		case sql[i] == quote:
+			return i + 1, nil
+		default:
+			i++
+		}
+	}
+	return 0, fmt.Errorf("unterminated quoted string at position %d", start)
+}
+
+// dollarTag returns the opening tag of a dollar-quoted string ("$$" or
+// "$name$") at the start of s.
+func dollarTag(s string) (string, bool) {
+	for i := 1; i < len(s); i++ {
+		switch {
+		case s[i] == '$':
+			return s[:i+1], true
+		case !isIdentChar(s[i]) || (i == 1 && isDigit(s[i])):
+			return "", false
+		}
+	}
+	return "", false
+}
+
+func scanNumber(sql string, i int) int {
+	for i < len(sql) && (isDigit(sql[i]) || sql[i] == '.' || sql[i] == '_') {
+		i++
+	}
+	if i < len(sql) && (sql[i] == 'e' || sql[i] == 'E') {
+		j := i + 1
+		if j < len(sql) && (sql[j] == '+' || sql[j] == '-') {
+			j++
+		}
+		if j < len(sql) && isDigit(sql[j]) {
+			i = j
+			for i < len(sql) && isDigit(sql[i]) {
+				i++
+			}
+		}
+	}
+	return i
+}
+
+func isDigit(c byte) bool { return c >= '0' && c <= '9' }
+
+func isIdentStart(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_' || c >= 0x80
+}
+
+func isIdentChar(c byte) bool { return isIdentStart(c) || isDigit(c) || c == '$' }
+
+// splitStatements groups tokens into statements separated by top-level
+// semicolons, dropping empty statements.
+func splitStatements(tokens []token) [][]token {
+	var statements [][]token
+	start := 0
+	for i, t := range tokens {
+		if t.kind == tokenPunct && t.text == ";" {
+			if i > start {
+				statements = append(statements, tokens[start:i])
+			}
+			start = i + 1
+		}
+	}
+	if start < len(tokens) {
+		statements = append(statements, tokens[start:])
+	}
+	return statements
+}
+
+// splitScript splits sql into the source text of its statements.
+func splitScript(sql string) ([]string, error) {
+	tokens, err := tokenize(sql)
+	if err != nil {
+		return nil, err
+	}
+	var statements []string
+	for _, stmt := range splitStatements(tokens) {
+		statements = append(statements, sql[stmt[0].pos:stmt[len(stmt)-1].end])
+	}
+	return statements, nil
+}
+
+// redactSQL replaces the string and number literals in sql with ?, so a
+// statement can be recorded without the values it contains. Comments are
+// dropped as well. Unparseable SQL is redacted entirely.
+func redactSQL(sql string) string {
+	return redact(sql, false)
+}
+
+// redactMessage redacts an error message the way redactSQL redacts SQL.
+// Postgres quotes the values it reports in double quotes, so quoted
+// identifiers are replaced as well.
+func redactMessage(msg string) string {
+	return redact(msg, true)
+}
+
+func redact(sql string, quotedIdents bool) string {
+	tokens, err := tokenize(sql)
+	if err != nil {
+		return "?"
+	}
+	var b strings.Builder
+	last := 0
+	for _, t := range tokens {
+		// Whatever isn't whitespace between two tokens is a comment.
+		if gap := sql[last:t.pos]; strings.TrimSpace(gap) == "" {
+			b.WriteString(gap)
+		} else {
+			b.WriteByte(' ')
+		}
+		if t.kind == tokenString || t.kind == tokenNumber || (quotedIdents && t.kind == tokenQuotedIdent) {
+			b.WriteByte('?')
+		} else {
+			b.WriteString(t.text)
+		}
+		last = t.end
+	}
+	return b.String()
+}
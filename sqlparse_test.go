@@ -0,0 +1,103 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTokenize(t *testing.T) {
+	tests := []struct {
+		sql     string
+		want    []string
+		wantErr bool
+	}{
+		{sql: "SELECT a, b FROM t", want: []string{"SELECT", "a", ",", "b", "FROM", "t"}},
+		{sql: "select 'it''s' -- DELETE\n, 1", want: []string{"select", "'it''s'", ",", "1"}},
+		{sql: "SELECT /* a /* nested */ DROP */ 1", want: []string{"SELECT", "1"}},
+		{sql: `SELECT "a ""b""" FROM "T"`, want: []string{"SELECT", `"a ""b"""`, "FROM", `"T"`}},
+		{sql: "SELECT $1::int, E'\\'x', $q$ ; $q$", want: []string{"SELECT", "$1", "::", "int", ",", `E'\'x'`, ",", "$q$ ; $q$"}},
+		{sql: "SELECT 3.14, .5, 1e10, x$1", want: []string{"SELECT", "3.14", ",", ".5", ",", "1e10", ",", "x$1"}},
+		{sql: "SELECT 'unterminated", wantErr: true},
+		{sql: `SELECT "unterminated`, wantErr: true},
+		{sql: "SELECT /* unterminated", wantErr: true},
+		{sql: "SELECT $a$ unterminated", wantErr: true},
+	}
+	for _, tt := range tests {
+		tokens, err := tokenize(tt.sql)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("tokenize(%q) error = %v, want error %v", tt.sql, err, tt.wantErr)
+			continue
+		}
+		var got []string
+		for _, tok := range tokens {
+			if tt.sql[tok.pos:tok.end] != tok.text {
+				t.Errorf("tokenize(%q): token %q at %d-%d", tt.sql, tok.text, tok.pos, tok.end)
+			}
+			got = append(got, tok.text)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("tokenize(%q) = %q, want %q", tt.sql, got, tt.want)
+		}
+	}
+}
+
+func TestSplitStatements(t *testing.T) {
+	tests := []struct {
+		sql  string
+		want []string
+	}{
+		{"SELECT 1", []string{"SELECT 1"}},
+		{"SELECT 1; SELECT 2;", []string{"SELECT 1", "SELECT 2"}},
+		{";; SELECT ';'; -- ;\n", []string{"SELECT ';'"}},
+		{"CREATE FUNCTION f() RETURNS int AS $$ SELECT 1; $$ LANGUAGE sql; SELECT f()",
+			[]string{"CREATE FUNCTION f() RETURNS int AS $$ SELECT 1; $$ LANGUAGE sql", "SELECT f()"}},
+		{"-- only a comment", nil},
+	}
+	for _, tt := range tests {
+		got, err := splitScript(tt.sql)
+		if err != nil {
+			t.Errorf("splitScript(%q): %v", tt.sql, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("splitScript(%q) = %q, want %q", tt.sql, got, tt.want)
+		}
+	}
+}
+
+func TestRedactSQL(t *testing.T) {
+	tests := []struct {
+		sql  string
+		want string
+	}{
+		{"SELECT * FROM t WHERE id = 42", "SELECT * FROM t WHERE id = ?"},
+		{"SELECT name FROM users WHERE email = 'a@example.com' AND age > 3.5", "SELECT name FROM users WHERE email = ? AND age > ?"},
+		{"SELECT $1, $tag$secret$tag$, E'x\\'y'", "SELECT $1, ?, ?"},
+		{`SELECT "Name" FROM t`, `SELECT "Name" FROM t`},
+		{"SELECT 1 -- password 'hunter2'\nFROM t", "SELECT ? FROM t"},
+		{"SELECT /* 'secret' */ x", "SELECT x"},
+		{"SELECT 'unterminated", "?"},
+	}
+	for _, tt := range tests {
+		if got := redactSQL(tt.sql); got != tt.want {
+			t.Errorf("redactSQL(%q) = %q, want %q", tt.sql, got, tt.want)
+		}
+	}
+}
+
+func TestRedactMessage(t *testing.T) {
+	tests := []struct {
+		msg  string
+		want string
+	}{
+		{`duplicate key value violates unique constraint "users_email_key"`, `duplicate key value violates unique constraint ?`},
+		{`invalid input syntax for type integer: "abc"`, `invalid input syntax for type integer: ?`},
+		{`value too long for type character varying(3)`, `value too long for type character varying(?)`},
+		{`unterminated quote: "abc`, `?`},
+	}
+	for _, tt := range tests {
+		if got := redactMessage(tt.msg); got != tt.want {
+			t.Errorf("redactMessage(%q) = %q, want %q", tt.msg, got, tt.want)
+		}
+	}
+}
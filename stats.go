@@ -0,0 +1,54 @@
+package main
+
+import "net/http"
+
+// poolStats is the state of a pool as reported by /stats.
+type poolStats struct {
+	TotalConns              int32   `json:"totalConns"`
+	IdleConns               int32   `json:"idleConns"`
+	AcquiredConns           int32   `json:"acquiredConns"`
+	ConstructingConns       int32   `json:"constructingConns"`
+	MaxConns                int32   `json:"maxConns"`
+	NewConnsCount           int64   `json:"newConnsCount"`
+	AcquireCount            int64   `json:"acquireCount"`
+	AcquireDurationMS       float64 `json:"acquireDurationMs"`
+	EmptyAcquireCount       int64   `json:"emptyAcquireCount"`
+	CanceledAcquireCount    int64   `json:"canceledAcquireCount"`
+	MaxLifetimeDestroyCount int64   `json:"maxLifetimeDestroyCount"`
+	MaxIdleDestroyCount     int64   `json:"maxIdleDestroyCount"`
+	CircuitBreaker          string  `json:"circuitBreaker"`
+}
+
+// statsHandler reports the statistics of every pool as JSON, for a quick
+// look at pool health without a Prometheus server. acquireDurationMs is the
+// total time spent waiting for connections. Unlike /health it requires
+// authentication when that is configured.
+//
+//	{"databases":{"default":{"totalConns":4,"idleConns":3,"acquiredConns":1,...}}}
+func statsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "Invalid request method")
+		return
+	}
+	pools := currentPools()
+	databases := make(map[string]poolStats, len(pools))
+	for name, pool := range pools {
+		stat := pool.Stat()
+		databases[name] = poolStats{
+			TotalConns:              stat.TotalConns(),
+			IdleConns:               stat.IdleConns(),
+			AcquiredConns:           stat.AcquiredConns(),
+			ConstructingConns:       stat.ConstructingConns(),
+			MaxConns:                stat.MaxConns(),
+			NewConnsCount:           stat.NewConnsCount(),
+			AcquireCount:            stat.AcquireCount(),
+			AcquireDurationMS:       float64(stat.AcquireDuration().Microseconds()) / 1000,
+			EmptyAcquireCount:       stat.EmptyAcquireCount(),
+			CanceledAcquireCount:    stat.CanceledAcquireCount(),
+			MaxLifetimeDestroyCount: stat.MaxLifetimeDestroyCount(),
+			MaxIdleDestroyCount:     stat.MaxIdleDestroyCount(),
+			CircuitBreaker:          breakerFor(pool).currentState().String(),
+		}
+	}
+	writeStatus(w, http.StatusOK, map[string]interface{}{"databases": databases})
+}
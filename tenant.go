@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// Tenant isolation: a request authenticated as a tenant has tenantSetting
+// (TENANT_SETTING, default app.tenant_id) set to the tenant for the
+// transaction of every query it runs, so row-level security policies can
+// enforce isolation with current_setting('app.tenant_id'). The tenant is
+// the JWT claim named by JWT_TENANT_CLAIM, or for API keys the one given by
+// API_KEY_TENANTS, a JSON object mapping keys to tenants, e.g.
+//
+//	API_KEY_TENANTS={"key-of-acme":"acme","key-of-globex":"globex"}
+//
+// API_KEY_TENANTS_FILE names a file to read it from instead.
+var (
+	tenantSetting = "app.tenant_id"
+	apiKeyTenants map[string]string
+)
+
+// loadTenants reads the tenant settings. It must run after apiKeys is set.
+func loadTenants() error {
+	name := "TENANT_SETTING"
+	setting := os.Getenv(name)
+	if setting == "" {
+		// Its name from when only JWTs carried tenants.
+		name, setting = "JWT_TENANT_SETTING", os.Getenv("JWT_TENANT_SETTING")
+	}
+	if setting != "" {
+		if !strings.Contains(setting, ".") {
+			return fmt.Errorf("invalid %s %q: must be a custom setting such as app.tenant_id", name, setting)
+		}
+		tenantSetting = setting
+	}
+
+	value, err := envOrFile("API_KEY_TENANTS")
+	if err != nil || value == "" {
+		return err
+	}
+	var tenants map[string]string
+	if err := json.Unmarshal([]byte(value), &tenants); err != nil {
+		return fmt.Errorf("invalid API_KEY_TENANTS: %v", err)
+	}
+	apiKeyTenants = make(map[string]string, len(tenants))
+	for key, tenant := range tenants {
+		if !slices.Contains(apiKeys, key) {
+			return errors.New("invalid API_KEY_TENANTS: every key must be one of API_KEYS")
+		}
+		if tenant == "" {
+			return errors.New("invalid API_KEY_TENANTS: tenants must not be empty")
+		}
+		apiKeyTenants[keyFingerprint(key)] = tenant
+	}
+	return nil
+}
+
+// requestTenant returns the tenant the request was authenticated as, if any.
+func requestTenant(ctx context.Context) (string, bool) {
+	if claims := claimsFrom(ctx); claims != nil && jwtTenantClaim != "" {
+		switch v := claims[jwtTenantClaim].(type) {
+		case string:
+			return v, true
+		case json.Number:
+			return v.String(), true
+		default:
+			buf, _ := json.Marshal(v)
+			return string(buf), true
+		}
+	}
+	tenant, ok := apiKeyTenants[requestInfoFrom(ctx).principal]
+	return tenant, ok
+}
+
+// tenantSettings returns the session settings scoping the request to its
+// tenant.
+func tenantSettings(ctx context.Context) []sessionSetting {
+	tenant, ok := requestTenant(ctx)
+	if !ok {
+		return nil
+	}
+	return []sessionSetting{{name: tenantSetting, value: tenant}}
+}
+
+// tenantOverrideStatements are the statements that can change settings for
+// the rest of a transaction, or run code that can.
+var tenantOverrideStatements = map[string]bool{
+	"SET":     true,
+	"RESET":   true,
+	"DISCARD": true,
+	"DO":      true,
+}
+
+var errTenantOverride = errors.New("queries of a tenant may not change session settings")
+
+// setStatement finds SET or RESET in the text of a literal.
+var setStatement = regexp.MustCompile(`\b(set|reset)\b`)
+
+// checkTenantOverride rejects SQL of a request scoped to a tenant that could
+// replace the tenant setting: SET, RESET, DISCARD and DO statements, calls of
+// set_config, and literals such as those run by EXECUTE in a function body
+// that mention set_config or SET the setting. Reading the setting is fine.
+// A role that may create functions could still get around this, so tenants'
+// roles shouldn't be able to.
+func checkTenantOverride(ctx context.Context, sql string) error {
+	if _, ok := requestTenant(ctx); !ok {
+		return nil
+	}
+	tokens, err := tokenize(sql)
+	if err != nil {
+		return err
+	}
+	for _, stmt := range splitStatements(tokens) {
+		if len(stmt) > 0 && stmt[0].kind == tokenWord && tenantOverrideStatements[strings.ToUpper(stmt[0].text)] {
+			return errTenantOverride
+		}
+	}
+	setting := strings.ToLower(tenantSetting)
+	for _, t := range tokens {
+		text := strings.ToLower(t.text)
+		switch t.kind {
+		case tokenWord:
+			if text == "set_config" {
+				return errTenantOverride
+			}
+		case tokenString, tokenQuotedIdent:
+			if strings.Contains(text, "set_config") || strings.Contains(text, setting) && setStatement.MatchString(text) {
+				return errTenantOverride
+			}
+		}
+	}
+	return nil
+}
+
+// checkClientQuery applies the checks every query sent by a client has to
+// pass: the allowlist and, for tenants, checkTenantOverride. The error is
+// meant for a 403 response.
+func checkClientQuery(ctx context.Context, sql string) error {
+	if err := checkAllowlist(sql); err != nil {
+		return err
+	}
+	return checkTenantOverride(ctx, sql)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCheckTenantOverride(t *testing.T) {
+	apiKeyTenants = map[string]string{"acme-key": "acme"}
+	defer func() { apiKeyTenants = nil }()
+	r := httptest.NewRequest(http.MethodGet, "/query", nil)
+	tenantCtx := withPrincipal(r, "acme-key").Context()
+
+	tests := []struct {
+		sql     string
+		wantErr bool
+	}{
+		{sql: "SELECT * FROM orders"},
+		{sql: "SELECT current_setting('app.tenant_id')"},
+		{sql: "UPDATE t SET a = 1"},
+		{sql: "SELECT 'reset your password'"},
+		{sql: "SET app.tenant_id = 'globex'", wantErr: true},
+		{sql: "set local app.tenant_id to 'globex'", wantErr: true},
+		{sql: "SELECT 1; RESET app.tenant_id", wantErr: true},
+		{sql: "RESET ALL", wantErr: true},
+		{sql: "DISCARD ALL", wantErr: true},
+		{sql: "DO $$ BEGIN PERFORM 1; END $$", wantErr: true},
+		{sql: "SELECT set_config('app.tenant_id', 'globex', false)", wantErr: true},
+		{sql: `SELECT "set_config"('app.tenant_id', 'globex', false)`, wantErr: true},
+		{sql: "SELECT pg_catalog.SET_CONFIG('app.tenant_id', 'globex', true)", wantErr: true},
+		{sql: "SELECT run($q$SET app.tenant_id = 'globex'$q$)", wantErr: true},
+		{sql: "SELECT 'unterminated", wantErr: true},
+	}
+	for _, tt := range tests {
+		if err := checkTenantOverride(tenantCtx, tt.sql); (err != nil) != tt.wantErr {
+			t.Errorf("checkTenantOverride(%q) error = %v, want error %v", tt.sql, err, tt.wantErr)
+		}
+		// Requests without a tenant may change any setting.
+		if err := checkTenantOverride(context.Background(), tt.sql); err != nil {
+			t.Errorf("checkTenantOverride(%q) without a tenant: %v", tt.sql, err)
+		}
+	}
+}
+
+func TestTenantSettings(t *testing.T) {
+	apiKeyTenants = map[string]string{"acme-key": "acme"}
+	defer func() { apiKeyTenants = nil }()
+	r := httptest.NewRequest(http.MethodGet, "/query", nil)
+
+	settings := tenantSettings(withPrincipal(r, "acme-key").Context())
+	if len(settings) != 1 || settings[0].name != tenantSetting || settings[0].value != "acme" {
+		t.Errorf("tenant settings %+v", settings)
+	}
+	if settings := tenantSettings(withPrincipal(r, "other-key").Context()); settings != nil {
+		t.Errorf("settings %+v for a key without a tenant", settings)
+	}
+}
+
+func TestLoadTenants(t *testing.T) {
+	apiKeys = []string{"acme-key"}
+	defer func(setting string) { apiKeys, apiKeyTenants, tenantSetting = nil, nil, setting }(tenantSetting)
+
+	tests := []struct {
+		name          string
+		setting       string
+		legacySetting string
+		tenants       string
+		wantSetting   string
+		wantErr       bool
+	}{
+		{name: "defaults", wantSetting: "app.tenant_id"},
+		{name: "setting", setting: "app.org", wantSetting: "app.org"},
+		{name: "legacy setting", legacySetting: "app.team", wantSetting: "app.team"},
+		{name: "builtin setting", setting: "search_path", wantErr: true},
+		{name: "tenants", tenants: `{"acme-key":"acme"}`, wantSetting: "app.tenant_id"},
+		{name: "unknown key", tenants: `{"other-key":"acme"}`, wantErr: true},
+		{name: "empty tenant", tenants: `{"acme-key":""}`, wantErr: true},
+		{name: "invalid JSON", tenants: `["acme"]`, wantErr: true},
+	}
+	for _, tt := range tests {
+		tenantSetting, apiKeyTenants = "app.tenant_id", nil
+		t.Setenv("TENANT_SETTING", tt.setting)
+		t.Setenv("JWT_TENANT_SETTING", tt.legacySetting)
+		t.Setenv("API_KEY_TENANTS", tt.tenants)
+		err := loadTenants()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: error = %v, want error %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if tt.wantErr {
+			continue
+		}
+		if tenantSetting != tt.wantSetting {
+			t.Errorf("%s: setting %q, want %q", tt.name, tenantSetting, tt.wantSetting)
+		}
+		if tt.tenants != "" && apiKeyTenants[keyFingerprint("acme-key")] != "acme" {
+			t.Errorf("%s: tenants %v", tt.name, apiKeyTenants)
+		}
+	}
+}
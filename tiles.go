@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// Vector tiles: tiles are cached for tileCacheTTL, set through
+// TILE_CACHE_TTL, and zero disables the cache. tileExtent is the size of a
+// tile in its own coordinate space and tileBuffer how far geometries extend
+// past its edges, both as used by ST_AsMVTGeom.
+var tileCacheTTL = 30 * time.Second
+
+const (
+	tileExtent = 4096
+	tileBuffer = 64
+	maxZoom    = 24
+)
+
+// tileCache holds recently rendered tiles. It is nil when disabled.
+var tileCache *responseCache
+
+// tileHandler renders a Mapbox Vector Tile from a query with PostGIS'
+// ST_AsMVT, for the tile given in Web Mercator tile coordinates:
+//
+//	GET /tiles/{z}/{x}/{y}.mvt?q=SELECT+id,+name,+geom+FROM+roads
+//	GET /tiles/{z}/{x}/{y}.mvt?named=roads&param=motorway
+//
+// The query is either ad hoc SQL in q, which must be read-only, or one of
+// the namedQueries. Its geometry column is found as for GeoJSON, or named
+// with geom, and transformed to EPSG:3857; every other column becomes a
+// feature attribute. layer names the tile's layer (default "default").
+// Other parameters work as for GET /query.
+func tileHandler(w http.ResponseWriter, r *http.Request) {
+	queriesTotal.Inc()
+	requestsInFlight.Inc()
+	defer requestsInFlight.Dec()
+
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "Invalid request method")
+		return
+	}
+	z, x, y, err := tileCoordinates(r)
+	if err != nil {
+		queryErrors.WithLabelValues(errorBadRequest).Inc()
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	sqlQuery, err := queryFromURL(r)
+	if err == nil {
+		err = checkQueryLength(sqlQuery.Query)
+	}
+	if err != nil {
+		queryErrors.WithLabelValues(errorBadRequest).Inc()
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	values := r.URL.Query()
+	if name := values.Get("named"); name != "" {
+		sql, ok := namedQueries[name]
+		if !ok {
+			queryErrors.WithLabelValues(errorBadRequest).Inc()
+			writeJSONError(w, http.StatusNotFound, fmt.Sprintf("Unknown query %q", name))
+			return
+		}
+		if sqlQuery.Query != "" {
+			queryErrors.WithLabelValues(errorBadRequest).Inc()
+			writeJSONError(w, http.StatusBadRequest, "Set either q or named, not both")
+			return
+		}
+		sqlQuery.Query = sql
+	} else {
+		if sqlQuery.Query == "" {
+			queryErrors.WithLabelValues(errorBadRequest).Inc()
+			writeJSONError(w, http.StatusBadRequest, "Missing q parameter")
+			return
+		}
+		if err := checkClientQuery(r.Context(), sqlQuery.Query); err != nil {
+			queryErrors.WithLabelValues(errorBadRequest).Inc()
+			writeJSONError(w, http.StatusForbidden, err.Error())
+			return
+		}
+	}
+	if err := checkReadOnly(sqlQuery.Query); err != nil {
+		queryErrors.WithLabelValues(errorBadRequest).Inc()
+		writeJSONError(w, http.StatusForbidden, err.Error())
+		return
+	}
+	layer := values.Get("layer")
+	if layer == "" {
+		layer = "default"
+	}
+
+	ctx, cancel := requestContext(w, r, sqlQuery.TimeoutMS)
+	defer cancel()
+	start := time.Now()
+	defer func() {
+		elapsed := time.Since(start)
+		requestInfoFrom(ctx).queryDuration = elapsed
+		queryDuration.Observe(elapsed.Seconds())
+	}()
+	recordQuery(ctx, sqlQuery.Query)
+
+	var key string
+	if tileCache != nil {
+		if key = cacheKey(r, "mvt", sqlQuery); key != "" {
+			key += fmt.Sprintf("/%d/%d/%d/%s", z, x, y, layer)
+			if entry, ok := tileCache.get(key); ok {
+				writeCached(w, r, entry)
+				return
+			}
+		}
+		w.Header().Set("X-Cache", "MISS")
+	}
+
+	pool, err := requestPool(r, sqlQuery.DB)
+	if err != nil {
+		queryErrors.WithLabelValues(errorBadRequest).Inc()
+		writePoolError(w, err)
+		return
+	}
+	settings, err := sessionSettings(ctx, sqlQuery.SessionOptions)
+	if err != nil {
+		queryErrors.WithLabelValues(errorBadRequest).Inc()
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	conn, err := acquireRead(ctx, pool, replicaPool(r, sqlQuery.DB))
+	if err != nil {
+		writeAcquireFailure(ctx, w, err)
+		return
+	}
+	defer conn.Release()
+	tx, err := conn.BeginTx(ctx, pgx.TxOptions{AccessMode: pgx.ReadOnly})
+	if err != nil {
+		writeQueryFailure(ctx, w, err)
+		return
+	}
+	defer tx.Rollback(ctx)
+	if err := applySettings(ctx, tx, settings); err != nil {
+		writeQueryFailure(ctx, w, err)
+		return
+	}
+
+	tileSQL, err := tileQuery(ctx, tx, sqlQuery.Query, values.Get("geom"), z, x, y, len(sqlQuery.Params)+1)
+	if err != nil {
+		writeQueryFailure(ctx, w, err)
+		return
+	}
+	var tile []byte
+	args := append(convertParams(sqlQuery.Params), layer)
+	if err := tx.QueryRow(ctx, tileSQL, args...).Scan(&tile); err != nil {
+		writeQueryFailure(ctx, w, err)
+		return
+	}
+
+	const contentType = "application/vnd.mapbox-vector-tile"
+	if key != "" && len(tile) <= maxCachedBytes {
+		tileCache.add(&cacheEntry{key: key, contentType: contentType, body: tile})
+	}
+	w.Header().Set("Content-Type", contentType)
+	body, closeBody := compressResponse(w, r)
+	defer closeBody()
+	body.Write(tile)
+}
+
+// tileCoordinates parses the z, x and y of a tile path, checking that the
+// tile exists at its zoom level.
+func tileCoordinates(r *http.Request) (z, x, y int, err error) {
+	name, ok := strings.CutSuffix(r.PathValue("tile"), ".mvt")
+	if !ok {
+		return 0, 0, 0, fmt.Errorf("Invalid tile %q: must be {y}.mvt", r.PathValue("tile"))
+	}
+	if z, err = strconv.Atoi(r.PathValue("z")); err != nil || z < 0 || z > maxZoom {
+		return 0, 0, 0, fmt.Errorf("Invalid zoom level %q: must be between 0 and %d", r.PathValue("z"), maxZoom)
+	}
+	tiles := 1 << z
+	if x, err = strconv.Atoi(r.PathValue("x")); err != nil || x < 0 || x >= tiles {
+		return 0, 0, 0, fmt.Errorf("Invalid tile column %q at zoom level %d", r.PathValue("x"), z)
+	}
+	if y, err = strconv.Atoi(name); err != nil || y < 0 || y >= tiles {
+		return 0, 0, 0, fmt.Errorf("Invalid tile row %q at zoom level %d", name, z)
+	}
+	return z, x, y, nil
+}
+
+// tileQuery wraps query so that it returns the tile z/x/y of its features,
+// with the layer name bound to parameter layerParam.
+func tileQuery(ctx context.Context, q querier, query, geomColumn string, z, x, y, layerParam int) (string, error) {
+	fields, geomIndex, err := describeGeometry(ctx, q, query, geomColumn)
+	if err != nil {
+		return "", err
+	}
+
+	var columns []string
+	for i, f := range fields {
+		if i != geomIndex {
+			columns = append(columns, "q."+pgx.Identifier{string(f.Name)}.Sanitize())
+		}
+	}
+	geom := fmt.Sprintf("ST_Transform(q.%s::geometry, 3857)", pgx.Identifier{string(fields[geomIndex].Name)}.Sanitize())
+	envelope := fmt.Sprintf("ST_TileEnvelope(%d, %d, %d)", z, x, y)
+	columns = append(columns, fmt.Sprintf("ST_AsMVTGeom(%s, %s, %d, %d, true) AS pgproxy_geom", geom, envelope, tileExtent, tileBuffer))
+	return fmt.Sprintf("SELECT ST_AsMVT(t, $%d, %d, 'pgproxy_geom') FROM (SELECT %s FROM (%s\n) AS q WHERE %s && %s) AS t",
+		layerParam, tileExtent, strings.Join(columns, ", "), trimQuery(query), geom, envelope), nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// tlsVersions are the accepted values of TLS_MIN_VERSION.
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// tlsConfig returns the TLS configuration for serving HTTPS, or nil to serve
+// plain HTTP. The certificate and key are read from the files named by
+// TLS_CERT_FILE and TLS_KEY_FILE, or taken as PEM from TLS_CERT and TLS_KEY
+// for secrets injected into the environment. TLS_MIN_VERSION is 1.2 or 1.3,
+// defaulting to 1.2.
+func tlsConfig() (*tls.Config, error) {
+	certFile, keyFile := os.Getenv("TLS_CERT_FILE"), os.Getenv("TLS_KEY_FILE")
+	certPEM, keyPEM := os.Getenv("TLS_CERT"), os.Getenv("TLS_KEY")
+
+	var cert tls.Certificate
+	var err error
+	switch {
+	case certFile == "" && keyFile == "" && certPEM == "" && keyPEM == "":
+		return nil, nil
+	case (certFile != "" || keyFile != "") && (certPEM != "" || keyPEM != ""):
+		return nil, errors.New("set either TLS_CERT_FILE and TLS_KEY_FILE or TLS_CERT and TLS_KEY, not both")
+	case certFile != "" || keyFile != "":
+		if certFile == "" || keyFile == "" {
+			return nil, errors.New("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+		}
+		cert, err = tls.LoadX509KeyPair(certFile, keyFile)
+	default:
+		if certPEM == "" || keyPEM == "" {
+			return nil, errors.New("TLS_CERT and TLS_KEY must be set together")
+		}
+		cert, err = tls.X509KeyPair([]byte(certPEM), []byte(keyPEM))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid TLS certificate: %v", err)
+	}
+
+	minVersion := uint16(tls.VersionTLS12)
+	if value := os.Getenv("TLS_MIN_VERSION"); value != "" {
+		v, ok := tlsVersions[value]
+		if !ok {
+			return nil, fmt.Errorf("invalid TLS_MIN_VERSION %q: must be 1.2 or 1.3", value)
+		}
+		minVersion = v
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   minVersion,
+	}, nil
+}
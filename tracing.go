@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("go-pgproxy")
+
+// traceStatements controls the SQL recorded on query spans, set through
+// TRACE_STATEMENTS: "redacted" (the default) replaces literals with ?, "full"
+// records the statement as is and "none" leaves it out.
+var traceStatements = "redacted"
+
+// setupTracing installs the OpenTelemetry propagator so incoming traceparent
+// headers are honored and, when OTEL_EXPORTER_OTLP_ENDPOINT is set, a tracer
+// provider exporting spans over OTLP/HTTP. The exporter reads the standard
+// OTEL_EXPORTER_OTLP_* variables itself. The returned function flushes
+// pending spans.
+func setupTracing(ctx context.Context) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{}, propagation.Baggage{}))
+
+	switch traceStatements = os.Getenv("TRACE_STATEMENTS"); traceStatements {
+	case "":
+		traceStatements = "redacted"
+	case "redacted", "full", "none":
+	default:
+		return nil, fmt.Errorf("invalid TRACE_STATEMENTS %q: must be redacted, full or none", traceStatements)
+	}
+
+	if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" && os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("invalid OTLP exporter configuration: %v", err)
+	}
+	res, err := resource.New(ctx,
+		resource.WithAttributes(semconv.ServiceName("go-pgproxy")),
+		resource.WithFromEnv(),
+		resource.WithTelemetrySDK(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// traceRequests starts a server span per request, continuing the trace of an
+// incoming traceparent header.
+func traceRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer.Start(ctx, r.Method+" "+r.URL.Path,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPRequestMethodKey.String(r.Method),
+				semconv.URLPath(r.URL.Path),
+			))
+		defer span.End()
+
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+
+		span.SetAttributes(semconv.HTTPResponseStatusCode(rec.status))
+		if rec.status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(rec.status))
+		}
+	})
+}
+
+// startQuerySpan starts a client span for running sql against the database.
+func startQuerySpan(ctx context.Context, sql string) (context.Context, trace.Span) {
+	opts := []trace.SpanStartOption{
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(semconv.DBSystemPostgreSQL),
+	}
+	switch traceStatements {
+	case "full":
+		opts = append(opts, trace.WithAttributes(semconv.DBQueryText(sql)))
+	case "redacted":
+		opts = append(opts, trace.WithAttributes(semconv.DBQueryText(redactSQL(sql))))
+	}
+	return tracer.Start(ctx, "db.query", opts...)
+}
+
+// endQuerySpan ends a span started by startQuerySpan, marking it failed when
+// err is set.
+func endQuerySpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// TransactionRequest is the body of a /transaction request: a list of
+// statements that are committed together or not at all.
+type TransactionRequest struct {
+	DB        string     `json:"db,omitempty"`
+	Queries   []SQLQuery `json:"queries"`
+	TimeoutMS int64      `json:"timeout_ms,omitempty"`
+
+	SessionOptions
+}
+
+// transactionHandler runs every statement of the request in order inside a
+// single transaction. The response lists, per statement, the command tag and
+// affected row count plus the rows for statements that return any. Unlike
+// /query the result is buffered, since nothing may be reported before the
+// transaction commits.
+func transactionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "Invalid request method")
+		return
+	}
+
+	var req TransactionRequest
+	if err := decodeBody(w, r, &req); err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	if len(req.Queries) == 0 {
+		writeJSONError(w, http.StatusBadRequest, "No queries given")
+		return
+	}
+	runTransaction(w, r, req)
+}
+
+// runTransaction runs the statements of req in a single transaction and
+// writes their results.
+func runTransaction(w http.ResponseWriter, r *http.Request, req TransactionRequest) {
+	for i := range req.Queries {
+		if err := bindNamedParams(&req.Queries[i]); err != nil {
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("Statement %d: %v", i+1, err))
+			return
+		}
+		q := req.Queries[i]
+		if err := checkQueryLength(q.Query); err != nil {
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("Statement %d: %v", i+1, err))
+			return
+		}
+		if err := checkParamCount(q.Query, q.Params); err != nil {
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("Statement %d: %v", i+1, err))
+			return
+		}
+		if err := checkClientQuery(r.Context(), q.Query); err != nil {
+			writeJSONError(w, http.StatusForbidden, fmt.Sprintf("Statement %d: %v", i+1, err))
+			return
+		}
+		if _, err := resultFormats(q.ResultFormat); err != nil {
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("Statement %d: %v", i+1, err))
+			return
+		}
+		if err := checkBinaryEncoding(q.BinaryEncoding); err != nil {
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("Statement %d: %v", i+1, err))
+			return
+		}
+	}
+	txOptions := pgx.TxOptions{}
+	if readOnly {
+		for i, q := range req.Queries {
+			if err := checkReadOnly(q.Query); err != nil {
+				writeJSONError(w, http.StatusForbidden, fmt.Sprintf("Statement %d: %v", i+1, err))
+				return
+			}
+		}
+		txOptions.AccessMode = pgx.ReadOnly
+	}
+
+	ctx, cancel := requestContext(w, r, req.TimeoutMS)
+	defer cancel()
+
+	settings, err := sessionSettings(ctx, req.SessionOptions)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	pool, err := requestPool(r, req.DB)
+	if err != nil {
+		writePoolError(w, err)
+		return
+	}
+
+	conn, err := acquireConn(ctx, pool)
+	if err != nil {
+		writeAcquireFailure(ctx, w, err)
+		return
+	}
+	defer conn.Release()
+
+	tx, err := conn.BeginTx(ctx, txOptions)
+	if err != nil {
+		writeQueryFailure(ctx, w, err)
+		return
+	}
+	// Rolling back after a successful commit is a no-op, so this only undoes
+	// the transaction when a statement failed, the context was canceled, or
+	// the handler panicked.
+	defer tx.Rollback(context.Background())
+	if err := applySettings(ctx, tx, settings); err != nil {
+		writeQueryFailure(ctx, w, err)
+		return
+	}
+
+	results := make([]map[string]interface{}, 0, len(req.Queries))
+	for i, q := range req.Queries {
+		recordQuery(ctx, q.Query)
+		result, err := runStatement(ctx, tx, q)
+		if err != nil {
+			writeQueryFailure(ctx, w, fmt.Errorf("statement %d: %w", i+1, err))
+			return
+		}
+		results = append(results, result)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		writeQueryFailure(ctx, w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	body, closeBody := compressResponse(w, r)
+	defer closeBody()
+	json.NewEncoder(body).Encode(map[string]interface{}{"results": results})
+}
+
+// runStatement executes q and collects its result. The result is buffered,
+// so rather than being cut off at maxRows rows as on /query, a statement
+// returning more fails.
+func runStatement(ctx context.Context, q querier, stmt SQLQuery) (map[string]interface{}, error) {
+	formats, err := resultFormats(stmt.ResultFormat)
+	if err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	defer func() {
+		requestInfoFrom(ctx).queryDuration += time.Since(start)
+	}()
+	rows, err := q.Query(ctx, stmt.Query, queryArgs(formats, convertParams(stmt.Params))...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	fields := rows.FieldDescriptions()
+	if err := checkColumns(len(fields)); err != nil {
+		return nil, err
+	}
+	var values [][]interface{}
+	for rows.Next() {
+		if maxRows > 0 && int64(len(values)) >= maxRows {
+			return nil, fmt.Errorf("result has more than the maximum of %d rows", maxRows)
+		}
+		row, err := rows.Values()
+		if err != nil {
+			return nil, err
+		}
+		for i, v := range row {
+			if row[i], err = normalizeValue(v, fields[i].DataTypeOID, stmt.BinaryEncoding); err != nil {
+				return nil, err
+			}
+		}
+		values = append(values, row)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	tag := rows.CommandTag()
+	requestInfoFrom(ctx).rows += tag.RowsAffected()
+	result := map[string]interface{}{
+		"command":      commandName(tag),
+		"rowsAffected": tag.RowsAffected(),
+	}
+	if len(fields) > 0 {
+		if values == nil {
+			values = [][]interface{}{}
+		}
+		result["columns"] = getColumnNames(fields)
+		result["rows"] = values
+	}
+	if notices := querierNotices(q); notices != nil {
+		result["notices"] = notices
+	}
+	return result, nil
+}
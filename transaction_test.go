@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/jackc/pgproto3/v2"
+	"github.com/jackc/pgtype"
+	"github.com/jackc/pgx/v4"
+)
+
+// rowsQuerier answers every query with rows.
+type rowsQuerier struct {
+	typeQuerier
+	rows *fakeRows
+}
+
+func (q *rowsQuerier) Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error) {
+	return q.rows, nil
+}
+
+func TestRunStatement(t *testing.T) {
+	fields := []pgproto3.FieldDescription{{Name: []byte("id"), DataTypeOID: pgtype.Int4OID}}
+	tests := []struct {
+		tag      string
+		fields   []pgproto3.FieldDescription
+		values   [][]interface{}
+		command  string
+		affected int64
+	}{
+		{"INSERT 0 3", nil, nil, "INSERT", 3},
+		{"UPDATE 2", nil, nil, "UPDATE", 2},
+		{"SELECT 2", fields, [][]interface{}{{int32(1)}, {int32(2)}}, "SELECT", 2},
+		{"CREATE TABLE", nil, nil, "CREATE TABLE", 0},
+	}
+	for _, tt := range tests {
+		q := &rowsQuerier{rows: &fakeRows{fields: tt.fields, values: tt.values, tag: []byte(tt.tag)}}
+		result, err := runStatement(context.Background(), q, SQLQuery{Query: "SELECT"})
+		if err != nil {
+			t.Errorf("%s: %v", tt.tag, err)
+			continue
+		}
+		if result["command"] != tt.command || result["rowsAffected"] != tt.affected {
+			t.Errorf("%s: command %v, %v rows affected, want %s, %d", tt.tag, result["command"], result["rowsAffected"], tt.command, tt.affected)
+		}
+		if _, ok := result["rows"]; ok != (tt.fields != nil) {
+			t.Errorf("%s: rows returned %v", tt.tag, ok)
+		}
+	}
+}
+
+func TestRunStatementMaxRows(t *testing.T) {
+	defer func(max int64) { maxRows = max }(maxRows)
+	maxRows = 2
+	fields := []pgproto3.FieldDescription{{Name: []byte("id"), DataTypeOID: pgtype.Int4OID}}
+	tests := []struct {
+		rows int
+		ok   bool
+	}{
+		{1, true},
+		{2, true},
+		{3, false},
+	}
+	for _, tt := range tests {
+		values := make([][]interface{}, tt.rows)
+		for i := range values {
+			values[i] = []interface{}{int32(i)}
+		}
+		q := &rowsQuerier{rows: &fakeRows{fields: fields, values: values, tag: []byte("SELECT")}}
+		if _, err := runStatement(context.Background(), q, SQLQuery{Query: "SELECT"}); (err == nil) != tt.ok {
+			t.Errorf("%d rows: error %v, want ok %v", tt.rows, err, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+
+	"github.com/jackc/pgproto3/v2"
+	"github.com/jackc/pgtype"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// column describes a result column. Fields are the attributes of a
+// composite type, which normalizeRow decodes into an object.
+type column struct {
+	Name   string
+	Type   string // Postgres type name, e.g. "int4", "timestamptz" or "geometry"
+	OID    uint32
+	Fields []compositeField
+}
+
+// compositeField is an attribute of a composite type.
+type compositeField struct {
+	Name string
+	OID  uint32
+}
+
+// typeInfo describes a type that pgx doesn't know about.
+type typeInfo struct {
+	name   string
+	fields []compositeField
+}
+
+// typeNameCache remembers the types that pgx doesn't know about, such as
+// the PostGIS geometry type or a composite type created with CREATE TYPE, per
+// pool. Their OIDs are assigned when a type or extension is created, so they
+// differ between databases.
+var typeNameCache = struct {
+	sync.Mutex
+	names map[*pgxpool.Pool]map[uint32]typeInfo
+}{names: make(map[*pgxpool.Pool]map[uint32]typeInfo)}
+
+// resultColumns describes the columns of a result. Built-in types are named
+// from pgx's type map; any others are looked up in pg_type, along with the
+// attributes of composite types, with q and remembered for pool. q must be
+// the request's own connection or transaction, before the query's rows are
+// read: taking a second connection from the pool for the lookup could wait
+// forever for one while the request holds its own.
+func resultColumns(ctx context.Context, q querier, pool *pgxpool.Pool, connInfo *pgtype.ConnInfo, fields []pgproto3.FieldDescription) []column {
+	columns := make([]column, len(fields))
+	var unknown []uint32
+	for i, f := range fields {
+		columns[i] = column{Name: string(f.Name), OID: f.DataTypeOID}
+		if dt, ok := connInfo.DataTypeForOID(f.DataTypeOID); ok {
+			columns[i].Type = dt.Name
+		} else {
+			unknown = append(unknown, f.DataTypeOID)
+		}
+	}
+	if len(unknown) == 0 {
+		return columns
+	}
+
+	types, err := lookupTypes(ctx, q, pool, unknown)
+	if err != nil {
+		slog.WarnContext(ctx, "Unable to resolve column types", "error", err)
+	}
+	for i := range columns {
+		if columns[i].Type == "" {
+			t := types[columns[i].OID]
+			columns[i].Type, columns[i].Fields = t.name, t.fields
+		}
+		if columns[i].Type == "" {
+			columns[i].Type = "unknown"
+		}
+	}
+	return columns
+}
+
+func lookupTypes(ctx context.Context, q querier, pool *pgxpool.Pool, oids []uint32) (map[uint32]typeInfo, error) {
+	typeNameCache.Lock()
+	cached := typeNameCache.names[pool]
+	var missing []uint32
+	types := make(map[uint32]typeInfo, len(oids))
+	for _, oid := range oids {
+		if t, ok := cached[oid]; ok {
+			types[oid] = t
+		} else {
+			missing = append(missing, oid)
+		}
+	}
+	typeNameCache.Unlock()
+	if len(missing) == 0 {
+		return types, nil
+	}
+
+	// pgx has no oid[] encoder, so compare as bigint.
+	ids := make([]int64, len(missing))
+	for i, oid := range missing {
+		ids[i] = int64(oid)
+	}
+	rows, err := q.Query(ctx, `SELECT t.oid, t.typname,
+		coalesce(array_agg(a.attname::text ORDER BY a.attnum) FILTER (WHERE a.attnum IS NOT NULL), '{}'),
+		coalesce(array_agg(a.atttypid::int8 ORDER BY a.attnum) FILTER (WHERE a.attnum IS NOT NULL), '{}')
+		FROM pg_type t
+		LEFT JOIN pg_attribute a ON t.typtype = 'c' AND a.attrelid = t.typrelid AND a.attnum > 0 AND NOT a.attisdropped
+		WHERE t.oid::int8 = ANY($1)
+		GROUP BY t.oid, t.typname`, ids)
+	if err != nil {
+		return types, err
+	}
+	defer rows.Close()
+
+	found := make(map[uint32]typeInfo)
+	for rows.Next() {
+		var oid uint32
+		var t typeInfo
+		var fieldNames []string
+		var fieldOIDs []int64
+		if err := rows.Scan(&oid, &t.name, &fieldNames, &fieldOIDs); err != nil {
+			return types, err
+		}
+		for i, name := range fieldNames {
+			t.fields = append(t.fields, compositeField{Name: name, OID: uint32(fieldOIDs[i])})
+		}
+		found[oid] = t
+		types[oid] = t
+	}
+	if err := rows.Err(); err != nil {
+		return types, err
+	}
+
+	typeNameCache.Lock()
+	defer typeNameCache.Unlock()
+	if typeNameCache.names[pool] == nil {
+		typeNameCache.names[pool] = make(map[uint32]typeInfo)
+	}
+	for oid, t := range found {
+		typeNameCache.names[pool][oid] = t
+	}
+	return types, nil
+}
+
+// describeQuery returns the result fields of sql without running it. It goes
+// through the connection's statement cache when there is one, so that
+// running sql next reuses the description instead of asking for it again.
+func describeQuery(ctx context.Context, conn *pgx.Conn, sql string) ([]pgproto3.FieldDescription, error) {
+	if cache := conn.StatementCache(); cache != nil {
+		sd, err := cache.Get(ctx, sql)
+		if err != nil {
+			return nil, err
+		}
+		return sd.Fields, nil
+	}
+	sd, err := conn.PgConn().Prepare(ctx, "", sql, nil)
+	if err != nil {
+		return nil, err
+	}
+	return sd.Fields, nil
+}
+
+func columnNames(columns []column) []string {
+	names := make([]string, len(columns))
+	for i, c := range columns {
+		names[i] = c.Name
+	}
+	return names
+}
+
+func columnTypeNames(columns []column) []string {
+	types := make([]string, len(columns))
+	for i, c := range columns {
+		types[i] = c.Type
+	}
+	return types
+}
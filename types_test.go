@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgproto3/v2"
+	"github.com/jackc/pgtype"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// typeQuerier answers the pg_type lookup of resultColumns, counting how
+// often it is asked.
+type typeQuerier struct {
+	rows    [][]interface{}
+	queries int
+}
+
+func (q *typeQuerier) Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error) {
+	q.queries++
+	return &fakeRows{values: q.rows}, nil
+}
+
+func (q *typeQuerier) Exec(ctx context.Context, sql string, args ...interface{}) (pgconn.CommandTag, error) {
+	return nil, errors.New("unexpected Exec")
+}
+
+func (q *typeQuerier) QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row {
+	return nil
+}
+
+func (q *typeQuerier) Prepare(ctx context.Context, name, sql string) (*pgconn.StatementDescription, error) {
+	return nil, errors.New("unexpected Prepare")
+}
+
+func TestResultColumns(t *testing.T) {
+	pool := new(pgxpool.Pool)
+	defer func() {
+		typeNameCache.Lock()
+		delete(typeNameCache.names, pool)
+		typeNameCache.Unlock()
+	}()
+	q := &typeQuerier{rows: [][]interface{}{
+		{uint32(90001), "geometry", []string{}, []int64{}},
+		{uint32(90002), "address", []string{"street", "number"}, []int64{pgtype.TextOID, pgtype.Int4OID}},
+	}}
+	fields := []pgproto3.FieldDescription{
+		{Name: []byte("id"), DataTypeOID: pgtype.Int4OID},
+		{Name: []byte("geom"), DataTypeOID: 90001},
+		{Name: []byte("home"), DataTypeOID: 90002},
+		{Name: []byte("gone"), DataTypeOID: 90003},
+	}
+	want := []column{
+		{Name: "id", Type: "int4", OID: pgtype.Int4OID},
+		{Name: "geom", Type: "geometry", OID: 90001},
+		{Name: "home", Type: "address", OID: 90002, Fields: []compositeField{{"street", pgtype.TextOID}, {"number", pgtype.Int4OID}}},
+		{Name: "gone", Type: "unknown", OID: 90003},
+	}
+	connInfo := pgtype.NewConnInfo()
+	for round := 1; round <= 2; round++ {
+		columns := resultColumns(context.Background(), q, pool, connInfo, fields)
+		if len(columns) != len(want) {
+			t.Fatalf("round %d: %d columns, want %d", round, len(columns), len(want))
+		}
+		for i := range want {
+			if columns[i].Name != want[i].Name || columns[i].Type != want[i].Type || columns[i].OID != want[i].OID ||
+				len(columns[i].Fields) != len(want[i].Fields) {
+				t.Errorf("round %d: column %d = %+v, want %+v", round, i, columns[i], want[i])
+				continue
+			}
+			for j := range want[i].Fields {
+				if columns[i].Fields[j] != want[i].Fields[j] {
+					t.Errorf("round %d: column %d field %d = %+v, want %+v", round, i, j, columns[i].Fields[j], want[i].Fields[j])
+				}
+			}
+		}
+	}
+	// The second round only looks up the type that wasn't found.
+	if q.queries != 2 {
+		t.Errorf("%d lookups, want 2", q.queries)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/jackc/pgproto3/v2"
+	"github.com/jackc/pgx/v4"
+)
+
+// validateStatement is the name of the statement prepared by /validate.
+const validateStatement = "pgproxy_validate"
+
+// validateHandler checks the query in the request body without executing it.
+// The query is prepared on the server, which reports syntax errors and
+// unknown tables or columns as a regular query error, and the response lists
+// the types Postgres inferred for the $n placeholders and the columns the
+// query would return:
+//
+//	{"params":[{"type":"int4","oid":23}],"columns":[{"name":"id","type":"int4","oid":23}]}
+func validateHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "Invalid request method")
+		return
+	}
+
+	var sqlQuery SQLQuery
+	if err := decodeBody(w, r, &sqlQuery); err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	if err := checkQueryLength(sqlQuery.Query); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := checkClientQuery(r.Context(), sqlQuery.Query); err != nil {
+		writeJSONError(w, http.StatusForbidden, err.Error())
+		return
+	}
+
+	ctx, cancel := requestContext(w, r, sqlQuery.TimeoutMS)
+	defer cancel()
+
+	pool, err := requestPool(r, sqlQuery.DB)
+	if err != nil {
+		writePoolError(w, err)
+		return
+	}
+	settings, err := sessionSettings(ctx, sqlQuery.SessionOptions)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	conn, err := acquireConn(ctx, pool)
+	if err != nil {
+		writeAcquireFailure(ctx, w, err)
+		return
+	}
+	defer conn.Release()
+
+	// The query is prepared with the settings it would run with, since the
+	// role and search_path decide what it can see.
+	tx, err := conn.BeginTx(ctx, pgx.TxOptions{AccessMode: pgx.ReadOnly})
+	if err != nil {
+		writeQueryFailure(ctx, w, err)
+		return
+	}
+	defer tx.Rollback(context.Background())
+	if err := applySettings(ctx, tx, settings); err != nil {
+		writeQueryFailure(ctx, w, err)
+		return
+	}
+
+	recordQuery(ctx, sqlQuery.Query)
+	start := time.Now()
+	defer func() {
+		elapsed := time.Since(start)
+		requestInfoFrom(ctx).queryDuration = elapsed
+		queryDuration.Observe(elapsed.Seconds())
+	}()
+
+	sd, err := conn.Conn().Prepare(ctx, validateStatement, sqlQuery.Query)
+	if err != nil {
+		writeQueryFailure(ctx, w, err)
+		return
+	}
+	defer func() {
+		// The request context may be done already.
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := conn.Conn().Deallocate(ctx, validateStatement); err != nil {
+			slog.WarnContext(ctx, "Error deallocating statement", "error", err)
+			conn.Conn().Close(ctx)
+		}
+	}()
+
+	paramFields := make([]pgproto3.FieldDescription, len(sd.ParamOIDs))
+	for i, oid := range sd.ParamOIDs {
+		paramFields[i] = pgproto3.FieldDescription{Name: []byte(fmt.Sprintf("$%d", i+1)), DataTypeOID: oid}
+	}
+	connInfo := conn.Conn().ConnInfo()
+	params := resultColumns(ctx, tx, pool, connInfo, paramFields)
+	columns := resultColumns(ctx, tx, pool, connInfo, sd.Fields)
+
+	paramInfo := make([]map[string]interface{}, len(params))
+	for i, p := range params {
+		paramInfo[i] = map[string]interface{}{"type": p.Type, "oid": p.OID}
+	}
+	columnInfo := make([]map[string]interface{}, len(columns))
+	for i, c := range columns {
+		columnInfo[i] = map[string]interface{}{"name": c.Name, "type": c.Type, "oid": c.OID}
+	}
+	writeStatus(w, http.StatusOK, map[string]interface{}{
+		"params":  paramInfo,
+		"columns": columnInfo,
+	})
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"runtime"
+	"sync"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// version is the proxy's build version, set when building with
+//
+//	go build -ldflags "-X main.version=1.2.3"
+var version = "dev"
+
+// serverVersions caches the server_version reported by each pool's
+// database. It only changes when the database is upgraded, so it is looked
+// up once per pool.
+var serverVersions = struct {
+	sync.Mutex
+	m map[*pgxpool.Pool]string
+}{m: make(map[*pgxpool.Pool]string)}
+
+// versionHandler reports what is running, for debugging deployments:
+//
+//	{"version": "1.2.3", "go": "go1.22.3", "postgres": {"main": {"version": "16.2"}}}
+//
+// A database that can't be reached has an "error" in place of its version.
+func versionHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), readyTimeout)
+	defer cancel()
+
+	pools := currentPools()
+	databases := make(map[string]map[string]string, len(pools))
+	for name, pool := range pools {
+		v, err := serverVersion(ctx, pool)
+		if err != nil {
+			databases[name] = map[string]string{"error": err.Error()}
+			continue
+		}
+		databases[name] = map[string]string{"version": v}
+	}
+	writeStatus(w, http.StatusOK, map[string]interface{}{
+		"version":  version,
+		"go":       runtime.Version(),
+		"postgres": databases,
+	})
+}
+
+// serverVersion returns the server_version of pool's database, which
+// Postgres reports when a connection starts.
+func serverVersion(ctx context.Context, pool *pgxpool.Pool) (string, error) {
+	serverVersions.Lock()
+	v, ok := serverVersions.m[pool]
+	serverVersions.Unlock()
+	if ok {
+		return v, nil
+	}
+
+	conn, err := acquireConn(ctx, pool)
+	if err != nil {
+		return "", err
+	}
+	v = conn.Conn().PgConn().ParameterStatus("server_version")
+	conn.Release()
+
+	serverVersions.Lock()
+	serverVersions.m[pool] = v
+	serverVersions.Unlock()
+	return v, nil
+}
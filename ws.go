@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// wsMessage is a query sent over a /ws session. ID is echoed in the reply so
+// clients can match results to queries.
+type wsMessage struct {
+	ID json.RawMessage `json:"id,omitempty"`
+	SQLQuery
+}
+
+// wsHandler serves an interactive session over a WebSocket: each text message
+// is a JSON query, answered with a message holding its result in the shape
+// of a /transaction result, or an error body. Queries run one at a time in the
+// order they arrive; the next message is only read once the previous result
+// has been sent, so a slow client holds up its own session only.
+//
+// The session runs on a single pooled connection, so temporary tables, SET
+// and prepared statements persist between queries. ?pin=false runs every
+// query on a connection from the pool instead.
+//
+// Each message counts as a request of its own towards the API key's quotas,
+// and is rejected with a 429 reply once one is used up, and towards the
+// slow query log.
+func wsHandler(w http.ResponseWriter, r *http.Request) {
+	pool, err := requestPool(r, "")
+	if err != nil {
+		writePoolError(w, err)
+		return
+	}
+
+	c, err := websocket.Accept(w, r, nil)
+	if err != nil {
+		// Accept has written the error response.
+		return
+	}
+	defer c.CloseNow()
+	if maxBodyBytes > 0 {
+		c.SetReadLimit(maxBodyBytes)
+	}
+
+	ctx := r.Context()
+	var conn *pgxpool.Conn
+	if r.URL.Query().Get("pin") != "false" {
+		if conn, err = acquireConn(ctx, pool); err != nil {
+			c.Close(websocket.StatusTryAgainLater, "No database connection available")
+			return
+		}
+		defer releaseSession(conn)
+	}
+
+	for {
+		_, data, err := c.Read(ctx)
+		if err != nil {
+			if websocket.CloseStatus(err) != websocket.StatusNormalClosure && !errors.Is(err, context.Canceled) {
+				slog.InfoContext(ctx, "WebSocket session ended", "error", err)
+			}
+			return
+		}
+
+		reply := runWSMessage(ctx, pool, conn, data)
+		buf, err := json.Marshal(reply)
+		if err != nil {
+			c.Close(websocket.StatusInternalError, "Error encoding result")
+			return
+		}
+		if err := c.Write(ctx, websocket.MessageText, buf); err != nil {
+			return
+		}
+	}
+}
+
+// runWSMessage runs the query in a session message and returns the reply.
+// conn is the session's pinned connection, or nil to use the pool.
+func runWSMessage(ctx context.Context, pool *pgxpool.Pool, conn *pgxpool.Conn, data []byte) map[string]interface{} {
+	queriesTotal.Inc()
+
+	var msg wsMessage
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&msg); err != nil {
+		queryErrors.WithLabelValues(errorBadRequest).Inc()
+		return wsReply(msg.ID, errorResponse{Error: "Invalid message", Status: http.StatusBadRequest})
+	}
+
+	session := requestInfoFrom(ctx)
+	session.perMessage = true
+	if key, limits, ok := requestQuota(session); ok {
+		if exceeded := checkQuota(key, limits, time.Now()); exceeded != nil {
+			return wsReply(msg.ID, quotaError(exceeded))
+		}
+	}
+	info := &requestInfo{id: session.id, principal: session.principal}
+	ctx = context.WithValue(ctx, requestInfoKey{}, info)
+	defer finishWSMessage(ctx, session, info)
+
+	if err := checkQueryLength(msg.Query); err != nil {
+		queryErrors.WithLabelValues(errorBadRequest).Inc()
+		return wsReply(msg.ID, errorResponse{Error: err.Error(), Status: http.StatusBadRequest})
+	}
+	if err := checkParamCount(msg.Query, msg.Params); err != nil {
+		queryErrors.WithLabelValues(errorBadRequest).Inc()
+		return wsReply(msg.ID, errorResponse{Error: err.Error(), Status: http.StatusBadRequest})
+	}
+	if err := checkClientQuery(ctx, msg.Query); err != nil {
+		queryErrors.WithLabelValues(errorBadRequest).Inc()
+		return wsReply(msg.ID, errorResponse{Error: err.Error(), Status: http.StatusForbidden})
+	}
+	if err := checkBinaryEncoding(msg.BinaryEncoding); err != nil {
+		queryErrors.WithLabelValues(errorBadRequest).Inc()
+		return wsReply(msg.ID, errorResponse{Error: err.Error(), Status: http.StatusBadRequest})
+	}
+	var txOptions *pgx.TxOptions
+	if readOnly {
+		if err := checkReadOnly(msg.Query); err != nil {
+			queryErrors.WithLabelValues(errorBadRequest).Inc()
+			return wsReply(msg.ID, errorResponse{Error: err.Error(), Status: http.StatusForbidden})
+		}
+		txOptions = &pgx.TxOptions{AccessMode: pgx.ReadOnly}
+	}
+	settings, err := sessionSettings(ctx, msg.SessionOptions)
+	if err != nil {
+		queryErrors.WithLabelValues(errorBadRequest).Inc()
+		return wsReply(msg.ID, errorResponse{Error: err.Error(), Status: http.StatusBadRequest})
+	}
+	if txOptions == nil && len(settings) > 0 {
+		// SET LOCAL needs a transaction, committed once the query succeeds.
+		txOptions = &pgx.TxOptions{}
+	}
+
+	if timeout := requestTimeout(msg.TimeoutMS); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	if conn == nil {
+		if conn, err = acquireConn(ctx, pool); err != nil {
+			return wsReply(msg.ID, errorResponse{Error: "Unable to acquire a database connection", Status: http.StatusServiceUnavailable})
+		}
+		defer conn.Release()
+	}
+
+	var q querier = conn.Conn()
+	var tx pgx.Tx
+	if txOptions != nil {
+		if tx, err = conn.BeginTx(ctx, *txOptions); err != nil {
+			queryErrors.WithLabelValues(errorQuery).Inc()
+			return wsReply(msg.ID, queryError(http.StatusBadRequest, "Query error", err))
+		}
+		defer tx.Rollback(context.Background())
+		q = tx
+		err = applySettings(ctx, q, settings)
+	}
+
+	var result map[string]interface{}
+	if err == nil {
+		recordQuery(ctx, msg.Query)
+		result, err = runStatement(ctx, q, msg.SQLQuery)
+	}
+	if err == nil && tx != nil {
+		err = tx.Commit(ctx)
+	}
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			queryErrors.WithLabelValues(errorTimeout).Inc()
+			return wsReply(msg.ID, errorResponse{Error: "Query timed out", Status: http.StatusGatewayTimeout})
+		}
+		queryErrors.WithLabelValues(errorQuery).Inc()
+		return wsReply(msg.ID, queryError(http.StatusBadRequest, "Query error", err))
+	}
+	if msg.ID != nil {
+		result["id"] = msg.ID
+	}
+	return result
+}
+
+// finishWSMessage charges what a session message ran, recorded in info, to
+// the quotas, logs it if slow and adds its rows and query time to the
+// session's. The statements aren't kept for the session's access log line,
+// which a long session would grow without bound.
+func finishWSMessage(ctx context.Context, session, info *requestInfo) {
+	if key, _, ok := requestQuota(session); ok && len(info.queries) > 0 {
+		addQuotaUsage(key, int64(len(info.queries)), info.rows, info.queryDuration, time.Now())
+	}
+	logSlowQuery(ctx, info)
+	session.rows += info.rows
+	session.queryDuration += info.queryDuration
+}
+
+// wsReply turns an error body into a session reply.
+func wsReply(id json.RawMessage, resp errorResponse) map[string]interface{} {
+	reply := map[string]interface{}{"error": resp.Error, "status": resp.Status}
+	if id != nil {
+		reply["id"] = id
+	}
+	if resp.Code != "" {
+		reply["code"] = resp.Code
+		reply["detail"] = resp.Detail
+		reply["hint"] = resp.Hint
+	}
+	if resp.Quota != nil {
+		reply["quota"] = resp.Quota
+	}
+	return reply
+}
+
+// releaseSession closes the pinned connection of a session before handing it
+// back, so the pool replaces it. Its temporary tables, settings and possibly
+// open transaction must not leak into other requests, and DISCARD ALL would
+// also drop the statements pgx has cached as prepared.
+func releaseSession(conn *pgxpool.Conn) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn.Conn().Close(ctx)
+	conn.Release()
+}